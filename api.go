@@ -16,6 +16,19 @@ type Daemon struct {
 	Config  *AppConfig
 	Logger  log.Logger
 	Backend backends.Backend
+	// Authenticator turns on SMTP AUTH (PLAIN and LOGIN, and CRAM-MD5 for a SecretAuthenticator)
+	// when set, see ServerConfig.AuthAllowInsecure
+	Authenticator Authenticator
+	// RateLimitStore keeps the buckets of ServerConfig.MessagesPerMinutePerIP, shared by all the
+	// servers. Each server keeps its own in memory when not set
+	RateLimitStore RateLimitStore
+	// Tracer traces each session, its messages and the processors they go through when set,
+	// see backends.Tracer. It's used instead of the exporter configured with tracing_endpoint
+	Tracer backends.Tracer
+	// Metrics records the connections, commands, messages and backend timings when set, see
+	// backends.MetricsRegistry. It's used instead of the registry served on metrics_listen_interface,
+	// and served there instead if it's an http.Handler, such as backends.NewMetrics
+	Metrics backends.MetricsRegistry
 
 	// Guerrilla will be managed through the API
 	g Guerrilla
@@ -61,6 +74,18 @@ func (d *Daemon) Start() (err error) {
 		if err != nil {
 			return err
 		}
+		if g, ok := d.g.(*guerrilla); ok && d.Authenticator != nil {
+			g.setAuthenticator(d.Authenticator)
+		}
+		if g, ok := d.g.(*guerrilla); ok && d.RateLimitStore != nil {
+			g.setRateLimitStore(d.RateLimitStore)
+		}
+		if g, ok := d.g.(*guerrilla); ok && d.Tracer != nil {
+			g.customTracer = d.Tracer
+		}
+		if g, ok := d.g.(*guerrilla); ok && d.Metrics != nil {
+			g.customMetrics = d.Metrics
+		}
 		for i := range d.subs {
 			_ = d.Subscribe(d.subs[i].topic, d.subs[i].fn)
 
@@ -10,8 +10,10 @@ import (
 	"github.com/flashmob/go-guerrilla/response"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -512,7 +514,7 @@ func talkToServer(address string) (err error) {
 	if err != nil {
 		return err
 	}
-	_, err = fmt.Fprint(conn, "MAIL FROM:<test@example.com>r\r\n")
+	_, err = fmt.Fprint(conn, "MAIL FROM:<test@example.com>\r\n")
 	if err != nil {
 		return err
 	}
@@ -699,6 +701,9 @@ func TestSkipAllowsHost(t *testing.T) {
 	if _, err := fmt.Fprint(conn, "HELO test\r\n"); err != nil {
 		t.Error(err)
 	}
+	if _, err := fmt.Fprint(conn, "MAIL FROM:<test@example.com>\r\n"); err != nil {
+		t.Error(err)
+	}
 	if _, err := fmt.Fprint(conn, "RCPT TO:<test@funkyhost.com>\r\n"); err != nil {
 		t.Error(err)
 	}
@@ -709,6 +714,9 @@ func TestSkipAllowsHost(t *testing.T) {
 	if _, err := in.ReadString('\n'); err != nil {
 		t.Error(err)
 	}
+	if _, err := in.ReadString('\n'); err != nil {
+		t.Error(err)
+	}
 	str, _ := in.ReadString('\n')
 	if strings.Index(str, "250") != 0 {
 		t.Error("expected 250 reply, got:", str)
@@ -774,3 +782,267 @@ func TestCustomBackendResult(t *testing.T) {
 	}
 
 }
+
+// Test that a transaction in progress is finished when shutting down with a grace period
+func TestShutdownGracePeriod(t *testing.T) {
+	if err := os.Truncate("tests/testlog", 0); err != nil {
+		t.Error(err)
+	}
+	saved := make(chan string, 1)
+	cfg := &AppConfig{
+		LogFile:             "tests/testlog",
+		AllowedHosts:        []string{"grr.la"},
+		ShutdownGracePeriod: 10,
+		BackendConfig: backends.BackendConfig{
+			"save_process": "HeadersParser|GraceStore",
+		},
+	}
+	d := Daemon{Config: cfg}
+	d.AddProcessor("GraceStore", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(
+				func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+					if task == backends.TaskSaveMail {
+						saved <- e.Data.String()
+					}
+					return p.Process(e, task)
+				})
+		}
+	})
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	dial := func(commands ...string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", "127.0.0.1:2525")
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := bufio.NewReader(conn)
+		_, _ = in.ReadString('\n')
+		for _, cmd := range commands {
+			_, _ = fmt.Fprint(conn, cmd+"\r\n")
+			_, _ = in.ReadString('\n')
+		}
+		return conn, in
+	}
+	// a slow client in the middle of DATA, and an idle one
+	busy, busyIn := dial("HELO busy.example.com", "MAIL FROM:<test@example.com>", "RCPT TO:<test@grr.la>", "DATA")
+	defer func() {
+		_ = busy.Close()
+	}()
+	_, _ = fmt.Fprint(busy, "Subject: Test subject\r\n\r\n")
+	idle, idleIn := dial("HELO idle.example.com")
+	defer func() {
+		_ = idle.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		d.Shutdown()
+		close(done)
+	}()
+	_ = idle.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if line, _ := idleIn.ReadString('\n'); !strings.HasPrefix(line, "421") {
+		t.Error("expecting the idle client to get a 421, got", line)
+	}
+	// longer than the timeout given to clients without a grace period
+	time.Sleep(time.Second * 2)
+	select {
+	case <-done:
+		t.Fatal("shutdown did not wait for the transaction")
+	default:
+	}
+	_, _ = fmt.Fprint(busy, "A slow email body\r\n.\r\n")
+	_ = busy.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if line, _ := busyIn.ReadString('\n'); !strings.HasPrefix(line, "250") {
+		t.Error("expecting the message to be queued, got", line)
+	}
+	if line, _ := busyIn.ReadString('\n'); !strings.HasPrefix(line, "421") {
+		t.Error("expecting a 421 after the transaction, got", line)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("shutdown did not complete")
+	}
+	select {
+	case msg := <-saved:
+		if !strings.Contains(msg, "A slow email body") {
+			t.Error("expecting the whole message to be stored, got", msg)
+		}
+	default:
+		t.Error("expecting the message to be stored before shutdown completed")
+	}
+}
+
+// recordingTracer keeps the spans started, for checking the span tree
+type recordingTracer struct {
+	spans []*recordedSpan
+	sync.Mutex
+}
+
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	ended  int
+	err    error
+	tracer *recordingTracer
+}
+
+func (t *recordingTracer) Start(name string, parent backends.Span) backends.Span {
+	t.Lock()
+	defer t.Unlock()
+	s := &recordedSpan{name: name, attrs: make(map[string]interface{}), tracer: t}
+	if p, ok := parent.(*recordedSpan); ok {
+		s.parent = p
+	}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End(err error) {
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	s.ended++
+	s.err = err
+}
+
+func (s *recordedSpan) TraceParent() string {
+	return "00-trace-" + s.name + "-01"
+}
+
+// A tracer set on the Daemon gets a span for the session, a child span for the message
+// from MAIL to its delivery, and a child of that for each processor
+func TestDaemonTracer(t *testing.T) {
+	if err := os.Truncate("tests/testlog", 0); err != nil {
+		t.Error(err)
+	}
+	cfg := &AppConfig{
+		LogFile:      "tests/testlog",
+		AllowedHosts: []string{"grr.la"},
+		BackendConfig: backends.BackendConfig{
+			"save_process": "HeadersParser|Debugger",
+		},
+	}
+	tracer := &recordingTracer{}
+	d := Daemon{Config: cfg, Tracer: tracer}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := talkToServer("127.0.0.1:2525"); err != nil {
+		t.Error(err)
+	}
+	d.Shutdown()
+
+	tracer.Lock()
+	defer tracer.Unlock()
+	var session, message *recordedSpan
+	var processors []*recordedSpan
+	for _, s := range tracer.spans {
+		switch {
+		case s.name == "smtp session":
+			session = s
+		case s.name == "smtp message":
+			message = s
+		case strings.HasPrefix(s.name, "processor "):
+			processors = append(processors, s)
+		}
+	}
+	if session == nil || message == nil {
+		t.Fatal("expecting a session and a message span, got", len(tracer.spans), "spans")
+	}
+	if session.parent != nil || session.ended != 1 || session.attrs["remote_ip"] != "127.0.0.1" {
+		t.Error("expecting the session to be an ended root span with the remote_ip, got", session)
+	}
+	if message.parent != session {
+		t.Error("expecting the message span to be a child of the session")
+	}
+	if message.ended != 1 || message.err != nil {
+		t.Error("expecting the message span to be ended once without an error, got", message.ended, message.err)
+	}
+	for key, value := range map[string]interface{}{
+		"remote_ip":   "127.0.0.1",
+		"recipients":  1,
+		"result_code": 250,
+	} {
+		if message.attrs[key] != value {
+			t.Errorf("expecting the message span to have %s %v, got %v", key, value, message.attrs[key])
+		}
+	}
+	if size, _ := message.attrs["size"].(int64); size == 0 {
+		t.Error("expecting the message span to have the size")
+	}
+	if len(processors) != 2 {
+		t.Fatal("expecting a span for each of the 2 processors, got", len(processors))
+	}
+	for _, s := range processors {
+		if s.parent != message || s.ended != 1 {
+			t.Error("expecting", s.name, "to be an ended child of the message span")
+		}
+	}
+}
+
+// TestDaemonMetrics scrapes the metrics served on metrics_listen_interface after a message
+func TestDaemonMetrics(t *testing.T) {
+	if err := os.Truncate("tests/testlog", 0); err != nil {
+		t.Error(err)
+	}
+	cfg := &AppConfig{
+		LogFile:                "tests/testlog",
+		AllowedHosts:           []string{"grr.la"},
+		MetricsListenInterface: "127.0.0.1:9190",
+		BackendConfig: backends.BackendConfig{
+			"save_process": "HeadersParser|Debugger",
+		},
+	}
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	if err := talkToServer("127.0.0.1:2525"); err != nil {
+		t.Error(err)
+	}
+	resp, err := http.Get("http://127.0.0.1:9190/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make(map[string]string)
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && !strings.HasPrefix(line, "#") {
+			samples[fields[0]] = fields[1]
+		}
+	}
+	for _, name := range []string{
+		`guerrilla_connections_accepted_total{server="127.0.0.1:2525"}`,
+		`guerrilla_commands_total{verb="HELO"}`,
+		`guerrilla_commands_total{verb="MAIL"}`,
+		`guerrilla_commands_total{verb="RCPT"}`,
+		`guerrilla_commands_total{verb="DATA"}`,
+		`guerrilla_messages_total{result="accepted"}`,
+		`guerrilla_received_bytes_total`,
+		`guerrilla_backend_duration_seconds_count{task="save_mail"}`,
+		`guerrilla_backend_duration_seconds_bucket{task="save_mail",le="+Inf"}`,
+	} {
+		if value, ok := samples[name]; !ok || value == "0" {
+			t.Errorf("expecting %s to be non-zero, got %q", name, value)
+		}
+	}
+	if _, ok := samples[`guerrilla_messages_total{result="rejected"}`]; ok {
+		t.Error("expecting no rejected messages")
+	}
+}
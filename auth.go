@@ -0,0 +1,286 @@
+package guerrilla
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// Authenticator checks the credentials given with the AUTH command (RFC 4954).
+// Set it on the Daemon to enable AUTH. Once a client authenticated, the backend finds
+// the username in e.Values["auth_user"] and e.Values["authenticated"] set to true
+type Authenticator interface {
+	// Authenticate returns true if the password is valid for username. The mechanism is the
+	// SASL mechanism used by the client, eg. "PLAIN". An error means that the credentials
+	// could not be checked, the client gets a temporary failure
+	Authenticate(ctx context.Context, mechanism, username string, password []byte) (bool, error)
+}
+
+// SecretAuthenticator is an Authenticator that can also give the shared secret of a user,
+// for mechanisms that need it in plain to verify the client's response. CRAM-MD5 is only
+// offered when the Authenticator implements it
+type SecretAuthenticator interface {
+	Authenticator
+	// Secret returns the shared secret of username. A nil secret rejects the username
+	Secret(username string) ([]byte, error)
+}
+
+// the SASL mechanisms supported
+const (
+	authPlain   = "PLAIN"
+	authLogin   = "LOGIN"
+	authCRAMMD5 = "CRAM-MD5"
+)
+
+var (
+	errAuthCancelled = errors.New("authentication cancelled")
+	errAuthDecode    = errors.New("cannot decode response")
+)
+
+// authenticatorHolder keeps the type stored in the server's atomic.Value the same,
+// whatever the type of the Authenticator
+type authenticatorHolder struct {
+	Authenticator
+}
+
+// setAuthenticator sets the Authenticator used for AUTH, nil turns AUTH off
+func (s *server) setAuthenticator(a Authenticator) {
+	s.authenticatorStore.Store(authenticatorHolder{a})
+}
+
+// authenticator gets the Authenticator used for AUTH, nil if AUTH is off
+func (s *server) authenticator() Authenticator {
+	if h, ok := s.authenticatorStore.Load().(authenticatorHolder); ok {
+		return h.Authenticator
+	}
+	return nil
+}
+
+// authAllowed returns true if AUTH can be used by the client: an Authenticator is set,
+// and the connection is over TLS unless the config allows AUTH without it
+func (s *server) authAllowed(client *client, sc *ServerConfig) bool {
+	return s.authenticator() != nil && (client.TLS || sc.AuthAllowInsecure)
+}
+
+// authMechanisms returns the SASL mechanisms that the authenticator supports, for the EHLO reply
+func authMechanisms(a Authenticator) string {
+	if _, ok := a.(SecretAuthenticator); ok {
+		return authPlain + " " + authLogin + " " + authCRAMMD5
+	}
+	return authPlain + " " + authLogin
+}
+
+// handleAuth runs the AUTH <mechanism> [initial-response] exchange
+func (s *server) handleAuth(client *client, args []byte, sc *ServerConfig) {
+	r := response.Canned
+	authenticator := s.authenticator()
+	if authenticator == nil {
+		client.sendResponse(r.FailUnrecognizedCmd)
+		return
+	}
+	if !client.TLS && !sc.AuthAllowInsecure {
+		client.sendResponse(r.FailEncryptionRequired)
+		return
+	}
+	if client.authUser != "" {
+		client.sendResponse(r.FailAlreadyAuthenticated)
+		return
+	}
+	if client.isInTransaction() {
+		client.sendResponse(r.FailAuthInTransaction)
+		return
+	}
+	fields := strings.Fields(string(args))
+	if len(fields) == 0 || len(fields) > 2 {
+		client.sendResponse(r.FailUnrecognizedAuthType)
+		return
+	}
+	mechanism := strings.ToUpper(fields[0])
+	var initial []byte
+	if len(fields) == 2 {
+		initial = []byte(fields[1])
+	}
+	var (
+		username  string
+		password  []byte
+		challenge []byte
+		err       error
+	)
+	switch mechanism {
+	case authPlain:
+		username, password, err = s.authPlain(client, initial)
+	case authLogin:
+		username, password, err = s.authLogin(client, initial)
+	case authCRAMMD5:
+		if _, ok := authenticator.(SecretAuthenticator); !ok {
+			client.sendResponse(r.FailUnrecognizedAuthType)
+			return
+		}
+		if initial != nil {
+			// the exchange starts with the server's challenge
+			s.authFailed(client, r.FailAuthDecode)
+			return
+		}
+		challenge = cramMD5Challenge(sc.Hostname)
+		username, password, err = s.authCRAMMD5(client, challenge)
+	default:
+		client.sendResponse(r.FailUnrecognizedAuthType)
+		return
+	}
+	if err == errAuthCancelled {
+		client.sendResponse(r.FailAuthCancelled)
+		return
+	} else if err == errAuthDecode {
+		s.authFailed(client, r.FailAuthDecode)
+		return
+	} else if err == LineLimitExceeded {
+		client.sendResponse(r.FailLineTooLong)
+		client.kill()
+		return
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		s.clientLog(client).WithError(err).Warnf("[%s] AUTH response timed out", client.RemoteIP)
+		client.kill()
+		return
+	} else if err != nil {
+		s.clientLog(client).WithError(err).Warnf("[%s] AUTH read error", client.RemoteIP)
+		client.kill()
+		return
+	}
+	var ok bool
+	if mechanism == authCRAMMD5 {
+		ok, err = cramMD5Verify(authenticator.(SecretAuthenticator), username, challenge, password)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout.Load().(time.Duration)*time.Second)
+		ok, err = authenticator.Authenticate(ctx, mechanism, username, password)
+		cancel()
+	}
+	if err != nil {
+		s.clientLog(client).WithError(err).Warnf("[%s] could not authenticate %s", client.RemoteIP, username)
+		client.sendResponse(r.ErrorAuthTemporary)
+		return
+	}
+	if !ok {
+		s.clientLog(client).Infof("[%s] AUTH %s failed for %s", client.RemoteIP, mechanism, username)
+		s.authFailed(client, r.FailAuthInvalid)
+		return
+	}
+	client.authUser = username
+	client.sendResponse(r.SuccessAuthCmd)
+}
+
+// authFailed replies to a failed authentication attempt. Failed attempts count as errors,
+// the client is disconnected after MaxUnrecognizedCommands, so that passwords can't be guessed
+// at length on the same connection
+func (s *server) authFailed(client *client, resp *response.Response) {
+	client.errors++
+	if client.errors >= MaxUnrecognizedCommands {
+		s.clientLog(client).Warnf("[%s] too many failed AUTH attempts, disconnecting", client.RemoteIP)
+		client.sendResponse(response.Canned.FailMaxAuthAttempts)
+		client.kill()
+		return
+	}
+	client.sendResponse(resp)
+}
+
+// authPlain decodes "authzid NUL authcid NUL passwd", RFC 4616. Only an empty authzid or
+// one equal to the authcid is accepted, acting as someone else is not supported
+func (s *server) authPlain(client *client, initial []byte) (string, []byte, error) {
+	decoded, err := s.authResponse(client, initial, "")
+	if err != nil {
+		return "", nil, err
+	}
+	parts := bytes.Split(decoded, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return "", nil, errAuthDecode
+	}
+	if len(parts[0]) > 0 && !bytes.Equal(parts[0], parts[1]) {
+		return "", nil, errAuthDecode
+	}
+	return string(parts[1]), parts[2], nil
+}
+
+// authLogin asks for the username, unless given in the initial response, then the password
+func (s *server) authLogin(client *client, initial []byte) (string, []byte, error) {
+	username, err := s.authResponse(client, initial, "Username:")
+	if err != nil {
+		return "", nil, err
+	}
+	password, err := s.authResponse(client, nil, "Password:")
+	if err != nil {
+		return "", nil, err
+	}
+	return string(username), password, nil
+}
+
+// authResponse decodes the initial response if given, otherwise it sends the challenge and
+// reads the client's base64 encoded response. "=" is an empty initial response
+func (s *server) authResponse(client *client, initial []byte, challenge string) ([]byte, error) {
+	line := initial
+	if line == nil {
+		client.sendResponse("334 ", base64.StdEncoding.EncodeToString([]byte(challenge)))
+		if err := s.flushResponse(client); err != nil {
+			return nil, err
+		}
+		var err error
+		if line, err = s.readCommand(client); err != nil {
+			return nil, err
+		}
+	} else if string(line) == "=" {
+		return []byte{}, nil
+	}
+	if string(line) == "*" {
+		return nil, errAuthCancelled
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, errAuthDecode
+	}
+	return decoded, nil
+}
+
+// cramMD5Challenge returns a unique challenge in the msg-id form of RFC 2195,
+// eg. <1896.697170952@postoffice.example.net>
+func cramMD5Challenge(hostname string) []byte {
+	random := make([]byte, 8)
+	_, _ = rand.Read(random)
+	return []byte(fmt.Sprintf("<%s.%d@%s>", hex.EncodeToString(random), time.Now().UnixNano(), hostname))
+}
+
+// authCRAMMD5 sends the challenge and reads the "username digest" response, RFC 2195.
+// The digest is returned as the password
+func (s *server) authCRAMMD5(client *client, challenge []byte) (string, []byte, error) {
+	decoded, err := s.authResponse(client, nil, string(challenge))
+	if err != nil {
+		return "", nil, err
+	}
+	i := bytes.LastIndexByte(decoded, ' ')
+	if i < 1 || len(decoded)-i-1 != md5.Size*2 {
+		return "", nil, errAuthDecode
+	}
+	return string(decoded[:i]), bytes.ToLower(decoded[i+1:]), nil
+}
+
+// cramMD5Verify checks that digest is the hex HMAC-MD5 of the challenge, keyed with
+// the secret of username
+func cramMD5Verify(a SecretAuthenticator, username string, challenge, digest []byte) (bool, error) {
+	secret, err := a.Secret(username)
+	if err != nil || secret == nil {
+		return false, err
+	}
+	mac := hmac.New(md5.New, secret)
+	_, _ = mac.Write(challenge)
+	expected := make([]byte, md5.Size*2)
+	hex.Encode(expected, mac.Sum(nil))
+	return hmac.Equal(expected, digest), nil
+}
@@ -0,0 +1,310 @@
+package guerrilla
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// testAuthenticator knows a single user, test@example.com with the password "secret"
+type testAuthenticator struct{}
+
+func (testAuthenticator) Authenticate(ctx context.Context, mechanism, username string, password []byte) (bool, error) {
+	return username == "test@example.com" && string(password) == "secret", nil
+}
+
+// testSecretAuthenticator is testAuthenticator with CRAM-MD5
+type testSecretAuthenticator struct {
+	testAuthenticator
+}
+
+func (testSecretAuthenticator) Secret(username string) ([]byte, error) {
+	if username == "test@example.com" {
+		return []byte("secret"), nil
+	}
+	return nil, nil
+}
+
+// authExpect sends each command and checks the start of the reply
+func authExpect(t *testing.T, r *textproto.Reader, w *textproto.Writer, expectations [][2]string) {
+	for _, e := range expectations {
+		if err := w.PrintfLine("%s", e[0]); err != nil {
+			t.Error(err)
+		}
+		line, _ := r.ReadLine()
+		if strings.Index(line, e[1]) != 0 {
+			t.Error(e[0], "expected", e[1], "but got:", line)
+		}
+	}
+}
+
+// authSession runs the expected command and reply pairs after EHLO, returning the client
+// and the EHLO reply. tls simulates a connection upgraded with STARTTLS
+func authSession(t *testing.T, tls, allowInsecure bool, expectations [][2]string) (*client, string) {
+	return authSessionFunc(t, testSecretAuthenticator{}, tls, allowInsecure, func(r *textproto.Reader, w *textproto.Writer) {
+		authExpect(t, r, w, expectations)
+	})
+}
+
+// authSessionFunc is authSession with the authenticator a, running the commands of session
+func authSessionFunc(t *testing.T, a Authenticator, tls, allowInsecure bool, session func(r *textproto.Reader, w *textproto.Writer)) (*client, string) {
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	sc.AuthAllowInsecure = allowInsecure
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	server.setAuthenticator(a)
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	client.TLS = tls
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	_, _ = r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	if err := w.PrintfLine("EHLO client.example.com"); err != nil {
+		t.Error(err)
+	}
+	var ehlo []string
+	for {
+		line, _ := r.ReadLine()
+		ehlo = append(ehlo, line)
+		if !strings.HasPrefix(line, "250-") {
+			break
+		}
+	}
+	session(r, w)
+	if err := w.PrintfLine("QUIT"); err != nil {
+		t.Error(err)
+	}
+	_, _ = r.ReadLine()
+	wg.Wait()
+	return client, strings.Join(ehlo, "\n")
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestAuthPlain(t *testing.T) {
+	client, ehlo := authSession(t, true, false, [][2]string{
+		{"AUTH DIGEST-MD5", "504 5.5.4"},
+		{"AUTH PLAIN " + b64("\x00test@example.com\x00wrong"), "535 5.7.8"},
+		{"AUTH PLAIN " + b64("admin@example.com\x00test@example.com\x00secret"), "501 5.5.2"},
+		{"AUTH PLAIN not-base64!", "501 5.5.2"},
+		{"AUTH PLAIN", "334 "},
+		{"*", "501 5.5.2 Authentication cancelled"},
+		{"AUTH PLAIN", "334 "},
+		{b64("test@example.com\x00test@example.com\x00secret"), "235 2.7.0"},
+		{"AUTH PLAIN " + b64("\x00test@example.com\x00secret"), "503 5.5.1"},
+		{"MAIL FROM:<test@example.com>", "250 2.1.0"},
+	})
+	if !strings.Contains(ehlo, "250-AUTH PLAIN LOGIN") {
+		t.Error("expecting AUTH to be advertised over TLS, got", ehlo)
+	}
+	if client.Values["authenticated"] != true || client.Values["auth_user"] != "test@example.com" {
+		t.Error("expecting the authenticated user in the envelope values, got", client.Values)
+	}
+}
+
+func TestAuthLoginInvalid(t *testing.T) {
+	client, _ := authSession(t, true, false, [][2]string{
+		{"AUTH LOGIN", "334 " + b64("Username:")},
+		{b64("test@example.com"), "334 " + b64("Password:")},
+		{b64("wrong"), "535 5.7.8"},
+		{"AUTH LOGIN " + b64("test@example.com"), "334 " + b64("Password:")},
+		{b64("secret"), "235 2.7.0"},
+	})
+	if client.authUser != "test@example.com" {
+		t.Error("expecting the second attempt to authenticate, got", client.authUser)
+	}
+	client, _ = authSession(t, true, false, [][2]string{
+		{"AUTH LOGIN", "334 "},
+		{b64("nobody@example.com"), "334 "},
+		{b64("secret"), "535 5.7.8"},
+		{"MAIL FROM:<test@example.com>", "250 2.1.0"},
+		{"AUTH LOGIN", "503 5.5.1"},
+	})
+	if _, ok := client.Values["authenticated"]; ok || client.authUser != "" {
+		t.Error("expecting the client not to be authenticated")
+	}
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	_, ehlo := authSession(t, false, false, [][2]string{
+		{"AUTH PLAIN " + b64("\x00test@example.com\x00secret"), "538 5.7.11"},
+		{"AUTH LOGIN", "538 5.7.11"},
+	})
+	if strings.Contains(ehlo, "AUTH") {
+		t.Error("expecting AUTH not to be advertised before TLS, got", ehlo)
+	}
+	_, ehlo = authSession(t, false, true, [][2]string{
+		{"AUTH PLAIN " + b64("\x00test@example.com\x00secret"), "235 2.7.0"},
+	})
+	if !strings.Contains(ehlo, "250-AUTH PLAIN LOGIN") {
+		t.Error("expecting AUTH to be advertised when allowed without TLS, got", ehlo)
+	}
+}
+
+func TestAuthCRAMMD5(t *testing.T) {
+	// cramMD5 answers the challenge in the 334 reply with the digest keyed by secret
+	cramMD5 := func(r *textproto.Reader, w *textproto.Writer, username, secret string) string {
+		if err := w.PrintfLine("AUTH CRAM-MD5"); err != nil {
+			t.Error(err)
+		}
+		line, _ := r.ReadLine()
+		if !strings.HasPrefix(line, "334 ") {
+			t.Fatal("expecting a challenge, got", line)
+		}
+		challenge, err := base64.StdEncoding.DecodeString(line[4:])
+		if err != nil || !strings.HasSuffix(string(challenge), "@"+getMockServerConfig().Hostname+">") {
+			t.Error("expecting a base64 msg-id challenge, got", string(challenge), err)
+		}
+		mac := hmac.New(md5.New, []byte(secret))
+		_, _ = mac.Write(challenge)
+		if err := w.PrintfLine("%s", b64(username+" "+hex.EncodeToString(mac.Sum(nil)))); err != nil {
+			t.Error(err)
+		}
+		line, _ = r.ReadLine()
+		return line
+	}
+	client, ehlo := authSessionFunc(t, testSecretAuthenticator{}, true, false, func(r *textproto.Reader, w *textproto.Writer) {
+		if line := cramMD5(r, w, "test@example.com", "wrong"); !strings.HasPrefix(line, "535 5.7.8") {
+			t.Error("expecting a wrong password to fail, got", line)
+		}
+		if line := cramMD5(r, w, "nobody@example.com", "secret"); !strings.HasPrefix(line, "535 5.7.8") {
+			t.Error("expecting an unknown user to fail, got", line)
+		}
+		authExpect(t, r, w, [][2]string{
+			{"AUTH CRAM-MD5 " + b64("test@example.com"), "501 5.5.2"},
+			{"AUTH CRAM-MD5", "334 "},
+			{b64("test@example.com not-a-digest"), "501 5.5.2"},
+			{"AUTH CRAM-MD5", "334 "},
+			{"*", "501 5.5.2 Authentication cancelled"},
+		})
+		if line := cramMD5(r, w, "test@example.com", "secret"); !strings.HasPrefix(line, "235 2.7.0") {
+			t.Error("expecting the right secret to authenticate, got", line)
+		}
+	})
+	if !strings.Contains(ehlo, "250-AUTH PLAIN LOGIN CRAM-MD5") {
+		t.Error("expecting CRAM-MD5 to be advertised, got", ehlo)
+	}
+	if client.authUser != "test@example.com" {
+		t.Error("expecting the client to be authenticated, got", client.authUser)
+	}
+
+	// CRAM-MD5 needs the secret
+	_, ehlo = authSessionFunc(t, testAuthenticator{}, true, false, func(r *textproto.Reader, w *textproto.Writer) {
+		authExpect(t, r, w, [][2]string{
+			{"AUTH CRAM-MD5", "504 5.5.4"},
+		})
+	})
+	if !strings.Contains(ehlo, "250-AUTH PLAIN LOGIN\n") {
+		t.Error("expecting CRAM-MD5 not to be advertised, got", ehlo)
+	}
+}
+
+// Failed attempts count as errors, the client is disconnected after too many
+func TestAuthMaxAttempts(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	mainlog, _ := log.GetLogger(sc.LogFile, "debug")
+	conn, server := getMockServerConn(sc, t)
+	server.setAuthenticator(testSecretAuthenticator{})
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	client.TLS = true
+	done := make(chan struct{})
+	go func() {
+		server.handleClient(client)
+		close(done)
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	_, _ = r.ReadLine()
+	expectations := [][2]string{
+		{"HELO client.example.com", "250 "},
+		{"AUTH PLAIN not-base64!", "501 5.5.2"},
+	}
+	for i := 2; i < MaxUnrecognizedCommands; i++ {
+		expectations = append(expectations, [2]string{"AUTH PLAIN " + b64("\x00test@example.com\x00wrong"), "535 5.7.8"})
+	}
+	expectations = append(expectations, [2]string{"AUTH PLAIN " + b64("\x00test@example.com\x00secret2"), "421 4.7.0"})
+	authExpect(t, r, w, expectations)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expecting the connection to be closed after too many failed attempts")
+	}
+	if client.authUser != "" {
+		t.Error("expecting the client not to be authenticated")
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	sc.Timeout = 1
+	mainlog, _ := log.GetLogger(sc.LogFile, "debug")
+	_, server := getMockServerConn(sc, t)
+	server.setAuthenticator(testSecretAuthenticator{})
+	// the mock connection has no deadlines, use a real one
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(accepted, 1, mainlog, mail.NewPool(5))
+	client.TLS = true
+	done := make(chan struct{})
+	go func() {
+		server.handleClient(client)
+		close(done)
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn))
+	w := textproto.NewWriter(bufio.NewWriter(conn))
+	_, _ = r.ReadLine()
+	authExpect(t, r, w, [][2]string{
+		{"HELO client.example.com", "250 "},
+		{"AUTH CRAM-MD5", "334 "},
+	})
+	// no answer to the challenge
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expecting the connection to be closed when the challenge times out")
+	}
+	if client.authUser != "" {
+		t.Error("expecting the client not to be authenticated")
+	}
+}
@@ -165,6 +165,19 @@ func Log() log.Logger {
 	return l
 }
 
+// EnvelopeLog returns the log for lines about e, with the remote_ip, helo and queue_id of the
+// connection it came from as fields, the same as in the lines logged by the server
+func EnvelopeLog(e *mail.Envelope) log.FieldLogger {
+	fields := map[string]interface{}{"remote_ip": e.RemoteIP}
+	if e.Helo != "" {
+		fields["helo"] = e.Helo
+	}
+	if e.QueuedId != "" {
+		fields["queue_id"] = e.QueuedId
+	}
+	return Log().WithFields(fields)
+}
+
 func (s *service) SetMainlog(l log.Logger) {
 	s.mainlog.Store(l)
 }
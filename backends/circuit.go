@@ -0,0 +1,225 @@
+package backends
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by CircuitBreaker.Do when the call was not attempted
+// because the dependency has been failing
+var ErrCircuitOpen = errors.New("circuit open, dependency unavailable")
+
+const (
+	defaultCircuitThreshold = 5
+	defaultCircuitWindow    = time.Second * 60
+	defaultCircuitCooldown  = time.Second * 30
+)
+
+// circuitStates publishes the state of each circuit breaker, keyed by name, eg.
+// "guerrilla_circuits": {"clamav": "closed", "dnsbl": "open"}
+var circuitStates = expvar.NewMap("guerrilla_circuits")
+
+// circuitTrips counts how many times each circuit has opened
+var circuitTrips = expvar.NewMap("guerrilla_circuit_trips")
+
+type CircuitState int
+
+const (
+	// CircuitClosed means calls pass through to the dependency
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means calls fail immediately without being attempted
+	CircuitOpen
+	// CircuitHalfOpen means a single probe call is allowed through to test the dependency
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitConfig holds the thresholds for a circuit breaker.
+// Each dependency reads its own values from the backend config, prefixed with the dependency name,
+// eg. for the prefix "clamav":
+//
+//	clamav_circuit_threshold - number of consecutive failures before opening, default 5
+//	clamav_circuit_window - the consecutive failures must happen within this duration, default "60s"
+//	clamav_circuit_cooldown - how long to stay open before probing the dependency again, default "30s"
+//	clamav_circuit_fail_open - true to accept the message when the circuit is open, false to defer it
+type CircuitConfig struct {
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+	FailOpen  bool
+}
+
+// NewCircuitConfig reads the circuit breaker settings for the dependency named by prefix
+func NewCircuitConfig(prefix string, backendConfig BackendConfig) (CircuitConfig, error) {
+	c := CircuitConfig{
+		Threshold: defaultCircuitThreshold,
+		Window:    defaultCircuitWindow,
+		Cooldown:  defaultCircuitCooldown,
+	}
+	key := prefix + "_circuit_threshold"
+	if v, ok := backendConfig[key]; ok {
+		switch n := v.(type) {
+		case float64:
+			c.Threshold = int(n)
+		case int:
+			c.Threshold = n
+		default:
+			return c, convertError("property invalid: '" + key + "' of expected type: int")
+		}
+	}
+	for key, d := range map[string]*time.Duration{
+		prefix + "_circuit_window":   &c.Window,
+		prefix + "_circuit_cooldown": &c.Cooldown,
+	} {
+		v, ok := backendConfig[key]
+		if !ok {
+			continue
+		}
+		str, ok := v.(string)
+		if !ok {
+			return c, convertError("property invalid: '" + key + "' of expected type: string")
+		}
+		t, err := time.ParseDuration(str)
+		if err != nil {
+			return c, convertError("property invalid: '" + key + "' " + err.Error())
+		}
+		*d = t
+	}
+	key = prefix + "_circuit_fail_open"
+	if v, ok := backendConfig[key]; ok {
+		if b, ok := v.(bool); ok {
+			c.FailOpen = b
+		} else {
+			return c, convertError("property invalid: '" + key + "' of expected type: bool")
+		}
+	}
+	return c, nil
+}
+
+// CircuitBreaker wraps calls to an external dependency such as clamd, spamd or a DNS resolver.
+// After Threshold consecutive failures within Window, the circuit opens and calls fail
+// immediately with ErrCircuitOpen. Once Cooldown has passed, a single probe call is let through;
+// if it succeeds the circuit closes again, otherwise it stays open for another Cooldown.
+type CircuitBreaker struct {
+	name   string
+	config CircuitConfig
+
+	state        CircuitState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+
+	// now can be replaced in tests
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+// NewCircuitBreaker returns a closed circuit breaker. The name is used for reporting its state
+// under the "guerrilla_circuits" expvar
+func NewCircuitBreaker(name string, config CircuitConfig) *CircuitBreaker {
+	if config.Threshold <= 0 {
+		config.Threshold = defaultCircuitThreshold
+	}
+	cb := &CircuitBreaker{
+		name:   name,
+		config: config,
+		now:    time.Now,
+	}
+	circuitStates.Set(name, expvar.Func(func() interface{} {
+		return cb.State().String()
+	}))
+	return cb
+}
+
+// Name returns the name of the dependency being protected
+func (cb *CircuitBreaker) Name() string {
+	return cb.name
+}
+
+// FailOpen reports whether callers should accept the message when the dependency is unavailable
+func (cb *CircuitBreaker) FailOpen() bool {
+	return cb.config.FailOpen
+}
+
+// State returns the current state of the circuit
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Do calls fn unless the circuit is open. The result of fn is recorded
+// and returned. ErrCircuitOpen is returned without calling fn when the circuit is open.
+func (cb *CircuitBreaker) Do(fn func() error) error {
+	if !cb.allow() {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	cb.record(err == nil)
+	return err
+}
+
+// allow decides whether a call can go through, transitioning to half-open when the cooldown elapsed
+func (cb *CircuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case CircuitOpen:
+		if cb.now().Sub(cb.openedAt) < cb.config.Cooldown {
+			return false
+		}
+		// let one probe through
+		cb.state = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		// a probe is already in flight
+		return false
+	}
+	return true
+}
+
+func (cb *CircuitBreaker) record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := cb.now()
+	if success {
+		if cb.state != CircuitClosed {
+			Log().WithField("circuit", cb.name).Info("dependency recovered, circuit closed")
+		}
+		cb.state = CircuitClosed
+		cb.failures = 0
+		return
+	}
+	if cb.state == CircuitHalfOpen {
+		// probe failed, back to open
+		cb.state = CircuitOpen
+		cb.openedAt = now
+		return
+	}
+	if cb.failures == 0 || (cb.config.Window > 0 && now.Sub(cb.firstFailure) > cb.config.Window) {
+		// start counting a new run of failures
+		cb.failures = 0
+		cb.firstFailure = now
+	}
+	cb.failures++
+	if cb.failures >= cb.config.Threshold {
+		cb.state = CircuitOpen
+		cb.openedAt = now
+		cb.failures = 0
+		circuitTrips.Add(cb.name, 1)
+		Log().WithField("circuit", cb.name).Warn("dependency failing, circuit opened")
+	}
+}
@@ -0,0 +1,82 @@
+package backends
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	config, err := NewCircuitConfig("test", BackendConfig{
+		"test_circuit_threshold": 3,
+		"test_circuit_window":    "10s",
+		"test_circuit_cooldown":  "5s",
+		"test_circuit_fail_open": true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !config.FailOpen || config.Threshold != 3 || config.Cooldown != time.Second*5 {
+		t.Error("config was not read, got", config)
+	}
+	cb := NewCircuitBreaker("test", config)
+	clock := time.Now()
+	cb.now = func() time.Time { return clock }
+
+	down := errors.New("connection refused")
+	calls := 0
+	failing := func() error {
+		calls++
+		return down
+	}
+	for i := 0; i < 3; i++ {
+		if err := cb.Do(failing); err != down {
+			t.Error("expecting the dependency error, got", err)
+		}
+	}
+	if cb.State() != CircuitOpen {
+		t.Error("circuit should be open after 3 failures, it is", cb.State())
+	}
+	if err := cb.Do(failing); err != ErrCircuitOpen {
+		t.Error("expecting ErrCircuitOpen, got", err)
+	}
+	if calls != 3 {
+		t.Error("the dependency should not be called while open, calls:", calls)
+	}
+
+	// after the cooldown a probe goes through and fails
+	clock = clock.Add(time.Second * 6)
+	if err := cb.Do(failing); err != down {
+		t.Error("expecting the probe to be attempted, got", err)
+	}
+	if cb.State() != CircuitOpen {
+		t.Error("circuit should re-open after a failed probe, it is", cb.State())
+	}
+
+	// successful probe closes the circuit
+	clock = clock.Add(time.Second * 6)
+	if err := cb.Do(func() error { return nil }); err != nil {
+		t.Error(err)
+	}
+	if cb.State() != CircuitClosed {
+		t.Error("circuit should be closed after a good probe, it is", cb.State())
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	cb := NewCircuitBreaker("test_window", CircuitConfig{Threshold: 2, Window: time.Second})
+	clock := time.Now()
+	cb.now = func() time.Time { return clock }
+	fail := func() error { return errors.New("timeout") }
+	_ = cb.Do(fail)
+	clock = clock.Add(time.Second * 2)
+	_ = cb.Do(fail)
+	if cb.State() != CircuitClosed {
+		t.Error("failures outside the window should not open the circuit")
+	}
+	_ = cb.Do(fail)
+	if cb.State() != CircuitOpen {
+		t.Error("circuit should be open, it is", cb.State())
+	}
+}
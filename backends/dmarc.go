@@ -0,0 +1,252 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARC results, as used in Authentication-Results (RFC 8601)
+const (
+	DMARCNone      = "none"
+	DMARCPass      = "pass"
+	DMARCFail      = "fail"
+	DMARCTempError = "temperror"
+	DMARCPermError = "permerror"
+)
+
+// DMARC policies (RFC 7489 section 6.3)
+const (
+	DMARCPolicyNone       = "none"
+	DMARCPolicyQuarantine = "quarantine"
+	DMARCPolicyReject     = "reject"
+)
+
+// DMARCResolver looks up DMARC records. *net.Resolver implements it
+type DMARCResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DMARCRecord is a parsed DMARC record
+type DMARCRecord struct {
+	// Policy is the p= tag, SubdomainPolicy the sp= tag, Policy if not given
+	Policy          string
+	SubdomainPolicy string
+	// StrictDKIM and StrictSPF are true for adkim=s and aspf=s
+	StrictDKIM bool
+	StrictSPF  bool
+	// Percent is the pct= tag, the percentage of failing messages the policy applies to
+	Percent int
+	// AggregateReports are the rua= URIs
+	AggregateReports []string
+}
+
+// DMARCResult is the outcome of a DMARC evaluation
+type DMARCResult struct {
+	// Result is one of DMARCNone, DMARCPass, DMARCFail, DMARCTempError or DMARCPermError
+	Result string
+	// Domain is the domain of the From header, OrgDomain its organizational domain
+	Domain    string
+	OrgDomain string
+	// Policy is the policy requested by the domain owner for the message, "" if there's no record
+	Policy string
+	// SPFAligned and DKIMAligned are true if the identifier passed and is aligned with Domain
+	SPFAligned  bool
+	DKIMAligned bool
+	// Record is the record that was used, nil if none was found
+	Record *DMARCRecord
+	// SourceIP is the address of the client, for reports
+	SourceIP string
+}
+
+var errDMARCSyntax = errors.New("dmarc: invalid record")
+
+// ParseDMARCRecord parses a DMARC TXT record, eg. "v=DMARC1; p=reject; rua=mailto:d@example.com"
+func ParseDMARCRecord(txt string) (*DMARCRecord, error) {
+	tags := strings.Split(txt, ";")
+	if strings.Replace(strings.TrimSpace(tags[0]), " ", "", -1) != "v=DMARC1" {
+		return nil, errDMARCSyntax
+	}
+	r := &DMARCRecord{Percent: 100}
+	for _, tag := range tags[1:] {
+		i := strings.Index(tag, "=")
+		if i < 0 {
+			if strings.TrimSpace(tag) == "" {
+				continue
+			}
+			return nil, errDMARCSyntax
+		}
+		name := strings.ToLower(strings.TrimSpace(tag[:i]))
+		value := strings.TrimSpace(tag[i+1:])
+		switch name {
+		case "p", "sp":
+			policy := strings.ToLower(value)
+			if policy != DMARCPolicyNone && policy != DMARCPolicyQuarantine && policy != DMARCPolicyReject {
+				return nil, errDMARCSyntax
+			}
+			if name == "p" {
+				r.Policy = policy
+			} else {
+				r.SubdomainPolicy = policy
+			}
+		case "adkim", "aspf":
+			strict := strings.EqualFold(value, "s")
+			if !strict && !strings.EqualFold(value, "r") {
+				return nil, errDMARCSyntax
+			}
+			if name == "adkim" {
+				r.StrictDKIM = strict
+			} else {
+				r.StrictSPF = strict
+			}
+		case "pct":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > 100 {
+				return nil, errDMARCSyntax
+			}
+			r.Percent = n
+		case "rua":
+			for _, uri := range strings.Split(value, ",") {
+				if uri = strings.TrimSpace(uri); uri != "" {
+					r.AggregateReports = append(r.AggregateReports, uri)
+				}
+			}
+		}
+	}
+	if r.Policy == "" {
+		// RFC 7489 6.6.3, a record with rua but no valid p is treated as p=none
+		if len(r.AggregateReports) == 0 {
+			return nil, errDMARCSyntax
+		}
+		r.Policy = DMARCPolicyNone
+	}
+	if r.SubdomainPolicy == "" {
+		r.SubdomainPolicy = r.Policy
+	}
+	return r, nil
+}
+
+// OrganizationalDomain returns the registered domain of domain using the public suffix list,
+// eg. "example.co.uk" for "mail.example.co.uk"
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+	return domain
+}
+
+// dmarcAligned returns true if the authenticated domain is aligned with the From domain
+func dmarcAligned(domain, fromDomain string, strict bool) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+	if strict {
+		return domain == fromDomain
+	}
+	return OrganizationalDomain(domain) == OrganizationalDomain(fromDomain)
+}
+
+// lookupDMARC returns the record of the domain, nil if it has none
+func lookupDMARC(ctx context.Context, resolver DMARCResolver, domain string) (*DMARCRecord, error) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if spfNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var records []*DMARCRecord
+	for _, txt := range txts {
+		if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(txt)), "v=dmarc1") {
+			continue
+		}
+		if r, err := ParseDMARCRecord(txt); err == nil {
+			records = append(records, r)
+		}
+	}
+	// more than one record is the same as none, RFC 7489 6.6.3
+	if len(records) != 1 {
+		return nil, nil
+	}
+	return records[0], nil
+}
+
+// CheckDMARC evaluates DMARC for a message from fromDomain, the domain of its From header.
+// spfDomain is the domain that SPF was checked for, and spfResult its result.
+// dkimDomains are the d= domains of the DKIM signatures that verified
+func CheckDMARC(ctx context.Context, resolver DMARCResolver, fromDomain, spfDomain, spfResult string, dkimDomains []string) *DMARCResult {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	result := &DMARCResult{Result: DMARCNone, Domain: fromDomain, OrgDomain: OrganizationalDomain(fromDomain)}
+	if fromDomain == "" {
+		result.Result = DMARCPermError
+		return result
+	}
+	record, err := lookupDMARC(ctx, resolver, fromDomain)
+	policyDomain := fromDomain
+	if err == nil && record == nil && result.OrgDomain != fromDomain {
+		record, err = lookupDMARC(ctx, resolver, result.OrgDomain)
+		policyDomain = result.OrgDomain
+	}
+	if err != nil {
+		result.Result = DMARCTempError
+		return result
+	}
+	if record == nil {
+		return result
+	}
+	result.Record = record
+	result.Policy = record.Policy
+	if policyDomain != fromDomain {
+		result.Policy = record.SubdomainPolicy
+	}
+	result.SPFAligned = spfResult == SPFPass && dmarcAligned(spfDomain, fromDomain, record.StrictSPF)
+	for _, d := range dkimDomains {
+		if dmarcAligned(d, fromDomain, record.StrictDKIM) {
+			result.DKIMAligned = true
+			break
+		}
+	}
+	if result.SPFAligned || result.DKIMAligned {
+		result.Result = DMARCPass
+	} else {
+		result.Result = DMARCFail
+	}
+	return result
+}
+
+// DMARCReporter receives the results of evaluations of domains that asked for aggregate
+// reports (rua=), so that they can be collected and sent
+type DMARCReporter interface {
+	Report(result *DMARCResult)
+}
+
+var (
+	dmarcReporter     DMARCReporter
+	dmarcReporterLock sync.RWMutex
+)
+
+// SetDMARCReporter sets the reporter of DMARC results, nil to stop reporting
+func SetDMARCReporter(r DMARCReporter) {
+	dmarcReporterLock.Lock()
+	defer dmarcReporterLock.Unlock()
+	dmarcReporter = r
+}
+
+// reportDMARC gives the result to the reporter, if one is set and the domain wants reports
+func reportDMARC(result *DMARCResult) {
+	if result.Record == nil || len(result.Record.AggregateReports) == 0 {
+		return
+	}
+	dmarcReporterLock.RLock()
+	r := dmarcReporter
+	dmarcReporterLock.RUnlock()
+	if r != nil {
+		r.Report(result)
+	}
+}
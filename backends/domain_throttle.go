@@ -0,0 +1,221 @@
+package backends
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrThrottled is returned by DomainThrottle.Wait when no delivery slot became free in time,
+// the message should be deferred and retried later
+var ErrThrottled = errors.New("destination domain throttled, deferred")
+
+// DomainThrottleConfig limits the deliveries to each destination domain.
+// The values are read from the backend config, prefixed with the name of the user, eg. for "relay":
+//
+//	relay_domain_max_concurrent - number of deliveries to the same domain at a time, 0 for no limit (default)
+//	relay_domain_per_minute - number of messages delivered to the same domain per minute, 0 for no limit (default)
+type DomainThrottleConfig struct {
+	MaxConcurrent int
+	PerMinute     int
+}
+
+// NewDomainThrottleConfig reads the throttle settings of the user named by prefix
+func NewDomainThrottleConfig(prefix string, backendConfig BackendConfig) (DomainThrottleConfig, error) {
+	c := DomainThrottleConfig{}
+	for key, n := range map[string]*int{
+		prefix + "_domain_max_concurrent": &c.MaxConcurrent,
+		prefix + "_domain_per_minute":     &c.PerMinute,
+	} {
+		v, ok := backendConfig[key]
+		if !ok {
+			continue
+		}
+		switch val := v.(type) {
+		case float64:
+			*n = int(val)
+		case int:
+			*n = val
+		default:
+			return c, convertError("property invalid: '" + key + "' of expected type: int")
+		}
+		if *n < 0 {
+			return c, convertError("property invalid: '" + key + "' cannot be negative")
+		}
+	}
+	return c, nil
+}
+
+type domainState struct {
+	active int
+	queued int
+	// sent holds the start times of the deliveries in the last minute, oldest first
+	sent []time.Time
+	// released is closed and replaced every time a slot is released, to wake up waiters
+	released chan struct{}
+}
+
+// DomainThrottle keeps deliveries to a single destination domain within the configured
+// concurrency and rate, so that receiving servers are not hammered with bursts.
+// Deliveries that cannot get a slot are deferred: Acquire tells the caller when to try again,
+// Wait blocks until a slot frees up, counting the message in the domain's queue depth meanwhile.
+type DomainThrottle struct {
+	name    string
+	config  DomainThrottleConfig
+	domains map[string]*domainState
+
+	// now can be replaced in tests
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+// NewDomainThrottle returns a throttle with the given limits. The name is the throttle label
+// of the MetricDomainThrottled metric
+func NewDomainThrottle(name string, config DomainThrottleConfig) *DomainThrottle {
+	return &DomainThrottle{
+		name:    name,
+		config:  config,
+		domains: make(map[string]*domainState),
+		now:     time.Now,
+	}
+}
+
+// Acquire reserves a delivery slot for domain. When a slot is free, it returns a release function
+// that must be called once the delivery finished. Otherwise release is nil and retryAfter is a
+// hint of when a slot may become free, it's 0 when waiting for a concurrent delivery to finish
+func (t *DomainThrottle) Acquire(domain string) (release func(), retryAfter time.Duration) {
+	domain = strings.ToLower(domain)
+	t.mu.Lock()
+	release, retryAfter, _ = t.acquire(domain)
+	t.mu.Unlock()
+	if release == nil {
+		t.throttled(domain)
+	}
+	return
+}
+
+// Wait is like Acquire, except that it blocks until a slot is free or the timeout passed,
+// in which case ErrThrottled is returned
+func (t *DomainThrottle) Wait(domain string, timeout time.Duration) (release func(), err error) {
+	domain = strings.ToLower(domain)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	t.mu.Lock()
+	s := t.domain(domain)
+	s.queued++
+	defer func() {
+		t.mu.Lock()
+		s.queued--
+		t.cleanup(domain, s)
+		t.mu.Unlock()
+	}()
+	for waited := false; ; waited = true {
+		release, retryAfter, released := t.acquire(domain)
+		t.mu.Unlock()
+		if release != nil {
+			return release, nil
+		}
+		if !waited {
+			t.throttled(domain)
+		}
+		var (
+			timer *time.Timer
+			retry <-chan time.Time
+		)
+		if retryAfter > 0 {
+			timer = time.NewTimer(retryAfter)
+			retry = timer.C
+		}
+		select {
+		case <-released:
+		case <-retry:
+		case <-deadline.C:
+			err = ErrThrottled
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.mu.Lock()
+	}
+}
+
+// Stats returns the number of active deliveries, deferred messages waiting for a slot and
+// deliveries started in the last minute, for each domain
+func (t *DomainThrottle) Stats() map[string]map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make(map[string]map[string]int, len(t.domains))
+	for domain, s := range t.domains {
+		t.prune(s)
+		stats[domain] = map[string]int{
+			"active":      s.active,
+			"queued":      s.queued,
+			"last_minute": len(s.sent),
+		}
+	}
+	return stats
+}
+
+// throttled counts a delivery to domain that had to be deferred
+func (t *DomainThrottle) throttled(domain string) {
+	AddMetric(MetricDomainThrottled, 1, "throttle", t.name, "domain", domain)
+}
+
+// acquire must be called with the lock held. It also returns the channel that will be closed
+// when the next slot is released
+func (t *DomainThrottle) acquire(domain string) (release func(), retryAfter time.Duration, released chan struct{}) {
+	s := t.domain(domain)
+	t.prune(s)
+	if t.config.MaxConcurrent > 0 && s.active >= t.config.MaxConcurrent {
+		return nil, 0, s.released
+	}
+	if t.config.PerMinute > 0 && len(s.sent) >= t.config.PerMinute {
+		return nil, s.sent[0].Add(time.Minute).Sub(t.now()), s.released
+	}
+	s.active++
+	if t.config.PerMinute > 0 {
+		s.sent = append(s.sent, t.now())
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			s.active--
+			close(s.released)
+			s.released = make(chan struct{})
+			t.cleanup(domain, s)
+		})
+	}, 0, s.released
+}
+
+func (t *DomainThrottle) domain(domain string) *domainState {
+	s, ok := t.domains[domain]
+	if !ok {
+		s = &domainState{released: make(chan struct{})}
+		t.domains[domain] = s
+	}
+	return s
+}
+
+// prune forgets the deliveries started over a minute ago
+func (t *DomainThrottle) prune(s *domainState) {
+	cutoff := t.now().Add(-time.Minute)
+	i := 0
+	for i < len(s.sent) && !s.sent[i].After(cutoff) {
+		i++
+	}
+	s.sent = s.sent[i:]
+}
+
+// cleanup removes the state of a domain once nothing is tracked for it
+func (t *DomainThrottle) cleanup(domain string, s *domainState) {
+	t.prune(s)
+	if s.active == 0 && s.queued == 0 && len(s.sent) == 0 && t.domains[domain] == s {
+		delete(t.domains, domain)
+	}
+}
@@ -0,0 +1,105 @@
+package backends
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDomainThrottleConcurrency(t *testing.T) {
+	throttle := NewDomainThrottle("test_concurrency", DomainThrottleConfig{MaxConcurrent: 2})
+	r1, _ := throttle.Acquire("example.com")
+	r2, _ := throttle.Acquire("EXAMPLE.com")
+	if r1 == nil || r2 == nil {
+		t.Fatal("expecting two slots")
+	}
+	if r, retry := throttle.Acquire("example.com"); r != nil || retry != 0 {
+		t.Error("expecting the third delivery to be deferred without a retry hint")
+	}
+	if r, _ := throttle.Acquire("example.net"); r == nil {
+		t.Error("other domains should not be throttled")
+	} else {
+		r()
+	}
+	if _, err := throttle.Wait("example.com", time.Millisecond*10); err != ErrThrottled {
+		t.Error("expecting", ErrThrottled, "got", err)
+	}
+
+	done := make(chan func())
+	go func() {
+		r, err := throttle.Wait("example.com", time.Second*5)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- r
+	}()
+	for i := 0; i < 100; i++ {
+		if throttle.Stats()["example.com"]["queued"] == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := throttle.Stats()["example.com"]; stats["active"] != 2 || stats["queued"] != 1 {
+		t.Error("expecting 2 active and 1 queued, got", stats)
+	}
+	r1()
+	r1() // releasing twice must not free another slot
+	r3 := <-done
+	if r3 == nil {
+		t.Fatal("expecting the waiting delivery to get the released slot")
+	}
+	if r, _ := throttle.Acquire("example.com"); r != nil {
+		t.Error("expecting the domain to be at its limit again")
+	}
+	r2()
+	r3()
+	if _, ok := throttle.Stats()["example.com"]; ok {
+		t.Error("expecting idle domains to be forgotten")
+	}
+}
+
+func TestDomainThrottleRate(t *testing.T) {
+	throttle := NewDomainThrottle("test_rate", DomainThrottleConfig{PerMinute: 2})
+	now := time.Unix(1500000000, 0)
+	throttle.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		r, _ := throttle.Acquire("example.com")
+		if r == nil {
+			t.Fatal("expecting a slot")
+		}
+		r()
+		now = now.Add(time.Second * 10)
+	}
+	r, retry := throttle.Acquire("example.com")
+	if r != nil {
+		t.Error("expecting the rate limit to defer the delivery")
+	}
+	if retry != time.Second*40 {
+		t.Error("expecting to retry after 40s, got", retry)
+	}
+	if stats := throttle.Stats()["example.com"]; stats["last_minute"] != 2 {
+		t.Error("expecting 2 deliveries in the last minute, got", stats)
+	}
+	now = now.Add(retry)
+	if r, _ := throttle.Acquire("example.com"); r == nil {
+		t.Error("expecting a slot once the oldest delivery is over a minute old")
+	}
+}
+
+func TestNewDomainThrottleConfig(t *testing.T) {
+	c, err := NewDomainThrottleConfig("relay", BackendConfig{
+		"relay_domain_max_concurrent": float64(3),
+		"relay_domain_per_minute":     60,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if c.MaxConcurrent != 3 || c.PerMinute != 60 {
+		t.Error("unexpected config", c)
+	}
+	if _, err := NewDomainThrottleConfig("relay", BackendConfig{"relay_domain_per_minute": "60"}); err == nil {
+		t.Error("expecting an error for a string value")
+	}
+	if _, err := NewDomainThrottleConfig("relay", BackendConfig{"relay_domain_max_concurrent": -1}); err == nil {
+		t.Error("expecting an error for a negative value")
+	}
+}
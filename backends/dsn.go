@@ -0,0 +1,45 @@
+package backends
+
+import (
+	"os"
+	"sort"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// DSNKey is the key in e.Values for the *mail.DSN of the recipients that failed after
+// the message was accepted, eg. by the lmtp processor. It's not set for messages from <>
+const DSNKey = "dsn"
+
+// DSNFor returns a DSN to the sender of e for the failed recipients, a map of each
+// address to the SMTP reply it failed with, eg. "550 5.1.1 no such user".
+// Returns mail.ErrNullReversePath if e was sent from <>
+func DSNFor(e *mail.Envelope, failed map[string]string) (*mail.DSN, error) {
+	if e.MailFrom.NullPath || e.MailFrom.User == "" {
+		return nil, mail.ErrNullReversePath
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	dsn, err := mail.NewDSN(hostname, e.MailFrom.String(), mail.HeadersOf([]byte(e.String())), dsnRecipients(failed)...)
+	if err != nil {
+		return nil, err
+	}
+	dsn.ArrivalDate = mail.DefaultClock.Now()
+	return dsn, nil
+}
+
+// dsnRecipients returns the status of each failed recipient, sorted by address
+func dsnRecipients(failed map[string]string) []mail.DSNRecipient {
+	rcpts := make([]string, 0, len(failed))
+	for rcpt := range failed {
+		rcpts = append(rcpts, rcpt)
+	}
+	sort.Strings(rcpts)
+	statuses := make([]mail.DSNRecipient, len(rcpts))
+	for i, rcpt := range rcpts {
+		statuses[i] = mail.NewDSNRecipient(rcpt, failed[rcpt])
+	}
+	return statuses
+}
@@ -0,0 +1,28 @@
+// +build !darwin
+// +build !dragonfly
+// +build !freebsd
+// +build !linux
+// +build !netbsd
+// +build !openbsd
+
+package backends
+
+import (
+	"os"
+	"sync"
+)
+
+// fileLock serializes the writers of this process, as flock is not available
+var fileLock sync.Mutex
+
+// lockFile only locks against the other writers of this process on your OS/platform
+func lockFile(f *os.File) error {
+	fileLock.Lock()
+	return nil
+}
+
+// unlockFile releases the lock taken with lockFile
+func unlockFile(f *os.File) error {
+	fileLock.Unlock()
+	return nil
+}
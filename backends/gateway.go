@@ -131,6 +131,7 @@ func (gw *BackendGateway) Process(e *mail.Envelope) Result {
 	if gw.State != BackendStateRunning {
 		return NewResult(response.Canned.FailBackendNotRunning, response.SP, gw.State)
 	}
+	defer observeDuration("save_mail", time.Now())
 	// borrow a workerMsg from the pool
 	workerMsg := workerMsgPool.Get().(*workerMsg)
 	workerMsg.reset(e, TaskSaveMail)
@@ -148,7 +149,7 @@ func (gw *BackendGateway) Process(e *mail.Envelope) Result {
 		// A custom result, there was probably an error, if so, log it
 		if status.result != nil {
 			if status.err != nil {
-				Log().Error(status.err)
+				EnvelopeLog(e).Error(status.err)
 			}
 			return status.result
 		}
@@ -163,11 +164,11 @@ func (gw *BackendGateway) Process(e *mail.Envelope) Result {
 
 		// both result & error are nil (should not happen)
 		err := errors.New("no response from backend - processor did not return a result or an error")
-		Log().Error(err)
+		EnvelopeLog(e).Error(err)
 		return NewResult(response.Canned.FailBackendTransaction, response.SP, err)
 
 	case <-time.After(gw.saveTimeout()):
-		Log().Error("Backend has timed out while saving email")
+		EnvelopeLog(e).Error("Backend has timed out while saving email")
 		e.Lock() // lock the envelope - it's still processing here, we don't want the server to recycle it
 		go func() {
 			// keep waiting for the backend to finish processing
@@ -189,6 +190,7 @@ func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
 		// no validator processors configured
 		return nil
 	}
+	defer observeDuration("validate_rcpt", time.Now())
 	// place on the channel so that one of the save mail workers can pick it up
 	workerMsg := workerMsgPool.Get().(*workerMsg)
 	workerMsg.reset(e, TaskValidateRcpt)
@@ -215,6 +217,11 @@ func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
 	}
 }
 
+// observeDuration records the time taken by a task since start in the MetricBackendDuration histogram
+func observeDuration(task string, start time.Time) {
+	ObserveMetric(MetricBackendDuration, time.Since(start).Seconds(), "task", task)
+}
+
 // Shutdown shuts down the backend and leaves it in BackendStateShuttered state
 func (gw *BackendGateway) Shutdown() error {
 	gw.Lock()
@@ -243,7 +250,7 @@ func (gw *BackendGateway) Reinitialize() error {
 
 	err := gw.Initialize(gw.config)
 	if err != nil {
-		fmt.Println("reinitialize to ", gw.config, err)
+		Log().WithError(err).WithField("component", "gateway").Error("reinitialize failed")
 		return fmt.Errorf("error while initializing the backend: %s", err)
 	}
 
@@ -265,7 +272,7 @@ func (gw *BackendGateway) newStack(stackConfig string) (Processor, error) {
 	for i := range items {
 		name := items[len(items)-1-i] // reverse order, since decorators are stacked
 		if makeFunc, ok := processors[name]; ok {
-			decorators = append(decorators, makeFunc())
+			decorators = append(decorators, traceDecorator(name, makeFunc()))
 		} else {
 			ErrProcessorNotFound = fmt.Errorf("processor [%s] not found", name)
 			return nil, ErrProcessorNotFound
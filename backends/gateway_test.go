@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -111,3 +113,56 @@ func TestStartProcessStop(t *testing.T) {
 		t.Error("Gateway did not shutdown")
 	}
 }
+
+// Nothing should be printed to stdout, everything goes through the logger
+func TestNoStdoutWrites(t *testing.T) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	printed := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		printed <- b
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":       "HeadersParser|Header|Hasher|Debugger",
+		"log_received_mails": true,
+		"save_workers_size":  1,
+		"primary_mail_host":  "example.com",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc12345"
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	_, _ = e.Data.WriteString("Subject: Test\n\nThis is a test.\n")
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting the message to be saved, got", result)
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error(err)
+	}
+	gateway.config = BackendConfig{"save_process": "NoSuchProcessor"}
+	if err := gateway.Reinitialize(); err == nil {
+		t.Error("expecting reinitialize to fail")
+	}
+
+	os.Stdout = stdout
+	_ = w.Close()
+	if b := <-printed; len(b) > 0 {
+		t.Error("expecting nothing on stdout, got", string(b))
+	}
+}
@@ -0,0 +1,60 @@
+package backends
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Greylister defers the first delivery attempt of each (client IP, sender, recipient) triplet.
+// Legitimate servers retry after a while and are let through, while most spam software does not.
+// The triplets are kept in a KVStore, so that instances sharing a Redis store agree
+type Greylister struct {
+	store KVStore
+	delay time.Duration
+	ttl   time.Duration
+
+	// now can be replaced in tests
+	now func() time.Time
+}
+
+const greylistPrefix = "greylist:"
+
+// NewGreylister accepts a triplet once delay has passed since it was first seen. Triplets are
+// forgotten when not seen for ttl
+func NewGreylister(store KVStore, delay, ttl time.Duration) *Greylister {
+	if ttl < delay {
+		ttl = delay
+	}
+	return &Greylister{
+		store: store,
+		delay: delay,
+		ttl:   ttl,
+		now:   time.Now,
+	}
+}
+
+// Check records an attempt for the triplet. It returns false if the triplet is new or was first
+// seen less than the delay ago, and how long until it will be accepted
+func (g *Greylister) Check(ip, from, rcpt string) (passed bool, retryAfter time.Duration, err error) {
+	key := greylistPrefix + ip + ":" + strings.ToLower(from) + ":" + strings.ToLower(rcpt)
+	now := g.now()
+	value, ok, err := g.store.Get(key)
+	if err != nil {
+		return false, 0, err
+	}
+	if ok {
+		if first, err := strconv.ParseInt(value, 10, 64); err == nil {
+			wait := time.Unix(0, first).Add(g.delay).Sub(now)
+			if wait > 0 {
+				return false, wait, nil
+			}
+			// seen again, keep it for another ttl
+			return true, 0, g.store.Expire(key, g.ttl)
+		}
+	}
+	if err = g.store.Set(key, strconv.FormatInt(now.UnixNano(), 10), g.ttl); err != nil {
+		return false, 0, err
+	}
+	return false, g.delay, nil
+}
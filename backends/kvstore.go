@@ -0,0 +1,369 @@
+package backends
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// KVStore holds the counters and sets used by anti-abuse features such as rate limiting,
+// greylisting and quotas. The in-memory store keeps the state local to one instance, the
+// Redis store lets several instances share it.
+// A ttl of 0 means the key does not expire.
+type KVStore interface {
+	// Get returns the value of key, ok is false if the key does not exist
+	Get(key string) (value string, ok bool, err error)
+	// Set sets the value of key, replacing its ttl
+	Set(key, value string, ttl time.Duration) error
+	// Incr adds delta to the integer value of key, a missing key counting as 0, and returns the
+	// new value. The ttl of an existing key is not changed
+	Incr(key string, delta int64) (int64, error)
+	// Expire sets the ttl of an existing key
+	Expire(key string, ttl time.Duration) error
+	// SAdd adds members to the set stored at key
+	SAdd(key string, members ...string) error
+	// SIsMember returns true if member is in the set stored at key
+	SIsMember(key, member string) (bool, error)
+}
+
+// ErrKVWrongType is returned when a key holds a value of a different type, eg. Incr on a set
+var ErrKVWrongType = errors.New("kv: value of the wrong type for the operation")
+
+var (
+	kvStores     = make(map[string]KVStore)
+	kvStoresLock sync.Mutex
+)
+
+// NewKVStore returns the store set by the backend config, so that every user of the config shares
+// the same state. It's a Redis store if kv_redis_interface is set, eg. "127.0.0.1:6379",
+// otherwise the in-memory store of this instance. kv_redis_timeout limits the time taken to
+// connect, send a command and read its reply, default "2s". The Redis commands go through a
+// circuit breaker configured with the kv_redis_circuit_* options, see CircuitConfig
+func NewKVStore(backendConfig BackendConfig) (KVStore, error) {
+	address := ""
+	if v, ok := backendConfig["kv_redis_interface"]; ok {
+		if address, ok = v.(string); !ok {
+			return nil, convertError("property invalid: 'kv_redis_interface' of expected type: string")
+		}
+	}
+	kvStoresLock.Lock()
+	defer kvStoresLock.Unlock()
+	if store, ok := kvStores[address]; ok {
+		return store, nil
+	}
+	var store KVStore
+	if address == "" {
+		store = NewMemoryKVStore()
+	} else {
+		timeout := defaultRedisKVTimeout
+		if v, ok := backendConfig["kv_redis_timeout"]; ok {
+			str, _ := v.(string)
+			var err error
+			if timeout, err = time.ParseDuration(str); err != nil || timeout <= 0 {
+				return nil, convertError("property invalid: 'kv_redis_timeout' must be a duration, eg. \"2s\"")
+			}
+		}
+		circuit, err := NewCircuitConfig("kv_redis", backendConfig)
+		if err != nil {
+			return nil, err
+		}
+		store = NewRedisKVStore(address, timeout, circuit)
+	}
+	kvStores[address] = store
+	return store, nil
+}
+
+type memoryKVItem struct {
+	value   string
+	set     map[string]struct{}
+	expires time.Time
+}
+
+// MemoryKVStore is a KVStore kept in memory. Expired keys are removed as they are accessed,
+// and by a sweep every few minutes
+type MemoryKVStore struct {
+	items     map[string]*memoryKVItem
+	lastSweep time.Time
+
+	// now can be replaced in tests
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+const memoryKVSweepInterval = time.Minute * 5
+
+func NewMemoryKVStore() *MemoryKVStore {
+	return &MemoryKVStore{
+		items: make(map[string]*memoryKVItem),
+		now:   time.Now,
+	}
+}
+
+// item returns the item at key, nil if missing or expired. The lock must be held
+func (m *MemoryKVStore) item(key string) *memoryKVItem {
+	now := m.now()
+	if now.Sub(m.lastSweep) > memoryKVSweepInterval {
+		m.lastSweep = now
+		for k, item := range m.items {
+			if item.expired(now) {
+				delete(m.items, k)
+			}
+		}
+	}
+	item, ok := m.items[key]
+	if !ok {
+		return nil
+	}
+	if item.expired(now) {
+		delete(m.items, key)
+		return nil
+	}
+	return item
+}
+
+func (i *memoryKVItem) expired(now time.Time) bool {
+	return !i.expires.IsZero() && !now.Before(i.expires)
+}
+
+func (m *MemoryKVStore) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return m.now().Add(ttl)
+}
+
+func (m *MemoryKVStore) Get(key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item := m.item(key)
+	if item == nil {
+		return "", false, nil
+	}
+	if item.set != nil {
+		return "", false, ErrKVWrongType
+	}
+	return item.value, true, nil
+}
+
+func (m *MemoryKVStore) Set(key, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[key] = &memoryKVItem{value: value, expires: m.expiry(ttl)}
+	return nil
+}
+
+func (m *MemoryKVStore) Incr(key string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item := m.item(key)
+	if item == nil {
+		item = &memoryKVItem{value: "0"}
+		m.items[key] = item
+	}
+	if item.set != nil {
+		return 0, ErrKVWrongType
+	}
+	n, err := strconv.ParseInt(item.value, 10, 64)
+	if err != nil {
+		return 0, ErrKVWrongType
+	}
+	n += delta
+	item.value = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (m *MemoryKVStore) Expire(key string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if item := m.item(key); item != nil {
+		item.expires = m.expiry(ttl)
+	}
+	return nil
+}
+
+func (m *MemoryKVStore) SAdd(key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item := m.item(key)
+	if item == nil {
+		item = &memoryKVItem{set: make(map[string]struct{})}
+		m.items[key] = item
+	}
+	if item.set == nil {
+		return ErrKVWrongType
+	}
+	for _, member := range members {
+		item.set[member] = struct{}{}
+	}
+	return nil
+}
+
+func (m *MemoryKVStore) SIsMember(key, member string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item := m.item(key)
+	if item == nil {
+		return false, nil
+	}
+	if item.set == nil {
+		return false, ErrKVWrongType
+	}
+	_, ok := item.set[member]
+	return ok, nil
+}
+
+const (
+	defaultRedisKVTimeout = time.Second * 2
+	// redisKVMaxIdle is the number of idle connections kept for reuse
+	redisKVMaxIdle = 16
+)
+
+// RedisKVStore is a KVStore in Redis, connected using the RedisDialer, so a Redis driver such as
+// backends/storage/redigo needs to be imported. Each command takes a connection from a pool of
+// idle connections, or dials a new one. A connection is closed after an error
+type RedisKVStore struct {
+	address string
+	options []RedisDialOption
+	idle    chan RedisConn
+	circuit *CircuitBreaker
+}
+
+// NewRedisKVStore returns a store for the Redis server at address. The timeout applies to
+// connecting, and to writing each command and reading its reply
+func NewRedisKVStore(address string, timeout time.Duration, circuit CircuitConfig) *RedisKVStore {
+	return &RedisKVStore{
+		address: address,
+		options: []RedisDialOption{
+			RedisDialConnectTimeout(timeout),
+			RedisDialReadTimeout(timeout),
+			RedisDialWriteTimeout(timeout),
+		},
+		idle:    make(chan RedisConn, redisKVMaxIdle),
+		circuit: NewCircuitBreaker("kv_redis", circuit),
+	}
+}
+
+// do runs a single command on a connection from the pool
+func (r *RedisKVStore) do(command string, args ...interface{}) (reply interface{}, err error) {
+	err = r.circuit.Do(func() error {
+		var conn RedisConn
+		select {
+		case conn = <-r.idle:
+		default:
+			if conn, err = RedisDialer("tcp", r.address, r.options...); err != nil {
+				return err
+			}
+		}
+		if reply, err = conn.Do(command, args...); err != nil {
+			_ = conn.Close()
+			return err
+		}
+		select {
+		case r.idle <- conn:
+		default:
+			// enough idle connections
+			_ = conn.Close()
+		}
+		return nil
+	})
+	return reply, err
+}
+
+// Close closes the idle connections to Redis
+func (r *RedisKVStore) Close() error {
+	var err error
+	for {
+		select {
+		case conn := <-r.idle:
+			if closeErr := conn.Close(); closeErr != nil {
+				err = closeErr
+			}
+		default:
+			return err
+		}
+	}
+}
+
+func (r *RedisKVStore) Get(key string) (string, bool, error) {
+	reply, err := r.do("GET", key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, err := redisString(reply)
+	return value, err == nil, err
+}
+
+func (r *RedisKVStore) Set(key, value string, ttl time.Duration) error {
+	var err error
+	if ttl > 0 {
+		_, err = r.do("SET", key, value, "PX", int64(ttl/time.Millisecond))
+	} else {
+		_, err = r.do("SET", key, value)
+	}
+	return err
+}
+
+func (r *RedisKVStore) Incr(key string, delta int64) (int64, error) {
+	reply, err := r.do("INCRBY", key, delta)
+	if err != nil {
+		return 0, err
+	}
+	return redisInt(reply)
+}
+
+func (r *RedisKVStore) Expire(key string, ttl time.Duration) error {
+	var err error
+	if ttl > 0 {
+		_, err = r.do("PEXPIRE", key, int64(ttl/time.Millisecond))
+	} else {
+		_, err = r.do("PERSIST", key)
+	}
+	return err
+}
+
+func (r *RedisKVStore) SAdd(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(members)+1)
+	args = append(args, key)
+	for _, member := range members {
+		args = append(args, member)
+	}
+	_, err := r.do("SADD", args...)
+	return err
+}
+
+func (r *RedisKVStore) SIsMember(key, member string) (bool, error) {
+	reply, err := r.do("SISMEMBER", key, member)
+	if err != nil {
+		return false, err
+	}
+	n, err := redisInt(reply)
+	return n == 1, err
+}
+
+// redisString converts a bulk string reply
+func redisString(reply interface{}) (string, error) {
+	switch v := reply.(type) {
+	case []byte:
+		return string(v), nil
+	case string:
+		return v, nil
+	}
+	return "", ErrKVWrongType
+}
+
+// redisInt converts an integer reply
+func redisInt(reply interface{}) (int64, error) {
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	}
+	return 0, ErrKVWrongType
+}
@@ -0,0 +1,224 @@
+package backends
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRedisConn understands the handful of commands used by RedisKVStore, ignoring expiry
+type fakeRedisConn struct {
+	strings map[string]string
+	sets    map[string]map[string]bool
+	ttls    map[string]int64
+}
+
+func newFakeRedisConn() *fakeRedisConn {
+	return &fakeRedisConn{
+		strings: make(map[string]string),
+		sets:    make(map[string]map[string]bool),
+		ttls:    make(map[string]int64),
+	}
+}
+
+func (f *fakeRedisConn) Close() error { return nil }
+
+func (f *fakeRedisConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	key := args[0].(string)
+	switch strings.ToUpper(commandName) {
+	case "GET":
+		if v, ok := f.strings[key]; ok {
+			return []byte(v), nil
+		}
+		return nil, nil
+	case "SET":
+		f.strings[key] = args[1].(string)
+		if len(args) == 4 {
+			f.ttls[key] = args[3].(int64)
+		}
+		return "OK", nil
+	case "INCRBY":
+		n, _ := strconv.ParseInt(f.strings[key], 10, 64)
+		n += args[1].(int64)
+		f.strings[key] = strconv.FormatInt(n, 10)
+		return n, nil
+	case "PEXPIRE":
+		f.ttls[key] = args[1].(int64)
+		return int64(1), nil
+	case "SADD":
+		if f.sets[key] == nil {
+			f.sets[key] = make(map[string]bool)
+		}
+		for _, m := range args[1:] {
+			f.sets[key][m.(string)] = true
+		}
+		return int64(len(args) - 1), nil
+	case "SISMEMBER":
+		if f.sets[key][args[1].(string)] {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return nil, errors.New("unknown command " + commandName)
+}
+
+func testKVStore(t *testing.T, store KVStore) {
+	if _, ok, err := store.Get("missing"); ok || err != nil {
+		t.Error("expecting a missing key, got", ok, err)
+	}
+	if err := store.Set("a", "1", 0); err != nil {
+		t.Error(err)
+	}
+	if v, ok, _ := store.Get("a"); !ok || v != "1" {
+		t.Error("expecting 1, got", v)
+	}
+	if n, err := store.Incr("a", 2); n != 3 || err != nil {
+		t.Error("expecting 3, got", n, err)
+	}
+	if n, err := store.Incr("counter", 1); n != 1 || err != nil {
+		t.Error("expecting a missing key to count from 0, got", n, err)
+	}
+	if err := store.SAdd("set", "x", "y"); err != nil {
+		t.Error(err)
+	}
+	if ok, _ := store.SIsMember("set", "y"); !ok {
+		t.Error("expecting y to be a member")
+	}
+	if ok, _ := store.SIsMember("set", "z"); ok {
+		t.Error("expecting z not to be a member")
+	}
+	if ok, _ := store.SIsMember("missing", "z"); ok {
+		t.Error("expecting no members in a missing set")
+	}
+}
+
+func TestMemoryKVStore(t *testing.T) {
+	store := NewMemoryKVStore()
+	testKVStore(t, store)
+
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+	if err := store.Set("b", "v", time.Second); err != nil {
+		t.Error(err)
+	}
+	if _, err := store.Incr("c", 1); err != nil {
+		t.Error(err)
+	}
+	_ = store.Expire("c", time.Second*2)
+	now = now.Add(time.Second)
+	if _, ok, _ := store.Get("b"); ok {
+		t.Error("expecting b to have expired")
+	}
+	if n, _ := store.Incr("c", 1); n != 2 {
+		t.Error("expecting c not to have expired yet, got", n)
+	}
+	now = now.Add(time.Second)
+	if n, _ := store.Incr("c", 1); n != 1 {
+		t.Error("expecting c to have expired and start again, got", n)
+	}
+	if _, err := store.Incr("set", 1); err != ErrKVWrongType {
+		t.Error("expecting", ErrKVWrongType, "got", err)
+	}
+}
+
+// brokenRedisConn fails every command
+type brokenRedisConn struct{}
+
+func (brokenRedisConn) Close() error { return nil }
+
+func (brokenRedisConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return nil, errors.New("i/o timeout")
+}
+
+func TestRedisKVStore(t *testing.T) {
+	var (
+		conn  RedisConn = newFakeRedisConn()
+		dials int
+	)
+	dialer := RedisDialer
+	RedisDialer = func(network, address string, options ...RedisDialOption) (RedisConn, error) {
+		dials++
+		if connect, read, write := RedisDialTimeouts(options...); connect != time.Second ||
+			read != time.Second || write != time.Second {
+			t.Error("expecting the timeouts to be passed to the dialer, got", connect, read, write)
+		}
+		return conn, nil
+	}
+	defer func() {
+		RedisDialer = dialer
+	}()
+	store := NewRedisKVStore("127.0.0.1:6379", time.Second, CircuitConfig{Threshold: 2, Cooldown: time.Minute})
+	testKVStore(t, store)
+	if err := store.Set("ttl", "v", time.Second*2); err != nil {
+		t.Error(err)
+	}
+	if ttl := conn.(*fakeRedisConn).ttls["ttl"]; ttl != 2000 {
+		t.Error("expecting a ttl of 2000ms, got", ttl)
+	}
+	if dials != 1 {
+		t.Error("expecting the connection to be reused, got", dials, "dials")
+	}
+
+	// failed connections are dropped, and the circuit opens
+	conn = brokenRedisConn{}
+	_ = store.Close()
+	for i := 0; i < 2; i++ {
+		if _, _, err := store.Get("a"); err == nil || err == ErrCircuitOpen {
+			t.Error("expecting the command to fail, got", err)
+		}
+	}
+	dials = 0
+	if _, _, err := store.Get("a"); err != ErrCircuitOpen {
+		t.Error("expecting", ErrCircuitOpen, "got", err)
+	}
+	if dials != 0 {
+		t.Error("expecting no connection while the circuit is open")
+	}
+}
+
+func TestNewKVStore(t *testing.T) {
+	a, err := NewKVStore(BackendConfig{})
+	if err != nil {
+		t.Error(err)
+	}
+	b, _ := NewKVStore(BackendConfig{"kv_redis_interface": ""})
+	if a != b {
+		t.Error("expecting the users of the same config to share the store")
+	}
+	if _, ok := a.(*MemoryKVStore); !ok {
+		t.Error("expecting an in-memory store by default")
+	}
+	if r, _ := NewKVStore(BackendConfig{"kv_redis_interface": "127.0.0.1:6379"}); r == a {
+		t.Error("expecting a different store for redis")
+	}
+	if _, err := NewKVStore(BackendConfig{"kv_redis_interface": 1}); err == nil {
+		t.Error("expecting an error for a non-string interface")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(NewMemoryKVStore(), "test", 2, time.Minute)
+	now := time.Unix(1500000000, 0).Truncate(time.Minute).Add(time.Second * 15)
+	limiter.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if ok, _, err := limiter.Allow("1.2.3.4"); !ok || err != nil {
+			t.Error("expecting event", i, "to be allowed", err)
+		}
+	}
+	ok, retry, _ := limiter.Allow("1.2.3.4")
+	if ok {
+		t.Error("expecting the third event to be over the limit")
+	}
+	if retry != time.Second*45 {
+		t.Error("expecting to retry in 45s, got", retry)
+	}
+	if ok, _, _ := limiter.Allow("5.6.7.8"); !ok {
+		t.Error("other keys have their own limit")
+	}
+	now = now.Add(retry)
+	if ok, _, _ := limiter.Allow("1.2.3.4"); !ok {
+		t.Error("expecting the next window to allow the event")
+	}
+}
@@ -0,0 +1,248 @@
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Names of the metrics recorded by the server and the backend gateway
+const (
+	// MetricConnections counts the accepted connections, labelled by server
+	MetricConnections = "guerrilla_connections_accepted_total"
+	// MetricCommands counts the SMTP commands received, labelled by verb
+	MetricCommands = "guerrilla_commands_total"
+	// MetricMessages counts the messages handed to the backend, labelled by result, "accepted" or "rejected"
+	MetricMessages = "guerrilla_messages_total"
+	// MetricReceivedBytes counts the bytes of the messages handed to the backend
+	MetricReceivedBytes = "guerrilla_received_bytes_total"
+	// MetricBackendDuration is the histogram of the time taken by the backend, labelled by task,
+	// "save_mail" or "validate_rcpt"
+	MetricBackendDuration = "guerrilla_backend_duration_seconds"
+	// MetricDomainThrottled counts the deliveries deferred by a DomainThrottle, labelled by
+	// throttle and destination domain
+	MetricDomainThrottled = "guerrilla_domain_throttled_total"
+)
+
+// metricHelp is the HELP line of the built-in metrics
+var metricHelp = map[string]string{
+	MetricConnections:     "Number of connections accepted.",
+	MetricCommands:        "Number of SMTP commands received, by verb.",
+	MetricMessages:        "Number of messages processed by the backend, by result.",
+	MetricReceivedBytes:   "Number of message bytes received.",
+	MetricBackendDuration: "Time taken by the backend to process a task, in seconds.",
+	MetricDomainThrottled: "Number of deliveries deferred by a destination domain throttle.",
+}
+
+// MetricsRegistry records metrics. NewMetrics returns one that can be scraped by Prometheus,
+// implement this interface to record them in another registry, eg. the application's own.
+// labels are given as name, value pairs
+type MetricsRegistry interface {
+	// Add adds value to the counter called name
+	Add(name string, value float64, labels ...string)
+	// Observe records value in the histogram called name
+	Observe(name string, value float64, labels ...string)
+}
+
+var (
+	metrics     MetricsRegistry
+	metricsLock sync.RWMutex
+)
+
+// SetMetrics sets the registry where the metrics are recorded, nil turns metrics off (default)
+func SetMetrics(m MetricsRegistry) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metrics = m
+}
+
+// AddMetric adds value to a counter of the registry set with SetMetrics, if any
+func AddMetric(name string, value float64, labels ...string) {
+	metricsLock.RLock()
+	m := metrics
+	metricsLock.RUnlock()
+	if m != nil {
+		m.Add(name, value, labels...)
+	}
+}
+
+// ObserveMetric records value in a histogram of the registry set with SetMetrics, if any
+func ObserveMetric(name string, value float64, labels ...string) {
+	metricsLock.RLock()
+	m := metrics
+	metricsLock.RUnlock()
+	if m != nil {
+		m.Observe(name, value, labels...)
+	}
+}
+
+// DefaultBuckets are the upper bounds of the histogram buckets, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics is a MetricsRegistry that writes its metrics in the Prometheus text format.
+// It's an http.Handler, so it can be served as is, or written after another
+// registry's metrics with WriteTo
+type Metrics struct {
+	families map[string]*metricFamily
+	mu       sync.Mutex
+}
+
+type metricFamily struct {
+	kind   string // "counter" or "histogram"
+	help   string
+	series map[string]*metricSeries
+}
+
+// metricSeries is a counter, or a histogram when buckets is not nil
+type metricSeries struct {
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+// NewMetrics returns an empty registry
+func NewMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+// Describe sets the HELP line of the metric called name
+func (m *Metrics) Describe(name, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.families[name]; ok {
+		f.help = help
+		return
+	}
+	m.families[name] = &metricFamily{help: help, series: make(map[string]*metricSeries)}
+}
+
+// Add adds value to the counter called name
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.get("counter", name, labels); s != nil {
+		s.value += value
+	}
+}
+
+// Observe records value in the histogram called name
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get("histogram", name, labels)
+	if s == nil {
+		return
+	}
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(DefaultBuckets))
+	}
+	for i, le := range DefaultBuckets {
+		if value <= le {
+			s.buckets[i]++
+		}
+	}
+	s.value += value
+	s.count++
+}
+
+// get returns the series of the labels, creating it if needed.
+// Returns nil if name is already a metric of another kind. Must be called with m.mu held
+func (m *Metrics) get(kind, name string, labels []string) *metricSeries {
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{help: metricHelp[name], series: make(map[string]*metricSeries)}
+		m.families[name] = f
+	}
+	if f.kind == "" {
+		f.kind = kind
+	} else if f.kind != kind {
+		return nil
+	}
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{}
+		f.series[key] = s
+	}
+	return s
+}
+
+// WriteTo writes the metrics in the Prometheus text format, sorted by name
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	m.mu.Lock()
+	names := make([]string, 0, len(m.families))
+	for name, f := range m.families {
+		if f.kind != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := m.families[name]
+		if f.help != "" {
+			fmt.Fprintf(&buf, "# HELP %s %s\n", name, f.help)
+		}
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, f.kind)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind == "counter" {
+				fmt.Fprintf(&buf, "%s%s %s\n", name, braces(key), formatFloat(s.value))
+				continue
+			}
+			for i, le := range DefaultBuckets {
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, braces(joinLabels(key, `le="`+formatFloat(le)+`"`)), s.buckets[i])
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, braces(joinLabels(key, `le="+Inf"`)), s.count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", name, braces(key), formatFloat(s.value))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", name, braces(key), s.count)
+		}
+	}
+	m.mu.Unlock()
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP writes the metrics for a Prometheus scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+// formatLabels formats name, value pairs as name="value",... in the order given
+func formatLabels(labels []string) string {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
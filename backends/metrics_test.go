@@ -0,0 +1,67 @@
+package backends
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := NewMetrics()
+	m.Add(MetricCommands, 1, "verb", "MAIL")
+	m.Add(MetricCommands, 2, "verb", "MAIL")
+	m.Add(MetricCommands, 1, "verb", `"quoted"`)
+	m.Observe(MetricBackendDuration, 0.02, "task", "save_mail")
+	m.Observe(MetricBackendDuration, 3, "task", "save_mail")
+	// a counter name can't be used for a histogram
+	m.Observe(MetricCommands, 1, "verb", "MAIL")
+	m.Describe("custom_total", "A custom counter.")
+	m.Add("custom_total", 1.5)
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# HELP custom_total A custom counter.",
+		"# TYPE custom_total counter",
+		"custom_total 1.5",
+		"# TYPE guerrilla_backend_duration_seconds histogram",
+		`guerrilla_backend_duration_seconds_bucket{task="save_mail",le="0.01"} 0`,
+		`guerrilla_backend_duration_seconds_bucket{task="save_mail",le="0.025"} 1`,
+		`guerrilla_backend_duration_seconds_bucket{task="save_mail",le="5"} 2`,
+		`guerrilla_backend_duration_seconds_bucket{task="save_mail",le="+Inf"} 2`,
+		`guerrilla_backend_duration_seconds_sum{task="save_mail"} 3.02`,
+		`guerrilla_backend_duration_seconds_count{task="save_mail"} 2`,
+		"# HELP guerrilla_commands_total " + metricHelp[MetricCommands],
+		`guerrilla_commands_total{verb="MAIL"} 3`,
+		`guerrilla_commands_total{verb="\"quoted\""} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expecting the line %s, got:\n%s", line, out)
+		}
+	}
+	if strings.Index(out, "custom_total") > strings.Index(out, "guerrilla_commands_total") {
+		t.Error("expecting the metrics to be sorted by name")
+	}
+}
+
+func TestAddMetric(t *testing.T) {
+	// nothing is recorded while off
+	AddMetric(MetricConnections, 1)
+	m := NewMetrics()
+	SetMetrics(m)
+	defer SetMetrics(nil)
+	AddMetric(MetricConnections, 1, "server", "127.0.0.1:2525")
+	ObserveMetric(MetricBackendDuration, 0.1, "task", "validate_rcpt")
+
+	var buf bytes.Buffer
+	_, _ = m.WriteTo(&buf)
+	if !strings.Contains(buf.String(), `guerrilla_connections_accepted_total{server="127.0.0.1:2525"} 1`) {
+		t.Error("expecting the connection to be counted, got", buf.String())
+	}
+	if !strings.Contains(buf.String(), `guerrilla_backend_duration_seconds_count{task="validate_rcpt"} 1`) {
+		t.Error("expecting the duration to be observed, got", buf.String())
+	}
+}
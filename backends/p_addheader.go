@@ -0,0 +1,228 @@
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: addheader
+// ----------------------------------------------------------------------------------
+// Description   : Adds headers to the message, after its existing headers and before
+//               : the blank line that separates them from the body. The values are
+//               : templates (text/template) executed with e.Values, eg.
+//               : "X-Spam-Score: {{.spam_score}}". A value that isn't set expands to
+//               : nothing, and headers that expand to an empty value are not added.
+//               : Can also add an Authentication-Results header (RFC 8601) with the
+//               : SPF, DKIM and DMARC results of earlier processors. Existing
+//               : Authentication-Results headers with the same authserv-id are removed
+//               : so that the sender can't forge them
+// ----------------------------------------------------------------------------------
+// Config Options: addheader_headers string - the headers to add, one per line, eg.
+//               : "X-Spam-Score: {{.spam_score}}\nX-Virus: {{.virus}}"
+//               : addheader_auth_results bool - add Authentication-Results, default false
+//               : addheader_authserv_id string - the authserv-id of Authentication-Results,
+//               : default is the host name
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.Values
+//               : e.Values["spf_result"], e.Values["dkim_result"], e.Values["dkim_domain"],
+//               : e.Values["dmarc_result"] and e.Values["dmarc_domain"] for
+//               : Authentication-Results
+// ----------------------------------------------------------------------------------
+// Output        : e.Data has the headers added. e.Header is parsed again if it was parsed
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["addheader"] = func() Decorator {
+		return AddHeader()
+	}
+}
+
+type addHeaderConfig struct {
+	Headers     string `json:"addheader_headers,omitempty"`
+	AuthResults bool   `json:"addheader_auth_results,omitempty"`
+	AuthServID  string `json:"addheader_authserv_id,omitempty"`
+}
+
+// headerTemplate is a header to add, its value is a template
+type headerTemplate struct {
+	name  string
+	value *template.Template
+}
+
+func AddHeader() Decorator {
+	var config *addHeaderConfig
+	var headers []headerTemplate
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&addHeaderConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*addHeaderConfig)
+		if headers, err = parseHeaderTemplates(config.Headers); err != nil {
+			return err
+		}
+		if config.AuthResults && config.AuthServID == "" {
+			if config.AuthServID, err = os.Hostname(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				var add bytes.Buffer
+				for _, h := range headers {
+					value, err := expandHeaderTemplate(h.value, e.Values)
+					if err != nil {
+						EnvelopeLog(e).WithError(err).Errorf("could not expand the %s header", h.name)
+						return NewResult(response.Canned.FailBackendTransaction), err
+					}
+					if value != "" {
+						add.WriteString(h.name + ": " + value + "\n")
+					}
+				}
+				if config.AuthResults {
+					add.WriteString("Authentication-Results: " + authResults(config.AuthServID, e) + "\n")
+				}
+				err := ApplyTransforms(e, TransformerFunc(func(e *mail.Envelope, header, body []byte) ([]byte, []byte, error) {
+					if config.AuthResults {
+						header = removeAuthResults(header, config.AuthServID)
+					}
+					return append(header, add.Bytes()...), body, nil
+				}))
+				if err != nil {
+					EnvelopeLog(e).WithError(err).Error("could not add headers")
+					return NewResult(response.Canned.FailBackendTransaction), err
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// parseHeaderTemplates parses "Name: template" lines
+func parseHeaderTemplates(headers string) ([]headerTemplate, error) {
+	var parsed []headerTemplate
+	for _, line := range strings.Split(headers, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 || strings.IndexFunc(line[:i], func(r rune) bool { return r <= ' ' || r > '~' }) > -1 {
+			return nil, fmt.Errorf("invalid header %q, expecting Name: value", line)
+		}
+		name := line[:i]
+		value, err := template.New(name).Option("missingkey=zero").Parse(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for the %s header: %s", name, err)
+		}
+		parsed = append(parsed, headerTemplate{name: name, value: value})
+	}
+	return parsed, nil
+}
+
+// expandHeaderTemplate executes the template, values that aren't set expand to nothing.
+// Line breaks are replaced by spaces so that a value can't add headers
+func expandHeaderTemplate(t *template.Template, values map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, values); err != nil {
+		return "", err
+	}
+	value := strings.Replace(buf.String(), "<no value>", "", -1)
+	value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+	return strings.TrimSpace(value), nil
+}
+
+// authResults returns the value of Authentication-Results for the results in e.Values
+func authResults(authServID string, e *mail.Envelope) string {
+	var results []string
+	value := func(key string) string {
+		v, _ := e.Values[key].(string)
+		return v
+	}
+	if spf := value("spf_result"); spf != "" {
+		r := "spf=" + spf
+		if !e.MailFrom.NullPath && !e.MailFrom.IsEmpty() {
+			r += " smtp.mailfrom=" + e.MailFrom.String()
+		} else if e.Helo != "" {
+			r += " smtp.helo=" + e.Helo
+		}
+		results = append(results, r)
+	}
+	if dkim := value("dkim_result"); dkim != "" {
+		r := "dkim=" + dkim
+		if d := value("dkim_domain"); d != "" {
+			r += " header.d=" + d
+		}
+		results = append(results, r)
+	}
+	if dmarc := value("dmarc_result"); dmarc != "" {
+		r := "dmarc=" + dmarc
+		if d := value("dmarc_domain"); d != "" {
+			r += " header.from=" + d
+		}
+		results = append(results, r)
+	}
+	if len(results) == 0 {
+		return authServID + "; none"
+	}
+	return authServID + "; " + strings.Join(results, "; ")
+}
+
+// removeAuthResults removes the Authentication-Results fields of the header block that
+// have the authserv-id, including their folded lines
+func removeAuthResults(header []byte, authServID string) []byte {
+	var out []byte
+	removing := false
+	for len(header) > 0 {
+		i := bytes.IndexByte(header, '\n')
+		if i < 0 {
+			i = len(header) - 1
+		}
+		line := header[:i+1]
+		header = header[i+1:]
+		if line[0] == ' ' || line[0] == '\t' {
+			// a folded line belongs to the field before it
+			if !removing {
+				out = append(out, line...)
+			}
+			continue
+		}
+		removing = false
+		if colon := bytes.IndexByte(line, ':'); colon > 0 &&
+			strings.EqualFold(string(bytes.TrimSpace(line[:colon])), "Authentication-Results") {
+			// the authserv-id is up to the first ;, which may be on a folded line
+			field := line[colon+1:]
+			for j := 0; j < len(header) && (header[j] == ' ' || header[j] == '\t'); {
+				k := bytes.IndexByte(header[j:], '\n')
+				if k < 0 {
+					k = len(header) - j - 1
+				}
+				field = append(append([]byte(nil), field...), header[j:j+k+1]...)
+				j += k + 1
+			}
+			id := string(field)
+			if semi := strings.Index(id, ";"); semi > -1 {
+				id = id[:semi]
+			}
+			// the authserv-id can be followed by a version
+			if fields := strings.Fields(id); len(fields) > 0 && strings.EqualFold(fields[0], authServID) {
+				removing = true
+				continue
+			}
+		}
+		out = append(out, line...)
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestAddHeader(t *testing.T) {
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, AddHeader())
+	if err := Svc.initialize(BackendConfig{
+		"addheader_headers":      "X-Spam-Score: {{.spam_score}}\nX-Virus: {{.virus}}\nX-Checked: spf={{.spf_result}} virus={{.virus}}",
+		"addheader_auth_results": true,
+		"addheader_authserv_id":  "mx.example.com",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "sender", Host: "example.org"}
+	e.Values["spam_score"] = 3.5
+	e.Values["spf_result"] = "pass"
+	e.Values["dmarc_result"] = "pass"
+	e.Values["dmarc_domain"] = "example.org"
+	e.Data.WriteString("Authentication-Results: mx.example.com;\n\tspf=pass smtp.mailfrom=forged@example.org\n" +
+		"Authentication-Results: other.example.net; dkim=pass\n" +
+		"Subject: test\n" +
+		"\n" +
+		"X-Not-A-Header: this is the body\n")
+	if err := e.ParseHeaders(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	expect := "Authentication-Results: other.example.net; dkim=pass\n" +
+		"Subject: test\n" +
+		"X-Spam-Score: 3.5\n" +
+		"X-Checked: spf=pass virus=\n" +
+		"Authentication-Results: mx.example.com; spf=pass smtp.mailfrom=sender@example.org; dmarc=pass header.from=example.org\n" +
+		"\n" +
+		"X-Not-A-Header: this is the body\n"
+	if e.Data.String() != expect {
+		t.Errorf("expecting\n%s\ngot\n%s", expect, e.Data.String())
+	}
+	if e.Header.Get("X-Spam-Score") != "3.5" {
+		t.Error("expecting the headers to be parsed again")
+	}
+	if e.Header.Get("X-Not-A-Header") != "" {
+		t.Error("the body should not become part of the headers")
+	}
+
+	// with the value present
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	e.Values["virus"] = "Eicar\nBcc: injected@example.com"
+	e.Data.WriteString("Subject: test\n\nhello\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	header, _ := splitMessage(e.Data.Bytes())
+	if !strings.Contains(string(header), "X-Virus: Eicar Bcc: injected@example.com\n") {
+		t.Error("expecting the value on one line, got", string(header))
+	}
+	if !strings.HasSuffix(string(header), "Authentication-Results: mx.example.com; none\n") {
+		t.Error("expecting Authentication-Results with no results, got", string(header))
+	}
+}
+
+func TestAddHeaderInvalid(t *testing.T) {
+	for _, headers := range []string{"X-Bad Name: value", "no colon", "X-Template: {{.unclosed"} {
+		Svc.reset()
+		Decorate(DefaultProcessor{}, AddHeader())
+		if err := Svc.initialize(BackendConfig{"addheader_headers": headers}); err == nil {
+			t.Errorf("expecting an error for %q", headers)
+		}
+	}
+}
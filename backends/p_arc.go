@@ -0,0 +1,293 @@
+package backends
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: arc
+// ----------------------------------------------------------------------------------
+// Description   : Seals the message with ARC (RFC 8617), so that the authentication
+//               : results seen here survive forwarding. Any existing ARC chain is
+//               : validated, then the next ARC set is added: ARC-Seal,
+//               : ARC-Message-Signature and ARC-Authentication-Results.
+//               : Uses rsa-sha256 and relaxed/relaxed canonicalization, like dkim.
+// ----------------------------------------------------------------------------------
+// Config Options: arc_selector string - the selector, the public key is published at
+//               : <selector>._domainkey.<domain>
+//               : arc_domain string - the sealing domain (d=)
+//               : arc_private_key string - path to the PEM encoded RSA private key,
+//               : PKCS #1 or PKCS #8
+//               : arc_auth_results string - the authentication results to embed in
+//               : ARC-Authentication-Results, eg. "mx.example.com; spf=pass
+//               : smtp.mailfrom=example.org". Default "<arc_domain>; arc=<result>"
+//               : with the result of validating the existing chain
+//               : arc_headers string - names of the headers to sign, separated by :
+//               : default is the dkim_headers default and DKIM-Signature
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Data gets the ARC set added to the top.
+//               : Place this processor after any processor that changes e.Data.
+//               : No set is added if the chain already failed at a previous hop,
+//               : or has reached the limit of 50 sets
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["arc"] = func() Decorator {
+		return ARC()
+	}
+}
+
+type arcConfig struct {
+	Selector    string `json:"arc_selector"`
+	Domain      string `json:"arc_domain"`
+	PrivateKey  string `json:"arc_private_key"`
+	AuthResults string `json:"arc_auth_results,omitempty"`
+	Headers     string `json:"arc_headers,omitempty"`
+}
+
+// arcMaxInstance is the limit of ARC sets in a message, RFC 8617 4.2.1
+const arcMaxInstance = 50
+
+// results of the chain validation, for the cv= tag
+const (
+	arcNone = "none"
+	arcPass = "pass"
+	arcFail = "fail"
+)
+
+func ARC() Decorator {
+	var sealer *arcSealer
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&arcConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*arcConfig)
+		if config.Selector == "" || config.Domain == "" {
+			return errors.New("arc_selector and arc_domain are required")
+		}
+		pemData, err := ioutil.ReadFile(config.PrivateKey)
+		if err != nil {
+			return errors.New("could not read arc_private_key: " + err.Error())
+		}
+		key, err := parseDKIMKey(pemData)
+		if err != nil {
+			return err
+		}
+		if config.Headers == "" {
+			config.Headers = defaultDKIMHeaders + ":DKIM-Signature"
+		}
+		sealer = &arcSealer{
+			dkimSigner: dkimSigner{
+				selector: config.Selector,
+				domain:   config.Domain,
+				key:      key,
+			},
+			authResults: config.AuthResults,
+		}
+		for _, name := range strings.Split(config.Headers, ":") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				sealer.headers = append(sealer.headers, name)
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if err := ApplyTransforms(e, sealer); err != nil {
+					EnvelopeLog(e).WithError(err).Error("arc sealing failed")
+					return NewResult(response.Canned.FailBackendTransaction), err
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// arcSealer is a BodyTransformer that adds the next ARC set
+type arcSealer struct {
+	dkimSigner
+	authResults string
+}
+
+// arcSet holds the raw header fields of one ARC instance
+type arcSet struct {
+	aar  string
+	ams  string
+	seal string
+}
+
+// Transform implements BodyTransformer
+func (a *arcSealer) Transform(e *mail.Envelope, header, body []byte) ([]byte, []byte, error) {
+	fields := dkimSplitHeader(header)
+	sets, cv := arcValidate(fields, body)
+	n := len(sets)
+	if n >= arcMaxInstance || (n > 0 && dkimTags(sets[n-1].seal)["cv"] == arcFail) {
+		Log().WithField("instances", n).Info("arc chain not sealed")
+		return header, body, nil
+	}
+	i := strconv.Itoa(n + 1)
+	t := strconv.FormatInt(mail.DefaultClock.Now().Unix(), 10)
+
+	authResults := a.authResults
+	if authResults == "" {
+		authResults = a.domain + "; arc=" + cv
+	}
+	next := arcSet{aar: "ARC-Authentication-Results: i=" + i + "; " + authResults}
+
+	bodyHash := sha256.Sum256(dkimRelaxedBody(body))
+	names := dkimPresent(fields, a.headers)
+	next.ams = "ARC-Message-Signature: i=" + i + "; a=rsa-sha256; c=relaxed/relaxed; d=" + a.domain +
+		"; s=" + a.selector + ";\r\n\tt=" + t + "; h=" + strings.Join(names, ":") +
+		";\r\n\tbh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + ";\r\n\tb="
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, dkimHeaderHash(fields, names, next.ams))
+	if err != nil {
+		return nil, nil, err
+	}
+	next.ams += base64.StdEncoding.EncodeToString(signature)
+
+	next.seal = "ARC-Seal: i=" + i + "; a=rsa-sha256; t=" + t + "; cv=" + cv +
+		";\r\n\td=" + a.domain + "; s=" + a.selector + ";\r\n\tb="
+	sets = append(sets, next)
+	signature, err = rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, arcSealHash(sets))
+	if err != nil {
+		return nil, nil, err
+	}
+	next.seal += base64.StdEncoding.EncodeToString(signature)
+
+	var b bytes.Buffer
+	for _, field := range []string{next.seal, next.ams, next.aar} {
+		// the message uses \n line endings
+		b.WriteString(strings.Replace(field, "\r\n", "\n", -1))
+		b.WriteByte('\n')
+	}
+	b.Write(header)
+	return b.Bytes(), body, nil
+}
+
+// arcValidate collects the ARC sets of the message, ordered by instance, and validates the
+// chain following RFC 8617 5.2. The result is one of arcNone, arcPass or arcFail
+func arcValidate(fields []dkimHeaderField, body []byte) ([]arcSet, string) {
+	var sets []arcSet
+	byInstance := make(map[int]*arcSet)
+	malformed := false
+	for _, f := range fields {
+		if f.name != "arc-authentication-results" && f.name != "arc-message-signature" && f.name != "arc-seal" {
+			continue
+		}
+		i, err := strconv.Atoi(dkimTags(f.raw)["i"])
+		if err != nil || i < 1 || i > arcMaxInstance {
+			malformed = true
+			continue
+		}
+		set, ok := byInstance[i]
+		if !ok {
+			set = &arcSet{}
+			byInstance[i] = set
+		}
+		var raw *string
+		switch f.name {
+		case "arc-authentication-results":
+			raw = &set.aar
+		case "arc-message-signature":
+			raw = &set.ams
+		default:
+			raw = &set.seal
+		}
+		if *raw != "" {
+			// more than one header of the same kind for an instance
+			malformed = true
+		}
+		*raw = f.raw
+	}
+	if len(byInstance) == 0 {
+		if malformed {
+			return nil, arcFail
+		}
+		return nil, arcNone
+	}
+	for i := 1; i <= len(byInstance); i++ {
+		set, ok := byInstance[i]
+		if !ok {
+			// the instances are not contiguous
+			malformed = true
+			break
+		}
+		sets = append(sets, *set)
+		if set.aar == "" || set.ams == "" || set.seal == "" {
+			malformed = true
+		}
+	}
+	if malformed {
+		return sets, arcFail
+	}
+	n := len(sets)
+	if dkimTags(sets[n-1].seal)["cv"] == arcFail {
+		return sets, arcFail
+	}
+	for i, set := range sets {
+		cv := dkimTags(set.seal)["cv"]
+		if (i == 0 && cv != arcNone) || (i > 0 && cv != arcPass) {
+			return sets, arcFail
+		}
+	}
+	// only the latest message signature needs to remain valid
+	if err := dkimVerify(fields, sets[n-1].ams, body); err != nil {
+		Log().WithError(err).Debug("arc message signature invalid")
+		return sets, arcFail
+	}
+	for i := n; i > 0; i-- {
+		tags := dkimTags(sets[i-1].seal)
+		if tags["a"] != "rsa-sha256" {
+			return sets, arcFail
+		}
+		signature, err := base64.StdEncoding.DecodeString(tags["b"])
+		if err != nil {
+			return sets, arcFail
+		}
+		key, err := dkimLookupKey(tags["s"], tags["d"])
+		if err != nil {
+			Log().WithError(err).Debug("arc seal key lookup failed")
+			return sets, arcFail
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, arcSealHash(sets[:i]), signature); err != nil {
+			Log().WithError(err).Debug("arc seal invalid")
+			return sets, arcFail
+		}
+	}
+	return sets, arcPass
+}
+
+// arcSealHash returns the hash signed by the seal of the last set: all the sets in instance
+// order, with the b= tag of the last seal empty and no final line ending, RFC 8617 5.1.1
+func arcSealHash(sets []arcSet) []byte {
+	h := sha256.New()
+	for i, set := range sets {
+		_, _ = h.Write([]byte(dkimRelaxedHeader(set.aar) + "\r\n"))
+		_, _ = h.Write([]byte(dkimRelaxedHeader(set.ams) + "\r\n"))
+		if i < len(sets)-1 {
+			_, _ = h.Write([]byte(dkimRelaxedHeader(set.seal) + "\r\n"))
+		} else {
+			_, _ = h.Write([]byte(dkimRelaxedHeader(dkimStripB(set.seal))))
+		}
+	}
+	return h.Sum(nil)
+}
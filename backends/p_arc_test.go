@@ -0,0 +1,184 @@
+package backends
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// arcTestHop seals the message as a hop of the chain would, returning the new message
+func arcTestHop(t *testing.T, sealer *arcSealer, msg string) string {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	_, _ = e.Data.WriteString(msg)
+	if err := ApplyTransforms(e, sealer); err != nil {
+		t.Fatal(err)
+	}
+	return e.Data.String()
+}
+
+func arcTestStatus(msg string) (int, string) {
+	i := strings.Index(msg, "\n\n")
+	sets, cv := arcValidate(dkimSplitHeader([]byte(msg[:i+1])), []byte(msg[i+2:]))
+	return len(sets), cv
+}
+
+func TestARCChain(t *testing.T) {
+	defer func(c mail.Clock, lookup func(selector, domain string) (*rsa.PublicKey, error)) {
+		mail.DefaultClock = c
+		dkimLookupKey = lookup
+	}(mail.DefaultClock, dkimLookupKey)
+	mail.DefaultClock = mail.FixedClock(time.Unix(1528637909, 0))
+
+	keys := make(map[string]*rsa.PublicKey)
+	dkimLookupKey = func(selector, domain string) (*rsa.PublicKey, error) {
+		if key, ok := keys[selector+"._domainkey."+domain]; ok {
+			return key, nil
+		}
+		return nil, errors.New("no key for " + selector + "._domainkey." + domain)
+	}
+	newSealer := func(selector, domain, authResults string) *arcSealer {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[selector+"._domainkey."+domain] = &key.PublicKey
+		return &arcSealer{
+			dkimSigner: dkimSigner{
+				selector: selector,
+				domain:   domain,
+				key:      key,
+				headers:  []string{"from", "to", "subject", "date", "message-id", "dkim-signature"},
+			},
+			authResults: authResults,
+		}
+	}
+	first := newSealer("s1", "lists.example.org", "lists.example.org; spf=pass smtp.mailfrom=football.example.com")
+	second := newSealer("s2", "forward.example.net", "")
+
+	if n, cv := arcTestStatus(dkimTestMessage); n != 0 || cv != arcNone {
+		t.Error("expecting no chain, got", n, cv)
+	}
+	hop1 := arcTestHop(t, first, dkimTestMessage)
+	if !strings.HasPrefix(hop1, "ARC-Seal: i=1; a=rsa-sha256; t=1528637909; cv=none;\n") {
+		t.Error("expecting the first seal at the top with cv=none, got", hop1)
+	}
+	if !strings.Contains(hop1, "\nARC-Authentication-Results: i=1; lists.example.org; spf=pass") {
+		t.Error("expecting the configured authentication results, got", hop1)
+	}
+	if n, cv := arcTestStatus(hop1); n != 1 || cv != arcPass {
+		t.Error("expecting the chain to validate after one hop, got", n, cv)
+	}
+
+	hop2 := arcTestHop(t, second, hop1)
+	if !strings.HasPrefix(hop2, "ARC-Seal: i=2; a=rsa-sha256; t=1528637909; cv=pass;\n") {
+		t.Error("expecting the second seal at the top with cv=pass, got", hop2)
+	}
+	if !strings.Contains(hop2, "\nARC-Authentication-Results: i=2; forward.example.net; arc=pass\n") {
+		t.Error("expecting the default authentication results, got", hop2)
+	}
+	if !strings.HasSuffix(hop2, hop1) {
+		t.Error("expecting the previous hop to be unchanged")
+	}
+	if n, cv := arcTestStatus(hop2); n != 2 || cv != arcPass {
+		t.Error("expecting the chain to validate after two hops, got", n, cv)
+	}
+
+	// a hop that changed the body without sealing breaks the chain
+	tampered := strings.Replace(hop2, "We lost the game.", "We won the game.", 1)
+	if _, cv := arcTestStatus(tampered); cv != arcFail {
+		t.Error("expecting a changed body to fail the chain, got", cv)
+	}
+	hop3 := arcTestHop(t, first, tampered)
+	if !strings.HasPrefix(hop3, "ARC-Seal: i=3; a=rsa-sha256; t=1528637909; cv=fail;\n") {
+		t.Error("expecting the third seal to record the failure, got", hop3)
+	}
+	// once failed, the chain is not sealed again
+	if hop4 := arcTestHop(t, second, hop3); hop4 != hop3 {
+		t.Error("expecting no more sets after a failed chain")
+	}
+
+	// a seal from an unknown key fails
+	delete(keys, "s1._domainkey.lists.example.org")
+	if _, cv := arcTestStatus(hop2); cv != arcFail {
+		t.Error("expecting a seal that cannot be verified to fail the chain, got", cv)
+	}
+}
+
+func TestARCMalformedChain(t *testing.T) {
+	for _, header := range []string{
+		// missing instance 1
+		"ARC-Authentication-Results: i=2; example.org; none\n" +
+			"ARC-Message-Signature: i=2; a=rsa-sha256; b=\n" +
+			"ARC-Seal: i=2; a=rsa-sha256; cv=pass; b=\n",
+		// incomplete set
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none; b=\n",
+		// duplicate field
+		"ARC-Authentication-Results: i=1; example.org; none\n" +
+			"ARC-Authentication-Results: i=1; example.org; none\n" +
+			"ARC-Message-Signature: i=1; a=rsa-sha256; b=\n" +
+			"ARC-Seal: i=1; a=rsa-sha256; cv=none; b=\n",
+	} {
+		if _, cv := arcTestStatus(header + dkimTestMessage); cv != arcFail {
+			t.Errorf("expecting %q to fail, got %s", header, cv)
+		}
+	}
+}
+
+func TestARCProcessor(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := ioutil.TempFile("", "arc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(keyFile.Name())
+	}()
+	_ = pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	_ = keyFile.Close()
+
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, ARC())
+	if err := Svc.initialize(BackendConfig{
+		"arc_selector":     "s1",
+		"arc_domain":       "lists.example.org",
+		"arc_private_key":  keyFile.Name(),
+		"arc_auth_results": "lists.example.org; dkim=none",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	_, _ = e.Data.WriteString(dkimTestMessage)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	msg := e.Data.String()
+	for _, prefix := range []string{"ARC-Seal: i=1;", "ARC-Message-Signature: i=1;", "ARC-Authentication-Results: i=1; lists.example.org; dkim=none"} {
+		if !strings.Contains(msg, prefix) {
+			t.Error("expecting", prefix, "in", msg)
+		}
+	}
+	if !strings.Contains(msg, "h=from:subject:date:to:message-id;") {
+		t.Error("expecting the default headers to be signed, got", msg)
+	}
+
+	Svc.reset()
+	_ = ARC()
+	if err := Svc.initialize(BackendConfig{
+		"arc_selector":    "s1",
+		"arc_private_key": keyFile.Name(),
+	}); err == nil {
+		t.Error("expecting an error for a missing arc_domain")
+	}
+}
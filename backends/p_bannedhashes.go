@@ -0,0 +1,178 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: bannedhashes
+// ----------------------------------------------------------------------------------
+// Description   : Rejects messages with an attachment whose MD5 or SHA-256 hash is on
+//               : a blocklist. Attachments are decoded before hashing, so the hashes
+//               : are of the files, the same as published by malware feeds.
+//               : The blocklist file is reloaded when it's modified. Messages with parts
+//               : that can't be walked or decoded, eg. nested deeper than
+//               : mail.MaxPartDepth, are rejected with a 554 as they can't be checked
+// ----------------------------------------------------------------------------------
+// Config Options: banned_hashes_file string - path to the blocklist, one hex encoded
+//               : hash per line. Text after the hash, and lines starting with # are ignored
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["banned_hash"] is set to the matched hash when rejected
+//               : e.Values["parse_failed"] is set to the error when the parts can't be checked
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["bannedhashes"] = func() Decorator {
+		return BannedHashes()
+	}
+}
+
+type bannedHashesConfig struct {
+	File string `json:"banned_hashes_file"`
+}
+
+// how often to check if the blocklist file was modified
+const hashBlocklistCheckInterval = time.Second * 5
+
+func BannedHashes() Decorator {
+	var blocklist *hashBlocklist
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&bannedHashesConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*bannedHashesConfig)
+		blocklist = &hashBlocklist{path: config.File}
+		return blocklist.load()
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				blocklist.reloadIfModified()
+				var banned string
+				err := mail.WalkParts(bytes.NewReader(e.Data.Bytes()), func(part *mail.Part) error {
+					if !part.Attachment && strings.HasPrefix(part.ContentType, "text/") {
+						return nil
+					}
+					md5Hash, sha256Hash := md5.New(), sha256.New()
+					if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), part.Body); err != nil {
+						return err
+					}
+					banned = blocklist.match(hex.EncodeToString(md5Hash.Sum(nil)), hex.EncodeToString(sha256Hash.Sum(nil)))
+					if banned != "" {
+						return errBannedAttachment
+					}
+					return nil
+				})
+				if err != nil && err != errBannedAttachment {
+					// a part that wasn't hashed could be banned
+					EnvelopeLog(e).WithError(err).Info("rejected as the attachments could not be checked")
+					e.Values["parse_failed"] = err.Error()
+					return NewResult(response.Canned.FailAttachmentsUnchecked), err
+				}
+				if banned != "" {
+					e.Values["banned_hash"] = banned
+					return NewResult(response.Canned.FailBannedAttachment, " ", banned), errors.New("banned attachment " + banned)
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+var errBannedAttachment = errors.New("banned attachment")
+
+// hashBlocklist is a set of hex encoded hashes loaded from a file
+type hashBlocklist struct {
+	path    string
+	hashes  map[string]struct{}
+	modTime time.Time
+	checked time.Time
+	sync.RWMutex
+}
+
+func (b *hashBlocklist) load() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			hashes[strings.ToLower(fields[0])] = struct{}{}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	b.Lock()
+	b.hashes = hashes
+	b.modTime = info.ModTime()
+	b.checked = time.Now()
+	b.Unlock()
+	return nil
+}
+
+// reloadIfModified reloads the file if its modification time changed since it was loaded.
+// The file is checked at most once every hashBlocklistCheckInterval
+func (b *hashBlocklist) reloadIfModified() {
+	b.Lock()
+	if time.Since(b.checked) < hashBlocklistCheckInterval {
+		b.Unlock()
+		return
+	}
+	b.checked = time.Now()
+	modTime := b.modTime
+	b.Unlock()
+	info, err := os.Stat(b.path)
+	if err != nil || info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := b.load(); err != nil {
+		Log().WithError(err).Error("could not reload banned hashes, keeping the previous list")
+		return
+	}
+	Log().Infof("reloaded banned hashes from %s", b.path)
+}
+
+// match returns the first of the hashes that is on the blocklist
+func (b *hashBlocklist) match(hashes ...string) string {
+	b.RLock()
+	defer b.RUnlock()
+	for _, h := range hashes {
+		if _, ok := b.hashes[h]; ok {
+			return h
+		}
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package backends
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func attachmentMessage(content []byte) string {
+	return "Subject: test\n" +
+		"MIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+		"--b1\n" +
+		"Content-Type: text/plain\n\n" +
+		"see attached\n" +
+		"--b1\n" +
+		"Content-Type: application/octet-stream; name=\"invoice.exe\"\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"Content-Disposition: attachment; filename=\"invoice.exe\"\n\n" +
+		base64.StdEncoding.EncodeToString(content) + "\n" +
+		"--b1--\n"
+}
+
+func TestBannedHashes(t *testing.T) {
+	malware := []byte("definitely a malicious payload")
+	sum := sha256.Sum256(malware)
+	banned := hex.EncodeToString(sum[:])
+	f, err := ioutil.TempFile("", "banned_hashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	_, _ = f.WriteString("# known bad\n" + strings.ToUpper(banned) + " trojan\n")
+	_ = f.Close()
+
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, BannedHashes())
+	if err := Svc.initialize(BackendConfig{"banned_hashes_file": f.Name()}); err != nil {
+		t.Fatal(err)
+	}
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(attachmentMessage(malware))
+	result, err := p.Process(e, TaskSaveMail)
+	if err == nil {
+		t.Error("expecting the banned attachment to be rejected")
+	}
+	if result.Code() != 550 || !strings.Contains(result.String(), banned) {
+		t.Error("expecting a 550 naming the hash, got", result)
+	}
+	if e.Values["banned_hash"] != banned {
+		t.Error("expecting banned_hash to be set, got", e.Values["banned_hash"])
+	}
+
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(attachmentMessage([]byte("a harmless spreadsheet")))
+	if _, err = p.Process(e, TaskSaveMail); err != nil {
+		t.Error("benign attachment should be accepted", err)
+	}
+
+	// attachments that can't be hashed are not let through
+	nested := attachmentMessage(malware)
+	for i := 0; i < mail.MaxPartDepth; i++ {
+		part := strings.SplitN(nested, "\n", 2)[1]
+		nested = fmt.Sprintf("Subject: test\nContent-Type: multipart/mixed; boundary=n%d\n\n--n%d\n%s--n%d--\n", i, i, part, i)
+	}
+	corrupt := strings.Replace(attachmentMessage(malware), "Content-Disposition: attachment; filename=\"invoice.exe\"\n\n",
+		"Content-Disposition: attachment; filename=\"invoice.exe\"\n\n!!!!", 1)
+	for name, data := range map[string]string{"nested": nested, "corrupt": corrupt} {
+		e = mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString(data)
+		result, err = p.Process(e, TaskSaveMail)
+		if err == nil || result.Code() != 554 || e.Values["parse_failed"] == nil {
+			t.Errorf("%s: expecting a 554 as the attachment can't be checked, got %v", name, result)
+		}
+	}
+}
+
+func TestHashBlocklistReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "banned_hashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	_ = f.Close()
+	b := &hashBlocklist{path: f.Name()}
+	if err := b.load(); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum([]byte("new threat"))
+	h := hex.EncodeToString(sum[:])
+	if b.match(h) != "" {
+		t.Error("empty list should not match")
+	}
+	if err := ioutil.WriteFile(f.Name(), []byte(h+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(f.Name(), later, later)
+	b.checked = time.Time{}
+	b.reloadIfModified()
+	if b.match(h) != h {
+		t.Error("expecting the modified list to be reloaded")
+	}
+}
@@ -0,0 +1,217 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: block_attachments
+// ----------------------------------------------------------------------------------
+// Description   : Rejects or quarantines messages with attachments of disallowed
+//               : types. Attachments are matched by the extension of their filename,
+//               : and by the type sniffed from their first bytes, so that renamed
+//               : executables are caught. Only the first bytes of each attachment are
+//               : decoded for sniffing, large attachments are not read into memory.
+//               : Messages whose parts can't all be walked, eg. nested deeper than
+//               : mail.MaxPartDepth, are rejected with a 554 or quarantined the same way
+// ----------------------------------------------------------------------------------
+// Config Options: block_attachments_extensions string - comma separated extensions
+//               : to block, eg. "exe, js". Default is a list of Windows executable
+//               : and script types
+//               : block_attachments_allow string - comma separated extensions to allow,
+//               : if set, attachments with any other extension are blocked too
+//               : block_attachments_types string - comma separated sniffed types to block,
+//               : default "application/x-msdownload, application/x-executable,
+//               : application/x-mach-binary"
+//               : block_attachments_mode string - "reject" (default) with a 550, or
+//               : "quarantine" to accept the message with e.Values["quarantine"] set
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["blocked_attachment"] is set to the filename, or the sniffed type
+//               : of an attachment without a filename
+//               : e.Values["parse_failed"] is set to the error when the parts can't be walked
+//               : e.Values["quarantine"] is set to "block_attachments" when quarantined
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["block_attachments"] = func() Decorator {
+		return BlockAttachments()
+	}
+}
+
+type blockAttachmentsConfig struct {
+	Extensions string `json:"block_attachments_extensions,omitempty"`
+	Allow      string `json:"block_attachments_allow,omitempty"`
+	Types      string `json:"block_attachments_types,omitempty"`
+	Mode       string `json:"block_attachments_mode,omitempty"`
+}
+
+const (
+	blockAttachmentsModeReject     = "reject"
+	blockAttachmentsModeQuarantine = "quarantine"
+
+	defaultBlockedExtensions = "ade, adp, bat, chm, cmd, com, cpl, exe, hta, ins, isp, jar, js, jse, lib, lnk, " +
+		"mde, msc, msi, msp, mst, pif, ps1, scr, sct, shb, sys, vb, vbe, vbs, vxd, wsc, wsf, wsh"
+	defaultBlockedTypes = "application/x-msdownload, application/x-executable, application/x-mach-binary"
+
+	// sniffLen is how many bytes of an attachment are decoded to sniff its type
+	sniffLen = 512
+)
+
+var errBlockedAttachment = errors.New("blocked attachment")
+
+// attachmentPolicy decides which attachments are blocked
+type attachmentPolicy struct {
+	extensions map[string]bool
+	allow      map[string]bool
+	types      map[string]bool
+}
+
+func BlockAttachments() Decorator {
+	var policy *attachmentPolicy
+	var quarantine bool
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&blockAttachmentsConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*blockAttachmentsConfig)
+		if config.Extensions == "" {
+			config.Extensions = defaultBlockedExtensions
+		}
+		if config.Types == "" {
+			config.Types = defaultBlockedTypes
+		}
+		policy = &attachmentPolicy{
+			extensions: attachmentList(config.Extensions),
+			allow:      attachmentList(config.Allow),
+			types:      attachmentList(config.Types),
+		}
+		switch config.Mode {
+		case "", blockAttachmentsModeReject:
+			quarantine = false
+		case blockAttachmentsModeQuarantine:
+			quarantine = true
+		default:
+			return convertError("property invalid: 'block_attachments_mode' must be \"reject\" or \"quarantine\"")
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				var blocked string
+				err := mail.WalkParts(bytes.NewReader(e.Data.Bytes()), func(part *mail.Part) error {
+					if !part.Attachment && strings.HasPrefix(part.ContentType, "text/") {
+						return nil
+					}
+					if blocked = policy.match(part); blocked != "" {
+						return errBlockedAttachment
+					}
+					return nil
+				})
+				if err != nil && err != errBlockedAttachment {
+					// the parts that weren't walked could hide a blocked attachment
+					e.Values["parse_failed"] = err.Error()
+					if quarantine {
+						EnvelopeLog(e).WithError(err).Warn("could not check the attachments, quarantined")
+						e.Values["quarantine"] = "block_attachments"
+						return p.Process(e, task)
+					}
+					EnvelopeLog(e).WithError(err).Info("rejected as the attachments could not be checked")
+					return NewResult(response.Canned.FailAttachmentsUnchecked), err
+				}
+				if blocked == "" {
+					return p.Process(e, task)
+				}
+				e.Values["blocked_attachment"] = blocked
+				if quarantine {
+					EnvelopeLog(e).Infof("quarantined for the attachment %s", blocked)
+					e.Values["quarantine"] = "block_attachments"
+					return p.Process(e, task)
+				}
+				EnvelopeLog(e).Infof("rejected for the attachment %s", blocked)
+				return NewResult(response.Canned.FailBlockedAttachment, " ", blocked), errors.New("blocked attachment " + blocked)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// attachmentList parses a comma separated list of extensions or types, in lower case and
+// without the leading dot of extensions
+func attachmentList(list string) map[string]bool {
+	m := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(item)), "."); item != "" {
+			m[item] = true
+		}
+	}
+	return m
+}
+
+// match returns the filename of the part, or its sniffed type if it has no filename, when
+// the part is blocked, or "" if it's allowed
+func (a *attachmentPolicy) match(part *mail.Part) string {
+	name := part.Filename
+	if name != "" {
+		ext := strings.TrimPrefix(strings.ToLower(path.Ext(strings.TrimRight(name, ". "))), ".")
+		if a.extensions[ext] || (len(a.allow) > 0 && !a.allow[ext]) {
+			return name
+		}
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(part.Body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		// can't be decoded, so it can't be run either
+		return ""
+	}
+	if sniffed := sniffContentType(head[:n]); a.types[sniffed] {
+		if name == "" {
+			return sniffed
+		}
+		return name
+	}
+	return ""
+}
+
+// magic numbers of types that http.DetectContentType doesn't know
+var attachmentMagic = []struct {
+	prefix      string
+	contentType string
+}{
+	{"MZ", "application/x-msdownload"},
+	{"\x7fELF", "application/x-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xca\xfe\xba\xbe", "application/x-mach-binary"},
+	{"#!", "text/x-shellscript"},
+	{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"},
+}
+
+// sniffContentType returns the media type of data from its first bytes
+func sniffContentType(data []byte) string {
+	for _, m := range attachmentMagic {
+		if bytes.HasPrefix(data, []byte(m.prefix)) {
+			return m.contentType
+		}
+	}
+	contentType := http.DetectContentType(data)
+	if i := strings.IndexByte(contentType, ';'); i > -1 {
+		contentType = contentType[:i]
+	}
+	return contentType
+}
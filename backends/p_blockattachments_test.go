@@ -0,0 +1,123 @@
+package backends
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestBlockAttachments(t *testing.T) {
+	newProcessor := func(config BackendConfig) Processor {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, BlockAttachments())
+		if err := Svc.initialize(config); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	newEnvelope := func(contentType, filename string, content []byte) *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString("Subject: test\n" +
+			"Content-Type: multipart/mixed; boundary=b\n\n" +
+			"--b\n" +
+			"Content-Type: text/plain\n\n" +
+			"see attached\n" +
+			"--b\n" +
+			"Content-Type: " + contentType + "\n" +
+			"Content-Disposition: attachment; filename=\"" + filename + "\"\n" +
+			"Content-Transfer-Encoding: base64\n\n" +
+			base64.StdEncoding.EncodeToString(content) + "\n" +
+			"--b--\n")
+		return e
+	}
+	// nestedEnvelope wraps the attachment in multiparts, so that it's nested depth levels deep
+	nestedEnvelope := func(depth int, contentType, filename string, content []byte) *mail.Envelope {
+		e := newEnvelope(contentType, filename, content)
+		for i := 1; i < depth; i++ {
+			part := strings.SplitN(e.Data.String(), "\n", 2)[1]
+			e.Data.Reset()
+			fmt.Fprintf(&e.Data, "Subject: test\nContent-Type: multipart/mixed; boundary=n%d\n\n--n%d\n%s--n%d--\n", i, i, part, i)
+		}
+		return e
+	}
+	exe := append([]byte("MZ\x90\x00\x03\x00\x00\x00"), make([]byte, 2000)...)
+	pdf := []byte("%PDF-1.4\n" + strings.Repeat("1 0 obj\n", 100))
+
+	p := newProcessor(BackendConfig{})
+	for _, test := range []struct {
+		name, contentType, filename string
+		content                     []byte
+		blocked                     string
+	}{
+		{"script", "application/javascript", "invoice.js", []byte("var x = 1;"), "invoice.js"},
+		{"uppercase", "application/octet-stream", "SETUP.EXE", exe, "SETUP.EXE"},
+		{"renamed executable", "application/pdf", "invoice.pdf", exe, "invoice.pdf"},
+		{"pdf", "application/pdf", "invoice.pdf", pdf, ""},
+	} {
+		e := newEnvelope(test.contentType, test.filename, test.content)
+		result, err := p.Process(e, TaskSaveMail)
+		if test.blocked == "" {
+			if err != nil {
+				t.Errorf("%s: expecting the message to be accepted, got %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || result.Code() != 550 || !strings.Contains(result.String(), test.blocked) {
+			t.Errorf("%s: expecting a 550 for %s, got %v", test.name, test.blocked, result)
+		}
+		if e.Values["blocked_attachment"] != test.blocked {
+			t.Errorf("%s: expecting blocked_attachment to be %s, got %v", test.name, test.blocked, e.Values["blocked_attachment"])
+		}
+	}
+
+	// nesting doesn't hide an executable
+	e := nestedEnvelope(mail.MaxPartDepth, "application/octet-stream", "setup.exe", exe)
+	if result, err := p.Process(e, TaskSaveMail); err == nil || result.Code() != 550 {
+		t.Error("expecting a 550 for setup.exe nested within the limit, got", result)
+	}
+	e = nestedEnvelope(mail.MaxPartDepth+1, "application/octet-stream", "setup.exe", exe)
+	if result, err := p.Process(e, TaskSaveMail); err != mail.ErrPartDepthExceeded || result.Code() != 554 {
+		t.Error("expecting a 554 for setup.exe nested deeper than can be checked, got", result, err)
+	}
+
+	// only pdf allowed, quarantined instead of rejected
+	p = newProcessor(BackendConfig{"block_attachments_allow": "pdf", "block_attachments_mode": "quarantine"})
+	e = newEnvelope("application/msword", "report.doc", []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"))
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting the message to be quarantined, got", err)
+	}
+	if e.Values["quarantine"] != "block_attachments" || e.Values["blocked_attachment"] != "report.doc" {
+		t.Error("expecting report.doc to be quarantined, got", e.Values["quarantine"], e.Values["blocked_attachment"])
+	}
+	e = newEnvelope("application/pdf", "report.pdf", pdf)
+	if _, err := p.Process(e, TaskSaveMail); err != nil || e.Values["quarantine"] != nil {
+		t.Error("expecting the pdf to be allowed, got", err, e.Values["quarantine"])
+	}
+	e = nestedEnvelope(mail.MaxPartDepth+1, "application/pdf", "report.pdf", pdf)
+	if _, err := p.Process(e, TaskSaveMail); err != nil || e.Values["quarantine"] != "block_attachments" {
+		t.Error("expecting a message nested too deep to be quarantined, got", err, e.Values["quarantine"])
+	}
+
+	Svc.reset()
+	_ = Decorate(DefaultProcessor{}, BlockAttachments())
+	if err := Svc.initialize(BackendConfig{"block_attachments_mode": "drop"}); err == nil {
+		t.Error("expecting an invalid mode to be an error")
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	for data, expect := range map[string]string{
+		"MZ\x90\x00":         "application/x-msdownload",
+		"\x7fELF\x02\x01":    "application/x-executable",
+		"%PDF-1.7\n":         "application/pdf",
+		"PK\x03\x04\x14\x00": "application/zip",
+		"hello":              "text/plain",
+	} {
+		if sniffed := sniffContentType([]byte(data)); sniffed != expect {
+			t.Errorf("expecting %s, got %s", expect, sniffed)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: clamav
+// ----------------------------------------------------------------------------------
+// Description   : Scans the message for viruses with clamd, using the INSTREAM command.
+//               : The message is sent in chunks straight from e.Data, so no copy of it
+//               : is made, and only up to clamav_max_size bytes are sent. Infected
+//               : messages are rejected with "554 5.7.1 virus detected: <name>".
+//               : If clamd can't be reached the message is deferred with a 451, or
+//               : accepted without a scan if clamav_circuit_fail_open is true
+// ----------------------------------------------------------------------------------
+// Config Options: clamav_address string - "<host>:<port>" of clamd, or the path of its
+//               : unix socket, default "/var/run/clamav/clamd.ctl"
+//               : clamav_max_size int - the number of bytes of the message to scan,
+//               : should not be more than clamd's StreamMaxLength, default 25MB
+//               : clamav_timeout string - time limit for a scan, default "30s"
+//               : clamav_circuit_* - the circuit breaker on clamd. See CircuitConfig
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["virus"] is set to the name of the virus found
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["clamav"] = func() Decorator {
+		return ClamAV()
+	}
+}
+
+type clamAVConfig struct {
+	Address string `json:"clamav_address,omitempty"`
+	MaxSize int    `json:"clamav_max_size,omitempty"`
+	Timeout string `json:"clamav_timeout,omitempty"`
+}
+
+const (
+	defaultClamAVAddress = "/var/run/clamav/clamd.ctl"
+	defaultClamAVMaxSize = 25 * 1024 * 1024
+	defaultClamAVTimeout = time.Second * 30
+
+	// clamAVChunkSize is the size of the chunks of the message sent with INSTREAM
+	clamAVChunkSize = 64 * 1024
+)
+
+func ClamAV() Decorator {
+	var client *clamdClient
+	var circuit *CircuitBreaker
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&clamAVConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*clamAVConfig)
+		client = &clamdClient{
+			address: config.Address,
+			maxSize: int64(config.MaxSize),
+			timeout: defaultClamAVTimeout,
+		}
+		if client.address == "" {
+			client.address = defaultClamAVAddress
+		}
+		if client.maxSize <= 0 {
+			client.maxSize = defaultClamAVMaxSize
+		}
+		if config.Timeout != "" {
+			if client.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+				return fmt.Errorf("invalid clamav_timeout: %s", err)
+			}
+		}
+		circuitConfig, err := NewCircuitConfig("clamav", backendConfig)
+		if err != nil {
+			return err
+		}
+		circuit = NewCircuitBreaker("clamav", circuitConfig)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				var virus string
+				err := circuit.Do(func() error {
+					var err error
+					virus, err = client.scan(bytes.NewReader(e.Data.Bytes()))
+					return err
+				})
+				if err != nil {
+					if !circuit.FailOpen() {
+						EnvelopeLog(e).WithError(err).Error("virus scan failed")
+						return NewResult(response.Canned.ErrorDependencyDown, " ", "virus scan failed"), err
+					}
+					EnvelopeLog(e).WithError(err).Warn("virus scan failed, accepting the message without a scan")
+					return p.Process(e, task)
+				}
+				if virus != "" {
+					e.Values["virus"] = virus
+					EnvelopeLog(e).Infof("virus detected: %s", virus)
+					return NewResult(response.Canned.FailVirusDetected, " ", virus), errors.New("virus detected: " + virus)
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// clamdClient scans with clamd, with a new connection for each scan
+type clamdClient struct {
+	address string
+	maxSize int64
+	timeout time.Duration
+}
+
+// scan sends up to maxSize bytes of r to clamd and returns the name of the virus found,
+// or "" if it's clean
+func (c *clamdClient) scan(r io.Reader) (virus string, err error) {
+	network := "tcp"
+	if strings.HasPrefix(c.address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, c.address, c.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err = conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return "", err
+	}
+	w := bufio.NewWriterSize(conn, clamAVChunkSize+4)
+	if _, err = w.WriteString("zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	chunk := make([]byte, clamAVChunkSize)
+	size := make([]byte, 4)
+	r = io.LimitReader(r, c.maxSize)
+	for {
+		n, readErr := io.ReadFull(r, chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err = w.Write(size); err != nil {
+				return "", err
+			}
+			if _, err = w.Write(chunk[:n]); err != nil {
+				return "", err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return "", readErr
+		}
+	}
+	// a zero length chunk ends the stream
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err = w.Write(size); err != nil {
+		return "", err
+	}
+	if err = w.Flush(); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply parses a reply to INSTREAM, eg. "stream: OK",
+// "stream: Eicar-Signature FOUND" or "INSTREAM size limit exceeded. ERROR"
+func parseClamdReply(reply string) (virus string, err error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", errors.New("clamd: " + reply)
+}
@@ -0,0 +1,155 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// stubClamd accepts INSTREAM scans, reporting the EICAR test file as a virus.
+// The size of each stream received is sent on the returned channel
+func stubClamd(t *testing.T) (string, chan int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan int, 10)
+	go func() {
+		defer func() {
+			_ = l.Close()
+		}()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			in := bufio.NewReader(conn)
+			cmd, err := in.ReadString(0)
+			if err != nil || cmd != "zINSTREAM\x00" {
+				_ = conn.Close()
+				continue
+			}
+			var stream bytes.Buffer
+			size := make([]byte, 4)
+			for {
+				if _, err = io.ReadFull(in, size); err != nil {
+					break
+				}
+				n := binary.BigEndian.Uint32(size)
+				if n == 0 {
+					break
+				}
+				if _, err = io.CopyN(&stream, in, int64(n)); err != nil {
+					break
+				}
+			}
+			received <- stream.Len()
+			if strings.Contains(stream.String(), eicar) {
+				_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				_, _ = conn.Write([]byte("stream: OK\x00"))
+			}
+			_ = conn.Close()
+			if stream.Len() == 0 {
+				// an empty stream stops the stub
+				return
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func clamAVTestEnvelope(body string) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = []mail.Address{{User: "jane", Host: "example.com"}}
+	e.Data.WriteString("Subject: test\r\n\r\n" + body + "\r\n")
+	return e
+}
+
+func TestClamAV(t *testing.T) {
+	address, received := stubClamd(t)
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, ClamAV())
+	if err := Svc.initialize(BackendConfig{
+		"clamav_address":  address,
+		"clamav_max_size": 100 * 1024,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// larger than a chunk, so that it's sent in several
+	e := clamAVTestEnvelope(strings.Repeat("clean line\r\n", 10000))
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting a clean message to pass, got", err)
+	}
+	if n := <-received; n != 100*1024 {
+		t.Error("expecting clamav_max_size bytes to be scanned, got", n)
+	}
+
+	e = clamAVTestEnvelope(eicar)
+	result, err := p.Process(e, TaskSaveMail)
+	if err == nil {
+		t.Fatal("expecting the EICAR test file to be rejected")
+	}
+	<-received
+	if result.String() != "554 5.7.1 virus detected: Eicar-Test-Signature" {
+		t.Error("unexpected result", result.String())
+	}
+	if e.Values["virus"] != "Eicar-Test-Signature" {
+		t.Error("expecting the virus name in e.Values, got", e.Values["virus"])
+	}
+
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	<-received
+}
+
+func TestClamAVUnavailable(t *testing.T) {
+	// nothing listening on the address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	_ = l.Close()
+
+	for _, failOpen := range []bool{false, true} {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, ClamAV())
+		if err := Svc.initialize(BackendConfig{
+			"clamav_address":           address,
+			"clamav_circuit_fail_open": failOpen,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		result, err := p.Process(clamAVTestEnvelope("hello"), TaskSaveMail)
+		if failOpen && err != nil {
+			t.Error("expecting the message to pass without a scan, got", err)
+		}
+		if !failOpen && (err == nil || !strings.HasPrefix(result.String(), "451")) {
+			t.Error("expecting a temporary failure, got", result, err)
+		}
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	if virus, err := parseClamdReply("stream: OK"); virus != "" || err != nil {
+		t.Error("expecting clean, got", virus, err)
+	}
+	if virus, err := parseClamdReply("stream: Win.Test.EICAR_HDB-1 FOUND"); virus != "Win.Test.EICAR_HDB-1" || err != nil {
+		t.Error("expecting a virus, got", virus, err)
+	}
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("expecting an error")
+	}
+}
@@ -0,0 +1,160 @@
+package backends
+
+import (
+	"errors"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: datepolicy
+// ----------------------------------------------------------------------------------
+// Description   : Checks the Date header of the message. What happens when the header
+//               : is missing or cannot be parsed depends on the date_policy option
+// ----------------------------------------------------------------------------------
+// Config Options: date_policy string - one of:
+//               : "tag" - (default) add an X-Date-Warning header and continue
+//               : "reject" - reject the message with a 550
+//               : "inject" - add a Date header with the time of receipt when the
+//               : header is missing, an invalid header is tagged
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header - generated by the HeadersParser processor
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["date"] is set to the parsed date as a time.Time
+//               : e.Values["date_invalid"] is set to true if missing or invalid
+//               : e.DeliveryHeader may have a header appended, so place this
+//               : processor after the Header processor
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["datepolicy"] = func() Decorator {
+		return DatePolicy()
+	}
+}
+
+type datePolicyConfig struct {
+	Policy string `json:"date_policy,omitempty"`
+}
+
+const (
+	datePolicyTag    = "tag"
+	datePolicyReject = "reject"
+	datePolicyInject = "inject"
+)
+
+func DatePolicy() Decorator {
+	var config *datePolicyConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&datePolicyConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*datePolicyConfig)
+		config.Policy = strings.ToLower(strings.TrimSpace(config.Policy))
+		switch config.Policy {
+		case "":
+			config.Policy = datePolicyTag
+		case datePolicyTag, datePolicyReject, datePolicyInject:
+		default:
+			return errors.New("date_policy must be one of tag, reject or inject")
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if e.Header == nil {
+					if err := e.ParseHeaders(); err != nil {
+						EnvelopeLog(e).WithError(err).Debug("date policy could not parse headers")
+					}
+				}
+				value := ""
+				if e.Header != nil {
+					value = e.Header.Get("Date")
+				}
+				var problem string
+				if value == "" {
+					problem = "missing Date header"
+				} else if date, err := parseDate(value); err != nil {
+					problem = "invalid Date header"
+				} else {
+					e.Values["date"] = date
+				}
+				if problem == "" {
+					return p.Process(e, task)
+				}
+				e.Values["date_invalid"] = true
+				switch {
+				case config.Policy == datePolicyReject:
+					return NewResult(response.Canned.FailInvalidDateHeader), errors.New(problem)
+				case config.Policy == datePolicyInject && value == "":
+					now := mail.DefaultClock.Now()
+					e.DeliveryHeader += "Date: " + now.Format(time.RFC1123Z) + "\n"
+					e.Values["date"] = now
+				default:
+					e.DeliveryHeader += "X-Date-Warning: " + problem + "\n"
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// dateLayouts are the variations of RFC 5322 date-time seen in the wild,
+// tried after net/mail fails to parse the date
+var dateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04:05 -0700 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04:05",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	"Mon, 2 Jan 06 15:04:05 MST",
+	"Mon, 2 January 2006 15:04:05 -0700",
+	"Monday, 2 Jan 2006 15:04:05 -0700",
+	"Monday, 2 January 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04 -0700",
+	"2 Jan 06 15:04:05 -0700",
+	"2 January 2006 15:04:05 -0700",
+	"Mon Jan 2 15:04:05 2006",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	"Mon Jan 2 15:04:05 MST 2006",
+	"Mon, Jan 2 2006 15:04:05 -0700",
+	"2006-01-02 15:04:05 -0700",
+	time.RFC3339,
+}
+
+var (
+	dateComment    = regexp.MustCompile(`\([^)]*\)`)
+	dateWhitespace = regexp.MustCompile(`\s+`)
+)
+
+// parseDate parses an RFC 5322 date-time, leniently accepting common variations such as
+// missing day names, two digit years, missing seconds, trailing comments and named zones
+func parseDate(value string) (time.Time, error) {
+	if t, err := netmail.ParseDate(value); err == nil {
+		return t, nil
+	}
+	value = dateComment.ReplaceAllString(value, " ")
+	value = dateWhitespace.ReplaceAllString(value, " ")
+	value = strings.Replace(value, " ,", ",", -1)
+	value = strings.Replace(value, ",", ", ", 1)
+	value = strings.Replace(value, ",  ", ", ", 1)
+	value = strings.TrimSpace(value)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("cannot parse date: " + value)
+}
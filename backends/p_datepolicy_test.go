@@ -0,0 +1,133 @@
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestParseDate(t *testing.T) {
+	valid := []string{
+		"Mon, 2 Jan 2006 15:04:05 -0700",
+		"Mon, 02 Jan 2006 15:04:05 +0000 (UTC)",
+		"2 Jan 2006 15:04:05 GMT",
+		"Mon,  2 Jan 2006 15:04:05 -0700",
+		"Mon,2 Jan 2006 15:04:05 -0700",
+		"Mon, 2 Jan 06 15:04:05 -0700",
+		"Mon, 2 Jan 2006 15:04 -0700",
+		"Monday, 2 January 2006 15:04:05 -0700",
+		"Mon Jan  2 15:04:05 2006",
+		"2006-01-02T15:04:05Z",
+		"mon, 2 jan 2006 15:04:05 -0700",
+	}
+	for _, v := range valid {
+		d, err := parseDate(v)
+		if err != nil {
+			t.Error("expecting date to parse:", v, err)
+		} else if d.Year() != 2006 || d.Day() != 2 {
+			t.Error("wrong date parsed from", v, "got", d)
+		}
+	}
+	invalid := []string{
+		"yesterday",
+		"Mon, 32 Jan 2006 15:04:05 -0700",
+		"",
+	}
+	for _, v := range invalid {
+		if _, err := parseDate(v); err == nil {
+			t.Error("expecting an error for date:", v)
+		}
+	}
+}
+
+func TestDatePolicyProcessor(t *testing.T) {
+	defer func(c mail.Clock) { mail.DefaultClock = c }(mail.DefaultClock)
+	received := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	mail.DefaultClock = mail.FixedClock(received)
+	newProcessor := func(policy string) Processor {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, DatePolicy())
+		if err := Svc.initialize(BackendConfig{"date_policy": policy}); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	newEnvelope := func(date string) *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		if date != "" {
+			e.Data.WriteString("Date: " + date + "\n")
+		}
+		e.Data.WriteString("Subject: test\n\nhello\n")
+		return e
+	}
+	const valid = "Mon, 2 Jan 2006 15:04:05 -0700"
+
+	for _, policy := range []string{"tag", "reject", "inject"} {
+		p := newProcessor(policy)
+		e := newEnvelope(valid)
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Error(policy, "expecting a valid date to be accepted", err)
+		}
+		if d, ok := e.Values["date"].(time.Time); !ok || d.Year() != 2006 {
+			t.Error(policy, "expecting the parsed date, got", e.Values["date"])
+		}
+		if e.DeliveryHeader != "" || e.Values["date_invalid"] != nil {
+			t.Error(policy, "expecting a valid date to be left alone, got", e.DeliveryHeader)
+		}
+	}
+
+	// tag
+	p := newProcessor("")
+	for date, expect := range map[string]string{
+		"":          "X-Date-Warning: missing Date header\n",
+		"yesterday": "X-Date-Warning: invalid Date header\n",
+	} {
+		e := newEnvelope(date)
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Error("expecting a tagged message to be saved", err)
+		}
+		if e.DeliveryHeader != expect || e.Values["date_invalid"] != true {
+			t.Errorf("%q: expecting %q, got %q", date, expect, e.DeliveryHeader)
+		}
+	}
+
+	// reject
+	p = newProcessor("reject")
+	for _, date := range []string{"", "yesterday"} {
+		e := newEnvelope(date)
+		result, err := p.Process(e, TaskSaveMail)
+		if err == nil || result.Code() != 550 {
+			t.Errorf("%q: expecting a 550, got %v %v", date, result, err)
+		}
+		if e.DeliveryHeader != "" {
+			t.Error("expecting no header on a rejected message, got", e.DeliveryHeader)
+		}
+	}
+
+	// inject the time of receipt when missing, an invalid date is tagged
+	p = newProcessor("inject")
+	e := newEnvelope("")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting the message to be saved", err)
+	}
+	if expect := "Date: Mon, 04 Mar 2019 05:06:07 +0000\n"; e.DeliveryHeader != expect {
+		t.Errorf("expecting %q, got %q", expect, e.DeliveryHeader)
+	}
+	if e.Values["date"] != received {
+		t.Error("expecting the date to be the time of receipt, got", e.Values["date"])
+	}
+	e = newEnvelope("yesterday")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting the message to be saved", err)
+	}
+	if expect := "X-Date-Warning: invalid Date header\n"; e.DeliveryHeader != expect {
+		t.Errorf("expecting %q, got %q", expect, e.DeliveryHeader)
+	}
+
+	Svc.reset()
+	_ = Decorate(DefaultProcessor{}, DatePolicy())
+	if err := Svc.initialize(BackendConfig{"date_policy": "drop"}); err == nil {
+		t.Error("expecting an invalid policy to be rejected")
+	}
+}
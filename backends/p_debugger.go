@@ -44,14 +44,14 @@ func Debugger() Decorator {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 			if task == TaskSaveMail {
 				if config.LogReceivedMails {
-					Log().Infof("Mail from: %s / to: %v", e.MailFrom.String(), e.RcptTo)
-					Log().Info("Headers are:", e.Header)
+					EnvelopeLog(e).Infof("Mail from: %s / to: %v", e.MailFrom.String(), e.RcptTo)
+					EnvelopeLog(e).Info("Headers are:", e.Header)
 				}
 
 				if config.SleepSec > 0 {
-					Log().Infof("sleeping for %d", config.SleepSec)
+					EnvelopeLog(e).Infof("sleeping for %d", config.SleepSec)
 					time.Sleep(time.Second * time.Duration(config.SleepSec))
-					Log().Infof("woke up")
+					EnvelopeLog(e).Infof("woke up")
 
 					if config.SleepSec == 1 {
 						panic("panic on purpose")
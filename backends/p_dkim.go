@@ -0,0 +1,367 @@
+package backends
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: dkim
+// ----------------------------------------------------------------------------------
+// Description   : Signs the message with DKIM (RFC 6376), adding a DKIM-Signature
+//               : header. The signature uses rsa-sha256 and relaxed/relaxed
+//               : canonicalization. Meant for mail that is relayed out.
+// ----------------------------------------------------------------------------------
+// Config Options: dkim_selector string - the selector, the public key is published at
+//               : <selector>._domainkey.<domain>
+//               : dkim_domain string - the signing domain (d=)
+//               : dkim_private_key string - path to the PEM encoded RSA private key,
+//               : PKCS #1 or PKCS #8
+//               : dkim_headers string - names of the headers to sign, separated by :
+//               : default "From:Reply-To:Subject:Date:To:Cc:Message-ID:In-Reply-To:
+//               : References:MIME-Version:Content-Type:Content-Transfer-Encoding"
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Data gets the DKIM-Signature header added to the top.
+//               : Place this processor after any processor that changes e.Data,
+//               : such as transform, otherwise the signature will not verify.
+//               : Headers in e.DeliveryHeader are not signed
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["dkim"] = func() Decorator {
+		return DKIM()
+	}
+}
+
+type dkimConfig struct {
+	Selector   string `json:"dkim_selector"`
+	Domain     string `json:"dkim_domain"`
+	PrivateKey string `json:"dkim_private_key"`
+	Headers    string `json:"dkim_headers,omitempty"`
+}
+
+const defaultDKIMHeaders = "From:Reply-To:Subject:Date:To:Cc:Message-ID:In-Reply-To:References:" +
+	"MIME-Version:Content-Type:Content-Transfer-Encoding"
+
+func DKIM() Decorator {
+	var signer *dkimSigner
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&dkimConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*dkimConfig)
+		if config.Selector == "" || config.Domain == "" {
+			return errors.New("dkim_selector and dkim_domain are required")
+		}
+		pemData, err := ioutil.ReadFile(config.PrivateKey)
+		if err != nil {
+			return errors.New("could not read dkim_private_key: " + err.Error())
+		}
+		key, err := parseDKIMKey(pemData)
+		if err != nil {
+			return err
+		}
+		if config.Headers == "" {
+			config.Headers = defaultDKIMHeaders
+		}
+		signer = &dkimSigner{
+			selector: config.Selector,
+			domain:   config.Domain,
+			key:      key,
+		}
+		for _, name := range strings.Split(config.Headers, ":") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				signer.headers = append(signer.headers, name)
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if err := ApplyTransforms(e, signer); err != nil {
+					EnvelopeLog(e).WithError(err).Error("dkim signing failed")
+					return NewResult(response.Canned.FailBackendTransaction), err
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+func parseDKIMKey(pemData []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("dkim_private_key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("could not parse dkim_private_key: " + err.Error())
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("dkim_private_key must be an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// dkimSigner is a BodyTransformer that adds the DKIM-Signature header
+type dkimSigner struct {
+	selector string
+	domain   string
+	key      *rsa.PrivateKey
+	// headers are the lower case names of the headers to sign
+	headers []string
+}
+
+type dkimHeaderField struct {
+	// name is lower case
+	name string
+	// raw is the whole field, continuation lines included, without the final line ending
+	raw string
+}
+
+// Transform implements BodyTransformer
+func (d *dkimSigner) Transform(e *mail.Envelope, header, body []byte) ([]byte, []byte, error) {
+	bodyHash := sha256.Sum256(dkimRelaxedBody(body))
+	fields := dkimSplitHeader(header)
+	names := dkimPresent(fields, d.headers)
+	sig := "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=" + d.domain +
+		"; s=" + d.selector + ";\r\n\tt=" + strconv.FormatInt(mail.DefaultClock.Now().Unix(), 10) +
+		"; h=" + strings.Join(names, ":") + ";\r\n\tbh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) +
+		";\r\n\tb="
+	signature, err := rsa.SignPKCS1v15(rand.Reader, d.key, crypto.SHA256, dkimHeaderHash(fields, names, sig))
+	if err != nil {
+		return nil, nil, err
+	}
+	sig += base64.StdEncoding.EncodeToString(signature)
+	// the message uses \n line endings
+	sig = strings.Replace(sig, "\r\n", "\n", -1) + "\n"
+	return append([]byte(sig), header...), body, nil
+}
+
+// dkimPresent returns the names to sign, for each of the wanted names, as many times as
+// the field is present in the header
+func dkimPresent(fields []dkimHeaderField, wanted []string) []string {
+	var names []string
+	count := make(map[string]int)
+	for _, f := range fields {
+		count[f.name]++
+	}
+	for _, name := range wanted {
+		if count[name] > 0 {
+			count[name]--
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// dkimHeaderHash returns the hash of the header fields listed in names, which are picked from
+// the bottom up for repeated names (RFC 6376 5.4.2), followed by the signature field with an
+// empty b= tag and no final line ending
+func dkimHeaderHash(fields []dkimHeaderField, names []string, sigField string) []byte {
+	h := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && fields[i].name == name {
+				used[i] = true
+				_, _ = h.Write([]byte(dkimRelaxedHeader(fields[i].raw)))
+				_, _ = h.Write([]byte("\r\n"))
+				break
+			}
+		}
+	}
+	_, _ = h.Write([]byte(dkimRelaxedHeader(dkimStripB(sigField))))
+	return h.Sum(nil)
+}
+
+// dkimTags parses the tag=value list of a signature field, whitespace is removed from the values
+func dkimTags(field string) map[string]string {
+	tags := make(map[string]string)
+	if i := strings.IndexByte(field, ':'); i > -1 {
+		field = field[i+1:]
+	}
+	for _, tag := range strings.Split(field, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, kv[1])
+		tags[strings.TrimSpace(kv[0])] = value
+	}
+	return tags
+}
+
+// dkimStripB removes the value of the b= tag from a signature field
+func dkimStripB(field string) string {
+	parts := strings.Split(field, ";")
+	for i, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "b" {
+			parts[i] = kv[0] + "="
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// dkimLookupKey fetches the public key of the selector from DNS, can be replaced in tests
+var dkimLookupKey = func(selector, domain string) (*rsa.PublicKey, error) {
+	txts, err := net.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+	tags := dkimTags(":" + strings.Join(txts, ""))
+	if k, ok := tags["k"]; ok && k != "rsa" {
+		return nil, errors.New("unsupported key type " + k)
+	}
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(der) == 0 {
+		return nil, errors.New("no public key for " + selector + "._domainkey." + domain)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return rsaKey, nil
+}
+
+// dkimVerify checks a DKIM-Signature or ARC-Message-Signature field against the message.
+// Only rsa-sha256 with relaxed/relaxed canonicalization is supported
+func dkimVerify(fields []dkimHeaderField, sigField string, body []byte) error {
+	tags := dkimTags(sigField)
+	if tags["a"] != "rsa-sha256" {
+		return errors.New("unsupported signature algorithm " + tags["a"])
+	}
+	if c := tags["c"]; c != "relaxed/relaxed" {
+		return errors.New("unsupported canonicalization " + c)
+	}
+	bodyHash := sha256.Sum256(dkimRelaxedBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		return errors.New("body hash does not match")
+	}
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+	key, err := dkimLookupKey(tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, dkimHeaderHash(fields, strings.Split(tags["h"], ":"), sigField), signature)
+}
+
+// dkimSplitHeader splits the header block into its fields
+func dkimSplitHeader(header []byte) []dkimHeaderField {
+	var fields []dkimHeaderField
+	for _, line := range strings.Split(string(header), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += "\r\n" + line
+			continue
+		}
+		name := line
+		if i := strings.IndexByte(line, ':'); i > -1 {
+			name = line[:i]
+		}
+		fields = append(fields, dkimHeaderField{
+			name: strings.ToLower(strings.TrimSpace(name)),
+			raw:  line,
+		})
+	}
+	return fields
+}
+
+// dkimRelaxedHeader canonicalizes a header field with the relaxed algorithm, RFC 6376 3.4.2
+func dkimRelaxedHeader(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(field)) + ":"
+	}
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	value = strings.Replace(value, "\n", "", -1)
+	return name + ":" + strings.TrimSpace(dkimCompressWSP(value))
+}
+
+// dkimRelaxedBody canonicalizes the body with the relaxed algorithm, RFC 6376 3.4.4
+func dkimRelaxedBody(body []byte) []byte {
+	var b bytes.Buffer
+	empty := 0 // empty lines not written yet, dropped if at the end
+	lines := strings.Split(string(body), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		// the final line ending
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		line = strings.TrimRight(dkimCompressWSP(strings.TrimRight(line, "\r")), " ")
+		if line == "" {
+			empty++
+			continue
+		}
+		for ; empty > 0; empty-- {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
+
+// dkimCompressWSP replaces each run of spaces and tabs with a single space
+func dkimCompressWSP(s string) string {
+	var b bytes.Buffer
+	wsp := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			b.WriteByte(' ')
+			wsp = false
+		}
+		b.WriteByte(s[i])
+	}
+	if wsp {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
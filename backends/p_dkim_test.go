@@ -0,0 +1,173 @@
+package backends
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// the example message of RFC 8463, appendix A
+const dkimTestMessage = "From: Joe SixPack <joe@football.example.com>\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\n" +
+	"Subject: Is dinner ready?\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\n" +
+	"\n" +
+	"Hi.\n" +
+	"\n" +
+	"We lost the game.  Are you hungry yet?\n" +
+	"\n" +
+	"Joe.\n"
+
+// dkimTestVerify checks the DKIM-Signature at the top of the message, written separately
+// from the signer, following RFC 6376 6.1.3
+func dkimTestVerify(t *testing.T, msg string, pub *rsa.PublicKey) map[string]string {
+	i := strings.Index(msg, "\n\n")
+	if i < 0 {
+		t.Fatal("no header found")
+	}
+	var fields []string
+	for _, line := range strings.Split(msg[:i], "\n") {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			fields[len(fields)-1] += "\r\n" + line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	if !strings.HasPrefix(fields[0], "DKIM-Signature:") {
+		t.Fatal("expecting the DKIM-Signature header at the top, got", fields[0])
+	}
+	wsp := regexp.MustCompile(`[ \t]+`)
+	relaxed := func(field string) string {
+		parts := strings.SplitN(field, ":", 2)
+		value := strings.Replace(parts[1], "\r\n", "", -1)
+		return strings.ToLower(strings.TrimSpace(parts[0])) + ":" + strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+	}
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(strings.SplitN(relaxed(fields[0]), ":", 2)[1], ";") {
+		if kv := strings.SplitN(strings.TrimSpace(tag), "=", 2); len(kv) == 2 {
+			tags[kv[0]] = strings.Replace(kv[1], " ", "", -1)
+		}
+	}
+	h := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for j := len(fields) - 1; j > 0; j-- {
+			if !used[j] && strings.EqualFold(strings.SplitN(fields[j], ":", 2)[0], name) {
+				used[j] = true
+				_, _ = h.Write([]byte(relaxed(fields[j]) + "\r\n"))
+				break
+			}
+		}
+	}
+	unsigned := regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(relaxed(fields[0]), "b=")
+	_, _ = h.Write([]byte(unsigned))
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, h.Sum(nil), sig); err != nil {
+		t.Error("signature did not verify:", err)
+	}
+	return tags
+}
+
+func TestDKIM(t *testing.T) {
+	defer func(c mail.Clock) {
+		mail.DefaultClock = c
+	}(mail.DefaultClock)
+	mail.DefaultClock = mail.FixedClock(time.Unix(1528637909, 0))
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := ioutil.TempFile("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(keyFile.Name())
+	}()
+	_ = pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	_ = keyFile.Close()
+
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, DKIM())
+	if err := Svc.initialize(BackendConfig{
+		"dkim_selector":    "brisbane",
+		"dkim_domain":      "football.example.com",
+		"dkim_private_key": keyFile.Name(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	_, _ = e.Data.WriteString(dkimTestMessage)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	msg := e.Data.String()
+	if !strings.HasSuffix(msg, dkimTestMessage) {
+		t.Error("the message should be unchanged after the signature, got", msg)
+	}
+	tags := dkimTestVerify(t, msg, &key.PublicKey)
+	// the body hash from RFC 8463
+	if tags["bh"] != "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=" {
+		t.Error("unexpected body hash", tags["bh"])
+	}
+	for k, v := range map[string]string{
+		"a": "rsa-sha256",
+		"c": "relaxed/relaxed",
+		"d": "football.example.com",
+		"s": "brisbane",
+		"t": "1528637909",
+		"h": "from:subject:date:to:message-id",
+	} {
+		if tags[k] != v {
+			t.Error("expecting", k, "to be", v, "got", tags[k])
+		}
+	}
+
+	// a missing key file fails on initialization
+	Svc.reset()
+	_ = DKIM()
+	if err := Svc.initialize(BackendConfig{
+		"dkim_selector":    "brisbane",
+		"dkim_domain":      "football.example.com",
+		"dkim_private_key": keyFile.Name() + ".missing",
+	}); err == nil {
+		t.Error("expecting an error for a missing key file")
+	}
+}
+
+func TestDKIMRelaxedBody(t *testing.T) {
+	for in, expect := range map[string]string{
+		"":                      "",
+		"\n\n":                  "",
+		"a  b \t\nc\n\n\n":      "a b\r\nc\r\n",
+		"a\r\n\r\n b\r\n":       "a\r\n\r\n b\r\n",
+		"no final line ending":  "no final line ending\r\n",
+		"trailing space \n \n":  "trailing space\r\n",
+		"\n\nleading lines\n":   "\r\n\r\nleading lines\r\n",
+		"tab\tinside\t\t end\n": "tab inside end\r\n",
+	} {
+		if got := string(dkimRelaxedBody([]byte(in))); got != expect {
+			t.Errorf("relaxed body of %q: expecting %q got %q", in, expect, got)
+		}
+	}
+	if got := dkimRelaxedHeader("SubJect :  hello \r\n\t world  "); got != "subject:hello world" {
+		t.Errorf("unexpected relaxed header %q", got)
+	}
+}
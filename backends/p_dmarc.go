@@ -0,0 +1,138 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: dmarc
+// ----------------------------------------------------------------------------------
+// Description   : Evaluates DMARC (RFC 7489) for the domain of the From header, using
+//               : the SPF and DKIM results of earlier processors. An identifier is
+//               : aligned if it's the From domain (strict), or has the same organizational
+//               : domain, found with the public suffix list (relaxed). The policy of the
+//               : domain is only recorded unless dmarc_enforce is true. Results for domains
+//               : asking for aggregate reports are given to the DMARCReporter set with
+//               : SetDMARCReporter
+// ----------------------------------------------------------------------------------
+// Config Options: dmarc_enforce bool - reject messages failing with a reject policy,
+//               : and quarantine the ones with a quarantine policy. Default false
+//               : dmarc_resolver string - address of the DNS resolver to use, eg.
+//               : "127.0.0.1:53", default is the system's resolver
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header, parsed if not parsed by an earlier processor
+//               : e.MailFrom, e.Helo and e.Values["spf_result"], set by the spf processor
+//               : e.Values["dkim_result"] and e.Values["dkim_domain"], the d= domain, a
+//               : string or a []string when several signatures verified
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["dmarc_result"] is set to none, pass, fail, temperror or
+//               : permerror, e.Values["dmarc_domain"] to the From domain and
+//               : e.Values["dmarc_policy"] to the policy applied, after sampling with pct=
+//               : e.Values["quarantine"] is set to "dmarc" when a quarantine is enforced
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["dmarc"] = func() Decorator {
+		return DMARC()
+	}
+}
+
+type dmarcConfig struct {
+	Enforce  bool   `json:"dmarc_enforce,omitempty"`
+	Resolver string `json:"dmarc_resolver,omitempty"`
+}
+
+const dmarcTimeout = time.Second * 10
+
+// newDMARCResolver returns the resolver at address, can be replaced in tests
+var newDMARCResolver = func(address string) DMARCResolver {
+	return dnsResolver(address)
+}
+
+func DMARC() Decorator {
+	var (
+		config   *dmarcConfig
+		resolver DMARCResolver
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&dmarcConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*dmarcConfig)
+		if config.Resolver != "" {
+			if _, _, err := net.SplitHostPort(config.Resolver); err != nil {
+				return convertError("property invalid: 'dmarc_resolver' must be a host:port address")
+			}
+		}
+		resolver = newDMARCResolver(config.Resolver)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if err := e.ParseHeaders(); err != nil {
+					EnvelopeLog(e).WithError(err).Debug("could not parse headers for dmarc")
+				}
+				var fromDomain string
+				if from, err := mail.NewAddress(e.Header.Get("From")); err == nil {
+					fromDomain = from.Host
+				}
+				spfDomain := e.MailFrom.Host
+				if e.MailFrom.NullPath || e.MailFrom.IsEmpty() {
+					spfDomain = e.Helo
+				}
+				spfResult, _ := e.Values["spf_result"].(string)
+				var dkimDomains []string
+				if dkimResult, _ := e.Values["dkim_result"].(string); dkimResult == "pass" {
+					switch d := e.Values["dkim_domain"].(type) {
+					case string:
+						dkimDomains = []string{d}
+					case []string:
+						dkimDomains = d
+					}
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), dmarcTimeout)
+				result := CheckDMARC(ctx, resolver, fromDomain, spfDomain, spfResult, dkimDomains)
+				cancel()
+				result.SourceIP = e.RemoteIP
+				reportDMARC(result)
+
+				policy := result.Policy
+				if result.Result == DMARCFail && result.Record.Percent < 100 && rand.Intn(100) >= result.Record.Percent {
+					// not sampled, the next policy down is applied, RFC 7489 6.6.4
+					if policy == DMARCPolicyReject {
+						policy = DMARCPolicyQuarantine
+					} else {
+						policy = DMARCPolicyNone
+					}
+				}
+				e.Values["dmarc_result"] = result.Result
+				e.Values["dmarc_domain"] = result.Domain
+				e.Values["dmarc_policy"] = policy
+				if result.Result != DMARCFail || !config.Enforce {
+					return p.Process(e, task)
+				}
+				switch policy {
+				case DMARCPolicyReject:
+					EnvelopeLog(e).Infof("rejected by the dmarc policy of %s", result.Domain)
+					return NewResult(response.Canned.FailDMARC, " ", result.Domain), errors.New("dmarc policy of " + result.Domain)
+				case DMARCPolicyQuarantine:
+					EnvelopeLog(e).Infof("quarantined by the dmarc policy of %s", result.Domain)
+					e.Values["quarantine"] = "dmarc"
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+type testDMARCReporter struct {
+	results []*DMARCResult
+}
+
+func (r *testDMARCReporter) Report(result *DMARCResult) {
+	r.results = append(r.results, result)
+}
+
+func TestDMARCProcessor(t *testing.T) {
+	defer func(f func(string) DMARCResolver) { newDMARCResolver = f }(newDMARCResolver)
+	resolver := &stubSPFResolver{txt: map[string][]string{
+		"_dmarc.example.com":   {"v=DMARC1; p=reject; sp=quarantine; rua=mailto:dmarc@example.com"},
+		"_dmarc.example.org":   {"v=DMARC1; p=reject; aspf=s; adkim=s"},
+		"_dmarc.example.co.uk": {"v=spf1 -all", "v=DMARC1; p=none"},
+	}, fail: "_dmarc.example.net"}
+	newDMARCResolver = func(address string) DMARCResolver {
+		return resolver
+	}
+	reporter := &testDMARCReporter{}
+	SetDMARCReporter(reporter)
+	defer SetDMARCReporter(nil)
+
+	newProcessor := func(config BackendConfig) Processor {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, DMARC())
+		if err := Svc.initialize(config); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	newEnvelope := func(from, mailFrom, spf string, dkimDomain interface{}) *mail.Envelope {
+		e := mail.NewEnvelope("192.0.2.10", 1)
+		e.Helo = "client.test"
+		e.MailFrom, _ = mail.NewAddress(mailFrom)
+		e.Values["spf_result"] = spf
+		if dkimDomain != nil {
+			e.Values["dkim_result"] = "pass"
+			e.Values["dkim_domain"] = dkimDomain
+		}
+		e.Data.WriteString("From: Sender <" + from + ">\nSubject: test\n\nhello\n")
+		return e
+	}
+	p := newProcessor(BackendConfig{"dmarc_enforce": true})
+
+	for _, test := range []struct {
+		name, from, mailFrom, spf string
+		dkimDomain                interface{}
+		result, policy            string
+		rejected                  bool
+	}{
+		{"aligned spf", "jane@example.com", "jane@example.com", SPFPass, nil, DMARCPass, DMARCPolicyReject, false},
+		{"aligned dkim", "jane@example.com", "bounce@esp.test", SPFPass, []string{"esp.test", "example.com"}, DMARCPass, DMARCPolicyReject, false},
+		// no record for news.example.com, the one of example.com is used with its subdomain policy
+		{"relaxed spf", "jane@news.example.com", "bounce@mail.example.com", SPFPass, nil, DMARCPass, DMARCPolicyQuarantine, false},
+		{"relaxed dkim", "jane@news.example.com", "bounce@esp.test", SPFPass, "example.com", DMARCPass, DMARCPolicyQuarantine, false},
+		{"strict spf", "jane@example.org", "bounce@mail.example.org", SPFPass, nil, DMARCFail, DMARCPolicyReject, true},
+		{"strict dkim", "jane@example.org", "jane@example.org", SPFFail, "mail.example.org", DMARCFail, DMARCPolicyReject, true},
+		{"reject", "jane@example.com", "jane@example.com", SPFFail, "example.net", DMARCFail, DMARCPolicyReject, true},
+		{"public suffix", "jane@shop.example.co.uk", "jane@example.co.uk", SPFPass, nil, DMARCPass, DMARCPolicyNone, false},
+		{"no record", "jane@example.info", "jane@example.info", SPFFail, nil, DMARCNone, "", false},
+		{"temperror", "jane@example.net", "jane@example.net", SPFPass, nil, DMARCTempError, "", false},
+	} {
+		e := newEnvelope(test.from, test.mailFrom, test.spf, test.dkimDomain)
+		result, err := p.Process(e, TaskSaveMail)
+		if e.Values["dmarc_result"] != test.result || e.Values["dmarc_policy"] != test.policy {
+			t.Errorf("%s: expecting %s with policy %q, got %v with policy %q",
+				test.name, test.result, test.policy, e.Values["dmarc_result"], e.Values["dmarc_policy"])
+		}
+		if test.rejected && (err == nil || result.Code() != 550) {
+			t.Errorf("%s: expecting a 550, got %v", test.name, result)
+		}
+		if !test.rejected && err != nil {
+			t.Errorf("%s: expecting the message to be accepted, got %v", test.name, err)
+		}
+	}
+
+	// only example.com asked for reports
+	if len(reporter.results) != 5 || reporter.results[0].SourceIP != "192.0.2.10" {
+		t.Error("expecting 5 reports, got", len(reporter.results))
+	}
+
+	// report only
+	p = newProcessor(BackendConfig{})
+	e := newEnvelope("jane@example.com", "jane@example.com", SPFFail, nil)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting the message to be accepted when not enforcing, got", err)
+	}
+	if e.Values["dmarc_result"] != DMARCFail || e.Values["dmarc_policy"] != DMARCPolicyReject {
+		t.Error("expecting the failure to be recorded, got", e.Values["dmarc_result"], e.Values["dmarc_policy"])
+	}
+
+	// quarantine
+	p = newProcessor(BackendConfig{"dmarc_enforce": true})
+	e = newEnvelope("jane@news.example.com", "jane@example.net", SPFPass, nil)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting a quarantined message to be accepted, got", err)
+	}
+	if e.Values["quarantine"] != "dmarc" {
+		t.Error("expecting the message to be quarantined, got", e.Values["quarantine"])
+	}
+}
+
+func TestParseDMARCRecord(t *testing.T) {
+	r, err := ParseDMARCRecord("v=DMARC1; p=quarantine; pct=20; adkim=s; rua=mailto:a@example.com, mailto:b@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Policy != DMARCPolicyQuarantine || r.SubdomainPolicy != DMARCPolicyQuarantine || r.Percent != 20 ||
+		!r.StrictDKIM || r.StrictSPF || len(r.AggregateReports) != 2 {
+		t.Errorf("unexpected record %+v", r)
+	}
+	for _, txt := range []string{"v=DMARC2; p=reject", "p=reject", "v=DMARC1; p=bounce", "v=DMARC1; pct=101; p=none", "v=DMARC1"} {
+		if _, err := ParseDMARCRecord(txt); err == nil {
+			t.Errorf("expecting %q to be invalid", txt)
+		}
+	}
+	if r, err := ParseDMARCRecord("v=DMARC1; rua=mailto:a@example.com"); err != nil || r.Policy != DMARCPolicyNone {
+		t.Error("expecting a record with only rua to have policy none, got", r, err)
+	}
+}
@@ -0,0 +1,256 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: dnsbl
+// ----------------------------------------------------------------------------------
+// Description   : Checks the client's IP address against DNS blocklists, such as
+//               : zen.spamhaus.org. The lists are queried concurrently, and the results
+//               : cached for each address. In reject mode, listed clients get a 550 at
+//               : RCPT when placed in validate_process, or after DATA in save_process
+// ----------------------------------------------------------------------------------
+// Config Options: dnsbl_lists string - comma separated blocklist zones, eg.
+//               : "zen.spamhaus.org, bl.spamcop.net"
+//               : dnsbl_mode string - "reject" listed clients, or only "tag" them,
+//               : default "tag"
+//               : dnsbl_timeout string - time allowed for each lookup, default "2s"
+//               : dnsbl_cache_ttl string - how long results are cached, default "5m"
+//               : dnsbl_resolver string - address of the DNS resolver to use, eg.
+//               : "127.0.0.1:53", default is the system's resolver
+//               : dnsbl_circuit_* - the circuit breaker on the lookups, a failed lookup
+//               : on any list counts as a failure. See CircuitConfig
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["dnsbl_hits"] is set to the lists the client is on, a []string
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["dnsbl"] = func() Decorator {
+		return DNSBL()
+	}
+}
+
+type dnsblConfig struct {
+	Lists    string `json:"dnsbl_lists"`
+	Mode     string `json:"dnsbl_mode,omitempty"`
+	Timeout  string `json:"dnsbl_timeout,omitempty"`
+	CacheTTL string `json:"dnsbl_cache_ttl,omitempty"`
+	Resolver string `json:"dnsbl_resolver,omitempty"`
+}
+
+// DNSBLResolver looks up the A records of blocklist entries. *net.Resolver implements it
+type DNSBLResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+const (
+	dnsblModeTag    = "tag"
+	dnsblModeReject = "reject"
+
+	defaultDNSBLTimeout  = time.Second * 2
+	defaultDNSBLCacheTTL = time.Minute * 5
+)
+
+// errDNSBLIncomplete counts a lookup that failed on any list as a failure of the circuit breaker
+var errDNSBLIncomplete = errors.New("dnsbl lookup incomplete")
+
+// newDNSBLResolver returns the resolver at address, can be replaced in tests
+var newDNSBLResolver = func(address string) DNSBLResolver {
+	return dnsResolver(address)
+}
+
+func DNSBL() Decorator {
+	var (
+		config   *dnsblConfig
+		lists    []string
+		resolver DNSBLResolver
+		timeout  time.Duration
+		cacheTTL time.Duration
+		// cache holds the comma separated hits of each address
+		cache   KVStore
+		circuit *CircuitBreaker
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&dnsblConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*dnsblConfig)
+		lists = lists[:0]
+		for _, list := range strings.Split(config.Lists, ",") {
+			if list = strings.Trim(strings.TrimSpace(list), "."); list != "" {
+				lists = append(lists, list)
+			}
+		}
+		if len(lists) == 0 {
+			return convertError("property missing: 'dnsbl_lists'")
+		}
+		switch config.Mode {
+		case "":
+			config.Mode = dnsblModeTag
+		case dnsblModeTag, dnsblModeReject:
+		default:
+			return convertError("property invalid: 'dnsbl_mode' must be \"reject\" or \"tag\"")
+		}
+		timeout, cacheTTL = defaultDNSBLTimeout, defaultDNSBLCacheTTL
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return convertError("property invalid: 'dnsbl_timeout' must be a duration, eg. \"2s\"")
+			}
+		}
+		if config.CacheTTL != "" {
+			if cacheTTL, err = time.ParseDuration(config.CacheTTL); err != nil || cacheTTL < 0 {
+				return convertError("property invalid: 'dnsbl_cache_ttl' must be a duration, eg. \"5m\"")
+			}
+		}
+		if config.Resolver != "" {
+			if _, _, err := net.SplitHostPort(config.Resolver); err != nil {
+				return convertError("property invalid: 'dnsbl_resolver' must be a host:port address")
+			}
+		}
+		resolver = newDNSBLResolver(config.Resolver)
+		cache = NewMemoryKVStore()
+		circuitConfig, err := NewCircuitConfig("dnsbl", backendConfig)
+		if err != nil {
+			return err
+		}
+		circuit = NewCircuitBreaker("dnsbl", circuitConfig)
+		return nil
+	}))
+
+	// check returns the lists ip is on
+	check := func(ip string) ([]string, error) {
+		if cached, ok, _ := cache.Get(ip); ok {
+			if cached == "" {
+				return []string{}, nil
+			}
+			return strings.Split(cached, ","), nil
+		}
+		var hits []string
+		err := circuit.Do(func() error {
+			var complete bool
+			if hits, complete = dnsblLookup(resolver, lists, ip, timeout); !complete {
+				return errDNSBLIncomplete
+			}
+			return nil
+		})
+		if err == ErrCircuitOpen {
+			return []string{}, err
+		}
+		if err == nil && cacheTTL > 0 {
+			_ = cache.Set(ip, strings.Join(hits, ","), cacheTTL)
+		}
+		return hits, nil
+	}
+
+	// listed checks the client once for the envelope
+	listed := func(e *mail.Envelope) (bool, error) {
+		hits, ok := e.Values["dnsbl_hits"].([]string)
+		if !ok {
+			var err error
+			if hits, err = check(e.RemoteIP); err != nil && !circuit.FailOpen() {
+				return false, err
+			}
+			e.Values["dnsbl_hits"] = hits
+			if len(hits) > 0 {
+				EnvelopeLog(e).Infof("[%s] is listed by %s", e.RemoteIP, strings.Join(hits, ", "))
+			}
+		}
+		return len(hits) > 0 && config.Mode == dnsblModeReject, nil
+	}
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt || task == TaskSaveMail {
+				rejected, err := listed(e)
+				if err != nil {
+					return NewResult(response.Canned.ErrorDependencyDown, " ", err), err
+				}
+				if rejected {
+					return NewResult(response.Canned.FailDNSBL, " ", Blocklisted), Blocklisted
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// dnsblLookup queries all the lists at the same time, returning the lists ip is on, in the
+// order of lists. complete is false if any lookup failed, eg. timed out
+func dnsblLookup(resolver DNSBLResolver, lists []string, ip string, timeout time.Duration) (hits []string, complete bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return []string{}, true
+	}
+	reversed := reverseIP(addr)
+	listed := make([]bool, len(lists))
+	failed := make([]bool, len(lists))
+	var wg sync.WaitGroup
+	for i := range lists {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			addrs, err := resolver.LookupIPAddr(ctx, reversed+"."+lists[i])
+			if err != nil {
+				if dnsErr, ok := err.(*net.DNSError); !ok || dnsErr.Err != "no such host" {
+					Log().WithError(err).Warnf("dnsbl lookup of %s on %s failed", ip, lists[i])
+					failed[i] = true
+				}
+				return
+			}
+			for _, a := range addrs {
+				a4 := a.IP.To4()
+				if a4 == nil || a4[0] != 127 {
+					continue
+				}
+				if a4[1] == 255 && a4[2] == 255 {
+					// 127.255.255.x are errors from the list, eg. the query was refused
+					Log().Warnf("dnsbl %s refused the query for %s: %s", lists[i], ip, a4)
+					failed[i] = true
+					return
+				}
+				listed[i] = true
+			}
+		}(i)
+	}
+	wg.Wait()
+	hits, complete = []string{}, true
+	for i, list := range lists {
+		if listed[i] {
+			hits = append(hits, list)
+		}
+		if failed[i] {
+			complete = false
+		}
+	}
+	return hits, complete
+}
+
+// reverseIP returns the labels of ip in reverse order, as used for reverse and blocklist
+// lookups: "4.3.2.1" for 1.2.3.4, reversed nibbles for IPv6
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPv4(ip4[3], ip4[2], ip4[1], ip4[0]).String()
+	}
+	const hexDigits = "0123456789abcdef"
+	ip16 := ip.To16()
+	nibbles := make([]byte, 0, 64)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, hexDigits[ip16[i]&0xf], '.', hexDigits[ip16[i]>>4], '.')
+	}
+	return string(nibbles[:len(nibbles)-1])
+}
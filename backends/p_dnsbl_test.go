@@ -0,0 +1,136 @@
+package backends
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// stubDNSBLResolver answers from crafted listings and counts the lookups
+type stubDNSBLResolver struct {
+	listings map[string]string
+	lookups  int
+	sync.Mutex
+}
+
+func (r *stubDNSBLResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.Lock()
+	r.lookups++
+	r.Unlock()
+	if a, ok := r.listings[host]; ok {
+		return []net.IPAddr{{IP: net.ParseIP(a)}}, nil
+	}
+	if host == "2.0.0.127.down.example" {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host}
+}
+
+func TestDNSBLProcessor(t *testing.T) {
+	r := &stubDNSBLResolver{
+		listings: map[string]string{
+			"2.0.0.127.zen.example":    "127.0.0.2",
+			"2.0.0.127.bl.example":     "127.0.0.4",
+			"7.2.0.192.bl.example":     "127.0.0.3",
+			"7.2.0.192.refuse.example": "127.255.255.254",
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example": "127.0.0.10",
+		},
+	}
+	defer func(f func(string) DNSBLResolver) { newDNSBLResolver = f }(newDNSBLResolver)
+	newDNSBLResolver = func(address string) DNSBLResolver {
+		return r
+	}
+	newProcessor := func(config BackendConfig) Processor {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, DNSBL())
+		if err := Svc.initialize(config); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	hits := func(e *mail.Envelope) string {
+		h, _ := e.Values["dnsbl_hits"].([]string)
+		s := ""
+		for _, list := range h {
+			s += list + ";"
+		}
+		return s
+	}
+
+	// tag only
+	p := newProcessor(BackendConfig{"dnsbl_lists": "zen.example, bl.example, refuse.example"})
+	for ip, expect := range map[string]string{
+		"127.0.0.2":    "zen.example;bl.example;",
+		"192.0.2.7":    "bl.example;",
+		"198.51.100.1": "",
+		"2001:db8::1":  "zen.example;",
+	} {
+		e := mail.NewEnvelope(ip, 1)
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Error(ip, "expecting the message to be saved in tag mode", err)
+		}
+		if got := hits(e); got != expect {
+			t.Errorf("%s: expecting hits %q, got %q", ip, expect, got)
+		}
+	}
+
+	// reject at RCPT, the results are cached
+	p = newProcessor(BackendConfig{"dnsbl_lists": "zen.example, down.example", "dnsbl_mode": "reject"})
+	lookups := r.lookups
+	e := mail.NewEnvelope("198.51.100.1", 1)
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Error("expecting an unlisted client to be accepted", err)
+	}
+	for i := 0; i < 2; i++ {
+		e = mail.NewEnvelope("127.0.0.2", 1)
+		result, err := p.Process(e, TaskValidateRcpt)
+		if err != Blocklisted {
+			t.Error("expecting a listed client to be rejected, got", err)
+		} else if result.Code() != 550 {
+			t.Error("expecting a 550, got", result)
+		}
+		if got := hits(e); got != "zen.example;" {
+			t.Error("expecting the hits to be recorded, got", got)
+		}
+	}
+	e = mail.NewEnvelope("198.51.100.1", 2)
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Error("expecting an unlisted client to be accepted", err)
+	}
+	// the failed down.example lookup for 127.0.0.2 is not cached
+	if n := r.lookups - lookups; n != 6 {
+		t.Error("expecting 6 lookups, got", n)
+	}
+
+	// the circuit opens after the failed lookup, messages are deferred unless it fails open
+	for _, failOpen := range []bool{false, true} {
+		p = newProcessor(BackendConfig{
+			"dnsbl_lists":             "down.example",
+			"dnsbl_mode":              "reject",
+			"dnsbl_circuit_threshold": 1,
+			"dnsbl_circuit_fail_open": failOpen,
+		})
+		if _, err := p.Process(mail.NewEnvelope("127.0.0.2", 1), TaskValidateRcpt); err != nil {
+			t.Error("expecting the failed lookup to be let through", err)
+		}
+		lookups = r.lookups
+		result, err := p.Process(mail.NewEnvelope("198.51.100.1", 1), TaskValidateRcpt)
+		if r.lookups != lookups {
+			t.Error("expecting no lookup while the circuit is open")
+		}
+		if failOpen && err != nil {
+			t.Error("expecting the message to be accepted when failing open, got", err)
+		} else if !failOpen && (err != ErrCircuitOpen || result.Code() != 451) {
+			t.Error("expecting a 451 while the circuit is open, got", result, err)
+		}
+	}
+
+	Svc.reset()
+	_ = Decorate(DefaultProcessor{}, DNSBL())
+	if err := Svc.initialize(BackendConfig{"dnsbl_lists": "zen.example", "dnsbl_mode": "block"}); err == nil {
+		t.Error("expecting an invalid mode to be rejected")
+	}
+}
@@ -0,0 +1,194 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: eightbitpolicy
+// ----------------------------------------------------------------------------------
+// Description   : Detects 8-bit data sent without BODY=8BITMIME (or BINARYMIME) on the
+//               : MAIL command. Bytes above 127 inside MIME parts declaring an 8bit or
+//               : binary Content-Transfer-Encoding are not counted.
+// ----------------------------------------------------------------------------------
+// Config Options: eightbit_policy string - one of:
+//               : "flag" - (default) accept and set the flag on the envelope
+//               : "reject" - reject the message with a 554
+//               : "note" - accept and add an X-Content-Type-Note header
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.MailFrom.PathParams
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["8bit_undeclared"] is set to true when detected
+//               : e.DeliveryHeader may have a header appended, so place this
+//               : processor after the Header processor
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["eightbitpolicy"] = func() Decorator {
+		return EightBitPolicy()
+	}
+}
+
+type eightBitPolicyConfig struct {
+	Policy string `json:"eightbit_policy,omitempty"`
+}
+
+const (
+	eightBitFlag   = "flag"
+	eightBitReject = "reject"
+	eightBitNote   = "note"
+)
+
+func EightBitPolicy() Decorator {
+	var config *eightBitPolicyConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&eightBitPolicyConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*eightBitPolicyConfig)
+		config.Policy = strings.ToLower(strings.TrimSpace(config.Policy))
+		switch config.Policy {
+		case "":
+			config.Policy = eightBitFlag
+		case eightBitFlag, eightBitReject, eightBitNote:
+		default:
+			return errors.New("eightbit_policy must be one of flag, reject or note")
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if declared8Bit(e.MailFrom.PathParams) || !hasUndeclared8Bit(e.Data.Bytes()) {
+					return p.Process(e, task)
+				}
+				e.Values["8bit_undeclared"] = true
+				switch config.Policy {
+				case eightBitReject:
+					return NewResult(response.Canned.FailUndeclared8Bit), errors.New("8-bit data without BODY=8BITMIME")
+				case eightBitNote:
+					e.DeliveryHeader += "X-Content-Type-Note: 8-bit data received without BODY=8BITMIME\n"
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// declared8Bit returns true if the BODY parameter of the MAIL command declared 8-bit content
+func declared8Bit(params [][]string) bool {
+	for _, param := range params {
+		if len(param) == 2 && strings.EqualFold(param[0], "BODY") {
+			return strings.EqualFold(param[1], "8BITMIME") || strings.EqualFold(param[1], "BINARYMIME")
+		}
+	}
+	return false
+}
+
+// hasUndeclared8Bit scans the message line by line for bytes greater than 127,
+// skipping the bodies of MIME parts that have an 8bit or binary Content-Transfer-Encoding
+func hasUndeclared8Bit(data []byte) bool {
+	if !has8Bit(data) {
+		return false
+	}
+	var (
+		boundaries []string
+		inHeader   = true
+		header     string // the current header being read, unfolded
+		cte        string
+		boundary   string
+	)
+	endHeader := func() {
+		if i := strings.Index(header, ":"); i > 0 {
+			name := strings.ToLower(strings.TrimSpace(header[:i]))
+			value := strings.TrimSpace(header[i+1:])
+			switch name {
+			case "content-transfer-encoding":
+				cte = strings.ToLower(value)
+			case "content-type":
+				if _, params, err := mime.ParseMediaType(value); err == nil {
+					boundary = params["boundary"]
+				}
+			}
+		}
+		header = ""
+	}
+	for len(data) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i > -1 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+		line = bytes.TrimRight(line, "\r")
+		if inHeader {
+			if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+				header += string(line)
+			} else {
+				endHeader()
+				header = string(line)
+			}
+			if has8Bit(line) {
+				return true
+			}
+			if len(line) == 0 {
+				inHeader = false
+				if boundary != "" {
+					boundaries = append(boundaries, boundary)
+					boundary = ""
+				}
+			}
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("--")) {
+			// a part delimiter of any of the enclosing multiparts starts a new part
+			isDelimiter := false
+			for j := len(boundaries) - 1; j >= 0; j-- {
+				b := boundaries[j]
+				if bytes.HasPrefix(line[2:], []byte(b)) {
+					isDelimiter = true
+					if bytes.HasPrefix(line[2+len(b):], []byte("--")) {
+						// close delimiter; the multipart ended, back to its parent's epilogue
+						boundaries = boundaries[:j]
+						cte = ""
+					} else {
+						boundaries = boundaries[:j+1]
+						inHeader = true
+						cte = ""
+					}
+					break
+				}
+			}
+			if isDelimiter {
+				continue
+			}
+		}
+		if cte == "8bit" || cte == "binary" {
+			continue
+		}
+		if has8Bit(line) {
+			return true
+		}
+	}
+	return false
+}
+
+func has8Bit(b []byte) bool {
+	for i := range b {
+		if b[i] > 127 {
+			return true
+		}
+	}
+	return false
+}
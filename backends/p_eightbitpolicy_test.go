@@ -0,0 +1,105 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestHasUndeclared8Bit(t *testing.T) {
+	plain := "Subject: hello\n\nJust ASCII here\n"
+	if hasUndeclared8Bit([]byte(plain)) {
+		t.Error("ASCII message should not be flagged")
+	}
+	body := "Subject: hello\n\nCaf\xc3\xa9\n"
+	if !hasUndeclared8Bit([]byte(body)) {
+		t.Error("8-bit body without a declared encoding should be flagged")
+	}
+	header := "Subject: Caf\xc3\xa9\n\nhello\n"
+	if !hasUndeclared8Bit([]byte(header)) {
+		t.Error("8-bit header should be flagged")
+	}
+	declared := "Subject: hello\nContent-Type: multipart/mixed;\n boundary=\"XYZ\"\n\n" +
+		"--XYZ\nContent-Type: text/plain\nContent-Transfer-Encoding: 8bit\n\nCaf\xc3\xa9\n" +
+		"--XYZ\nContent-Type: text/plain\nContent-Transfer-Encoding: 7bit\n\nplain\n" +
+		"--XYZ--\n"
+	if hasUndeclared8Bit([]byte(declared)) {
+		t.Error("8-bit data inside a part declaring 8bit should not be flagged")
+	}
+	undeclared := "Subject: hello\nContent-Type: multipart/mixed; boundary=XYZ\n\n" +
+		"--XYZ\nContent-Type: text/plain\nContent-Transfer-Encoding: 8bit\n\nplain\n" +
+		"--XYZ\nContent-Type: text/plain\n\nCaf\xc3\xa9\n" +
+		"--XYZ--\n"
+	if !hasUndeclared8Bit([]byte(undeclared)) {
+		t.Error("8-bit data in a 7bit part should be flagged")
+	}
+	if !declared8Bit([][]string{{"SIZE", "100"}, {"BODY", "8bitmime"}}) {
+		t.Error("BODY=8BITMIME should be detected")
+	}
+}
+
+func TestEightBitPolicyProcessor(t *testing.T) {
+	newProcessor := func(policy string) Processor {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, EightBitPolicy())
+		if err := Svc.initialize(BackendConfig{"eightbit_policy": policy}); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	newEnvelope := func(body string, params [][]string) *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.MailFrom = mail.Address{User: "test", Host: "example.com", PathParams: params}
+		e.Data.WriteString("Subject: test\n\n" + body + "\n")
+		return e
+	}
+	declared := [][]string{{"BODY", "8BITMIME"}}
+
+	for _, policy := range []string{"flag", "reject", "note"} {
+		p := newProcessor(policy)
+		for _, e := range []*mail.Envelope{newEnvelope("plain", nil), newEnvelope("Caf\xc3\xa9", declared)} {
+			if _, err := p.Process(e, TaskSaveMail); err != nil {
+				t.Error(policy, "expecting the message to be accepted", err)
+			}
+			if e.Values["8bit_undeclared"] != nil || e.DeliveryHeader != "" {
+				t.Error(policy, "expecting the message to be left alone, got", e.DeliveryHeader)
+			}
+		}
+	}
+
+	// flag
+	p := newProcessor("")
+	e := newEnvelope("Caf\xc3\xa9", nil)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting a flagged message to be saved", err)
+	}
+	if e.Values["8bit_undeclared"] != true || e.DeliveryHeader != "" {
+		t.Error("expecting only the flag to be set, got", e.Values["8bit_undeclared"], e.DeliveryHeader)
+	}
+
+	// reject
+	p = newProcessor("reject")
+	e = newEnvelope("Caf\xc3\xa9", nil)
+	if result, err := p.Process(e, TaskSaveMail); err == nil || result.Code() != 554 {
+		t.Error("expecting a 554, got", result, err)
+	}
+
+	// note
+	p = newProcessor("note")
+	e = newEnvelope("Caf\xc3\xa9", nil)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting a noted message to be saved", err)
+	}
+	if expect := "X-Content-Type-Note: 8-bit data received without BODY=8BITMIME\n"; e.DeliveryHeader != expect {
+		t.Errorf("expecting %q, got %q", expect, e.DeliveryHeader)
+	}
+	if e.Values["8bit_undeclared"] != true {
+		t.Error("expecting the flag to be set with note")
+	}
+
+	Svc.reset()
+	_ = Decorate(DefaultProcessor{}, EightBitPolicy())
+	if err := Svc.initialize(BackendConfig{"eightbit_policy": "strip"}); err == nil {
+		t.Error("expecting an invalid policy to be rejected")
+	}
+}
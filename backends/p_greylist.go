@@ -0,0 +1,125 @@
+package backends
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: greylist
+// ----------------------------------------------------------------------------------
+// Description   : Greylists each (client IP, MAIL FROM, RCPT TO) triplet: the first
+//               : attempt is deferred with a 451, and retries are accepted once the
+//               : delay has passed. Place it in validate_process to defer at RCPT,
+//               : or in save_process to defer the message after DATA.
+//               : The triplets are kept in the shared KVStore, in memory unless
+//               : kv_redis_interface is set
+// ----------------------------------------------------------------------------------
+// Config Options: greylist_delay string - how long a new triplet is deferred, default "5m"
+//               : greylist_ttl string - triplets not seen for this long are forgotten,
+//               : default "168h"
+//               : greylist_allowlist string - comma separated IP addresses and CIDR
+//               : ranges that are never greylisted, eg. "192.0.2.0/24, 2001:db8::1"
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP, e.MailFrom, e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["greylist"] is set to "pass" or "allowlist" for accepted messages
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["greylist"] = func() Decorator {
+		return Greylist()
+	}
+}
+
+type greylistConfig struct {
+	Delay     string `json:"greylist_delay,omitempty"`
+	TTL       string `json:"greylist_ttl,omitempty"`
+	Allowlist string `json:"greylist_allowlist,omitempty"`
+}
+
+const (
+	defaultGreylistDelay = time.Minute * 5
+	defaultGreylistTTL   = time.Hour * 168
+)
+
+func Greylist() Decorator {
+	var (
+		greylister *Greylister
+		allowlist  []*net.IPNet
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&greylistConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*greylistConfig)
+		delay, ttl := defaultGreylistDelay, defaultGreylistTTL
+		if config.Delay != "" {
+			if delay, err = time.ParseDuration(config.Delay); err != nil || delay < 0 {
+				return convertError("property invalid: 'greylist_delay' must be a duration, eg. \"5m\"")
+			}
+		}
+		if config.TTL != "" {
+			if ttl, err = time.ParseDuration(config.TTL); err != nil || ttl <= 0 {
+				return convertError("property invalid: 'greylist_ttl' must be a duration, eg. \"168h\"")
+			}
+		}
+		if allowlist, err = ParseNetworks(strings.Split(config.Allowlist, ",")); err != nil {
+			return convertError("property invalid: 'greylist_allowlist', " + err.Error())
+		}
+		store, err := NewKVStore(backendConfig)
+		if err != nil {
+			return err
+		}
+		greylister = NewGreylister(store, delay, ttl)
+		return nil
+	}))
+
+	// check greylists the recipients, deferring at the first one not accepted yet
+	check := func(e *mail.Envelope, rcpts []mail.Address) (Result, error) {
+		if InNetworks(allowlist, net.ParseIP(e.RemoteIP)) {
+			e.Values["greylist"] = "allowlist"
+			return nil, nil
+		}
+		for i := range rcpts {
+			passed, retryAfter, err := greylister.Check(e.RemoteIP, e.MailFrom.String(), rcpts[i].String())
+			if err != nil {
+				EnvelopeLog(e).WithError(err).Error("greylist store failed")
+				return NewResult(response.Canned.ErrorRcptStorage), StorageError
+			}
+			if !passed {
+				EnvelopeLog(e).Infof("greylisted [%s] %s -> %s, retry in %s",
+					e.RemoteIP, e.MailFrom.String(), rcpts[i].String(), retryAfter)
+				return NewResult(response.Canned.ErrorGreylisted), Greylisted
+			}
+		}
+		e.Values["greylist"] = "pass"
+		return nil, nil
+	}
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt {
+				// the recipient being validated is the last one added
+				if len(e.RcptTo) > 0 {
+					if result, err := check(e, e.RcptTo[len(e.RcptTo)-1:]); err != nil {
+						return result, err
+					}
+				}
+				return p.Process(e, task)
+			} else if task == TaskSaveMail {
+				if result, err := check(e, e.RcptTo); err != nil {
+					return result, err
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestGreylister(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryKVStore()
+	store.now = func() time.Time { return now }
+	g := NewGreylister(store, time.Minute*5, time.Hour)
+	g.now = store.now
+
+	// first delivery is deferred, and so is an early retry
+	if passed, retryAfter, err := g.Check("192.0.2.1", "sender@example.com", "rcpt@test.com"); err != nil || passed {
+		t.Error("expecting the first attempt to be deferred", err)
+	} else if retryAfter != time.Minute*5 {
+		t.Error("expecting to retry after the delay, got", retryAfter)
+	}
+	now = now.Add(time.Minute * 2)
+	if passed, retryAfter, _ := g.Check("192.0.2.1", "sender@example.com", "rcpt@test.com"); passed {
+		t.Error("expecting a retry before the delay to be deferred")
+	} else if retryAfter != time.Minute*3 {
+		t.Error("expecting to retry after 3m, got", retryAfter)
+	}
+
+	// a retry after the delay is accepted, the triplet is case-insensitive
+	now = now.Add(time.Minute * 3)
+	if passed, _, err := g.Check("192.0.2.1", "Sender@Example.com", "rcpt@test.com"); err != nil || !passed {
+		t.Error("expecting a retry after the delay to be accepted", err)
+	}
+
+	// the triplet is only accepted for the same client IP
+	if passed, _, _ := g.Check("192.0.2.2", "sender@example.com", "rcpt@test.com"); passed {
+		t.Error("expecting a new triplet to be deferred")
+	}
+
+	// accepted triplets are kept for the ttl from when they were last seen
+	now = now.Add(time.Minute * 50)
+	if passed, _, _ := g.Check("192.0.2.1", "sender@example.com", "rcpt@test.com"); !passed {
+		t.Error("expecting the triplet to be remembered")
+	}
+	now = now.Add(time.Hour)
+	if passed, _, _ := g.Check("192.0.2.1", "sender@example.com", "rcpt@test.com"); passed {
+		t.Error("expecting the triplet to expire after the ttl")
+	}
+}
+
+func TestGreylistProcessor(t *testing.T) {
+	// a store of our own, so that triplets from other tests are not seen
+	kvStoresLock.Lock()
+	kvStores[""] = NewMemoryKVStore()
+	kvStoresLock.Unlock()
+	defer func() {
+		kvStoresLock.Lock()
+		delete(kvStores, "")
+		kvStoresLock.Unlock()
+	}()
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, Greylist())
+	err := Svc.initialize(BackendConfig{
+		"greylist_delay":     "0s",
+		"greylist_allowlist": "198.51.100.0/24, 2001:db8::1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEnvelope := func(ip string) *mail.Envelope {
+		e := mail.NewEnvelope(ip, 1)
+		e.MailFrom = mail.Address{User: "sender", Host: "example.com"}
+		e.RcptTo = append(e.RcptTo, mail.Address{User: "rcpt", Host: "test.com"})
+		return e
+	}
+
+	// first delivery is deferred, the retry is accepted
+	e := newEnvelope("192.0.2.1")
+	if result, err := p.Process(e, TaskValidateRcpt); err != Greylisted {
+		t.Error("expecting the first delivery to be greylisted, got", err)
+	} else if result.Code() != 451 {
+		t.Error("expecting a 451, got", result)
+	}
+	e = newEnvelope("192.0.2.1")
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Error("expecting the retry to be accepted, got", err)
+	}
+	if _, err := p.Process(e, TaskSaveMail); err != nil || e.Values["greylist"] != "pass" {
+		t.Error("expecting the message to be saved", err, e.Values["greylist"])
+	}
+
+	// a new recipient for the message is deferred when saving
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "other", Host: "test.com"})
+	if result, err := p.Process(e, TaskSaveMail); err != Greylisted || result.Code() != 451 {
+		t.Error("expecting the new recipient to be greylisted, got", err, result)
+	}
+
+	// allowlisted addresses skip greylisting entirely
+	for _, ip := range []string{"198.51.100.7", "2001:db8::1"} {
+		e = newEnvelope(ip)
+		if _, err := p.Process(e, TaskValidateRcpt); err != nil || e.Values["greylist"] != "allowlist" {
+			t.Error("expecting", ip, "to be allowlisted, got", err)
+		}
+	}
+
+	Svc.reset()
+	_ = Decorate(DefaultProcessor{}, Greylist())
+	if err := Svc.initialize(BackendConfig{"greylist_allowlist": "192.0.2.0/33"}); err == nil {
+		t.Error("expecting an invalid allowlist to be rejected")
+	}
+}
@@ -425,7 +425,7 @@ func GuerrillaDbRedis() Decorator {
 				to = trimToLimit(strings.TrimSpace(e.RcptTo[0].User)+"@"+g.config.PrimaryHost, 255)
 				e.Helo = trimToLimit(e.Helo, 255)
 				e.RcptTo[0].Host = trimToLimit(e.RcptTo[0].Host, 255)
-				ts := fmt.Sprintf("%d", time.Now().UnixNano())
+				ts := fmt.Sprintf("%d", mail.DefaultClock.Now().UnixNano())
 				if err := e.ParseHeaders(); err != nil {
 					Log().WithError(err).Error("failed to parse headers")
 				}
@@ -440,7 +440,7 @@ func GuerrillaDbRedis() Decorator {
 				addHead += "Delivered-To: " + to + "\r\n"
 				addHead += "Received: from " + e.Helo + " (" + e.Helo + "  [" + e.RemoteIP + "])\r\n"
 				addHead += "	by " + e.RcptTo[0].Host + " with SMTP id " + hash + "@" + e.RcptTo[0].Host + ";\r\n"
-				addHead += "	" + time.Now().Format(time.RFC1123Z) + "\r\n"
+				addHead += "	" + mail.DefaultClock.Now().Format(time.RFC1123Z) + "\r\n"
 
 				// data will be compressed when printed, with addHead added to beginning
 
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"strings"
-	"time"
 
 	"github.com/flashmob/go-guerrilla/mail"
 )
@@ -37,7 +36,7 @@ func Hasher() Decorator {
 			if task == TaskSaveMail {
 				// base hash, use subject from and timestamp-nano
 				h := md5.New()
-				ts := fmt.Sprintf("%d", time.Now().UnixNano())
+				ts := fmt.Sprintf("%d", mail.DefaultClock.Now().UnixNano())
 				_, _ = io.Copy(h, strings.NewReader(e.MailFrom.String()))
 				_, _ = io.Copy(h, strings.NewReader(e.Subject))
 				_, _ = io.Copy(h, strings.NewReader(ts))
@@ -21,6 +21,8 @@ type HeaderConfig struct {
 //               : e.RemoteAddress
 //               : e.RcptTo
 //               : e.Hashes
+//               : e.TLSInfo
+//               : e.Values["trace_span"] - when tracing, a Traceparent header is added
 // ----------------------------------------------------------------------------------
 // Output        : Sets e.DeliveryHeader with additional delivery info
 // ----------------------------------------------------------------------------------
@@ -57,10 +59,17 @@ func Header() Decorator {
 				var addHead string
 				addHead += "Delivered-To: " + to + "\n"
 				addHead += "Received: from " + e.Helo + " (" + e.Helo + "  [" + e.RemoteIP + "])\n"
+				if e.TLS {
+					addHead += "	(" + e.TLSInfo.String() + ")\n"
+				}
 				if len(e.RcptTo) > 0 {
 					addHead += "	by " + e.RcptTo[0].Host + " with SMTP id " + hash + "@" + e.RcptTo[0].Host + ";\n"
 				}
-				addHead += "	" + time.Now().Format(time.RFC1123Z) + "\n"
+				addHead += "	" + mail.DefaultClock.Now().Format(time.RFC1123Z) + "\n"
+				if span := EnvelopeSpan(e); span != nil {
+					// so that downstream consumers can continue the trace
+					addHead += "Traceparent: " + span.TraceParent() + "\n"
+				}
 				// save the result
 				e.DeliveryHeader = addHead
 				// next processor
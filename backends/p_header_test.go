@@ -0,0 +1,49 @@
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestHeaderDeterministic(t *testing.T) {
+	defer func(c mail.Clock, g mail.IDGenerator) {
+		mail.DefaultClock, mail.DefaultIDGenerator = c, g
+	}(mail.DefaultClock, mail.DefaultIDGenerator)
+	mail.DefaultClock = mail.FixedClock(time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC))
+	mail.DefaultIDGenerator = &mail.SequenceIDGenerator{Prefix: "q"}
+
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, Header(), Hasher())
+	if err := Svc.initialize(BackendConfig{"primary_mail_host": "mx.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	if e.QueuedId != "q1" {
+		t.Error("expecting queued id q1, got", e.QueuedId)
+	}
+	e.Helo = "client.example.org"
+	e.MailFrom = mail.Address{User: "from", Host: "example.org"}
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "to", Host: "example.com"})
+	e.Data.WriteString("Subject: test\n\nhello\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	expect := "Delivered-To: to@mx.example.com\n" +
+		"Received: from client.example.org (client.example.org  [127.0.0.1])\n" +
+		"	by example.com with SMTP id " + e.Hashes[0] + "@example.com;\n" +
+		"	Mon, 04 Mar 2019 05:06:07 +0000\n"
+	if e.DeliveryHeader != expect {
+		t.Errorf("expecting header:\n%s\ngot:\n%s", expect, e.DeliveryHeader)
+	}
+	// same clock, same hash
+	hash := e.Hashes[0]
+	e.Hashes = nil
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	if e.Hashes[0] != hash {
+		t.Error("expecting the hash to be the same with a fixed clock")
+	}
+}
@@ -1,7 +1,11 @@
 package backends
 
 import (
+	"bytes"
+	"errors"
+
 	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
 )
 
 // ----------------------------------------------------------------------------------
@@ -9,11 +13,29 @@ import (
 // ----------------------------------------------------------------------------------
 // Description   : Parses the header using e.ParseHeaders()
 // ----------------------------------------------------------------------------------
-// Config Options: none
+// Config Options: default_charset string - charset assumed for text that does not
+//               : declare one, eg. "windows-1252". Default is "us-ascii"
+//               : max_header_count int - reject messages with more header fields
+//               : than this, 0 for no limit (default)
+//               : max_header_size int - reject messages with a header section larger
+//               : than this many bytes, 0 for no limit (default)
+//               : quarantine_on_parse_failure bool - accept messages exceeding the limits
+//               : or with headers that cannot be parsed, flagging them instead of
+//               : rejecting, so that they are stored for analysis. Default false
+//               : mime_attachments bool - walk the MIME parts and record the attachments
+//               : in e.Values["attachments"], for attachment policies. Default false
+//               : mime_max_depth int - reject messages with multiparts nested deeper than
+//               : this. Default 0, for mail.MaxPartDepth (10) when the parts are walked
+//               : mime_max_parts int - reject messages with more MIME parts than this,
+//               : 0 for no limit (default)
 // --------------:-------------------------------------------------------------------
 // Input         : envelope
 // ----------------------------------------------------------------------------------
 // Output        : Headers will be populated in e.Header
+//               : e.Values["content_type"] and e.Values["charset"] are set to the
+//               : message's media type and charset, with the defaults applied
+//               : e.Values["parse_failed"] is set to the error when quarantined
+//               : e.Values["attachments"] is set to a []mail.Attachment with mime_attachments
 // ----------------------------------------------------------------------------------
 func init() {
 	processors["headersparser"] = func() Decorator {
@@ -21,12 +43,87 @@ func init() {
 	}
 }
 
+type headersParserConfig struct {
+	DefaultCharset string `json:"default_charset,omitempty"`
+	MaxHeaderCount int    `json:"max_header_count,omitempty"`
+	MaxHeaderSize  int    `json:"max_header_size,omitempty"`
+	Quarantine     bool   `json:"quarantine_on_parse_failure,omitempty"`
+	Attachments    bool   `json:"mime_attachments,omitempty"`
+	MaxMIMEDepth   int    `json:"mime_max_depth,omitempty"`
+	MaxMIMEParts   int    `json:"mime_max_parts,omitempty"`
+}
+
+var (
+	errHeaderCountExceeded = errors.New("too many header fields")
+	errHeaderSizeExceeded  = errors.New("header section too large")
+)
+
 func HeadersParser() Decorator {
+	var config *headersParserConfig
+	var limits mail.PartLimits
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&headersParserConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*headersParserConfig)
+		limits = mail.PartLimits{
+			MaxDepth:       config.MaxMIMEDepth,
+			MaxParts:       config.MaxMIMEParts,
+			DefaultCharset: config.DefaultCharset,
+		}
+		return nil
+	}))
+
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 			if task == TaskSaveMail {
-				if err := e.ParseHeaders(); err != nil {
-					Log().WithError(err).Error("parse headers error")
+				if e.Values == nil {
+					e.Values = make(map[string]interface{})
+				}
+				if err := checkHeaderLimits(e.Data.Bytes(), config.MaxHeaderCount, config.MaxHeaderSize); err != nil {
+					if !config.Quarantine {
+						return NewResult(response.Canned.FailHeaderLimitExceeded), err
+					}
+					EnvelopeLog(e).WithError(err).Warn("header limits exceeded, quarantined")
+					e.Values["parse_failed"] = err.Error()
+					// the headers are not parsed, store the message as is
+					return p.Process(e, task)
+				}
+				if err := e.ParseHeadersCharset(config.DefaultCharset); err != nil {
+					EnvelopeLog(e).WithError(err).Error("parse headers error")
+					if config.Quarantine {
+						e.Values["parse_failed"] = err.Error()
+					}
+				}
+				if e.Header != nil {
+					mediaType, charset := mail.PartTypeCharset(e.Header, config.DefaultCharset)
+					e.Values["content_type"] = mediaType
+					e.Values["charset"] = charset
+				}
+				if config.Attachments || limits.MaxDepth > 0 || limits.MaxParts > 0 {
+					var attachments []mail.Attachment
+					var err error
+					if config.Attachments {
+						attachments, err = mail.Attachments(bytes.NewReader(e.Data.Bytes()), limits)
+					} else {
+						err = mail.WalkPartsLimited(bytes.NewReader(e.Data.Bytes()), limits, func(*mail.Part) error {
+							return nil
+						})
+					}
+					if err == mail.ErrPartDepthExceeded || err == mail.ErrPartCountExceeded {
+						if !config.Quarantine {
+							return NewResult(response.Canned.FailMIMELimitExceeded), err
+						}
+						EnvelopeLog(e).WithError(err).Warn("mime limits exceeded, quarantined")
+						e.Values["parse_failed"] = err.Error()
+					} else if err != nil {
+						EnvelopeLog(e).WithError(err).Debug("could not read all the mime parts")
+					}
+					if config.Attachments {
+						e.Values["attachments"] = attachments
+					}
 				}
 				// next processor
 				return p.Process(e, task)
@@ -37,3 +134,36 @@ func HeadersParser() Decorator {
 		})
 	}
 }
+
+// checkHeaderLimits scans the header section of the message and stops with an error as soon as
+// there are more than maxCount header fields, or more than maxSize bytes. Zero means no limit
+func checkHeaderLimits(data []byte, maxCount, maxSize int) error {
+	if maxCount <= 0 && maxSize <= 0 {
+		return nil
+	}
+	count, size := 0, 0
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i > -1 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+		size += len(line)
+		if maxSize > 0 && size > maxSize {
+			return errHeaderSizeExceeded
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			// end of the header section
+			return nil
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			// not a continuation of a folded header
+			count++
+			if maxCount > 0 && count > maxCount {
+				return errHeaderCountExceeded
+			}
+		}
+	}
+	return nil
+}
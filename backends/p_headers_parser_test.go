@@ -0,0 +1,198 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestHeadersParser(t *testing.T) {
+	Svc.reset()
+	var subject string
+	last := ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+		if e.Header != nil {
+			subject = e.Header.Get("Subject")
+		}
+		return BackendResultOK, nil
+	})
+	// messageid runs first, both work on the same *mail.Envelope
+	p := Decorate(last, HeadersParser(), MessageID())
+	if err := Svc.initialize(BackendConfig{"messageid_hostname": "mx.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: hello\nContent-Type: text/plain; charset=utf-8\n\nbody\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if subject != "hello" {
+		t.Error("expecting e.Header to be populated, got subject", subject)
+	}
+	if e.Header.Get("Message-ID") == "" {
+		t.Error("expecting e.Header to have the header added by messageid")
+	}
+	if e.Values["content_type"] != "text/plain" || e.Values["charset"] != "utf-8" {
+		t.Error("unexpected content type", e.Values["content_type"], e.Values["charset"])
+	}
+}
+
+// The default charset applies to this processor's messages only
+func TestHeadersParserDefaultCharset(t *testing.T) {
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, HeadersParser())
+	if err := Svc.initialize(BackendConfig{"default_charset": "windows-1252"}); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: caf\xe9 \x805\n\nbody\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if e.Subject != "café €5" || e.Values["charset"] != "windows-1252" {
+		t.Error("expecting the subject and body to be windows-1252, got", e.Subject, e.Values["charset"])
+	}
+	if mail.DefaultCharset != "us-ascii" {
+		t.Error("mail.DefaultCharset should not be changed, got", mail.DefaultCharset)
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	Svc.reset()
+	parsed := false
+	last := ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+		parsed = e.Header != nil
+		return BackendResultOK, nil
+	})
+	p := Decorate(last, HeadersParser())
+	if err := Svc.initialize(BackendConfig{"max_header_count": 100, "max_header_size": 4096}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a flood of tiny headers
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(strings.Repeat("X-A: b\n", 20000) + "\nbody\n")
+	result, err := p.Process(e, TaskSaveMail)
+	if err != errHeaderCountExceeded {
+		t.Error("expecting", errHeaderCountExceeded, "got", err)
+	}
+	if result.Code() != 552 {
+		t.Error("expecting a 552, got", result)
+	}
+	if parsed {
+		t.Error("the header flood should be rejected before the next processor")
+	}
+
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: test\nX-Big: " + strings.Repeat("a", 5000) + "\n\nbody\n")
+	if _, err = p.Process(e, TaskSaveMail); err != errHeaderSizeExceeded {
+		t.Error("expecting", errHeaderSizeExceeded, "got", err)
+	}
+
+	// folded lines count as one header and the body is not counted
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: test\n" + strings.Repeat(" folded\n", 150) + "\n" + strings.Repeat("X-A: b\n", 500))
+	if _, err = p.Process(e, TaskSaveMail); err != nil {
+		t.Error("message should have been accepted", err)
+	}
+	if !parsed {
+		t.Error("expecting the headers to be parsed")
+	}
+}
+
+func TestHeadersQuarantine(t *testing.T) {
+	Svc.reset()
+	saved := false
+	last := ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+		saved = true
+		return BackendResultOK, nil
+	})
+	p := Decorate(last, HeadersParser())
+	if err := Svc.initialize(BackendConfig{"max_header_count": 100, "quarantine_on_parse_failure": true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{
+		strings.Repeat("X-A: b\n", 1000) + "\nbody\n",
+		"Subject: test\nthis is not a header\n\nbody\n",
+		"no header section at all",
+	} {
+		saved = false
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString(data)
+		result, err := p.Process(e, TaskSaveMail)
+		if err != nil || result.Code() != 200 {
+			t.Error("expecting the message to be accepted, got", result, err)
+		}
+		if !saved {
+			t.Error("expecting the message to be passed on to be saved")
+		}
+		if reason, ok := e.Values["parse_failed"].(string); !ok || reason == "" {
+			t.Error("expecting parse_failed to be set for", data[:20])
+		}
+	}
+}
+
+func TestHeadersParserAttachments(t *testing.T) {
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, HeadersParser())
+	if err := Svc.initialize(BackendConfig{"mime_attachments": true}); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: test\n" +
+		"Content-Type: multipart/mixed; boundary=b\n\n" +
+		"--b\n" +
+		"Content-Type: text/plain\n\n" +
+		"hello\n" +
+		"--b\n" +
+		"Content-Type: application/pdf\n" +
+		"Content-Disposition: attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf\n" +
+		"Content-Transfer-Encoding: base64\n\n" +
+		"JVBERi0=\n" +
+		"--b\n" +
+		"Content-Type: application/zip\n" +
+		"Content-Disposition: attachment; filename=\"archive 2019.zip\"\n\n" +
+		"PK\n" +
+		"--b--\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	attachments, ok := e.Values["attachments"].([]mail.Attachment)
+	if !ok || len(attachments) != 2 {
+		t.Fatal("expecting 2 attachments, got", e.Values["attachments"])
+	}
+	if attachments[0].Filename != "résumé.pdf" || attachments[0].ContentType != "application/pdf" ||
+		attachments[1].Filename != "archive 2019.zip" || attachments[1].ContentType != "application/zip" {
+		t.Errorf("unexpected attachments %+v", attachments)
+	}
+}
+
+func TestHeadersParserMIMELimits(t *testing.T) {
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, HeadersParser())
+	if err := Svc.initialize(BackendConfig{"mime_max_depth": 20, "mime_max_parts": 500}); err != nil {
+		t.Fatal(err)
+	}
+	nested := "Subject: nested\nContent-Type: multipart/mixed; boundary=b0\n\n"
+	for i := 1; i <= 50; i++ {
+		nested += fmt.Sprintf("--b%d\nContent-Type: multipart/mixed; boundary=b%d\n\n", i-1, i)
+	}
+	nested += "--b50\n\nhello\n--b50--\n"
+	parts := "Subject: parts\nContent-Type: multipart/mixed; boundary=b\n\n" +
+		strings.Repeat("--b\n\nx\n", 5000) + "--b--\n"
+	for _, data := range []string{nested, parts} {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString(data)
+		result, err := p.Process(e, TaskSaveMail)
+		if err == nil || result.Code() != 554 {
+			t.Error("expecting a 554, got", result, err)
+		}
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: parts\nContent-Type: multipart/mixed; boundary=b\n\n" +
+		strings.Repeat("--b\n\nx\n", 10) + "--b--\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting the message to be accepted, got", err)
+	}
+}
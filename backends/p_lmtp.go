@@ -0,0 +1,219 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: lmtp
+// ----------------------------------------------------------------------------------
+// Description   : Hands the message to a local delivery agent, such as Dovecot or Cyrus,
+//               : over LMTP (RFC 2033). The agent replies for each recipient: the message
+//               : is accepted if at least one recipient was delivered to, the others are
+//               : logged and kept in e.Values["lmtp_failed"]. If none were, the reply of
+//               : the first recipient is returned, or of the first temporary failure if
+//               : any, so that the client tries again later
+// ----------------------------------------------------------------------------------
+// Config Options: lmtp_address string - "<host>:<port>", or the path of a unix socket,
+//               : eg. "/var/run/dovecot/lmtp"
+//               : lmtp_timeout string - time limit for the whole delivery, default "30s"
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.DeliveryHeader and e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["lmtp_failed"] is set to a map[string]string of the reply for
+//               : each recipient that was not delivered to, and e.Values[DSNKey] to the
+//               : DSN for the sender when the message was accepted
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["lmtp"] = func() Decorator {
+		return LMTP()
+	}
+}
+
+type lmtpConfig struct {
+	Address string `json:"lmtp_address"`
+	Timeout string `json:"lmtp_timeout,omitempty"`
+}
+
+const defaultLMTPTimeout = time.Second * 30
+
+func LMTP() Decorator {
+	var client *lmtpClient
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&lmtpConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*lmtpConfig)
+		if config.Address == "" {
+			return errors.New("lmtp_address is required")
+		}
+		client = &lmtpClient{address: config.Address, timeout: defaultLMTPTimeout}
+		if config.Timeout != "" {
+			if client.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+				return fmt.Errorf("invalid lmtp_timeout: %s", err)
+			}
+		}
+		if client.hostname, err = os.Hostname(); err != nil {
+			client.hostname = "localhost"
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				replies, err := client.deliver(e)
+				if err != nil {
+					EnvelopeLog(e).WithError(err).Error("lmtp delivery failed")
+					if tpErr, ok := err.(*textproto.Error); ok {
+						return NewResult(fmt.Sprintf("%d %s", tpErr.Code, tpErr.Msg)), err
+					}
+					return NewResult(response.Canned.FailBackendTransaction, response.SP, "lmtp delivery failed"), err
+				}
+				var delivered int
+				var failure *lmtpReply
+				failed := make(map[string]string)
+				for i := range replies {
+					r := &replies[i]
+					if r.code < 300 {
+						delivered++
+						continue
+					}
+					failed[r.rcpt] = r.String()
+					if failure == nil || (r.code < 500 && failure.code >= 500) {
+						failure = r
+					}
+				}
+				if len(failed) > 0 {
+					e.Values["lmtp_failed"] = failed
+					EnvelopeLog(e).WithField("failed", failed).Warnf("lmtp delivered to %d of %d recipients", delivered, len(replies))
+				}
+				if delivered == 0 && failure != nil {
+					return NewResult(failure.String()), errors.New("lmtp rejected all recipients")
+				}
+				if len(failed) > 0 {
+					// accepted, so the sender has to be told about the others
+					if dsn, err := DSNFor(e, failed); err == nil {
+						e.Values[DSNKey] = dsn
+					}
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// lmtpClient delivers messages over LMTP, with a new connection for each message
+type lmtpClient struct {
+	address  string
+	timeout  time.Duration
+	hostname string
+}
+
+// lmtpReply is the reply of the LMTP server for a recipient
+type lmtpReply struct {
+	rcpt string
+	code int
+	msg  string
+}
+
+func (r *lmtpReply) String() string {
+	return fmt.Sprintf("%d %s", r.code, r.msg)
+}
+
+// deliver sends the message and returns the reply for each recipient, either to RCPT,
+// or to DATA if the recipient was accepted. An error is returned if the transaction failed
+func (c *lmtpClient) deliver(e *mail.Envelope) (replies []lmtpReply, err error) {
+	network := "tcp"
+	if strings.HasPrefix(c.address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err = conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	text := textproto.NewConn(conn)
+	if _, _, err = text.ReadResponse(220); err != nil {
+		return nil, err
+	}
+	if err = lmtpCmd(text, 250, "LHLO %s", c.hostname); err != nil {
+		return nil, err
+	}
+	from := ""
+	if !e.MailFrom.NullPath && e.MailFrom.User != "" {
+		from = e.MailFrom.String()
+	}
+	if err = lmtpCmd(text, 250, "MAIL FROM:<%s>", from); err != nil {
+		return nil, err
+	}
+	var accepted []int
+	for i := range e.RcptTo {
+		rcpt := e.RcptTo[i].String()
+		replies = append(replies, lmtpReply{rcpt: rcpt})
+		err = lmtpCmd(text, 250, "RCPT TO:<%s>", rcpt)
+		if tpErr, ok := err.(*textproto.Error); ok {
+			replies[i].code, replies[i].msg = tpErr.Code, tpErr.Msg
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		accepted = append(accepted, i)
+	}
+	if len(accepted) == 0 {
+		_ = lmtpCmd(text, 221, "QUIT")
+		return replies, nil
+	}
+	if err = lmtpCmd(text, 354, "DATA"); err != nil {
+		return nil, err
+	}
+	w := text.DotWriter()
+	if _, err = io.Copy(w, e.NewReader()); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	// one reply for each accepted recipient, in the same order
+	for _, i := range accepted {
+		code, msg, err := text.ReadResponse(0)
+		if err != nil {
+			return nil, err
+		}
+		replies[i].code, replies[i].msg = code, msg
+	}
+	_ = lmtpCmd(text, 221, "QUIT")
+	return replies, nil
+}
+
+// lmtpCmd sends a command and reads the reply, returning a *textproto.Error if the
+// reply doesn't have the expected code
+func lmtpCmd(text *textproto.Conn, expectCode int, format string, args ...interface{}) error {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, _, err = text.ReadResponse(expectCode)
+	return err
+}
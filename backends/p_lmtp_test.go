@@ -0,0 +1,152 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// stubLMTPServer accepts one connection and replies to each recipient with the reply in
+// rcptReplies, at RCPT if it's a failure, or after DATA. The received message is sent on the channel
+func stubLMTPServer(t *testing.T, rcptReplies map[string]string) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		defer func() {
+			_ = l.Close()
+		}()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		in := bufio.NewReader(conn)
+		reply := func(s string) {
+			_, _ = conn.Write([]byte(s + "\r\n"))
+		}
+		reply("220 stub LMTP ready")
+		var accepted []string
+		for {
+			line, err := in.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case strings.HasPrefix(line, "LHLO "):
+				reply("250-stub\r\n250 PIPELINING")
+			case strings.HasPrefix(line, "MAIL FROM:"):
+				reply("250 2.1.0 Ok")
+			case strings.HasPrefix(line, "RCPT TO:"):
+				rcpt := strings.Trim(line[len("RCPT TO:"):], "<>")
+				if r := rcptReplies[rcpt]; strings.HasPrefix(r, "550") {
+					reply(r)
+					continue
+				}
+				accepted = append(accepted, rcpt)
+				reply("250 2.1.5 Ok")
+			case line == "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data bytes.Buffer
+				for {
+					l, err := in.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				received <- data.String()
+				for _, rcpt := range accepted {
+					reply(rcptReplies[rcpt])
+				}
+			case line == "QUIT":
+				reply("221 2.0.0 Bye")
+				return
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func lmtpTestEnvelope(rcpt ...string) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "sender", Host: "example.com"}
+	for _, r := range rcpt {
+		parts := strings.SplitN(r, "@", 2)
+		e.RcptTo = append(e.RcptTo, mail.Address{User: parts[0], Host: parts[1]})
+	}
+	e.Data.WriteString("Subject: test\r\n\r\n.leading dot\r\nhello\r\n")
+	return e
+}
+
+func TestLMTPMixedReplies(t *testing.T) {
+	addr, received := stubLMTPServer(t, map[string]string{
+		"alice@example.com":  "250 2.0.0 <alice@example.com> Saved",
+		"bob@example.com":    "452 4.2.2 <bob@example.com> Mailbox full",
+		"nobody@example.com": "550 5.1.1 <nobody@example.com> User doesn't exist",
+	})
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, LMTP())
+	if err := Svc.initialize(BackendConfig{"lmtp_address": addr, "lmtp_timeout": "5s"}); err != nil {
+		t.Fatal(err)
+	}
+	e := lmtpTestEnvelope("alice@example.com", "bob@example.com", "nobody@example.com")
+	result, err := p.Process(e, TaskSaveMail)
+	if err != nil || result != BackendResultOK {
+		t.Error("expecting the message to be accepted as alice got it, got", result, err)
+	}
+	if data := <-received; data != "Subject: test\r\n\r\n..leading dot\r\nhello\r\n" {
+		t.Errorf("expecting the dot-stuffed message, got %q", data)
+	}
+	failed, _ := e.Values["lmtp_failed"].(map[string]string)
+	if len(failed) != 2 ||
+		!strings.HasPrefix(failed["bob@example.com"], "452 4.2.2") ||
+		!strings.HasPrefix(failed["nobody@example.com"], "550 5.1.1") {
+		t.Error("expecting bob and nobody to have failed, got", failed)
+	}
+	dsn, _ := e.Values[DSNKey].(*mail.DSN)
+	if dsn == nil || dsn.Sender != "sender@example.com" || len(dsn.Recipients) != 2 ||
+		dsn.Recipients[0].Status != "4.2.2" || dsn.Recipients[1].Status != "5.1.1" {
+		t.Error("expecting a DSN for bob and nobody, got", dsn)
+	}
+}
+
+func TestLMTPAllRejected(t *testing.T) {
+	addr, _ := stubLMTPServer(t, map[string]string{
+		"nobody@example.com": "550 5.1.1 <nobody@example.com> User doesn't exist",
+		"bob@example.com":    "452 4.2.2 <bob@example.com> Mailbox full",
+	})
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, LMTP())
+	if err := Svc.initialize(BackendConfig{"lmtp_address": addr}); err != nil {
+		t.Fatal(err)
+	}
+	// the temporary failure is returned, so that the client tries again
+	result, err := p.Process(lmtpTestEnvelope("nobody@example.com", "bob@example.com"), TaskSaveMail)
+	if err == nil || result.Code() != 452 {
+		t.Error("expecting the temporary failure of bob, got", result, err)
+	}
+}
+
+func TestLMTPUnreachable(t *testing.T) {
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, LMTP())
+	if err := Svc.initialize(BackendConfig{"lmtp_address": "/nonexistent/lmtp.sock"}); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := p.Process(lmtpTestEnvelope("alice@example.com"), TaskSaveMail); err == nil || result.Code() != 554 {
+		t.Error("expecting a backend failure, got", result, err)
+	}
+}
@@ -0,0 +1,231 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: maildir
+// ----------------------------------------------------------------------------------
+// Description   : Delivers the message to a Maildir for each recipient. The message is
+//               : written to tmp/, synced to disk, then renamed into new/ so that mail
+//               : readers never see a partial message. The tmp, new and cur directories
+//               : are created as needed, readable by the owner only
+// ----------------------------------------------------------------------------------
+// Config Options: maildir_path string - the directory where the maildirs are
+//               : maildir_mailbox string - path of the maildir of a recipient relative to
+//               : maildir_path, {user} and {host} are replaced with the recipient's
+//               : local part and domain, in lower case. Default "{host}/{user}"
+//               : maildir_mailboxes string - comma separated address=path pairs to use
+//               : instead of maildir_mailbox for some recipients,
+//               : eg. "postmaster@example.com=admin,abuse@example.com=admin"
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo, e.DeliveryHeader and e.Data
+//               : e.Values[FileIntoKey], set by the sieve processor, has the folders to
+//               : deliver to, in the Maildir++ layout. Otherwise the inbox is used
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["maildir_files"] is set to the []string of delivered files
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["maildir"] = func() Decorator {
+		return Maildir()
+	}
+}
+
+type maildirConfig struct {
+	Path      string `json:"maildir_path"`
+	Mailbox   string `json:"maildir_mailbox,omitempty"`
+	Mailboxes string `json:"maildir_mailboxes,omitempty"`
+}
+
+const defaultMaildirMailbox = "{host}/{user}"
+
+func Maildir() Decorator {
+	var md *maildirs
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&maildirConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*maildirConfig)
+		md, err = newMaildirs(config)
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				delivered := make(map[string]bool, len(e.RcptTo))
+				var files []string
+				fileinto, _ := e.Values[FileIntoKey].(map[string][]string)
+				for i := range e.RcptTo {
+					mailbox, err := md.mailbox(e.RcptTo[i])
+					if err != nil {
+						EnvelopeLog(e).WithError(err).Error("no maildir for recipient")
+						return NewResult(response.Canned.FailBackendTransaction, response.SP, err), err
+					}
+					folders, ok := fileinto[strings.ToLower(e.RcptTo[i].String())]
+					if !ok {
+						folders = []string{""}
+					}
+					for _, folder := range folders {
+						dir := mailbox
+						if folder != "" {
+							if dir, err = maildirFolder(mailbox, folder); err != nil {
+								EnvelopeLog(e).WithError(err).Error("could not create maildir folder")
+								return NewResult(response.Canned.FailBackendTransaction, response.SP, "maildir delivery failed"), err
+							}
+						}
+						if delivered[dir] {
+							continue
+						}
+						file, err := md.deliver(dir, e)
+						if err != nil {
+							EnvelopeLog(e).WithError(err).Error("maildir delivery failed")
+							return NewResult(response.Canned.FailBackendTransaction, response.SP, "maildir delivery failed"), err
+						}
+						delivered[dir] = true
+						files = append(files, file)
+					}
+				}
+				e.Values["maildir_files"] = files
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// maildirs maps the recipients to their maildir, and delivers to it
+type maildirs struct {
+	path      string
+	template  string
+	mailboxes map[string]string
+	hostname  string
+}
+
+// maildirCounter makes the file names unique within the process
+var maildirCounter uint64
+
+func newMaildirs(config *maildirConfig) (*maildirs, error) {
+	if config.Path == "" {
+		return nil, errors.New("maildir_path is required")
+	}
+	path, err := filepath.Abs(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	md := &maildirs{
+		path:      path,
+		template:  config.Mailbox,
+		mailboxes: make(map[string]string),
+	}
+	if md.template == "" {
+		md.template = defaultMaildirMailbox
+	}
+	for _, pair := range strings.Split(config.Mailboxes, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 1 || i == len(pair)-1 {
+			return nil, fmt.Errorf("invalid maildir_mailboxes entry %q, expecting address=path", pair)
+		}
+		md.mailboxes[strings.ToLower(strings.TrimSpace(pair[:i]))] = strings.TrimSpace(pair[i+1:])
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// '/' and ':' are not allowed in the host part of a maildir file name
+	md.hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return md, nil
+}
+
+// mailbox returns the maildir of the recipient. The path is checked to be inside the base path
+func (md *maildirs) mailbox(rcpt mail.Address) (string, error) {
+	user, host := strings.ToLower(rcpt.User), strings.ToLower(rcpt.Host)
+	mailbox, ok := md.mailboxes[user+"@"+host]
+	if !ok {
+		mailbox = strings.NewReplacer(
+			"{user}", safePathElement(user),
+			"{host}", safePathElement(host)).Replace(md.template)
+	}
+	dir := filepath.Join(md.path, mailbox)
+	if !strings.HasPrefix(dir, md.path+string(filepath.Separator)) {
+		return "", fmt.Errorf("maildir of %s is outside of maildir_path", rcpt.String())
+	}
+	return dir, nil
+}
+
+// safePathElement makes s safe to use as a single element of a path
+func safePathElement(s string) string {
+	s = strings.NewReplacer("/", "_", `\`, "_", "\x00", "_").Replace(s)
+	if s == "" || s == "." || s == ".." {
+		return "_" + s
+	}
+	return s
+}
+
+// maildirFolder returns the directory of a folder in a Maildir++ mailbox, where "Lists/Go"
+// is the directory ".Lists.Go". The folder is created with its maildirfolder marker file
+func maildirFolder(mailbox, folder string) (string, error) {
+	dir := filepath.Join(mailbox, "."+safePathElement(strings.Replace(folder, "/", ".", -1)))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "maildirfolder"), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	return dir, f.Close()
+}
+
+// deliver writes the message to tmp/ in dir and moves it to new/ once it's on disk.
+// Returns the path of the delivered file
+func (md *maildirs) deliver(dir string, e *mail.Envelope) (string, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&maildirCounter, 1), md.hostname)
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, e.NewReader())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	// the size in the name lets mail readers skip a stat
+	file := filepath.Join(dir, "new", name+",S="+strconv.FormatInt(n, 10))
+	if err = os.Rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return file, nil
+}
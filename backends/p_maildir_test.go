@@ -0,0 +1,134 @@
+package backends
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func maildirTestEnvelope(body string, rcpt ...mail.Address) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = rcpt
+	e.DeliveryHeader = "Delivered-To: " + rcpt[0].String() + "\r\n"
+	e.Data.WriteString("Subject: test\r\n\r\n" + body + "\r\n")
+	return e
+}
+
+func TestMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, Maildir())
+	if err := Svc.initialize(BackendConfig{
+		"maildir_path":      dir,
+		"maildir_mailboxes": "postmaster@example.com=admin",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	e := maildirTestEnvelope("hello",
+		mail.Address{User: "Alice", Host: "Example.com"},
+		mail.Address{User: "postmaster", Host: "example.com"},
+		mail.Address{User: "../../etc", Host: "example.com"})
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := e.Values["maildir_files"].([]string)
+	if len(files) != 3 {
+		t.Fatal("expecting a file for each recipient, got", files)
+	}
+	for i, mailbox := range []string{"example.com/alice", "admin", "example.com/.._.._etc"} {
+		if filepath.Dir(files[i]) != filepath.Join(dir, mailbox, "new") {
+			t.Error("expecting the message in", filepath.Join(mailbox, "new"), "got", files[i])
+		}
+		b, err := ioutil.ReadFile(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != e.String() {
+			t.Errorf("expecting the file to have the message, got %q", b)
+		}
+		if info, err := os.Stat(files[i]); err != nil || info.Mode().Perm() != 0600 {
+			t.Error("expecting the file to be readable by the owner only")
+		}
+		if tmp, _ := ioutil.ReadDir(filepath.Join(dir, mailbox, "tmp")); len(tmp) != 0 {
+			t.Error("expecting tmp to be empty, got", len(tmp), "files")
+		}
+		if _, err := os.Stat(filepath.Join(dir, mailbox, "cur")); err != nil {
+			t.Error("expecting cur to be created", err)
+		}
+	}
+}
+
+func TestMaildirConcurrentDeliveries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	md, err := newMaildirs(&maildirConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt := mail.Address{User: "bob", Host: "example.com"}
+	mailbox, err := md.mailbox(rcpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	const deliveries = 50
+	errs := make(chan error, deliveries)
+	for i := 0; i < deliveries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := md.deliver(mailbox, maildirTestEnvelope(fmt.Sprint("message ", i), rcpt))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	files, err := ioutil.ReadDir(filepath.Join(mailbox, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != deliveries {
+		t.Error("expecting", deliveries, "files, got", len(files))
+	}
+	for _, f := range files {
+		if !strings.Contains(f.Name(), ",S=") {
+			t.Error("expecting the size in the file name, got", f.Name())
+		}
+	}
+}
+
+func TestMaildirMailboxOutsidePath(t *testing.T) {
+	md, err := newMaildirs(&maildirConfig{Path: "/var/mail", Mailboxes: "evil@example.com=../../etc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := md.mailbox(mail.Address{User: "evil", Host: "example.com"}); err == nil {
+		t.Error("expecting a mailbox outside maildir_path to be refused")
+	}
+	if _, err := newMaildirs(&maildirConfig{Path: "/var/mail", Mailboxes: "nopath"}); err == nil {
+		t.Error("expecting an invalid maildir_mailboxes entry to be refused")
+	}
+}
@@ -0,0 +1,154 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: mbox
+// ----------------------------------------------------------------------------------
+// Description   : Appends the message to an mbox file, in the mboxrd format: lines of
+//               : the message starting with "From ", after any number of '>', get
+//               : another '>' so that they can't be taken for the start of a message.
+//               : Line endings are converted to LF. The file is locked with flock while
+//               : appending, so other writers that use flock can share it
+// ----------------------------------------------------------------------------------
+// Config Options: mbox_path string - path of the mbox file. {user} and {host} are replaced
+//               : with the local part and domain of each recipient, in lower case, for a
+//               : file per recipient, eg. "/var/mail/{user}". Without them, the message
+//               : is appended once to a file shared by all the recipients
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.DeliveryHeader and e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["mbox_files"] is set to the []string of the files appended to
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["mbox"] = func() Decorator {
+		return Mbox()
+	}
+}
+
+type mboxConfig struct {
+	Path string `json:"mbox_path"`
+}
+
+func Mbox() Decorator {
+	var config *mboxConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&mboxConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*mboxConfig)
+		if config.Path == "" {
+			return errors.New("mbox_path is required")
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				var message []byte
+				appended := make(map[string]bool, len(e.RcptTo))
+				var files []string
+				for i := range e.RcptTo {
+					file := mboxFile(config.Path, e.RcptTo[i])
+					if appended[file] {
+						continue
+					}
+					if message == nil {
+						message = mboxMessage(e, time.Now())
+					}
+					if err := appendMbox(file, message); err != nil {
+						EnvelopeLog(e).WithError(err).Error("mbox delivery failed")
+						return NewResult(response.Canned.FailBackendTransaction, response.SP, "mbox delivery failed"), err
+					}
+					appended[file] = true
+					files = append(files, file)
+				}
+				e.Values["mbox_files"] = files
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// mboxFile returns the path of the mbox of the recipient
+func mboxFile(path string, rcpt mail.Address) string {
+	return filepath.Clean(strings.NewReplacer(
+		"{user}", safePathElement(strings.ToLower(rcpt.User)),
+		"{host}", safePathElement(strings.ToLower(rcpt.Host))).Replace(path))
+}
+
+// mboxMessage formats the message for an mbox: the From_ line, the message with its "From "
+// lines quoted and LF line endings, then an empty line
+func mboxMessage(e *mail.Envelope, received time.Time) []byte {
+	var buf bytes.Buffer
+	sender := "MAILER-DAEMON"
+	if !e.MailFrom.NullPath && e.MailFrom.User != "" {
+		sender = e.MailFrom.String()
+	}
+	fmt.Fprintf(&buf, "From %s %s\n", sender, received.UTC().Format(time.ANSIC))
+	r := bufio.NewReader(e.NewReader())
+	var line []byte
+	var err error
+	for err == nil {
+		line, err = r.ReadBytes('\n')
+		if len(line) == 0 {
+			break
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// appendMbox appends the formatted message to the mbox file while holding its lock.
+// The file is truncated back to its previous size if the message could not be written in full
+func appendMbox(file string, message []byte) (err error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if err = lockFile(f); err != nil {
+		return err
+	}
+	defer func() {
+		_ = unlockFile(f)
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(message); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Truncate(info.Size())
+	}
+	return err
+}
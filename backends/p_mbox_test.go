@@ -0,0 +1,116 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// readMbox splits an mbox file written by the mbox processor into its messages,
+// removing the From_ lines and the quoting of "From " lines
+func readMbox(r io.Reader) ([]string, error) {
+	var messages []string
+	var current *bytes.Buffer
+	scanner := bufio.NewScanner(r)
+	prevEmpty := true
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if prevEmpty && bytes.HasPrefix(line, []byte("From ")) {
+			if current != nil {
+				messages = append(messages, strings.TrimSuffix(current.String(), "\n"))
+			}
+			current = &bytes.Buffer{}
+			prevEmpty = false
+			continue
+		}
+		prevEmpty = len(line) == 0
+		if current == nil {
+			return nil, errors.New("mbox does not start with a From line")
+		}
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			line = line[1:]
+		}
+		current.Write(line)
+		current.WriteByte('\n')
+	}
+	if current != nil {
+		messages = append(messages, strings.TrimSuffix(current.String(), "\n"))
+	}
+	return messages, scanner.Err()
+}
+
+func TestMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, Mbox())
+	file := filepath.Join(dir, "shared.mbox")
+	if err := Svc.initialize(BackendConfig{"mbox_path": file}); err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := []string{
+		"Subject: first\r\n\r\nFrom the start\r\n>From quoted already\r\n\r\nFrom after an empty line\r\n",
+		"Subject: second\r\n\r\nhello\r\n",
+	}
+	for _, body := range bodies {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.MailFrom = mail.Address{User: "sender", Host: "example.com"}
+		e.RcptTo = []mail.Address{{User: "alice", Host: "example.com"}, {User: "bob", Host: "example.com"}}
+		e.Data.WriteString(body)
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Fatal(err)
+		}
+		if files, _ := e.Values["mbox_files"].([]string); len(files) != 1 || files[0] != file {
+			t.Error("expecting the message to be appended once to the shared file, got", files)
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	messages, err := readMbox(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != len(bodies) {
+		t.Fatal("expecting", len(bodies), "messages, got", len(messages))
+	}
+	for i := range bodies {
+		if want := strings.Replace(bodies[i], "\r\n", "\n", -1); messages[i] != want {
+			t.Errorf("expecting message %d to be %q, got %q", i, want, messages[i])
+		}
+	}
+	b, _ := ioutil.ReadFile(file)
+	if !strings.HasPrefix(string(b), "From sender@example.com ") || !strings.Contains(string(b), "\n>>From quoted already\n") {
+		t.Errorf("expecting a From_ line and the From lines to be quoted, got %q", b)
+	}
+}
+
+func TestMboxFilePerRecipient(t *testing.T) {
+	rcpt := mail.Address{User: "Alice", Host: "example.com"}
+	if file := mboxFile("/var/mail/{user}", rcpt); file != "/var/mail/alice" {
+		t.Error("expecting /var/mail/alice, got", file)
+	}
+	rcpt.User = "../root"
+	if file := mboxFile("/var/mail/{user}", rcpt); file != "/var/mail/.._root" {
+		t.Error("expecting the recipient to stay in /var/mail, got", file)
+	}
+}
@@ -0,0 +1,100 @@
+package backends
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: messageid
+// ----------------------------------------------------------------------------------
+// Description   : Adds a Message-ID header to messages that don't have one, as some
+//               : clients omit it, eg. Message-ID: <QUEUEID.5f2b9c0e4d1a7386@mx.example.com>
+//               : where the part after the queue id is random, as the queue id can repeat
+//               : Messages that have a Message-ID are left alone. Can also add a Date
+//               : header, with the time the message was received, when it's missing
+// ----------------------------------------------------------------------------------
+// Config Options: messageid_hostname string - the host name used after the @, default
+//               : primary_mail_host, or the system's hostname if not set
+//               : messageid_add_date bool - add a Date header if missing, default false
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.QueuedId
+// ----------------------------------------------------------------------------------
+// Output        : e.Data has the headers added. e.Header is parsed again if it was parsed
+//               : e.Values["message_id"] is set to the Message-ID that was added
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["messageid"] = func() Decorator {
+		return MessageID()
+	}
+}
+
+type messageIDConfig struct {
+	Hostname    string `json:"messageid_hostname,omitempty"`
+	AddDate     bool   `json:"messageid_add_date,omitempty"`
+	PrimaryHost string `json:"primary_mail_host,omitempty"`
+}
+
+func MessageID() Decorator {
+	var config *messageIDConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&messageIDConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*messageIDConfig)
+		if config.Hostname == "" {
+			config.Hostname = config.PrimaryHost
+		}
+		if config.Hostname == "" {
+			if config.Hostname, err = os.Hostname(); err != nil {
+				return convertError("property missing: 'messageid_hostname', could not get the hostname")
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				err := ApplyTransforms(e, TransformerFunc(func(e *mail.Envelope, header, body []byte) ([]byte, []byte, error) {
+					var hasID, hasDate bool
+					for _, field := range dkimSplitHeader(header) {
+						switch field.name {
+						case "message-id":
+							hasID = true
+						case "date":
+							hasDate = true
+						}
+					}
+					if !hasID {
+						random := make([]byte, 8)
+						if _, err := rand.Read(random); err != nil {
+							return nil, nil, err
+						}
+						id := "<" + e.QueuedId + "." + hex.EncodeToString(random) + "@" + config.Hostname + ">"
+						header = append(header, "Message-ID: "+id+"\n"...)
+						e.Values["message_id"] = id
+					}
+					if config.AddDate && !hasDate {
+						header = append(header, "Date: "+mail.DefaultClock.Now().Format(time.RFC1123Z)+"\n"...)
+					}
+					return header, body, nil
+				}))
+				if err != nil {
+					EnvelopeLog(e).WithError(err).Error("could not add the message-id")
+					return NewResult(response.Canned.FailBackendTransaction), err
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package backends
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestMessageID(t *testing.T) {
+	defer func(c mail.Clock) { mail.DefaultClock = c }(mail.DefaultClock)
+	mail.DefaultClock = mail.FixedClock(time.Date(2018, 10, 20, 12, 30, 0, 0, time.UTC))
+
+	newProcessor := func(config BackendConfig) Processor {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, MessageID())
+		if err := Svc.initialize(config); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	process := func(p Processor, data string) *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = "abc123"
+		e.Data.WriteString(data)
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	idPattern := regexp.MustCompile(`^<abc123\.[0-9a-f]{16}@mx\.example\.com>$`)
+	p := newProcessor(BackendConfig{"messageid_hostname": "mx.example.com"})
+	e := process(p, "Subject: test\nDate: Sat, 20 Oct 2018 12:00:00 +0000\n\nhello\n")
+	id, _ := e.Values["message_id"].(string)
+	if !idPattern.MatchString(id) {
+		t.Error("expecting message_id to be set, got", e.Values["message_id"])
+	}
+	expect := "Subject: test\nDate: Sat, 20 Oct 2018 12:00:00 +0000\nMessage-ID: " + id + "\n\nhello\n"
+	if e.Data.String() != expect {
+		t.Errorf("expecting\n%s\ngot\n%s", expect, e.Data.String())
+	}
+	// the same queue id at the same time still gets a new Message-ID
+	if e = process(p, "Subject: test\n\nhello\n"); e.Values["message_id"] == id {
+		t.Error("expecting a unique Message-ID, got", id, "twice")
+	}
+
+	// already has one, in any case
+	data := "Subject: test\nMessage-Id: <original@example.org>\n\nhello\n"
+	if e = process(p, data); e.Data.String() != data {
+		t.Errorf("expecting the message to be unchanged, got\n%s", e.Data.String())
+	}
+	if _, ok := e.Values["message_id"]; ok {
+		t.Error("message_id should not be set")
+	}
+
+	// missing both, the date is only added when configured
+	data = "Subject: test\n\nhello\n"
+	e = process(p, data)
+	if lines := strings.Split(e.Data.String(), "\n"); len(lines) != 5 || !strings.HasPrefix(lines[1], "Message-ID: ") {
+		t.Errorf("expecting only the Message-ID to be added, got\n%s", e.Data.String())
+	}
+	p = newProcessor(BackendConfig{"primary_mail_host": "example.com", "messageid_add_date": true})
+	e = process(p, data)
+	id, _ = e.Values["message_id"].(string)
+	expect = "Subject: test\nMessage-ID: " + id + "\nDate: Sat, 20 Oct 2018 12:30:00 +0000\n\nhello\n"
+	if !strings.HasSuffix(id, "@example.com>") || e.Data.String() != expect {
+		t.Errorf("expecting\n%s\ngot\n%s", expect, e.Data.String())
+	}
+	if err := e.ParseHeaders(); err != nil || e.Header.Get("Date") == "" {
+		t.Error("expecting the Date header to be parsed, got", err)
+	}
+}
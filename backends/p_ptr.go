@@ -0,0 +1,194 @@
+package backends
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: ptr
+// ----------------------------------------------------------------------------------
+// Description   : Looks up the reverse DNS (PTR) name of the client's IP address, and
+//               : optionally checks that the name resolves back to the address, which
+//               : is known as forward-confirmed reverse DNS (FCrDNS). Results are cached
+//               : for a short while, so that bursts of connections from the same address
+//               : do not each query the DNS. Place it before processors using the name,
+//               : such as received
+// ----------------------------------------------------------------------------------
+// Config Options: ptr_resolver string - address of the DNS resolver to use, eg.
+//               : "127.0.0.1:53", default is the system's resolver
+//               : ptr_timeout string - time allowed for the lookups, default "5s"
+//               : ptr_fcrdns bool - also check that the name resolves back to the address
+//               : ptr_cache_ttl string - how long results are cached, default "1m"
+//               : ptr_circuit_* - the circuit breaker on the DNS lookups, see CircuitConfig
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["ptr"] is set to the name, when the address has one. With
+//               : FCrDNS, the name is one that resolves back to the address if any.
+//               : e.Values["fcrdns"] is set to true or false when ptr_fcrdns is set
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["ptr"] = func() Decorator {
+		return PTR()
+	}
+}
+
+type ptrConfig struct {
+	Resolver string `json:"ptr_resolver,omitempty"`
+	Timeout  string `json:"ptr_timeout,omitempty"`
+	FCrDNS   bool   `json:"ptr_fcrdns,omitempty"`
+	CacheTTL string `json:"ptr_cache_ttl,omitempty"`
+}
+
+// PTRResolver looks up the DNS records needed for reverse DNS checks. *net.Resolver implements it
+type PTRResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+const (
+	defaultPTRTimeout  = time.Second * 5
+	defaultPTRCacheTTL = time.Minute
+	// ptrMaxNames limits the forward lookups for addresses with many names
+	ptrMaxNames = 10
+)
+
+// newPTRResolver returns the resolver at address, can be replaced in tests
+var newPTRResolver = func(address string) PTRResolver {
+	return dnsResolver(address)
+}
+
+func PTR() Decorator {
+	var (
+		config   *ptrConfig
+		resolver PTRResolver
+		timeout  time.Duration
+		cacheTTL time.Duration
+		// cache holds "name confirmed" for each address, an empty name when there is no PTR
+		cache   KVStore
+		circuit *CircuitBreaker
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ptrConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*ptrConfig)
+		if config.Resolver != "" {
+			if _, _, err := net.SplitHostPort(config.Resolver); err != nil {
+				return convertError("property invalid: 'ptr_resolver' must be a host:port address")
+			}
+		}
+		timeout, cacheTTL = defaultPTRTimeout, defaultPTRCacheTTL
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return convertError("property invalid: 'ptr_timeout' must be a duration, eg. \"5s\"")
+			}
+		}
+		if config.CacheTTL != "" {
+			if cacheTTL, err = time.ParseDuration(config.CacheTTL); err != nil || cacheTTL < 0 {
+				return convertError("property invalid: 'ptr_cache_ttl' must be a duration, eg. \"1m\"")
+			}
+		}
+		resolver = newPTRResolver(config.Resolver)
+		cache = NewMemoryKVStore()
+		circuitConfig, err := NewCircuitConfig("ptr", backendConfig)
+		if err != nil {
+			return err
+		}
+		circuit = NewCircuitBreaker("ptr", circuitConfig)
+		return nil
+	}))
+
+	// lookup returns the name of ip, and whether it resolves back to ip
+	lookup := func(ip string) (name string, confirmed bool, err error) {
+		if cached, ok, _ := cache.Get(ip); ok {
+			i := strings.LastIndexByte(cached, ' ')
+			return cached[:i], cached[i+1:] == "true", nil
+		}
+		err = circuit.Do(func() (err error) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			name, confirmed, err = reverseLookup(ctx, resolver, ip, config.FCrDNS)
+			return err
+		})
+		if err != nil {
+			// not cached, the next message tries again
+			if err != ErrCircuitOpen {
+				Log().WithError(err).Warnf("reverse DNS lookup of %s failed", ip)
+			}
+			return "", false, err
+		}
+		if cacheTTL > 0 {
+			_ = cache.Set(ip, name+" "+strconv.FormatBool(confirmed), cacheTTL)
+		}
+		return name, confirmed, nil
+	}
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt || task == TaskSaveMail {
+				if _, done := e.Values["ptr"]; !done {
+					name, confirmed, err := lookup(e.RemoteIP)
+					if err == ErrCircuitOpen && !circuit.FailOpen() {
+						return NewResult(response.Canned.ErrorDependencyDown, " ", err), err
+					}
+					if name != "" {
+						e.Values["ptr"] = name
+					}
+					if config.FCrDNS {
+						e.Values["fcrdns"] = confirmed
+					}
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// reverseLookup returns the PTR name of ip, without the trailing dot. With fcrdns, it looks up
+// the names and returns the first that resolves back to ip, and true. A missing PTR is not an error
+func reverseLookup(ctx context.Context, resolver PTRResolver, ip string, fcrdns bool) (string, bool, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", false, nil
+	}
+	names, err := resolver.LookupAddr(ctx, ip)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.Err == "no such host" {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	if len(names) == 0 {
+		return "", false, nil
+	}
+	first := strings.TrimSuffix(names[0], ".")
+	if !fcrdns {
+		return first, false, nil
+	}
+	for i, name := range names {
+		if i == ptrMaxNames {
+			break
+		}
+		name = strings.TrimSuffix(name, ".")
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(addr) {
+				return name, true, nil
+			}
+		}
+	}
+	return first, false, nil
+}
@@ -0,0 +1,130 @@
+package backends
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// stubPTRResolver answers from crafted records and counts the PTR lookups
+type stubPTRResolver struct {
+	ptr     map[string][]string
+	ip      map[string][]string
+	lookups int
+}
+
+func (r *stubPTRResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.lookups++
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	if addr == "192.0.2.99" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: addr, IsTemporary: true}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr}
+}
+
+func (r *stubPTRResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	for _, ip := range r.ip[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	return addrs, nil
+}
+
+func TestPTRProcessor(t *testing.T) {
+	r := &stubPTRResolver{
+		ptr: map[string][]string{
+			"192.0.2.1":   {"mail.example.com."},
+			"192.0.2.2":   {"forged.example.com."},
+			"192.0.2.3":   {"other.example.net.", "mx.example.net."},
+			"2001:db8::1": {"mail6.example.com."},
+		},
+		ip: map[string][]string{
+			"mail.example.com":   {"192.0.2.1"},
+			"forged.example.com": {"198.51.100.1"},
+			"mx.example.net":     {"192.0.2.3"},
+			"mail6.example.com":  {"2001:db8::1"},
+		},
+	}
+	defer func(f func(string) PTRResolver) { newPTRResolver = f }(newPTRResolver)
+	newPTRResolver = func(address string) PTRResolver {
+		return r
+	}
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, PTR())
+	if err := Svc.initialize(BackendConfig{"ptr_fcrdns": true, "ptr_timeout": "2s"}); err != nil {
+		t.Fatal(err)
+	}
+	for ip, expect := range map[string]struct {
+		name      string
+		confirmed bool
+	}{
+		"192.0.2.1":   {"mail.example.com", true},    // matching
+		"192.0.2.2":   {"forged.example.com", false}, // mismatching
+		"192.0.2.3":   {"mx.example.net", true},      // the second name matches
+		"2001:db8::1": {"mail6.example.com", true},
+		"192.0.2.4":   {"", false}, // missing
+		"192.0.2.99":  {"", false}, // lookup failed
+	} {
+		e := mail.NewEnvelope(ip, 1)
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Error(err)
+		}
+		name, ok := e.Values["ptr"].(string)
+		if expect.name == "" && ok {
+			t.Error(ip, "expecting no ptr, got", name)
+		} else if name != expect.name {
+			t.Error(ip, "expecting ptr", expect.name, "got", name)
+		}
+		if e.Values["fcrdns"] != expect.confirmed {
+			t.Error(ip, "expecting fcrdns", expect.confirmed, "got", e.Values["fcrdns"])
+		}
+	}
+
+	// results are cached, except failed lookups
+	lookups := r.lookups
+	for _, ip := range []string{"192.0.2.1", "192.0.2.4", "192.0.2.99"} {
+		e := mail.NewEnvelope(ip, 2)
+		if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+			t.Error(err)
+		}
+	}
+	if r.lookups != lookups+1 {
+		t.Error("expecting only the failed lookup to be repeated, got", r.lookups-lookups, "lookups")
+	}
+
+	// without FCrDNS the first name is used
+	name, confirmed, err := reverseLookup(context.Background(), r, "192.0.2.3", false)
+	if err != nil || name != "other.example.net" || confirmed {
+		t.Error("expecting the first name unconfirmed, got", name, confirmed, err)
+	}
+
+	// the circuit opens after the failed lookup, the next lookup is deferred
+	Svc.reset()
+	p = Decorate(DefaultProcessor{}, PTR())
+	if err := Svc.initialize(BackendConfig{"ptr_circuit_threshold": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Process(mail.NewEnvelope("192.0.2.99", 1), TaskSaveMail); err != nil {
+		t.Error("expecting the failed lookup to be let through", err)
+	}
+	lookups = r.lookups
+	if result, err := p.Process(mail.NewEnvelope("192.0.2.1", 1), TaskSaveMail); err != ErrCircuitOpen || result.Code() != 451 {
+		t.Error("expecting a 451 while the circuit is open, got", result, err)
+	}
+	if r.lookups != lookups {
+		t.Error("expecting no lookup while the circuit is open")
+	}
+
+	Svc.reset()
+	_ = Decorate(DefaultProcessor{}, PTR())
+	if err := Svc.initialize(BackendConfig{"ptr_timeout": "soon"}); err == nil {
+		t.Error("expecting an invalid timeout to be rejected")
+	}
+}
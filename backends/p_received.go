@@ -0,0 +1,103 @@
+package backends
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: received
+// ----------------------------------------------------------------------------------
+// Description   : Prepends a Received trace header (RFC 5321 4.4) to e.DeliveryHeader,
+//               : eg. Received: from helo (ptr [ip]) (using TLSv1.3 ...) by host with
+//               : ESMTPS id QUEUEID for <rcpt>; date
+//               : The protocol is one of the RFC 3848 types: ESMTP, ESMTPS with TLS,
+//               : ESMTPA or ESMTPSA when the client authenticated. Place it before the
+//               : processors that save the message, so that the header is stored with it
+// ----------------------------------------------------------------------------------
+// Config Options: received_hostname string - the name of this host used after "by",
+//               : default primary_mail_host, or the system's hostname if not set
+// --------------:-------------------------------------------------------------------
+// Input         : e.Helo, e.RemoteIP, e.QueuedId, e.RcptTo, e.TLSInfo
+//               : e.Values["ptr"] - the client's reverse DNS name, if looked up
+//               : e.Values["authenticated"] - true if the client used AUTH
+// ----------------------------------------------------------------------------------
+// Output        : e.DeliveryHeader has the Received header prepended
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["received"] = func() Decorator {
+		return Received()
+	}
+}
+
+type receivedConfig struct {
+	Hostname    string `json:"received_hostname,omitempty"`
+	PrimaryHost string `json:"primary_mail_host,omitempty"`
+}
+
+func Received() Decorator {
+	var hostname string
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&receivedConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*receivedConfig)
+		hostname = config.Hostname
+		if hostname == "" {
+			hostname = config.PrimaryHost
+		}
+		if hostname == "" {
+			if hostname, err = os.Hostname(); err != nil {
+				return convertError("property missing: 'received_hostname', could not get the hostname")
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				e.DeliveryHeader = receivedHeader(e, hostname) + e.DeliveryHeader
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// receivedHeader formats the Received header of e, folded over a few lines
+func receivedHeader(e *mail.Envelope, hostname string) string {
+	helo := e.Helo
+	if helo == "" {
+		helo = "unknown"
+	}
+	header := "Received: from " + helo + " ("
+	if ptr, ok := e.Values["ptr"].(string); ok && ptr != "" {
+		header += ptr + " "
+	}
+	header += "[" + e.RemoteIP + "])\n"
+	protocol := "ESMTP"
+	if e.TLS {
+		protocol += "S"
+		if e.TLSInfo.Version != "" {
+			bits := strconv.Itoa(e.TLSInfo.Bits)
+			header += "\t(using " + e.TLSInfo.Version + " with cipher " + e.TLSInfo.Cipher +
+				" (" + bits + "/" + bits + " bits))\n"
+		}
+	}
+	if authenticated, _ := e.Values["authenticated"].(bool); authenticated {
+		protocol += "A"
+	}
+	header += "\tby " + hostname + " with " + protocol + " id " + e.QueuedId
+	if len(e.RcptTo) == 1 {
+		// with more recipients, listing one would disclose it to the others
+		header += "\n\tfor <" + e.RcptTo[0].String() + ">"
+	}
+	return header + ";\n\t" + mail.DefaultClock.Now().Format(time.RFC1123Z) + "\n"
+}
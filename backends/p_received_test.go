@@ -0,0 +1,73 @@
+package backends
+
+import (
+	"bufio"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestReceived(t *testing.T) {
+	defer func(c mail.Clock, g mail.IDGenerator) {
+		mail.DefaultClock, mail.DefaultIDGenerator = c, g
+	}(mail.DefaultClock, mail.DefaultIDGenerator)
+	mail.DefaultClock = mail.FixedClock(time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC))
+	mail.DefaultIDGenerator = &mail.SequenceIDGenerator{Prefix: "q"}
+
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, Received())
+	if err := Svc.initialize(BackendConfig{"received_hostname": "mx.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("192.0.2.7", 1)
+	e.Helo = "client.example.org"
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "to", Host: "example.com"})
+	e.TLS = true
+	e.TLSInfo = mail.TLSInfo{Version: "TLSv1.3", Cipher: "TLS_AES_256_GCM_SHA384", Bits: 256}
+	e.Values["ptr"] = "mail.example.org"
+	e.DeliveryHeader = "X-Existing: yes\n"
+	e.Data.WriteString("Subject: test\n\nhello\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	expect := "Received: from client.example.org (mail.example.org [192.0.2.7])\n" +
+		"\t(using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits))\n" +
+		"\tby mx.example.com with ESMTPS id q1\n" +
+		"\tfor <to@example.com>;\n" +
+		"\tMon, 04 Mar 2019 05:06:07 +0000\n" +
+		"X-Existing: yes\n"
+	if e.DeliveryHeader != expect {
+		t.Errorf("expecting header:\n%s\ngot:\n%s", expect, e.DeliveryHeader)
+	}
+
+	// the stored message parses, with the header unfolded
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(e.String())))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal("expecting the header to parse", err)
+	}
+	received := header.Get("Received")
+	if !strings.Contains(received, "[192.0.2.7]") || !strings.Contains(received, " id q1 ") {
+		t.Error("expecting the client IP and queue id, got", received)
+	}
+	if header.Get("Subject") != "test" {
+		t.Error("expecting the message headers to follow, got", header)
+	}
+
+	// no TLS, authenticated, several recipients
+	e = mail.NewEnvelope("2001:db8::7", 2)
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "a", Host: "example.com"}, mail.Address{User: "b", Host: "example.com"})
+	e.Values["authenticated"] = true
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	expect = "Received: from unknown ([2001:db8::7])\n" +
+		"\tby mx.example.com with ESMTPA id q2;\n" +
+		"\tMon, 04 Mar 2019 05:06:07 +0000\n"
+	if e.DeliveryHeader != expect {
+		t.Errorf("expecting header:\n%s\ngot:\n%s", expect, e.DeliveryHeader)
+	}
+}
@@ -0,0 +1,293 @@
+package backends
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: recipient_callout
+// ----------------------------------------------------------------------------------
+// Description   : Checks that each recipient exists at RCPT time, using a RecipientValidator:
+//               : a static list, an SQL query or an HTTP endpoint. Unknown recipients get
+//               : a 550, and a 451 if the check fails or times out so that the client tries
+//               : again later. The answers are cached for a short while
+// ----------------------------------------------------------------------------------
+// Config Options: recipient_callout_type string - "static", "sql", "http", or the name given
+//               : to AddRecipientValidator
+//               : recipient_callout_timeout string - time limit for a check, default "5s"
+//               : recipient_callout_cache_ttl string - how long answers are cached, default "60s"
+//               : recipient_callout_list string - for "static", comma separated addresses,
+//               : "@example.com" allows all the recipients of a domain
+//               : recipient_callout_sql_driver string - for "sql", the database/sql driver
+//               : recipient_callout_sql_dsn string - for "sql", the data source name
+//               : recipient_callout_sql_query string - for "sql", a query with one placeholder
+//               : for the address, the recipient exists if it returns a row,
+//               : eg. "SELECT 1 FROM users WHERE email = ?"
+//               : recipient_callout_url string - for "http", the endpoint, with {rcpt}
+//               : replaced by the address. 2xx means the recipient exists, 404 that it doesn't
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo, the last one is checked
+// ----------------------------------------------------------------------------------
+// Output        : NoSuchUser, StorageTimeout or StorageError when the recipient is refused
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["recipient_callout"] = func() Decorator {
+		return RecipientCallout()
+	}
+}
+
+// RecipientValidator checks if a recipient exists. The check should return when ctx is done
+type RecipientValidator interface {
+	Valid(ctx context.Context, rcpt *mail.Address) (bool, error)
+}
+
+// RecipientValidatorConstructor makes a RecipientValidator from the backend config
+type RecipientValidatorConstructor func(backendConfig BackendConfig) (RecipientValidator, error)
+
+var (
+	recipientValidators = map[string]RecipientValidatorConstructor{
+		"static": newStaticRecipientValidator,
+		"sql":    newSQLRecipientValidator,
+		"http":   newHTTPRecipientValidator,
+	}
+	recipientValidatorsLock sync.Mutex
+)
+
+// AddRecipientValidator adds a validator that can be used with recipient_callout_type set to name
+func AddRecipientValidator(name string, c RecipientValidatorConstructor) {
+	recipientValidatorsLock.Lock()
+	defer recipientValidatorsLock.Unlock()
+	recipientValidators[strings.ToLower(name)] = c
+}
+
+type recipientCalloutConfig struct {
+	Type     string `json:"recipient_callout_type"`
+	Timeout  string `json:"recipient_callout_timeout,omitempty"`
+	CacheTTL string `json:"recipient_callout_cache_ttl,omitempty"`
+}
+
+const (
+	defaultRecipientCalloutTimeout  = time.Second * 5
+	defaultRecipientCalloutCacheTTL = time.Second * 60
+)
+
+func RecipientCallout() Decorator {
+	var validator RecipientValidator
+	var timeout time.Duration
+	var cache *recipientCache
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&recipientCalloutConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*recipientCalloutConfig)
+		recipientValidatorsLock.Lock()
+		constructor, ok := recipientValidators[strings.ToLower(config.Type)]
+		recipientValidatorsLock.Unlock()
+		if !ok {
+			return fmt.Errorf("unknown recipient_callout_type %q", config.Type)
+		}
+		if validator, err = constructor(backendConfig); err != nil {
+			return err
+		}
+		timeout = defaultRecipientCalloutTimeout
+		ttl := defaultRecipientCalloutCacheTTL
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil {
+				return fmt.Errorf("invalid recipient_callout_timeout: %s", err)
+			}
+		}
+		if config.CacheTTL != "" {
+			if ttl, err = time.ParseDuration(config.CacheTTL); err != nil {
+				return fmt.Errorf("invalid recipient_callout_cache_ttl: %s", err)
+			}
+		}
+		cache = &recipientCache{ttl: ttl, entries: make(map[string]recipientCacheEntry)}
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if closer, ok := validator.(interface{ Close() error }); ok {
+			return closer.Close()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt && len(e.RcptTo) > 0 {
+				// the recipient being validated is the last one added
+				rcpt := &e.RcptTo[len(e.RcptTo)-1]
+				key := strings.ToLower(rcpt.String())
+				valid, cached := cache.get(key)
+				if !cached {
+					ctx, cancel := context.WithTimeout(context.Background(), timeout)
+					var err error
+					valid, err = validator.Valid(ctx, rcpt)
+					timedOut := ctx.Err() == context.DeadlineExceeded
+					cancel()
+					if err != nil {
+						EnvelopeLog(e).WithError(err).Warnf("could not check recipient %s", rcpt.String())
+						if timedOut {
+							return NewResult(response.Canned.ErrorRcptStorage), StorageTimeout
+						}
+						return NewResult(response.Canned.ErrorRcptStorage), StorageError
+					}
+					cache.set(key, valid)
+				}
+				if !valid {
+					return NewResult(response.Canned.FailRcptCmd), NoSuchUser
+				}
+				return p.Process(e, task)
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// recipientCache keeps the answers of the validator for ttl
+type recipientCache struct {
+	ttl     time.Duration
+	entries map[string]recipientCacheEntry
+	sync.Mutex
+}
+
+type recipientCacheEntry struct {
+	valid   bool
+	expires time.Time
+}
+
+// recipientCacheSweep is the number of entries above which expired entries are removed
+const recipientCacheSweep = 10000
+
+func (c *recipientCache) get(key string) (valid bool, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return false, false
+	}
+	return entry.valid, true
+}
+
+func (c *recipientCache) set(key string, valid bool) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if len(c.entries) >= recipientCacheSweep {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = recipientCacheEntry{valid: valid, expires: now.Add(c.ttl)}
+}
+
+// StaticRecipientValidator accepts the addresses in a list, and all the addresses of a domain
+// listed as "@example.com"
+type StaticRecipientValidator map[string]bool
+
+func newStaticRecipientValidator(backendConfig BackendConfig) (RecipientValidator, error) {
+	list, _ := backendConfig["recipient_callout_list"].(string)
+	v := make(StaticRecipientValidator)
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.ToLower(strings.TrimSpace(addr)); addr != "" {
+			v[addr] = true
+		}
+	}
+	if len(v) == 0 {
+		return nil, errors.New("recipient_callout_list is empty")
+	}
+	return v, nil
+}
+
+func (v StaticRecipientValidator) Valid(ctx context.Context, rcpt *mail.Address) (bool, error) {
+	host := strings.ToLower(rcpt.Host)
+	return v[strings.ToLower(rcpt.User)+"@"+host] || v["@"+host], nil
+}
+
+// SQLRecipientValidator accepts the recipients for which Query returns a row.
+// Query has one placeholder, for the address
+type SQLRecipientValidator struct {
+	DB    *sql.DB
+	Query string
+}
+
+func newSQLRecipientValidator(backendConfig BackendConfig) (RecipientValidator, error) {
+	driver, _ := backendConfig["recipient_callout_sql_driver"].(string)
+	dsn, _ := backendConfig["recipient_callout_sql_dsn"].(string)
+	query, _ := backendConfig["recipient_callout_sql_query"].(string)
+	if driver == "" || query == "" {
+		return nil, errors.New("recipient_callout_sql_driver and recipient_callout_sql_query are required")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLRecipientValidator{DB: db, Query: query}, nil
+}
+
+func (v *SQLRecipientValidator) Valid(ctx context.Context, rcpt *mail.Address) (bool, error) {
+	var found interface{}
+	err := v.DB.QueryRowContext(ctx, v.Query, strings.ToLower(rcpt.String())).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Close closes the database
+func (v *SQLRecipientValidator) Close() error {
+	return v.DB.Close()
+}
+
+// HTTPRecipientValidator asks an HTTP endpoint about the recipient, with a GET request to URL
+// with {rcpt} replaced by the address. 2xx means the recipient exists, 404 that it doesn't,
+// anything else is an error
+type HTTPRecipientValidator struct {
+	URL    string
+	Client *http.Client
+}
+
+func newHTTPRecipientValidator(backendConfig BackendConfig) (RecipientValidator, error) {
+	u, _ := backendConfig["recipient_callout_url"].(string)
+	if u == "" {
+		return nil, errors.New("recipient_callout_url is required")
+	}
+	return &HTTPRecipientValidator{URL: u, Client: http.DefaultClient}, nil
+}
+
+func (v *HTTPRecipientValidator) Valid(ctx context.Context, rcpt *mail.Address) (bool, error) {
+	u := strings.Replace(v.URL, "{rcpt}", url.QueryEscape(strings.ToLower(rcpt.String())), -1)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := v.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("recipient callout returned %s", resp.Status)
+}
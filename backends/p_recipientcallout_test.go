@@ -0,0 +1,197 @@
+package backends
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// calloutTestDriver is a database/sql driver where the only query returns a row if the
+// address is in calloutTestUsers. The query for slow@example.com blocks until ctx is done
+type calloutTestDriver struct{}
+
+var calloutTestUsers = map[string]bool{"alice@example.com": true}
+
+func init() {
+	sql.Register("callout_test", calloutTestDriver{})
+}
+
+func (calloutTestDriver) Open(name string) (driver.Conn, error) {
+	return calloutTestConn{}, nil
+}
+
+type calloutTestConn struct{}
+
+func (calloutTestConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (calloutTestConn) Close() error {
+	return nil
+}
+
+func (calloutTestConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+func (calloutTestConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	addr, _ := args[0].Value.(string)
+	if addr == "slow@example.com" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	rows := &calloutTestRows{}
+	if calloutTestUsers[addr] {
+		rows.n = 1
+	}
+	return rows, nil
+}
+
+type calloutTestRows struct {
+	n int
+}
+
+func (r *calloutTestRows) Columns() []string {
+	return []string{"1"}
+}
+
+func (r *calloutTestRows) Close() error {
+	return nil
+}
+
+func (r *calloutTestRows) Next(dest []driver.Value) error {
+	if r.n == 0 {
+		return io.EOF
+	}
+	r.n--
+	dest[0] = int64(1)
+	return nil
+}
+
+// checkRcpt validates rcpt with the processor, returning the error
+func checkRcpt(p Processor, rcpt string) error {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	addr, _ := mail.NewAddress(rcpt)
+	e.RcptTo = []mail.Address{addr}
+	_, err := p.Process(e, TaskValidateRcpt)
+	return err
+}
+
+func TestRecipientCalloutStatic(t *testing.T) {
+	Svc.reset()
+	defer Svc.reset()
+	p := Decorate(DefaultProcessor{}, RecipientCallout())
+	if err := Svc.initialize(BackendConfig{
+		"recipient_callout_type": "static",
+		"recipient_callout_list": "Alice@example.com, @example.org",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for rcpt, want := range map[string]error{
+		"alice@Example.com":  nil,
+		"bob@example.com":    NoSuchUser,
+		"anyone@example.org": nil,
+	} {
+		if err := checkRcpt(p, rcpt); err != want {
+			t.Errorf("expecting %v for %s, got %v", want, rcpt, err)
+		}
+	}
+}
+
+func TestRecipientCalloutSQL(t *testing.T) {
+	Svc.reset()
+	defer Svc.reset()
+	p := Decorate(DefaultProcessor{}, RecipientCallout())
+	if err := Svc.initialize(BackendConfig{
+		"recipient_callout_type":       "sql",
+		"recipient_callout_sql_driver": "callout_test",
+		"recipient_callout_sql_query":  "SELECT 1 FROM users WHERE email = ?",
+		"recipient_callout_timeout":    "50ms",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = Svc.shutdown()
+	}()
+	if err := checkRcpt(p, "alice@example.com"); err != nil {
+		t.Error("expecting alice to exist, got", err)
+	}
+	if err := checkRcpt(p, "bob@example.com"); err != NoSuchUser {
+		t.Error("expecting bob to be unknown, got", err)
+	}
+	// a timeout is a temporary failure, not a rejection
+	if err := checkRcpt(p, "slow@example.com"); err != StorageTimeout {
+		t.Error("expecting a timeout, got", err)
+	}
+}
+
+func TestRecipientCalloutHTTP(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Query().Get("rcpt") {
+		case "alice@example.com":
+			w.WriteHeader(http.StatusOK)
+		case "slow@example.com":
+			time.Sleep(time.Millisecond * 200)
+		case "broken@example.com":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	Svc.reset()
+	defer Svc.reset()
+	p := Decorate(DefaultProcessor{}, RecipientCallout())
+	if err := Svc.initialize(BackendConfig{
+		"recipient_callout_type":    "http",
+		"recipient_callout_url":     ts.URL + "/check?rcpt={rcpt}",
+		"recipient_callout_timeout": "50ms",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRcpt(p, "alice@example.com"); err != nil {
+		t.Error("expecting alice to exist, got", err)
+	}
+	if err := checkRcpt(p, "bob@example.com"); err != NoSuchUser {
+		t.Error("expecting bob to be unknown, got", err)
+	}
+	if err := checkRcpt(p, "broken@example.com"); err != StorageError {
+		t.Error("expecting a storage error, got", err)
+	}
+	if err := checkRcpt(p, "slow@example.com"); err != StorageTimeout {
+		t.Error("expecting a timeout, got", err)
+	}
+
+	// both answers are cached, errors aren't
+	before := atomic.LoadInt32(&requests)
+	_ = checkRcpt(p, "alice@example.com")
+	_ = checkRcpt(p, "bob@example.com")
+	if after := atomic.LoadInt32(&requests); after != before {
+		t.Error("expecting the answers to be cached, got", after-before, "requests")
+	}
+	_ = checkRcpt(p, "broken@example.com")
+	if after := atomic.LoadInt32(&requests); after != before+1 {
+		t.Error("expecting errors not to be cached")
+	}
+}
+
+func TestRecipientCalloutUnknownType(t *testing.T) {
+	Svc.reset()
+	defer Svc.reset()
+	Decorate(DefaultProcessor{}, RecipientCallout())
+	if err := Svc.initialize(BackendConfig{"recipient_callout_type": "ldap"}); err == nil {
+		t.Error("expecting an unknown recipient_callout_type to be refused")
+	}
+}
@@ -0,0 +1,623 @@
+package backends
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: relay
+// ----------------------------------------------------------------------------------
+// Description   : Queues the message on disk and forwards it over SMTP, to a smarthost,
+//               : or to the MX of each recipient's domain. STARTTLS is used when offered,
+//               : the certificate of the smarthost is verified, while the MX certificates
+//               : are not, as there's no policy to check them against.
+//               : Messages are delivered in order of their MT-PRIORITY (RFC 6710), which
+//               : is passed on to servers that support it. The deliveries to each domain
+//               : can be throttled, recipients over the limits are deferred without
+//               : counting as an attempt.
+//               : Recipients with a temporary failure are retried later, with the delay
+//               : doubling after each attempt, up to 4 hours. Recipients with a permanent
+//               : failure, or still failing after the last retry, are bounced to the sender
+// ----------------------------------------------------------------------------------
+// Config Options: relay_queue_dir string - directory where the queued messages are kept
+//               : relay_smarthost string - <host>:<port> to forward all the messages to.
+//               : When empty, the MX of the recipient's domain is used, on port 25
+//               : relay_username string - username for AUTH PLAIN with the smarthost
+//               : relay_password string - password for AUTH PLAIN with the smarthost
+//               : relay_max_retries int - attempts before giving up, default 15
+//               : relay_retry_backoff string - delay before the first retry, default "5m"
+//               : relay_domain_max_concurrent int - deliveries to the same domain at a
+//               : time, 0 for no limit (default)
+//               : relay_domain_per_minute int - deliveries to the same domain per minute,
+//               : 0 for no limit (default)
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.MTPriority, e.DeliveryHeader and e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["relay_queue_id"] is set to the id of the queued message
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["relay"] = func() Decorator {
+		return Relay()
+	}
+}
+
+type relayConfig struct {
+	QueueDir     string `json:"relay_queue_dir"`
+	Smarthost    string `json:"relay_smarthost,omitempty"`
+	Username     string `json:"relay_username,omitempty"`
+	Password     string `json:"relay_password,omitempty"`
+	MaxRetries   int    `json:"relay_max_retries,omitempty"`
+	RetryBackoff string `json:"relay_retry_backoff,omitempty"`
+}
+
+const (
+	defaultRelayMaxRetries   = 15
+	defaultRelayRetryBackoff = time.Minute * 5
+	// relayMaxBackoff caps the delay between retries
+	relayMaxBackoff = time.Hour * 4
+	// relayQueueInterval is how often the queue is checked for messages due a retry
+	relayQueueInterval = time.Second * 30
+	// relayTimeout limits the time spent delivering to a host
+	relayTimeout = time.Minute * 5
+	// relayWorkers is how many messages are delivered at a time
+	relayWorkers = 10
+)
+
+func Relay() Decorator {
+	var queue *relayQueue
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&relayConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*relayConfig)
+		throttleConfig, err := NewDomainThrottleConfig("relay", backendConfig)
+		if err != nil {
+			return err
+		}
+		if queue, err = newRelayQueue(config); err != nil {
+			return err
+		}
+		queue.throttle = NewDomainThrottle("relay", throttleConfig)
+		queue.start()
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if queue != nil {
+			queue.stop()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				from := ""
+				if !e.MailFrom.NullPath {
+					from = e.MailFrom.String()
+				}
+				rcpts := make([]string, len(e.RcptTo))
+				for i := range e.RcptTo {
+					rcpts[i] = e.RcptTo[i].String()
+				}
+				id, err := queue.enqueue(from, rcpts, e.MTPriority, []byte(e.String()))
+				if err != nil {
+					EnvelopeLog(e).WithError(err).Error("could not queue the message for relay")
+					return NewResult(response.Canned.FailBackendTransaction, response.SP, "could not queue the message"), err
+				}
+				e.Values["relay_queue_id"] = id
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// relayEntry is a queued message, saved as <id>.json next to the message in <id>.msg
+type relayEntry struct {
+	ID          string    `json:"id"`
+	From        string    `json:"from"`
+	Rcpt        []string  `json:"rcpt"`
+	Priority    int       `json:"priority,omitempty"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// relayQueue keeps the messages to relay in a directory, and delivers them
+type relayQueue struct {
+	dir        string
+	smarthost  string
+	auth       smtp.Auth
+	maxRetries int
+	backoff    time.Duration
+	hostname   string
+	// lookupMX finds the mail servers of a domain, net.LookupMX by default
+	lookupMX func(domain string) ([]*net.MX, error)
+	// mxPort is the port of the MX hosts, 25
+	mxPort string
+	// throttle limits the deliveries to each domain
+	throttle *DomainThrottle
+	// guards against delivering the same entry twice
+	sync.Mutex
+	kick chan struct{}
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newRelayQueue(config *relayConfig) (*relayQueue, error) {
+	if config.QueueDir == "" {
+		return nil, errors.New("relay_queue_dir is required")
+	}
+	if err := os.MkdirAll(config.QueueDir, 0700); err != nil {
+		return nil, err
+	}
+	q := &relayQueue{
+		dir:        config.QueueDir,
+		smarthost:  config.Smarthost,
+		maxRetries: config.MaxRetries,
+		backoff:    defaultRelayRetryBackoff,
+		lookupMX:   net.LookupMX,
+		mxPort:     "25",
+		throttle:   NewDomainThrottle("relay", DomainThrottleConfig{}),
+	}
+	if q.maxRetries <= 0 {
+		q.maxRetries = defaultRelayMaxRetries
+	}
+	if config.RetryBackoff != "" {
+		var err error
+		if q.backoff, err = time.ParseDuration(config.RetryBackoff); err != nil || q.backoff <= 0 {
+			return nil, fmt.Errorf("invalid relay_retry_backoff: %q", config.RetryBackoff)
+		}
+	}
+	if config.Username != "" {
+		if config.Smarthost == "" {
+			return nil, errors.New("relay_username needs a relay_smarthost")
+		}
+		host, _, err := net.SplitHostPort(config.Smarthost)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay_smarthost: %s", err)
+		}
+		q.auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+	var err error
+	if q.hostname, err = os.Hostname(); err != nil {
+		q.hostname = "localhost"
+	}
+	return q, nil
+}
+
+// start delivers the queue in the background, until stop is called
+func (q *relayQueue) start() {
+	q.kick = make(chan struct{}, 1)
+	q.quit = make(chan struct{})
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		ticker := time.NewTicker(relayQueueInterval)
+		defer ticker.Stop()
+		for {
+			q.runOnce(time.Now())
+			select {
+			case <-q.quit:
+				return
+			case <-q.kick:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (q *relayQueue) stop() {
+	if q.quit != nil {
+		close(q.quit)
+		q.wg.Wait()
+		q.quit = nil
+	}
+}
+
+// enqueue saves the message in the queue, due for delivery now. priority is the MT-PRIORITY
+// of the message. Returns the id of the entry
+func (q *relayQueue) enqueue(from string, rcpts []string, priority int, msg []byte) (string, error) {
+	return q.enqueueAt(from, rcpts, priority, msg, time.Now())
+}
+
+// enqueueAt saves the message in the queue, due for delivery at now. Returns the id of the entry
+func (q *relayQueue) enqueueAt(from string, rcpts []string, priority int, msg []byte, now time.Time) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	entry := &relayEntry{
+		ID:          hex.EncodeToString(b),
+		From:        from,
+		Rcpt:        rcpts,
+		Priority:    priority,
+		NextAttempt: now,
+		Created:     now,
+	}
+	if err := q.writeFile(entry.ID+".msg", msg); err != nil {
+		return "", err
+	}
+	if err := q.save(entry); err != nil {
+		_ = os.Remove(filepath.Join(q.dir, entry.ID+".msg"))
+		return "", err
+	}
+	if q.kick != nil {
+		select {
+		case q.kick <- struct{}{}:
+		default:
+		}
+	}
+	return entry.ID, nil
+}
+
+// writeFile writes the file in the queue directory atomically
+func (q *relayQueue) writeFile(name string, data []byte) error {
+	tmp := filepath.Join(q.dir, "."+name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(q.dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+func (q *relayQueue) save(entry *relayEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return q.writeFile(entry.ID+".json", b)
+}
+
+func (q *relayQueue) remove(entry *relayEntry) {
+	_ = os.Remove(filepath.Join(q.dir, entry.ID+".json"))
+	_ = os.Remove(filepath.Join(q.dir, entry.ID+".msg"))
+}
+
+// entries returns the queued entries, by priority then oldest first
+func (q *relayQueue) entries() ([]*relayEntry, error) {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*relayEntry
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		entry := &relayEntry{}
+		if err := json.Unmarshal(b, entry); err != nil {
+			Log().WithError(err).Errorf("skipping invalid relay queue file %s", file)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Priority != entries[j].Priority {
+			return entries[i].Priority > entries[j].Priority
+		}
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+// runOnce attempts the delivery of the entries that are due at now, up to relayWorkers
+// at a time, started in the order of the queue
+func (q *relayQueue) runOnce(now time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	entries, err := q.entries()
+	if err != nil {
+		Log().WithError(err).Error("could not read the relay queue")
+		return
+	}
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, relayWorkers)
+	for _, entry := range entries {
+		if entry.NextAttempt.After(now) {
+			continue
+		}
+		msg, err := ioutil.ReadFile(filepath.Join(q.dir, entry.ID+".msg"))
+		if err != nil {
+			Log().WithError(err).Errorf("message of relay queue entry %s is missing, dropping it", entry.ID)
+			q.remove(entry)
+			continue
+		}
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(entry *relayEntry, msg []byte) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			q.attempt(entry, msg, now)
+		}(entry, msg)
+	}
+	wg.Wait()
+}
+
+// attempt delivers the entry to the recipients still in it. Delivered and permanently failed
+// recipients are removed, the failures are bounced. The entry is removed once it has no recipients.
+// Recipients in a throttled domain are kept for later, they don't count as an attempt
+func (q *relayQueue) attempt(entry *relayEntry, msg []byte, now time.Time) {
+	results := make(map[string]error, len(entry.Rcpt))
+	var wait time.Duration
+	attempted := false
+	for domain, rcpts := range q.routes(entry.Rcpt) {
+		release, retryAfter := q.throttle.Acquire(domain)
+		if release == nil {
+			for _, rcpt := range rcpts {
+				results[rcpt] = ErrThrottled
+			}
+			if retryAfter < relayQueueInterval {
+				// waiting for a concurrent delivery, or almost due
+				retryAfter = relayQueueInterval
+			}
+			if wait == 0 || retryAfter < wait {
+				wait = retryAfter
+			}
+			continue
+		}
+		attempted = true
+		for rcpt, err := range q.deliver(domain, entry.From, rcpts, entry.Priority, msg) {
+			results[rcpt] = err
+		}
+		release()
+	}
+	if attempted {
+		entry.Attempts++
+	}
+	var failed []mail.DSNRecipient
+	var deferred []string
+	retrying := false
+	for _, rcpt := range entry.Rcpt {
+		err := results[rcpt]
+		if err == nil {
+			continue
+		}
+		entry.LastError = err.Error()
+		if err == ErrThrottled {
+			deferred = append(deferred, rcpt)
+		} else if isPermanent(err) || entry.Attempts >= q.maxRetries {
+			failed = append(failed, relayFailure(rcpt, err))
+		} else {
+			deferred = append(deferred, rcpt)
+			retrying = true
+		}
+	}
+	logger := Log().WithField("queue_id", entry.ID)
+	if len(failed) > 0 {
+		logger.WithField("failed", failed).Warn("relay failed, bouncing")
+		q.bounce(entry, msg, failed, now)
+	}
+	if len(deferred) == 0 {
+		q.remove(entry)
+		return
+	}
+	entry.Rcpt = deferred
+	if retrying {
+		entry.NextAttempt = now.Add(q.retryDelay(entry.Attempts))
+	}
+	if wait > 0 && (!retrying || now.Add(wait).Before(entry.NextAttempt)) {
+		entry.NextAttempt = now.Add(wait)
+	}
+	logger.Infof("relay deferred for %d recipients until %s: %s", len(deferred), entry.NextAttempt, entry.LastError)
+	if err := q.save(entry); err != nil {
+		logger.WithError(err).Error("could not update the relay queue entry")
+	}
+}
+
+// retryDelay is the delay before the next attempt, after the given number of attempts
+func (q *relayQueue) retryDelay(attempts int) time.Duration {
+	delay := q.backoff
+	for i := 1; i < attempts && delay < relayMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > relayMaxBackoff {
+		delay = relayMaxBackoff
+	}
+	return delay
+}
+
+// bounce queues a DSN for the sender listing the failed recipients.
+// The DSN is due at now, the time of the attempt that failed.
+// Nothing is sent if the sender is the null reverse-path, so that bounces never loop
+func (q *relayQueue) bounce(entry *relayEntry, msg []byte, failed []mail.DSNRecipient, now time.Time) {
+	dsn, err := mail.NewDSN(q.hostname, entry.From, mail.HeadersOf(msg), failed...)
+	if err != nil {
+		return
+	}
+	dsn.ArrivalDate = entry.Created
+	if _, err := q.enqueueAt("", []string{entry.From}, 0, dsn.Bytes(), now); err != nil {
+		Log().WithError(err).WithField("queue_id", entry.ID).Error("could not queue the bounce")
+	}
+}
+
+// routes groups the recipients by their domain
+func (q *relayQueue) routes(rcpts []string) map[string][]string {
+	routes := make(map[string][]string)
+	for _, rcpt := range rcpts {
+		domain := strings.ToLower(rcpt[strings.LastIndex(rcpt, "@")+1:])
+		routes[domain] = append(routes[domain], rcpt)
+	}
+	return routes
+}
+
+// deliver sends the message to the recipients in domain, to the smarthost or the MX of the domain,
+// and returns the outcome for each recipient, nil if delivered
+func (q *relayQueue) deliver(domain, from string, rcpts []string, priority int, msg []byte) map[string]error {
+	results := make(map[string]error, len(rcpts))
+	addrs := []string{q.smarthost}
+	if q.smarthost == "" {
+		addrs = nil
+		mxs, err := q.lookupMX(domain)
+		if isNoSuchHost(err) {
+			// no MX, the domain itself is the mail server
+			mxs, err = []*net.MX{{Host: domain}}, nil
+		}
+		if err != nil {
+			for _, rcpt := range rcpts {
+				results[rcpt] = err
+			}
+			return results
+		}
+		for _, mx := range mxs {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), q.mxPort))
+		}
+	}
+	for _, addr := range addrs {
+		var err error
+		results, err = q.send(addr, from, rcpts, priority, msg)
+		if err == nil {
+			return results
+		}
+		for _, rcpt := range rcpts {
+			results[rcpt] = err
+		}
+		if isPermanent(err) {
+			return results
+		}
+		// try the next MX
+		Log().WithError(err).Debugf("relay to %s failed", addr)
+	}
+	return results
+}
+
+// send delivers the message to the mail server at addr. The error is for the whole
+// transaction, otherwise the outcome of each recipient is returned
+func (q *relayQueue) send(addr, from string, rcpts []string, priority int, msg []byte) (map[string]error, error) {
+	results := make(map[string]error, len(rcpts))
+	conn, err := net.DialTimeout("tcp", addr, relayTimeout)
+	if err != nil {
+		return results, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err = conn.SetDeadline(time.Now().Add(relayTimeout)); err != nil {
+		return results, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return results, err
+	}
+	if err = c.Hello(q.hostname); err != nil {
+		return results, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		// MX hosts are only encrypted to, as nothing says what their certificates should be
+		tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: q.smarthost == ""}
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return results, err
+		}
+	}
+	if q.auth != nil {
+		if err = c.Auth(q.auth); err != nil {
+			return results, err
+		}
+	}
+	if err = relayMail(c, from, priority); err != nil {
+		return results, err
+	}
+	var accepted []string
+	for _, rcpt := range rcpts {
+		if results[rcpt] = c.Rcpt(rcpt); results[rcpt] == nil {
+			accepted = append(accepted, rcpt)
+		}
+	}
+	if len(accepted) == 0 {
+		_ = c.Quit()
+		return results, nil
+	}
+	w, err := c.Data()
+	if err != nil {
+		return results, err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return results, err
+	}
+	if err = w.Close(); err != nil {
+		return results, err
+	}
+	_ = c.Quit()
+	return results, nil
+}
+
+// relayMail sends MAIL FROM, with the MT-PRIORITY parameter when the message has a priority
+// and the server supports it. smtp.Client.Mail can't send other parameters
+func relayMail(c *smtp.Client, from string, priority int) error {
+	if ok, _ := c.Extension("MT-PRIORITY"); !ok || priority == 0 {
+		return c.Mail(from)
+	}
+	params := ""
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		params = " BODY=8BITMIME"
+	}
+	id, err := c.Text.Cmd("MAIL FROM:<%s>%s MT-PRIORITY=%d", from, params, priority)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	return err
+}
+
+// isNoSuchHost returns true if err is a DNS error for a name without records of the type looked up.
+// net.DNSError.IsNotFound is only in Go 1.13 and later
+func isNoSuchHost(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.Err == "no such host"
+}
+
+// relayFailure returns the delivery status of rcpt that failed with err. The status of a
+// reply is taken from its code and text, as the text is quoted by textproto.Error.Error
+func relayFailure(rcpt string, err error) mail.DSNRecipient {
+	if tpErr, ok := err.(*textproto.Error); ok {
+		return mail.NewDSNReply(rcpt, tpErr.Code, tpErr.Msg)
+	}
+	return mail.NewDSNRecipient(rcpt, err.Error())
+}
+
+// isPermanent returns true if err is a 5xx reply
+func isPermanent(err error) bool {
+	tpErr, ok := err.(*textproto.Error)
+	return ok && tpErr.Code >= 500
+}
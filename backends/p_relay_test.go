@@ -0,0 +1,359 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubMessage struct {
+	from   string
+	params string
+	rcpts  []string
+	data   string
+}
+
+// stubSMTPServer is an upstream mail server that replies to RCPT with rcptReply
+type stubSMTPServer struct {
+	sync.Mutex
+	listener  net.Listener
+	rcptReply func(rcpt string) string
+	received  []stubMessage
+	// extensions are advertised in reply to EHLO, after 8BITMIME
+	extensions []string
+}
+
+func newStubSMTPServer(t *testing.T, rcptReply func(rcpt string) string) *stubSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubSMTPServer{listener: l, rcptReply: rcptReply}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *stubSMTPServer) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	in := bufio.NewReader(conn)
+	reply := func(r string) {
+		_, _ = conn.Write([]byte(r + "\r\n"))
+	}
+	reply("220 stub ESMTP")
+	var msg stubMessage
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "EHLO "), strings.HasPrefix(line, "HELO "):
+			s.Lock()
+			ehlo := append([]string{"stub", "8BITMIME"}, s.extensions...)
+			s.Unlock()
+			for i := range ehlo[:len(ehlo)-1] {
+				ehlo[i] = "250-" + ehlo[i]
+			}
+			ehlo[len(ehlo)-1] = "250 " + ehlo[len(ehlo)-1]
+			reply(strings.Join(ehlo, "\r\n"))
+		case strings.HasPrefix(line, "MAIL FROM:"):
+			args := strings.SplitN(line[len("MAIL FROM:"):]+" ", " ", 2)
+			msg = stubMessage{from: strings.Trim(args[0], "<>"), params: strings.TrimSpace(args[1])}
+			reply("250 2.1.0 Ok")
+		case strings.HasPrefix(line, "RCPT TO:"):
+			rcpt := strings.Trim(line[len("RCPT TO:"):], "<>")
+			r := s.rcptReply(rcpt)
+			if strings.HasPrefix(r, "250") {
+				msg.rcpts = append(msg.rcpts, rcpt)
+			}
+			reply(r)
+		case line == "DATA":
+			reply("354 go ahead")
+			var data bytes.Buffer
+			for {
+				l, err := in.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			msg.data = data.String()
+			s.Lock()
+			s.received = append(s.received, msg)
+			s.Unlock()
+			reply("250 2.0.0 queued")
+		case line == "QUIT":
+			reply("221 2.0.0 Bye")
+			return
+		default:
+			reply("250 Ok")
+		}
+	}
+}
+
+func (s *stubSMTPServer) messages() []stubMessage {
+	s.Lock()
+	defer s.Unlock()
+	return append([]stubMessage(nil), s.received...)
+}
+
+func relayTestQueue(t *testing.T, config *relayConfig) (*relayQueue, func()) {
+	dir, err := ioutil.TempDir("", "relay_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.QueueDir = dir
+	q, err := newRelayQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestRelayQueue(t *testing.T) {
+	var deferredOnce sync.Once
+	upstream := newStubSMTPServer(t, func(rcpt string) string {
+		switch rcpt {
+		case "later@example.com":
+			deferred := false
+			deferredOnce.Do(func() {
+				deferred = true
+			})
+			if deferred {
+				return "451 4.7.1 try again later"
+			}
+		case "bad@example.com":
+			return "550 5.1.1 no such user"
+		}
+		return "250 2.1.5 Ok"
+	})
+	defer func() {
+		_ = upstream.listener.Close()
+	}()
+	q, cleanup := relayTestQueue(t, &relayConfig{Smarthost: upstream.listener.Addr().String(), RetryBackoff: "1m"})
+	defer cleanup()
+
+	msg := "Subject: relay test\r\n\r\nhello\r\n"
+	if _, err := q.enqueue("sender@example.com",
+		[]string{"ok@example.com", "later@example.com", "bad@example.com"}, 0, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.runOnce(now)
+	received := upstream.messages()
+	if len(received) != 1 || strings.Join(received[0].rcpts, ",") != "ok@example.com" || received[0].data != msg {
+		t.Fatal("expecting the message to be delivered to ok@example.com only, got", received)
+	}
+	entries, _ := q.entries()
+	if len(entries) != 2 {
+		t.Fatal("expecting the deferred message and a bounce in the queue, got", len(entries))
+	}
+	deferred, bounce := entries[0], entries[1]
+	if strings.Join(deferred.Rcpt, ",") != "later@example.com" || deferred.Attempts != 1 ||
+		!deferred.NextAttempt.Equal(now.Add(time.Minute)) {
+		t.Error("expecting later@example.com to be retried in a minute, got", deferred)
+	}
+	if bounce.From != "" || strings.Join(bounce.Rcpt, ",") != "sender@example.com" {
+		t.Error("expecting a bounce from <> to the sender, got", bounce)
+	}
+
+	// the bounce is due, the deferred message isn't
+	q.runOnce(now)
+	received = upstream.messages()
+	if len(received) != 2 || received[1].from != "" ||
+		!strings.Contains(received[1].data, "report-type=delivery-status") ||
+		!strings.Contains(received[1].data, "Final-Recipient: rfc822; bad@example.com\r\n") ||
+		!strings.Contains(received[1].data, "Status: 5.1.1\r\n") {
+		t.Fatal("expecting a DSN for bad@example.com to be sent, got", received)
+	}
+
+	q.runOnce(now.Add(time.Minute))
+	received = upstream.messages()
+	if len(received) != 3 || strings.Join(received[2].rcpts, ",") != "later@example.com" {
+		t.Fatal("expecting the retry to deliver to later@example.com, got", received)
+	}
+	if entries, _ = q.entries(); len(entries) != 0 {
+		t.Error("expecting the queue to be empty, got", len(entries))
+	}
+	if files, _ := ioutil.ReadDir(q.dir); len(files) != 0 {
+		t.Error("expecting no files left in the queue directory, got", len(files))
+	}
+}
+
+func TestRelayMaxRetries(t *testing.T) {
+	upstream := newStubSMTPServer(t, func(rcpt string) string {
+		return "451 4.3.0 temporary failure"
+	})
+	defer func() {
+		_ = upstream.listener.Close()
+	}()
+	q, cleanup := relayTestQueue(t, &relayConfig{Smarthost: upstream.listener.Addr().String(), MaxRetries: 2})
+	defer cleanup()
+
+	// no bounces are sent for bounces
+	if _, err := q.enqueue("", []string{"later@example.com"}, 0, []byte("Subject: test\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.runOnce(now)
+	if entries, _ := q.entries(); len(entries) != 1 || entries[0].Attempts != 1 {
+		t.Fatal("expecting the message to be deferred")
+	}
+	q.runOnce(now.Add(q.retryDelay(1)))
+	if entries, _ := q.entries(); len(entries) != 0 {
+		t.Error("expecting the message to be given up on after 2 attempts, got", len(entries), "entries")
+	}
+}
+
+func TestRelayRetryDelay(t *testing.T) {
+	q := &relayQueue{backoff: time.Minute * 5}
+	for attempts, want := range map[int]time.Duration{
+		1:  time.Minute * 5,
+		2:  time.Minute * 10,
+		4:  time.Minute * 40,
+		20: relayMaxBackoff,
+	} {
+		if got := q.retryDelay(attempts); got != want {
+			t.Errorf("expecting a delay of %s after %d attempts, got %s", want, attempts, got)
+		}
+	}
+}
+
+func TestRelayMX(t *testing.T) {
+	upstream := newStubSMTPServer(t, func(rcpt string) string {
+		return "250 2.1.5 Ok"
+	})
+	defer func() {
+		_ = upstream.listener.Close()
+	}()
+	q, cleanup := relayTestQueue(t, &relayConfig{})
+	defer cleanup()
+	_, q.mxPort, _ = net.SplitHostPort(upstream.listener.Addr().String())
+	q.lookupMX = func(domain string) ([]*net.MX, error) {
+		if domain != "example.org" {
+			t.Error("expecting the MX of example.org to be looked up, got", domain)
+		}
+		return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, nil
+	}
+	routes := q.routes([]string{"a@example.org", "b@example.net", "c@example.org"})
+	if len(routes) != 2 || len(routes["example.org"]) != 2 {
+		t.Error("expecting the recipients to be grouped by domain, got", routes)
+	}
+	results := q.deliver("example.org", "sender@example.com", routes["example.org"], 0, []byte("Subject: test\r\n\r\n"))
+	if len(results) != 2 || results["a@example.org"] != nil || results["c@example.org"] != nil {
+		t.Error("expecting both recipients to be delivered, got", results)
+	}
+	if received := upstream.messages(); len(received) != 1 || len(received[0].rcpts) != 2 {
+		t.Error("expecting one message for both recipients, got", received)
+	}
+}
+
+// Deliveries over the domain limit are deferred until the throttle lets them through,
+// without counting as an attempt
+func TestRelayDomainThrottle(t *testing.T) {
+	upstream := newStubSMTPServer(t, func(rcpt string) string {
+		return "250 2.1.5 Ok"
+	})
+	defer func() {
+		_ = upstream.listener.Close()
+	}()
+	q, cleanup := relayTestQueue(t, &relayConfig{Smarthost: upstream.listener.Addr().String()})
+	defer cleanup()
+	now := time.Now()
+	q.throttle = NewDomainThrottle("relay", DomainThrottleConfig{PerMinute: 1})
+	q.throttle.now = func() time.Time { return now }
+	m := NewMetrics()
+	SetMetrics(m)
+	defer SetMetrics(nil)
+
+	for _, rcpt := range []string{"a@example.com", "b@example.com", "c@example.org"} {
+		if _, err := q.enqueueAt("sender@example.com", []string{rcpt}, 0, []byte("Subject: test\r\n\r\n"), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.runOnce(now)
+	if received := upstream.messages(); len(received) != 2 {
+		t.Fatal("expecting one message for each domain, got", received)
+	}
+	entries, _ := q.entries()
+	if len(entries) != 1 || entries[0].Attempts != 0 || entries[0].LastError != ErrThrottled.Error() ||
+		!entries[0].NextAttempt.Equal(now.Add(time.Minute)) {
+		t.Fatal("expecting the second message to example.com to be deferred for a minute, got", entries)
+	}
+	var out bytes.Buffer
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `guerrilla_domain_throttled_total{throttle="relay",domain="example.com"} 1`) {
+		t.Error("expecting the throttled delivery to be counted, got", out.String())
+	}
+
+	now = now.Add(time.Minute)
+	q.runOnce(now)
+	if received := upstream.messages(); len(received) != 3 {
+		t.Fatal("expecting the deferred message to be delivered a minute later, got", received)
+	}
+	if entries, _ = q.entries(); len(entries) != 0 {
+		t.Error("expecting the queue to be empty, got", len(entries))
+	}
+}
+
+// Messages are delivered by priority, which is passed on when the server supports MT-PRIORITY
+func TestRelayMTPriority(t *testing.T) {
+	upstream := newStubSMTPServer(t, func(rcpt string) string {
+		return "250 2.1.5 Ok"
+	})
+	defer func() {
+		_ = upstream.listener.Close()
+	}()
+	q, cleanup := relayTestQueue(t, &relayConfig{Smarthost: upstream.listener.Addr().String()})
+	defer cleanup()
+
+	for _, priority := range []int{0, 5, -3} {
+		if _, err := q.enqueue("sender@example.com", []string{"rcpt@example.com"}, priority, []byte("Subject: test\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, _ := q.entries()
+	if len(entries) != 3 || entries[0].Priority != 5 || entries[1].Priority != 0 || entries[2].Priority != -3 {
+		t.Fatal("expecting the entries in order of priority, got", entries)
+	}
+
+	q.runOnce(time.Now())
+	received := upstream.messages()
+	if len(received) != 3 || strings.Contains(received[0].params, "MT-PRIORITY") {
+		t.Fatal("expecting no MT-PRIORITY for a server without the extension, got", received)
+	}
+	upstream.Lock()
+	upstream.extensions = []string{"MT-PRIORITY MIXER"}
+	upstream.Unlock()
+	if _, err := q.enqueue("sender@example.com", []string{"rcpt@example.com"}, 5, []byte("Subject: test\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	q.runOnce(time.Now())
+	if received = upstream.messages(); len(received) != 4 || received[3].params != "BODY=8BITMIME MT-PRIORITY=5" {
+		t.Error("expecting MT-PRIORITY=5 to be passed on, got", received)
+	}
+}
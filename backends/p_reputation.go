@@ -0,0 +1,134 @@
+package backends
+
+import (
+	"errors"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: reputation
+// ----------------------------------------------------------------------------------
+// Description   : Scores senders by their IP address and MAIL FROM domain over time,
+//               : using the results of the check processors placed before it, and
+//               : throttles or rejects senders whose score falls below a threshold.
+//               : Place it in validate_process too, so that recipients rejected with
+//               : NoSuchUser lower the score. Current scores are published with expvar
+//               : as "guerrilla_reputation"
+// ----------------------------------------------------------------------------------
+// Config Options: reputation_half_life string - scores halve after this duration, default "24h"
+//               : reputation_throttle_below int - defer messages with a 451 when the
+//               : score is below this (negative) value, 0 to disable
+//               : reputation_reject_below int - reject messages with a 554 when the score
+//               : is below this (negative) value, 0 to disable
+//               : reputation_trusted_above int - mark a sender as trusted when the score
+//               : is at least this value, 0 to disable
+// --------------:-------------------------------------------------------------------
+// Input         : e.Values["spf"], e.Values["dkim"], e.Values["dmarc"] - "pass" or "fail"
+//               : e.Values["spam"] - true if a spam check found the message to be spam
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["reputation"] is set to the sender's score, a float64
+//               : e.Values["reputation_trusted"] is set to true for trusted senders,
+//               : so that processors after this one can fast-track them
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["reputation"] = func() Decorator {
+		return ReputationScore()
+	}
+}
+
+type reputationConfig struct {
+	HalfLife      string `json:"reputation_half_life,omitempty"`
+	ThrottleBelow int    `json:"reputation_throttle_below,omitempty"`
+	RejectBelow   int    `json:"reputation_reject_below,omitempty"`
+	TrustedAbove  int    `json:"reputation_trusted_above,omitempty"`
+}
+
+// reputationSignals are the results set by other processors, and how much they move the score
+var reputationSignals = map[string]map[string]float64{
+	"spf":   {"pass": 1, "fail": -2, "softfail": -1},
+	"dkim":  {"pass": 1, "fail": -2},
+	"dmarc": {"pass": 1, "fail": -3},
+}
+
+const (
+	reputationSpam       = -5
+	reputationHam        = 1
+	reputationNoSuchUser = -1
+)
+
+func ReputationScore() Decorator {
+	var config *reputationConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&reputationConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*reputationConfig)
+		if config.HalfLife != "" {
+			halfLife, err := time.ParseDuration(config.HalfLife)
+			if err != nil || halfLife <= 0 {
+				return convertError("property invalid: 'reputation_half_life' must be a duration, eg. \"24h\"")
+			}
+			reputation.SetHalfLife(halfLife)
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt {
+				result, err := p.Process(e, task)
+				if err == NoSuchUser {
+					for _, key := range ReputationKeys(e) {
+						reputation.Add(key, reputationNoSuchUser)
+					}
+				}
+				return result, err
+			} else if task == TaskSaveMail {
+				delta := reputationDelta(e)
+				// the sender is as good as its worst key
+				score := 0.0
+				for i, key := range ReputationKeys(e) {
+					s := reputation.Add(key, delta)
+					if i == 0 || s < score {
+						score = s
+					}
+				}
+				e.Values["reputation"] = score
+				if config.RejectBelow != 0 && score < float64(config.RejectBelow) {
+					return NewResult(response.Canned.FailReputation), errors.New("sender reputation too low")
+				}
+				if config.ThrottleBelow != 0 && score < float64(config.ThrottleBelow) {
+					return NewResult(response.Canned.ErrorReputation), errors.New("sender throttled")
+				}
+				if config.TrustedAbove != 0 && score >= float64(config.TrustedAbove) {
+					e.Values["reputation_trusted"] = true
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// reputationDelta adds up the signals recorded on the envelope
+func reputationDelta(e *mail.Envelope) (delta float64) {
+	for name, results := range reputationSignals {
+		if result, ok := e.Values[name].(string); ok {
+			delta += results[result]
+		}
+	}
+	if spam, ok := e.Values["spam"].(bool); ok {
+		if spam {
+			delta += reputationSpam
+		} else {
+			delta += reputationHam
+		}
+	}
+	return
+}
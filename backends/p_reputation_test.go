@@ -0,0 +1,93 @@
+package backends
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestReputationStoreDecay(t *testing.T) {
+	now := time.Now()
+	r := NewReputationStore(time.Hour)
+	r.now = func() time.Time { return now }
+	r.Add("ip:192.0.2.1", -8)
+	r.Add("ip:192.0.2.1", 2)
+	if s := r.Score("ip:192.0.2.1"); s != -6 {
+		t.Error("expecting -6, got", s)
+	}
+	now = now.Add(time.Hour * 2)
+	if s := r.Score("ip:192.0.2.1"); math.Abs(s+1.5) > 0.0001 {
+		t.Error("expecting the score to decay to -1.5 after two half-lives, got", s)
+	}
+	now = now.Add(time.Hour * 24)
+	if scores := r.Scores(); len(scores) != 0 {
+		t.Error("expecting decayed scores to be forgotten, got", scores)
+	}
+}
+
+func TestReputationProcessor(t *testing.T) {
+	defer func(r *ReputationStore) { reputation = r }(reputation)
+	reputation = NewReputationStore(time.Hour)
+	now := time.Now()
+	reputation.now = func() time.Time { return now }
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, ReputationScore())
+	err := Svc.initialize(BackendConfig{
+		"reputation_throttle_below": -6,
+		"reputation_reject_below":   -10,
+		"reputation_trusted_above":  3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEnvelope := func(ip, host string) *mail.Envelope {
+		e := mail.NewEnvelope(ip, 1)
+		e.MailFrom = mail.Address{User: "sender", Host: host}
+		return e
+	}
+
+	// a good sender becomes trusted
+	for i := 0; i < 2; i++ {
+		e := newEnvelope("192.0.2.1", "Example.com")
+		e.Values["spf"] = "pass"
+		e.Values["spam"] = false
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Error(err)
+		}
+		if trusted := e.Values["reputation_trusted"] == true; trusted != (i == 1) {
+			t.Error("unexpected trust after", i+1, "good messages, score", e.Values["reputation"])
+		}
+	}
+	if s := Reputation("domain:example.com"); s != 4 {
+		t.Error("expecting domain:example.com to score 4, got", s)
+	}
+
+	// repeat spam from another address is throttled, then rejected
+	codes := []int{0, 451, 554}
+	for i, code := range codes {
+		e := newEnvelope("192.0.2.66", "spam.example")
+		e.Values["spam"] = true
+		result, err := p.Process(e, TaskSaveMail)
+		if code == 0 {
+			if err != nil {
+				t.Error("first spam should not be throttled yet", err)
+			}
+		} else if result.Code() != code {
+			t.Error("message", i+1, "expecting", code, "got", result)
+		}
+	}
+
+	// unknown recipients count against the sender
+	e := newEnvelope("192.0.2.99", "")
+	rcpt := Decorate(ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+		return NewResult("550 no"), NoSuchUser
+	}), ReputationScore())
+	if _, err := rcpt.Process(e, TaskValidateRcpt); err != NoSuchUser {
+		t.Error("expecting NoSuchUser, got", err)
+	}
+	if s := Reputation("ip:192.0.2.99"); s != reputationNoSuchUser {
+		t.Error("expecting score", reputationNoSuchUser, "got", s)
+	}
+}
@@ -0,0 +1,330 @@
+package backends
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: rewrite
+// ----------------------------------------------------------------------------------
+// Description   : Rewrites the sender and recipient addresses. Regexp rules are applied
+//               : first, to the sender and to each recipient, then the recipients are
+//               : looked up in a virtual alias table, where an address can expand to
+//               : several others. Aliases are expanded again, up to 10 levels deep.
+//               : When placed in validate_process, the recipient is rewritten at RCPT
+//               : so that later validators check the real mailbox. Aliases that expand to
+//               : more than one address are only expanded when the message is saved
+// ----------------------------------------------------------------------------------
+// Config Options: rewrite_rules string - rules separated by ";", each a regexp and its
+//               : replacement separated by a space, matched against the lower case
+//               : address. The first rule that matches is used, eg.
+//               : "^([^+]+)\+.*@(.*)$ $1@$2" strips plus-addressing
+//               : rewrite_alias_file string - path to the alias table, one alias per line,
+//               : the address then a comma separated list of targets, eg.
+//               : "team@example.com jane@example.com, bob@example.com"
+//               : "@example.com" is a catch-all for a domain, a target "@example.net"
+//               : keeps the local part. Lines starting with # are ignored
+//               : rewrite_alias_sql_driver string - database driver for an alias table in SQL
+//               : rewrite_alias_sql_dsn string - data source name of the alias table
+//               : rewrite_alias_sql_query string - query with one placeholder, for the
+//               : address or "@domain", returning a row for each target, eg.
+//               : "SELECT target FROM aliases WHERE alias = ?"
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : e.MailFrom and e.RcptTo are rewritten, e.Values["original_rcpt_to"] is
+//               : set to the []mail.Address before rewriting if any recipient changed
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["rewrite"] = func() Decorator {
+		return Rewrite()
+	}
+}
+
+type rewriteConfig struct {
+	Rules          string `json:"rewrite_rules,omitempty"`
+	AliasFile      string `json:"rewrite_alias_file,omitempty"`
+	AliasSQLDriver string `json:"rewrite_alias_sql_driver,omitempty"`
+	AliasSQLDSN    string `json:"rewrite_alias_sql_dsn,omitempty"`
+	AliasSQLQuery  string `json:"rewrite_alias_sql_query,omitempty"`
+}
+
+// maxAliasDepth limits how many times an alias can expand to other aliases
+const maxAliasDepth = 10
+
+func Rewrite() Decorator {
+	var rewriter *addressRewriter
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&rewriteConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*rewriteConfig)
+		rewriter = &addressRewriter{}
+		if rewriter.rules, err = parseRewriteRules(config.Rules); err != nil {
+			return err
+		}
+		if config.AliasFile != "" && config.AliasSQLDriver != "" {
+			return errors.New("only one of rewrite_alias_file and rewrite_alias_sql_driver can be set")
+		}
+		if config.AliasFile != "" {
+			if rewriter.aliases, err = loadAliasFile(config.AliasFile); err != nil {
+				return err
+			}
+		} else if config.AliasSQLDriver != "" {
+			if config.AliasSQLQuery == "" {
+				return errors.New("rewrite_alias_sql_query is required")
+			}
+			db, err := sql.Open(config.AliasSQLDriver, config.AliasSQLDSN)
+			if err != nil {
+				return err
+			}
+			rewriter.aliases = &sqlAliasTable{db: db, query: config.AliasSQLQuery}
+		}
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if rewriter == nil {
+			return nil
+		}
+		if t, ok := rewriter.aliases.(*sqlAliasTable); ok {
+			return t.db.Close()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt {
+				// the recipient being validated is the last one added
+				if len(e.RcptTo) == 0 {
+					return p.Process(e, task)
+				}
+				rcpt := &e.RcptTo[len(e.RcptTo)-1]
+				expanded, err := rewriter.expand(*rcpt)
+				if err != nil {
+					EnvelopeLog(e).WithError(err).Error("could not look up alias")
+					return NewResult(response.Canned.ErrorRcptStorage), StorageError
+				}
+				if len(expanded) == 1 {
+					*rcpt = expanded[0]
+				}
+				return p.Process(e, task)
+			} else if task == TaskSaveMail {
+				if !e.MailFrom.NullPath && !e.MailFrom.IsEmpty() {
+					e.MailFrom = rewriter.rewrite(e.MailFrom)
+				}
+				original := e.RcptTo
+				var rcptTo []mail.Address
+				seen := make(map[string]bool, len(original))
+				changed := false
+				for i := range original {
+					expanded, err := rewriter.expand(original[i])
+					if err != nil {
+						EnvelopeLog(e).WithError(err).Error("could not look up alias")
+						return NewResult(response.Canned.FailBackendTransaction, response.SP, "alias lookup failed"), err
+					}
+					if len(expanded) != 1 || expanded[0].String() != original[i].String() {
+						changed = true
+					}
+					for _, a := range expanded {
+						if key := strings.ToLower(a.String()); !seen[key] {
+							seen[key] = true
+							rcptTo = append(rcptTo, a)
+						}
+					}
+				}
+				if changed {
+					e.Values["original_rcpt_to"] = original
+					e.RcptTo = rcptTo
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// rewriteRule replaces addresses that match pattern with replacement, which can refer to
+// the submatches as $1, $2...
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func parseRewriteRules(rules string) ([]rewriteRule, error) {
+	var parsed []rewriteRule
+	for _, rule := range strings.Split(rules, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid rewrite rule %q, expecting a regexp and a replacement", rule)
+		}
+		pattern, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule %q: %s", rule, err)
+		}
+		parsed = append(parsed, rewriteRule{pattern: pattern, replacement: fields[1]})
+	}
+	return parsed, nil
+}
+
+// aliasTable looks up the targets of an alias, returning none if it's not an alias
+type aliasTable interface {
+	lookup(alias string) ([]string, error)
+}
+
+// fileAliasTable is an alias table loaded from a file
+type fileAliasTable map[string][]string
+
+func loadAliasFile(path string) (fileAliasTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	table := make(fileAliasTable)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		alias := strings.ToLower(fields[0])
+		var targets []string
+		for _, target := range strings.Split(strings.Join(fields[1:], " "), ",") {
+			if target = strings.TrimSpace(target); target != "" {
+				targets = append(targets, target)
+			}
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("alias %s in %s has no targets", alias, path)
+		}
+		table[alias] = append(table[alias], targets...)
+	}
+	return table, scanner.Err()
+}
+
+func (t fileAliasTable) lookup(alias string) ([]string, error) {
+	return t[alias], nil
+}
+
+// sqlAliasTable is an alias table in a database, queried for each lookup
+type sqlAliasTable struct {
+	db    *sql.DB
+	query string
+}
+
+func (t *sqlAliasTable) lookup(alias string) ([]string, error) {
+	rows, err := t.db.Query(t.query, alias)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var targets []string
+	for rows.Next() {
+		var target string
+		if err := rows.Scan(&target); err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, rows.Err()
+}
+
+// addressRewriter applies the rewrite rules and the alias table
+type addressRewriter struct {
+	rules   []rewriteRule
+	aliases aliasTable
+}
+
+// rewrite returns the address rewritten by the first rule that matches it
+func (r *addressRewriter) rewrite(a mail.Address) mail.Address {
+	addr := strings.ToLower(a.String())
+	for _, rule := range r.rules {
+		if !rule.pattern.MatchString(addr) {
+			continue
+		}
+		if user, host, ok := splitAddress(rule.pattern.ReplaceAllString(addr, rule.replacement)); ok {
+			a.User, a.Host = user, host
+		}
+		break
+	}
+	return a
+}
+
+// expand rewrites the address, then expands it if it's an alias
+func (r *addressRewriter) expand(a mail.Address) ([]mail.Address, error) {
+	return r.expandAlias(r.rewrite(a), 0)
+}
+
+func (r *addressRewriter) expandAlias(a mail.Address, depth int) ([]mail.Address, error) {
+	if r.aliases == nil || depth >= maxAliasDepth {
+		return []mail.Address{a}, nil
+	}
+	addr := strings.ToLower(a.String())
+	targets, err := r.aliases.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		// catch-all for the domain
+		if targets, err = r.aliases.lookup("@" + strings.ToLower(a.Host)); err != nil {
+			return nil, err
+		}
+	}
+	if len(targets) == 0 {
+		return []mail.Address{a}, nil
+	}
+	var expanded []mail.Address
+	for _, target := range targets {
+		if strings.HasPrefix(target, "@") {
+			// domain mapping, keeps the local part
+			target = a.User + target
+		}
+		user, host, ok := splitAddress(target)
+		if !ok {
+			return nil, fmt.Errorf("invalid target %q for alias %s", target, addr)
+		}
+		t := a
+		t.User, t.Host = user, host
+		if strings.ToLower(t.String()) == addr {
+			// an alias that also delivers to itself
+			expanded = append(expanded, t)
+			continue
+		}
+		more, err := r.expandAlias(t, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, more...)
+	}
+	return expanded, nil
+}
+
+// splitAddress splits an address into the local part and domain, at the last @
+func splitAddress(addr string) (user, host string, ok bool) {
+	i := strings.LastIndex(addr, "@")
+	if i < 1 || i == len(addr)-1 {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
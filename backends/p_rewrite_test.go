@@ -0,0 +1,130 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func rewriteTestProcessor(t *testing.T, config BackendConfig, aliases string) Processor {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	if aliases != "" {
+		file := filepath.Join(dir, "aliases")
+		if err := ioutil.WriteFile(file, []byte(aliases), 0600); err != nil {
+			t.Fatal(err)
+		}
+		config["rewrite_alias_file"] = file
+	}
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, Rewrite())
+	if err := Svc.initialize(config); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func rcptStrings(rcpts []mail.Address) []string {
+	var s []string
+	for i := range rcpts {
+		s = append(s, rcpts[i].String())
+	}
+	return s
+}
+
+func TestRewriteAliasExpansion(t *testing.T) {
+	p := rewriteTestProcessor(t, BackendConfig{}, `# aliases
+team@example.com   jane@example.com, staff@example.com
+staff@example.com  bob@example.com,ann@example.com
+jane@example.com   jane@example.com, archive@example.com
+`)
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "sender", Host: "example.org"}
+	e.RcptTo = []mail.Address{{User: "Team", Host: "example.com"}, {User: "bob", Host: "example.com"}}
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	got := rcptStrings(e.RcptTo)
+	expect := []string{"jane@example.com", "archive@example.com", "bob@example.com", "ann@example.com"}
+	if len(got) != len(expect) {
+		t.Fatal("expecting", expect, "got", got)
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Error("expecting", expect[i], "got", got[i])
+		}
+	}
+	if original, ok := e.Values["original_rcpt_to"].([]mail.Address); !ok || len(original) != 2 {
+		t.Error("expecting the original recipients to be kept, got", e.Values["original_rcpt_to"])
+	}
+	if e.MailFrom.String() != "sender@example.org" {
+		t.Error("sender should not change, got", e.MailFrom.String())
+	}
+}
+
+func TestRewritePlusAddressing(t *testing.T) {
+	p := rewriteTestProcessor(t, BackendConfig{
+		"rewrite_rules": `^([^+@]+)\+[^@]*@(.*)$ $1@$2`,
+	}, "")
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "news+bounce-123", Host: "example.org"}
+	e.RcptTo = []mail.Address{{User: "jane+lists", Host: "example.com"}}
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Fatal(err)
+	}
+	if e.RcptTo[0].String() != "jane@example.com" {
+		t.Error("expecting the recipient to be rewritten at RCPT, got", e.RcptTo[0].String())
+	}
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "bob", Host: "example.com"})
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if got := rcptStrings(e.RcptTo); len(got) != 2 || got[0] != "jane@example.com" || got[1] != "bob@example.com" {
+		t.Error("unexpected recipients", got)
+	}
+	if e.MailFrom.String() != "news@example.org" {
+		t.Error("expecting the sender to be rewritten, got", e.MailFrom.String())
+	}
+	if _, ok := e.Values["original_rcpt_to"]; ok {
+		t.Error("recipients were already rewritten at RCPT, so no change expected at save")
+	}
+}
+
+func TestRewriteCatchAll(t *testing.T) {
+	p := rewriteTestProcessor(t, BackendConfig{}, `
+@old.example.com   @example.com
+@example.net       postmaster@example.com
+info@example.net   info@example.com
+`)
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = []mail.Address{{User: "jane", Host: "old.example.com"}}
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Fatal(err)
+	}
+	if e.RcptTo[0].String() != "jane@example.com" {
+		t.Error("expecting the domain to be mapped, got", e.RcptTo[0].String())
+	}
+	e.RcptTo = []mail.Address{{User: "anyone", Host: "example.net"}, {User: "info", Host: "example.net"}}
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if got := rcptStrings(e.RcptTo); len(got) != 2 || got[0] != "postmaster@example.com" || got[1] != "info@example.com" {
+		t.Error("expecting the catch-all and the exact alias, got", got)
+	}
+}
+
+func TestRewriteInvalidRule(t *testing.T) {
+	Svc.reset()
+	Decorate(DefaultProcessor{}, Rewrite())
+	if err := Svc.initialize(BackendConfig{"rewrite_rules": "(unclosed $1"}); err == nil {
+		t.Error("expecting an invalid regexp to be refused")
+	}
+}
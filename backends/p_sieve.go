@@ -0,0 +1,175 @@
+package backends
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: sieve
+// ----------------------------------------------------------------------------------
+// Description   : Filters the message for each recipient with scripts in a subset of
+//               : the Sieve language, see sieve.go. The actions are keep, discard,
+//               : fileinto and redirect. Discarded recipients are removed, redirect
+//               : addresses are added to the recipients, and the folders are given to
+//               : the maildir processor, so place this processor before it.
+//               : If all the recipients are discarded, the message is accepted and the
+//               : processors after this one are not run.
+//               : Scripts are reloaded when they are modified
+// ----------------------------------------------------------------------------------
+// Config Options: sieve_script string - path of a script run for all the recipients
+//               : sieve_user_script string - path of the script of a recipient, {user}
+//               : and {host} are replaced with the local part and domain, in lower case,
+//               : eg. "/etc/guerrilla/sieve/{host}/{user}.sieve". Run after sieve_script,
+//               : unless it stopped. A recipient without a script is not filtered
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo, e.Header, parsed if not parsed by an earlier processor
+// ----------------------------------------------------------------------------------
+// Output        : e.RcptTo has the recipients to deliver to
+//               : e.Values[FileIntoKey] is set to a map[string][]string of the folders
+//               : for each recipient, by lower case address, "" is the inbox
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["sieve"] = func() Decorator {
+		return Sieve()
+	}
+}
+
+// FileIntoKey is the key of e.Values with the folders that the recipients' messages are
+// delivered to, set by the sieve processor
+const FileIntoKey = "fileinto"
+
+type sieveConfig struct {
+	Script     string `json:"sieve_script,omitempty"`
+	UserScript string `json:"sieve_user_script,omitempty"`
+}
+
+func Sieve() Decorator {
+	var config *sieveConfig
+	var scripts *sieveScripts
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&sieveConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*sieveConfig)
+		if config.Script == "" && config.UserScript == "" {
+			return errors.New("sieve_script or sieve_user_script is required")
+		}
+		scripts = &sieveScripts{entries: make(map[string]*sieveScriptEntry)}
+		if config.Script != "" {
+			// fail early if the script is missing or has errors
+			if _, err := scripts.load(config.Script); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if err := e.ParseHeaders(); err != nil {
+					EnvelopeLog(e).WithError(err).Debug("could not parse headers for filtering")
+				}
+				m := &sieveMessage{header: e.Header, size: int64(e.Len())}
+				var global *sieveScript
+				if config.Script != "" {
+					var err error
+					if global, err = scripts.load(config.Script); err != nil {
+						Log().WithError(err).Error("could not load sieve script")
+					}
+				}
+				fileinto := make(map[string][]string)
+				var rcptTo []mail.Address
+				var redirects []mail.Address
+				for i := range e.RcptTo {
+					actions := newSieveActions()
+					if global != nil {
+						global.run(m, actions)
+					}
+					if config.UserScript != "" {
+						file := strings.NewReplacer(
+							"{user}", safePathElement(strings.ToLower(e.RcptTo[i].User)),
+							"{host}", safePathElement(strings.ToLower(e.RcptTo[i].Host))).Replace(config.UserScript)
+						script, err := scripts.load(file)
+						if err != nil && !os.IsNotExist(err) {
+							EnvelopeLog(e).WithError(err).Warnf("could not load sieve script of %s", e.RcptTo[i].String())
+						} else if script != nil {
+							script.run(m, actions)
+						}
+					}
+					for _, r := range actions.redirect {
+						user, host, _ := splitAddress(r)
+						redirects = append(redirects, mail.Address{User: user, Host: host})
+					}
+					folders := actions.folders()
+					if len(folders) == 0 {
+						EnvelopeLog(e).Debugf("message discarded for %s", e.RcptTo[i].String())
+						continue
+					}
+					rcptTo = append(rcptTo, e.RcptTo[i])
+					fileinto[strings.ToLower(e.RcptTo[i].String())] = folders
+				}
+				e.RcptTo = rcptTo
+				for _, r := range redirects {
+					if !e.HasRcpt(r) {
+						e.PushRcpt(r)
+					}
+				}
+				e.Values[FileIntoKey] = fileinto
+				if len(e.RcptTo) == 0 {
+					EnvelopeLog(e).Info("message discarded for all recipients")
+					return BackendResultOK, nil
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// sieveScripts caches the parsed scripts by path
+type sieveScripts struct {
+	entries map[string]*sieveScriptEntry
+	sync.Mutex
+}
+
+type sieveScriptEntry struct {
+	script  *sieveScript
+	modTime time.Time
+}
+
+// load returns the script at path, parsing it again if it was modified since the last load
+func (s *sieveScripts) load(path string) (*sieveScript, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	entry, ok := s.entries[path]
+	s.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) {
+		return entry.script, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	script, err := parseSieve(string(b))
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	s.Lock()
+	s.entries[path] = &sieveScriptEntry{script: script, modTime: info.ModTime()}
+	s.Unlock()
+	return script, nil
+}
@@ -0,0 +1,152 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const sieveTestScript = `require ["fileinto"];
+# lists are filed
+if header :matches "list-id" "*<golang-nuts.*>" {
+	fileinto "Lists/Go";
+	stop;
+}
+if anyof (header :contains "subject" ["[SPAM]", "lottery"], size :over 1M) {
+	discard;
+} elsif header :is "from" "boss@example.com" {
+	redirect "jane@example.net";
+	keep;
+}
+`
+
+func sieveTestEnvelope(headers string, rcpt ...mail.Address) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = rcpt
+	e.Data.WriteString(headers + "\r\nhello\r\n")
+	return e
+}
+
+func sieveTestProcessor(t *testing.T, dir string, config BackendConfig) Processor {
+	if err := ioutil.WriteFile(filepath.Join(dir, "global.sieve"), []byte(sieveTestScript), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config["sieve_script"] = filepath.Join(dir, "global.sieve")
+	Svc.reset()
+	// the last decorator runs first, so that sieve decides before maildir saves
+	p := Decorate(DefaultProcessor{}, Maildir(), Sieve())
+	if err := Svc.initialize(config); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSieveRedirect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sieve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	p := sieveTestProcessor(t, dir, BackendConfig{"maildir_path": dir})
+	e := sieveTestEnvelope("From: boss@example.com\r\nSubject: meeting\r\n", mail.Address{User: "jane", Host: "example.com"})
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.RcptTo) != 2 || e.RcptTo[0].String() != "jane@example.com" || e.RcptTo[1].String() != "jane@example.net" {
+		t.Error("expecting the message kept and redirected, got", e.RcptTo)
+	}
+	files, _ := e.Values["maildir_files"].([]string)
+	if len(files) != 2 || filepath.Dir(files[0]) != filepath.Join(dir, "example.com", "jane", "new") {
+		t.Error("expecting delivery to the inbox, got", files)
+	}
+}
+
+func TestSieveDiscard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sieve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	userScripts := filepath.Join(dir, "users")
+	if err := os.MkdirAll(filepath.Join(userScripts, "example.com"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// bob keeps everything, his script runs after the global one
+	if err := ioutil.WriteFile(filepath.Join(userScripts, "example.com", "bob.sieve"), []byte("keep;"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := sieveTestProcessor(t, dir, BackendConfig{
+		"maildir_path":      filepath.Join(dir, "mail"),
+		"sieve_user_script": filepath.Join(userScripts, "{host}", "{user}.sieve"),
+	})
+	e := sieveTestEnvelope("From: someone@example.org\r\nSubject: You won the =?utf-8?q?LOTTERY?=\r\n",
+		mail.Address{User: "jane", Host: "example.com"},
+		mail.Address{User: "bob", Host: "example.com"})
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.RcptTo) != 1 || e.RcptTo[0].String() != "bob@example.com" {
+		t.Error("expecting the message discarded for jane only, got", e.RcptTo)
+	}
+
+	e = sieveTestEnvelope("Subject: [SPAM] offer\r\n", mail.Address{User: "jane", Host: "example.com"})
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.RcptTo) != 0 {
+		t.Error("expecting no recipients left, got", e.RcptTo)
+	}
+	if _, ok := e.Values["maildir_files"]; ok {
+		t.Error("maildir should not run when all recipients are discarded")
+	}
+}
+
+func TestSieveFileInto(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sieve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	p := sieveTestProcessor(t, dir, BackendConfig{"maildir_path": dir})
+	e := sieveTestEnvelope("List-Id: Go <golang-nuts.googlegroups.com>\r\nFrom: boss@example.com\r\n",
+		mail.Address{User: "jane", Host: "example.com"})
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := e.Values["maildir_files"].([]string)
+	folder := filepath.Join(dir, "example.com", "jane", ".Lists.Go")
+	if len(files) != 1 || filepath.Dir(files[0]) != filepath.Join(folder, "new") {
+		t.Fatal("expecting delivery to the Lists/Go folder only, got", files)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "maildirfolder")); err != nil {
+		t.Error("expecting the maildirfolder marker,", err)
+	}
+	// stop prevented the redirect
+	if len(e.RcptTo) != 1 {
+		t.Error("expecting no redirect after stop, got", e.RcptTo)
+	}
+}
+
+func TestParseSieveErrors(t *testing.T) {
+	for _, script := range []string{
+		`if header :contains "subject" "x" { discard; `,
+		`reject "no";`,
+		`fileinto Junk;`,
+		`if size :over lots { discard; }`,
+		`redirect "not an address";`,
+		`keep`,
+	} {
+		if _, err := parseSieve(script); err == nil {
+			t.Errorf("expecting an error for %q", script)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: spamcheck
+// ----------------------------------------------------------------------------------
+// Description   : Scores the message with Rspamd, over its HTTP protocol, or with
+//               : SpamAssassin's spamd. Messages scoring at or above the reject threshold
+//               : are rejected with a 550, and X-Spam headers are added for messages at
+//               : or above the tag threshold. Messages larger than spamcheck_max_size are
+//               : not scored. Rspamd is preferred for large messages, as the message is
+//               : streamed to it without a copy being made
+// ----------------------------------------------------------------------------------
+// Config Options: spamcheck_engine string - "rspamd" (default) or "spamassassin"
+//               : spamcheck_address string - for rspamd, the URL of the normal worker,
+//               : default "http://127.0.0.1:11333". For spamassassin, "<host>:<port>" of
+//               : spamd or the path of its unix socket, default "127.0.0.1:783"
+//               : spamcheck_reject_threshold string - score to reject at, eg. "15",
+//               : no messages are rejected if empty
+//               : spamcheck_tag_threshold string - score to add the X-Spam-Flag header at,
+//               : eg. "5". X-Spam-Score is added to all messages. No headers if empty
+//               : spamcheck_max_size int - largest message to score, default 2MB
+//               : spamcheck_timeout string - time limit for scoring, default "15s"
+//               : spamcheck_circuit_* - the circuit breaker on the scorer. See CircuitConfig
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader, e.RemoteIP, e.Helo, e.MailFrom, e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["spam_score"] is set to the float64 score and
+//               : e.Values["spam_symbols"] to the []string of rules that matched
+//               : e.DeliveryHeader has X-Spam-Score and X-Spam-Flag appended when tagging
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["spamcheck"] = func() Decorator {
+		return SpamCheck()
+	}
+}
+
+type spamCheckConfig struct {
+	Engine          string `json:"spamcheck_engine,omitempty"`
+	Address         string `json:"spamcheck_address,omitempty"`
+	RejectThreshold string `json:"spamcheck_reject_threshold,omitempty"`
+	TagThreshold    string `json:"spamcheck_tag_threshold,omitempty"`
+	MaxSize         int    `json:"spamcheck_max_size,omitempty"`
+	Timeout         string `json:"spamcheck_timeout,omitempty"`
+}
+
+const (
+	spamEngineRspamd       = "rspamd"
+	spamEngineSpamAssassin = "spamassassin"
+
+	defaultRspamdAddress = "http://127.0.0.1:11333"
+	defaultSpamdAddress  = "127.0.0.1:783"
+	defaultSpamMaxSize   = 2 * 1024 * 1024
+	defaultSpamTimeout   = time.Second * 15
+)
+
+// spamScorer scores a message
+type spamScorer interface {
+	score(e *mail.Envelope) (*spamResult, error)
+}
+
+type spamResult struct {
+	score   float64
+	symbols []string
+}
+
+func SpamCheck() Decorator {
+	var (
+		config      *spamCheckConfig
+		scorer      spamScorer
+		circuit     *CircuitBreaker
+		reject, tag float64
+		rejectOn    bool
+		tagOn       bool
+		maxSize     int
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&spamCheckConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*spamCheckConfig)
+		timeout := defaultSpamTimeout
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil {
+				return fmt.Errorf("invalid spamcheck_timeout: %s", err)
+			}
+		}
+		switch strings.ToLower(config.Engine) {
+		case "", spamEngineRspamd:
+			address := config.Address
+			if address == "" {
+				address = defaultRspamdAddress
+			}
+			scorer = &rspamdClient{url: strings.TrimRight(address, "/") + "/checkv2", client: &http.Client{Timeout: timeout}}
+		case spamEngineSpamAssassin:
+			address := config.Address
+			if address == "" {
+				address = defaultSpamdAddress
+			}
+			scorer = &spamdClient{address: address, timeout: timeout}
+		default:
+			return fmt.Errorf("unknown spamcheck_engine %q", config.Engine)
+		}
+		if rejectOn = config.RejectThreshold != ""; rejectOn {
+			if reject, err = strconv.ParseFloat(config.RejectThreshold, 64); err != nil {
+				return fmt.Errorf("invalid spamcheck_reject_threshold: %s", err)
+			}
+		}
+		if tagOn = config.TagThreshold != ""; tagOn {
+			if tag, err = strconv.ParseFloat(config.TagThreshold, 64); err != nil {
+				return fmt.Errorf("invalid spamcheck_tag_threshold: %s", err)
+			}
+		}
+		if maxSize = config.MaxSize; maxSize <= 0 {
+			maxSize = defaultSpamMaxSize
+		}
+		circuitConfig, err := NewCircuitConfig("spamcheck", backendConfig)
+		if err != nil {
+			return err
+		}
+		circuit = NewCircuitBreaker("spamcheck", circuitConfig)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if e.Len() > maxSize {
+					EnvelopeLog(e).Debugf("message of %d bytes is too large to score", e.Len())
+					return p.Process(e, task)
+				}
+				var result *spamResult
+				err := circuit.Do(func() error {
+					var err error
+					result, err = scorer.score(e)
+					return err
+				})
+				if err != nil {
+					if !circuit.FailOpen() {
+						EnvelopeLog(e).WithError(err).Error("spam check failed")
+						return NewResult(response.Canned.ErrorDependencyDown, " ", "spam check failed"), err
+					}
+					EnvelopeLog(e).WithError(err).Warn("spam check failed, accepting the message without a score")
+					return p.Process(e, task)
+				}
+				score := strconv.FormatFloat(result.score, 'f', 2, 64)
+				e.Values["spam_score"] = result.score
+				e.Values["spam_symbols"] = result.symbols
+				if rejectOn && result.score >= reject {
+					EnvelopeLog(e).WithField("symbols", result.symbols).Infof("rejected as spam, score %s", score)
+					return NewResult(response.Canned.FailSpam, " ", score), errors.New("spam score " + score)
+				}
+				if tagOn {
+					e.DeliveryHeader += "X-Spam-Score: " + score + "\n"
+					if result.score >= tag {
+						e.DeliveryHeader += "X-Spam-Flag: YES\n"
+					}
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// rspamdClient scores with Rspamd's /checkv2 endpoint
+type rspamdClient struct {
+	url    string
+	client *http.Client
+}
+
+type rspamdReply struct {
+	Score   float64 `json:"score"`
+	Symbols map[string]struct {
+		Score float64 `json:"score"`
+	} `json:"symbols"`
+}
+
+func (c *rspamdClient) score(e *mail.Envelope) (*spamResult, error) {
+	req, err := http.NewRequest("POST", c.url, e.NewReader())
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(e.Len())
+	req.Header.Set("IP", e.RemoteIP)
+	req.Header.Set("Helo", e.Helo)
+	req.Header.Set("Queue-Id", e.QueuedId)
+	if !e.MailFrom.NullPath && !e.MailFrom.IsEmpty() {
+		req.Header.Set("From", e.MailFrom.String())
+	}
+	for i := range e.RcptTo {
+		req.Header.Add("Rcpt", e.RcptTo[i].String())
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd returned %s", resp.Status)
+	}
+	var reply rspamdReply
+	if err = json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	result := &spamResult{score: reply.Score}
+	for name := range reply.Symbols {
+		result.symbols = append(result.symbols, name)
+	}
+	sort.Strings(result.symbols)
+	return result, nil
+}
+
+// spamdClient scores with spamd, using the SYMBOLS command
+type spamdClient struct {
+	address string
+	timeout time.Duration
+}
+
+func (c *spamdClient) score(e *mail.Envelope) (*spamResult, error) {
+	network := "tcp"
+	if strings.HasPrefix(c.address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err = conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err = fmt.Fprintf(conn, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n\r\n", e.Len()); err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(conn, e.NewReader()); err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = tcp.CloseWrite()
+	}
+	r := textproto.NewReader(bufio.NewReader(conn))
+	status, err := r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	// eg. "SPAMD/1.1 0 EX_OK"
+	if fields := strings.Fields(status); len(fields) < 2 || fields[1] != "0" {
+		return nil, errors.New("spamd: " + status)
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// eg. "True ; 15.3 / 5.0"
+	spam := header.Get("Spam")
+	i, j := strings.Index(spam, ";"), strings.Index(spam, "/")
+	if i < 0 || j < i {
+		return nil, errors.New("spamd: invalid Spam header " + spam)
+	}
+	result := &spamResult{}
+	if result.score, err = strconv.ParseFloat(strings.TrimSpace(spam[i+1:j]), 64); err != nil {
+		return nil, errors.New("spamd: invalid Spam header " + spam)
+	}
+	body, err := ioutil.ReadAll(r.R)
+	if err != nil {
+		return nil, err
+	}
+	for _, symbol := range strings.Split(string(body), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			result.symbols = append(result.symbols, symbol)
+		}
+	}
+	sort.Strings(result.symbols)
+	return result, nil
+}
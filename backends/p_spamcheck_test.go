@@ -0,0 +1,151 @@
+package backends
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// spamTestScore scores messages mentioning viagra as spam
+func spamTestScore(message string) float64 {
+	if strings.Contains(message, "viagra") {
+		return 17.5
+	}
+	return 1.2
+}
+
+func spamTestEnvelope(body string) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "sender", Host: "example.org"}
+	e.RcptTo = []mail.Address{{User: "jane", Host: "example.com"}}
+	e.Data.WriteString("Subject: test\r\n\r\n" + body + "\r\n")
+	return e
+}
+
+func stubRspamd(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/checkv2" || r.Header.Get("Rcpt") != "jane@example.com" || r.Header.Get("From") != "sender@example.org" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"score": %v, "required_score": 15, "action": "no action",
+			"symbols": {"R_SPF_ALLOW": {"name": "R_SPF_ALLOW", "score": -0.2}, "BAYES_SPAM": {"name": "BAYES_SPAM", "score": 5.1}}}`,
+			spamTestScore(string(b)))
+	}))
+}
+
+// stubSpamd answers SYMBOLS requests, for as long as the listener is open
+func stubSpamd(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := textproto.NewReader(bufio.NewReader(conn))
+			if line, err := r.ReadLine(); err != nil || line != "SYMBOLS SPAMC/1.5" {
+				_ = conn.Close()
+				continue
+			}
+			header, _ := r.ReadMIMEHeader()
+			size, _ := strconv.Atoi(header.Get("Content-Length"))
+			b := make([]byte, size)
+			_, _ = io.ReadFull(r.R, b)
+			score := spamTestScore(string(b))
+			_, _ = fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: 23\r\nSpam: %v ; %v / 5.0\r\n\r\nBAYES_99,HTML_MESSAGE\r\n", score > 5, score)
+			_ = conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestSpamCheck(t *testing.T) {
+	rspamd := stubRspamd(t)
+	defer rspamd.Close()
+	spamd := stubSpamd(t)
+	defer func() {
+		_ = spamd.Close()
+	}()
+
+	for engine, address := range map[string]string{
+		"rspamd":       rspamd.URL,
+		"spamassassin": spamd.Addr().String(),
+	} {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, SpamCheck())
+		if err := Svc.initialize(BackendConfig{
+			"spamcheck_engine":           engine,
+			"spamcheck_address":          address,
+			"spamcheck_reject_threshold": "15",
+			"spamcheck_tag_threshold":    "1",
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// a low score is tagged
+		e := spamTestEnvelope("hello")
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Error(engine, "expecting a low score to pass, got", err)
+		}
+		if e.Values["spam_score"] != 1.2 {
+			t.Error(engine, "expecting score 1.2, got", e.Values["spam_score"])
+		}
+		if symbols, _ := e.Values["spam_symbols"].([]string); len(symbols) != 2 {
+			t.Error(engine, "expecting the symbols, got", e.Values["spam_symbols"])
+		}
+		if e.DeliveryHeader != "X-Spam-Score: 1.20\nX-Spam-Flag: YES\n" {
+			t.Errorf("%s: unexpected headers %q", engine, e.DeliveryHeader)
+		}
+
+		// a high score is rejected
+		e = spamTestEnvelope("cheap viagra")
+		result, err := p.Process(e, TaskSaveMail)
+		if err == nil {
+			t.Error(engine, "expecting a high score to be rejected")
+		} else if result.String() != "550 5.7.1 Error: message rejected as spam, score 17.50" {
+			t.Error(engine, "unexpected result", result.String())
+		}
+	}
+}
+
+func TestSpamCheckTagOnly(t *testing.T) {
+	rspamd := stubRspamd(t)
+	defer rspamd.Close()
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, SpamCheck())
+	if err := Svc.initialize(BackendConfig{
+		"spamcheck_address":       rspamd.URL,
+		"spamcheck_tag_threshold": "5",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	e := spamTestEnvelope("cheap viagra")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting the message to be tagged, not rejected, got", err)
+	}
+	if e.DeliveryHeader != "X-Spam-Score: 17.50\nX-Spam-Flag: YES\n" {
+		t.Errorf("unexpected headers %q", e.DeliveryHeader)
+	}
+	e = spamTestEnvelope("hello")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	if e.DeliveryHeader != "X-Spam-Score: 1.20\n" {
+		t.Errorf("expecting no X-Spam-Flag below the threshold, got %q", e.DeliveryHeader)
+	}
+}
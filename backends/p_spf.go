@@ -0,0 +1,119 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: spf
+// ----------------------------------------------------------------------------------
+// Description   : Checks the sender with SPF (RFC 7208), using the client's IP address,
+//               : the HELO name and the MAIL FROM domain. The HELO name is checked
+//               : instead when the reverse-path is null. The check is limited to 10
+//               : terms doing DNS lookups and 2 lookups returning nothing, after which
+//               : the result is a permerror
+// ----------------------------------------------------------------------------------
+// Config Options: spf_reject_fail bool - reject messages failing the check with a 550,
+//               : otherwise the result is only recorded
+//               : spf_resolver string - address of the DNS resolver to use, eg.
+//               : "127.0.0.1:53", default is the system's resolver
+//               : spf_circuit_* - the circuit breaker on the DNS lookups, a temperror
+//               : counts as a failure. See CircuitConfig
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP, e.Helo, e.MailFrom
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["spf_result"] is set to the result: pass, fail, softfail,
+//               : neutral, none, temperror or permerror. e.Values["spf"] is set too,
+//               : it's read by the reputation processor
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["spf"] = func() Decorator {
+		return SPF()
+	}
+}
+
+type spfConfig struct {
+	RejectFail bool   `json:"spf_reject_fail,omitempty"`
+	Resolver   string `json:"spf_resolver,omitempty"`
+}
+
+// spfTimeout limits the time taken by a check, RFC 7208 4.6.4 suggests at least 20 seconds
+const spfTimeout = time.Second * 20
+
+// errSPFTempError counts a temperror result as a failure of the circuit breaker
+var errSPFTempError = errors.New("spf temperror")
+
+// newSPFResolver returns the resolver at address, can be replaced in tests
+var newSPFResolver = func(address string) SPFResolver {
+	return dnsResolver(address)
+}
+
+func SPF() Decorator {
+	var (
+		config   *spfConfig
+		resolver SPFResolver
+		circuit  *CircuitBreaker
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&spfConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*spfConfig)
+		if config.Resolver != "" {
+			if _, _, err := net.SplitHostPort(config.Resolver); err != nil {
+				return convertError("property invalid: 'spf_resolver' must be a host:port address")
+			}
+		}
+		resolver = newSPFResolver(config.Resolver)
+		circuitConfig, err := NewCircuitConfig("spf", backendConfig)
+		if err != nil {
+			return err
+		}
+		circuit = NewCircuitBreaker("spf", circuitConfig)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				result := SPFNone
+				if ip := net.ParseIP(e.RemoteIP); ip != nil {
+					sender := ""
+					if !e.MailFrom.NullPath && !e.MailFrom.IsEmpty() {
+						sender = e.MailFrom.String()
+					}
+					err := circuit.Do(func() error {
+						ctx, cancel := context.WithTimeout(context.Background(), spfTimeout)
+						defer cancel()
+						if result = CheckSPF(ctx, resolver, ip, e.Helo, sender); result == SPFTempError {
+							return errSPFTempError
+						}
+						return nil
+					})
+					if err == ErrCircuitOpen {
+						if !circuit.FailOpen() {
+							return NewResult(response.Canned.ErrorDependencyDown, " ", err), err
+						}
+						result = SPFTempError
+					}
+				}
+				e.Values["spf_result"] = result
+				e.Values["spf"] = result
+				if result == SPFFail && config.RejectFail {
+					return NewResult(response.Canned.FailSPF), errors.New("spf check failed")
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
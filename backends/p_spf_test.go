@@ -0,0 +1,250 @@
+package backends
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// stubSPFResolver answers from crafted records, names without records do not exist
+type stubSPFResolver struct {
+	txt map[string][]string
+	ip  map[string][]string
+	mx  map[string][]string
+	ptr map[string][]string
+	// fail makes lookups of the name return a temporary error
+	fail string
+}
+
+func (r *stubSPFResolver) err(name string) error {
+	if name == r.fail {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name}
+}
+
+func (r *stubSPFResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok && name != r.fail {
+		return txt, nil
+	}
+	return nil, r.err(name)
+}
+
+func (r *stubSPFResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ip[host]
+	if !ok || host == r.fail {
+		return nil, r.err(host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *stubSPFResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := r.mx[name]
+	if !ok || name == r.fail {
+		return nil, r.err(name)
+	}
+	var mxs []*net.MX
+	for _, host := range hosts {
+		mxs = append(mxs, &net.MX{Host: host, Pref: 10})
+	}
+	return mxs, nil
+}
+
+func (r *stubSPFResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, r.err(addr)
+}
+
+func newStubSPFResolver() *stubSPFResolver {
+	r := &stubSPFResolver{
+		txt: map[string][]string{
+			"example.com":       {"some other record", "v=spf1 ip4:192.0.2.0/24 include:_spf.example.net -all"},
+			"_spf.example.net":  {"v=spf1 a mx/24 ip6:2001:db8::/32 ~all"},
+			"example.net":       {"v=spf1 redirect=_spf.example.net"},
+			"ptr.example":       {"v=spf1 ptr -all"},
+			"macro.example":     {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+			"helo.example":      {"v=spf1 a -all"},
+			"neutral.example":   {"v=spf1 ?all"},
+			"double.example":    {"v=spf1 -all", "v=spf1 +all"},
+			"syntax.example":    {"v=spf1 ip4:192.0.2.300 -all"},
+			"void.example":      {"v=spf1 a:a.void.example a:b.void.example a:c.void.example -all"},
+			"temp.example":      {"v=spf1 a:down.example -all"},
+			"temp-include.test": {"v=spf1 include:down.example -all"},
+			"down.example":      {"v=spf1 -all"},
+		},
+		ip: map[string][]string{
+			"_spf.example.net": {"198.51.100.1"},
+			"mx.example.net":   {"203.0.113.1"},
+			"mail.ptr.example": {"198.51.100.99"},
+			"helo.example":     {"198.51.100.50"},
+			"1.100.51.198.john.bar._spf.macro.example": {"127.0.0.2"},
+		},
+		mx: map[string][]string{
+			"_spf.example.net": {"mx.example.net"},
+		},
+		ptr: map[string][]string{
+			"198.51.100.99": {"mail.ptr.example."},
+		},
+		fail: "down.example",
+	}
+	// a chain of includes over the lookup limit
+	for i := 0; i < spfLookupLimit+1; i++ {
+		r.txt["limit"+strconv.Itoa(i)+".example"] = []string{"v=spf1 include:limit" + strconv.Itoa(i+1) + ".example"}
+	}
+	r.txt["limit"+strconv.Itoa(spfLookupLimit+1)+".example"] = []string{"v=spf1 +all"}
+	return r
+}
+
+func TestCheckSPF(t *testing.T) {
+	r := newStubSPFResolver()
+	tests := []struct {
+		ip, helo, sender, expect string
+	}{
+		{"192.0.2.5", "client.test", "user@example.com", SPFPass},
+		{"198.51.100.1", "client.test", "user@example.com", SPFPass},     // include, a
+		{"203.0.113.77", "client.test", "user@example.com", SPFPass},     // include, mx/24
+		{"2001:db8::25", "client.test", "user@Example.com", SPFPass},     // include, ip6
+		{"198.51.100.2", "client.test", "user@example.com", SPFFail},     // include gives softfail, no match
+		{"198.51.100.2", "client.test", "user@example.net", SPFSoftFail}, // redirect
+		{"198.51.100.99", "mail.ptr.example", "user@ptr.example", SPFPass},
+		{"198.51.100.98", "mail.ptr.example", "user@ptr.example", SPFFail},
+		{"198.51.100.1", "client.test", "john.bar@macro.example", SPFPass},
+		{"198.51.100.1", "client.test", "jane@macro.example", SPFFail},
+		{"198.51.100.50", "helo.example", "", SPFPass}, // null sender, the HELO name is checked
+		{"198.51.100.51", "helo.example", "", SPFFail},
+		{"192.0.2.5", "client.test", "user@neutral.example", SPFNeutral},
+		{"192.0.2.5", "client.test", "user@nothing.example", SPFNone},
+		{"192.0.2.5", "client.test", "user@localhost", SPFNone},
+		{"192.0.2.5", "client.test", "user@double.example", SPFPermError},
+		{"192.0.2.5", "client.test", "user@syntax.example", SPFPermError},
+		{"192.0.2.5", "client.test", "user@void.example", SPFPermError},
+		{"192.0.2.5", "client.test", "user@limit0.example", SPFPermError},
+		{"192.0.2.5", "client.test", "user@limit2.example", SPFPass},
+		{"192.0.2.5", "client.test", "user@temp.example", SPFTempError},
+		{"192.0.2.5", "client.test", "user@temp-include.test", SPFTempError},
+		{"192.0.2.5", "client.test", "user@down.example", SPFTempError},
+	}
+	for _, test := range tests {
+		result := CheckSPF(context.Background(), r, net.ParseIP(test.ip), test.helo, test.sender)
+		if result != test.expect {
+			t.Errorf("%s from %s: expecting %s, got %s", test.sender, test.ip, test.expect, result)
+		}
+	}
+}
+
+func TestSPFMacros(t *testing.T) {
+	// the examples of RFC 7208 section 7.4
+	c := &spfCheck{
+		ip:     net.ParseIP("192.0.2.3"),
+		helo:   "mx.example.org",
+		sender: "strong-bad@email.example.com",
+	}
+	for spec, expect := range map[string]string{
+		"%{s}":                              "strong-bad@email.example.com",
+		"%{o}":                              "email.example.com",
+		"%{d}":                              "email.example.com",
+		"%{d4}":                             "email.example.com",
+		"%{d3}":                             "email.example.com",
+		"%{d2}":                             "example.com",
+		"%{d1}":                             "com",
+		"%{dr}":                             "com.example.email",
+		"%{d2r}":                            "example.email",
+		"%{l}":                              "strong-bad",
+		"%{l-}":                             "strong.bad",
+		"%{lr}":                             "strong-bad",
+		"%{lr-}":                            "bad.strong",
+		"%{l1r-}":                           "strong",
+		"%{ir}.%{v}._spf.%{d2}":             "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":              "bad.strong.lp._spf.example.com",
+		"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}":  "3.2.0.192.in-addr.strong.lp._spf.example.com",
+		"%{d2}.trusted-domains.example.net": "example.com.trusted-domains.example.net",
+		"%{h}.%%.%_":                        "mx.example.org.%. ",
+	} {
+		if got, err := c.expand(spec, "email.example.com"); err != nil || got != expect {
+			t.Errorf("%s: expecting %q, got %q %v", spec, expect, got, err)
+		}
+	}
+	c.ip = net.ParseIP("2001:db8::cb01")
+	if got, _ := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com"); got !=
+		"1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com" {
+		t.Error("unexpected IPv6 expansion", got)
+	}
+	for _, spec := range []string{"%{x}", "%{d0}", "%", "%a", "%{d"} {
+		if _, err := c.expand(spec, "email.example.com"); err == nil {
+			t.Error("expecting an error for", spec)
+		}
+	}
+}
+
+func TestSPFProcessor(t *testing.T) {
+	defer func(f func(string) SPFResolver) { newSPFResolver = f }(newSPFResolver)
+	resolver := newStubSPFResolver()
+	newSPFResolver = func(address string) SPFResolver {
+		return resolver
+	}
+	newEnvelope := func(ip string) *mail.Envelope {
+		e := mail.NewEnvelope(ip, 1)
+		e.Helo = "client.test"
+		e.MailFrom = mail.Address{User: "user", Host: "example.com"}
+		return e
+	}
+	newProcessor := func(config BackendConfig) Processor {
+		Svc.reset()
+		p := Decorate(DefaultProcessor{}, SPF())
+		if err := Svc.initialize(config); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// a fail is only recorded by default
+	p := newProcessor(BackendConfig{})
+	e := newEnvelope("198.51.100.200")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting the message to be saved", err)
+	}
+	if e.Values["spf_result"] != SPFFail {
+		t.Error("expecting fail, got", e.Values["spf_result"])
+	}
+
+	// or rejected
+	p = newProcessor(BackendConfig{"spf_reject_fail": true, "spf_resolver": "127.0.0.1:53"})
+	e = newEnvelope("198.51.100.200")
+	if result, err := p.Process(e, TaskSaveMail); err == nil || result.Code() != 550 {
+		t.Error("expecting a fail to be rejected with 550, got", result, err)
+	}
+	e = newEnvelope("192.0.2.10")
+	if _, err := p.Process(e, TaskSaveMail); err != nil || e.Values["spf_result"] != SPFPass {
+		t.Error("expecting a pass to be saved, got", e.Values["spf_result"], err)
+	}
+	if e.Values["spf"] != SPFPass {
+		t.Error("expecting the result for the reputation processor, got", e.Values["spf"])
+	}
+
+	// a temperror opens the circuit, the next message is deferred
+	p = newProcessor(BackendConfig{"spf_circuit_threshold": 1})
+	resolver.fail = "example.com"
+	e = newEnvelope("192.0.2.10")
+	if _, err := p.Process(e, TaskSaveMail); err != nil || e.Values["spf_result"] != SPFTempError {
+		t.Error("expecting a temperror to be saved, got", e.Values["spf_result"], err)
+	}
+	resolver.fail = ""
+	if result, err := p.Process(newEnvelope("192.0.2.10"), TaskSaveMail); err != ErrCircuitOpen || result.Code() != 451 {
+		t.Error("expecting a 451 while the circuit is open, got", result, err)
+	}
+
+	Svc.reset()
+	_ = Decorate(DefaultProcessor{}, SPF())
+	if err := Svc.initialize(BackendConfig{"spf_resolver": "no port"}); err == nil {
+		t.Error("expecting an invalid resolver address to be rejected")
+	}
+}
@@ -0,0 +1,89 @@
+package backends
+
+import (
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: subaddress
+// ----------------------------------------------------------------------------------
+// Description   : Strips the detail from plus-addressed recipients (user+tag@host) so
+//               : that recipient validation and delivery use the base mailbox. The
+//               : detail is kept in e.RcptTo[i].Detail, so that it can still be used for
+//               : filtering.
+//               : Place it before any processors that validate recipients.
+// ----------------------------------------------------------------------------------
+// Config Options: subaddress_separator string - separator between the mailbox and the
+//               : detail, default "+" (some sites use "-")
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : e.RcptTo[i].User is set to the base mailbox, e.RcptTo[i].Detail to the detail
+//               : e.DeliveryHeader has an X-Original-To header appended when the only
+//               : recipient was rewritten, so place this processor after the Header processor.
+//               : The header is shared by all the recipients, so it's left out when there
+//               : are several, it would disclose the others (eg. Bcc) to each of them
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["subaddress"] = func() Decorator {
+		return Subaddress()
+	}
+}
+
+type subaddressConfig struct {
+	Separator string `json:"subaddress_separator,omitempty"`
+}
+
+const defaultSubaddressSeparator = "+"
+
+func Subaddress() Decorator {
+	var config *subaddressConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&subaddressConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*subaddressConfig)
+		if config.Separator == "" {
+			config.Separator = defaultSubaddressSeparator
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt {
+				// the recipient being validated is the last one added
+				if len(e.RcptTo) > 0 {
+					stripSubaddress(&e.RcptTo[len(e.RcptTo)-1], config.Separator)
+				}
+				return p.Process(e, task)
+			} else if task == TaskSaveMail {
+				for i := range e.RcptTo {
+					stripSubaddress(&e.RcptTo[i], config.Separator)
+				}
+				if len(e.RcptTo) == 1 && e.RcptTo[0].Detail != "" {
+					e.DeliveryHeader += "X-Original-To: " +
+						e.RcptTo[0].User + config.Separator + e.RcptTo[0].Detail + "@" + e.RcptTo[0].Host + "\n"
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// stripSubaddress sets the address to its base mailbox, unless it was already stripped
+func stripSubaddress(a *mail.Address, separator string) {
+	if a.Detail != "" {
+		return
+	}
+	base, detail := a.Subaddress(separator)
+	if detail == "" {
+		return
+	}
+	a.User = base
+	a.Detail = detail
+}
@@ -0,0 +1,51 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestSubaddress(t *testing.T) {
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, Subaddress())
+	if err := Svc.initialize(BackendConfig{"subaddress_separator": "-"}); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "jane-lists", Host: "example.com"})
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Error(err)
+	}
+	if e.RcptTo[0].User != "jane" || e.RcptTo[0].Detail != "lists" {
+		t.Error("expecting base mailbox jane with detail lists, got", e.RcptTo[0].User, e.RcptTo[0].Detail)
+	}
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	if expect := "X-Original-To: jane-lists@example.com\n"; e.DeliveryHeader != expect {
+		t.Error("expecting headers", expect, "got", e.DeliveryHeader)
+	}
+
+	e.DeliveryHeader = ""
+	e.RcptTo = append(e.RcptTo,
+		mail.Address{User: "bob", Host: "example.com"},
+		mail.Address{User: "-bob", Host: "example.com"},
+		mail.Address{User: "ann-a-b", Host: "example.com"})
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	if e.RcptTo[0].User != "jane" || e.RcptTo[0].Detail != "lists" {
+		t.Error("already stripped recipient should not change, got", e.RcptTo[0].User, e.RcptTo[0].Detail)
+	}
+	if e.RcptTo[1].User != "bob" || e.RcptTo[2].User != "-bob" {
+		t.Error("recipients without a detail should not change")
+	}
+	if e.RcptTo[3].User != "ann" || e.RcptTo[3].Detail != "a-b" {
+		t.Error("expecting base mailbox ann with detail a-b, got", e.RcptTo[3].User, e.RcptTo[3].Detail)
+	}
+	if strings.Contains(e.DeliveryHeader, "X-Original-To") {
+		t.Error("the original recipients should not be disclosed to each other, got", e.DeliveryHeader)
+	}
+}
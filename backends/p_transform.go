@@ -0,0 +1,79 @@
+package backends
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: transform
+// ----------------------------------------------------------------------------------
+// Description   : Runs an ordered list of BodyTransformers on the message. Each
+//               : transformer sees the output of the one before it, and e.Data is
+//               : rewritten once all of them ran. Transformers are added with
+//               : Svc.AddTransformer
+// ----------------------------------------------------------------------------------
+// Config Options: transform_process string - names of the transformers to run, in
+//               : order, separated by |
+//               : Transformers that add or change headers need to be listed before
+//               : transformers that hash the message, such as a DKIM signer, so that
+//               : the hash covers the final message
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Data is replaced with the transformed message
+//               : e.Header is parsed again if it was parsed by an earlier processor
+//               : e.DeliveryHeader is not given to the transformers, so processors
+//               : appending to it may be placed before or after this processor
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["transform"] = func() Decorator {
+		return Transform()
+	}
+}
+
+type transformConfig struct {
+	TransformProcess string `json:"transform_process,omitempty"`
+}
+
+func Transform() Decorator {
+	var stack []BodyTransformer
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&transformConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*transformConfig)
+		stack = nil
+		for _, name := range strings.Split(config.TransformProcess, "|") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			makeFunc, ok := transformers[name]
+			if !ok {
+				return errors.New("transformer [" + name + "] not found")
+			}
+			stack = append(stack, makeFunc())
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if err := ApplyTransforms(e, stack...); err != nil {
+					EnvelopeLog(e).WithError(err).Error("message transform failed")
+					return NewResult(response.Canned.FailBackendTransaction), err
+				}
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestTransform(t *testing.T) {
+	Svc.reset()
+	Svc.AddTransformer("testaddheader", func() BodyTransformer {
+		return TransformerFunc(func(e *mail.Envelope, header, body []byte) ([]byte, []byte, error) {
+			return append(header, "X-Added: yes\n"...), body, nil
+		})
+	})
+	var seen []byte
+	Svc.AddTransformer("testupper", func() BodyTransformer {
+		return TransformerFunc(func(e *mail.Envelope, header, body []byte) ([]byte, []byte, error) {
+			seen = append([]byte(nil), header...)
+			return header, bytes.ToUpper(body), nil
+		})
+	})
+	defer func() {
+		delete(transformers, "testaddheader")
+		delete(transformers, "testupper")
+	}()
+	p := Decorate(DefaultProcessor{}, Transform())
+	if err := Svc.initialize(BackendConfig{"transform_process": "TestAddHeader|testupper"}); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	_, _ = e.Data.WriteString("Subject: test\n\nhello\n")
+	if err := e.ParseHeaders(); err != nil {
+		t.Error(err)
+	}
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error(err)
+	}
+	if string(seen) != "Subject: test\nX-Added: yes\n" {
+		t.Error("the second transform should see the header added by the first, got", string(seen))
+	}
+	expect := "Subject: test\nX-Added: yes\n\nHELLO\n"
+	if e.Data.String() != expect {
+		t.Error("expecting", expect, "got", e.Data.String())
+	}
+	if e.Len() != len(expect) {
+		t.Error("expecting the length to be", len(expect), "got", e.Len())
+	}
+	if e.Header.Get("X-Added") != "yes" {
+		t.Error("expecting the headers to be parsed again")
+	}
+
+	Svc.reset()
+	_ = Transform()
+	if err := Svc.initialize(BackendConfig{"transform_process": "nosuchtransform"}); err == nil {
+		t.Error("expecting an error for an unknown transformer")
+	}
+}
+
+func TestApplyTransforms(t *testing.T) {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	_, _ = e.Data.WriteString("no header here")
+	noNewline := TransformerFunc(func(e *mail.Envelope, header, body []byte) ([]byte, []byte, error) {
+		if len(header) != 0 {
+			t.Error("expecting no header, got", string(header))
+		}
+		return []byte("X-Test: 1"), body, nil
+	})
+	if err := ApplyTransforms(e, noNewline); err != nil {
+		t.Error(err)
+	}
+	if e.Data.String() != "X-Test: 1\n\nno header here" {
+		t.Error("unexpected message", e.Data.String())
+	}
+	failed := TransformerFunc(func(e *mail.Envelope, header, body []byte) ([]byte, []byte, error) {
+		return nil, nil, errors.New("failed")
+	})
+	if err := ApplyTransforms(e, failed); err == nil {
+		t.Error("expecting an error")
+	}
+	if e.Data.String() != "X-Test: 1\n\nno header here" {
+		t.Error("a failed transform should not change the message, got", e.Data.String())
+	}
+}
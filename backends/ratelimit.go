@@ -0,0 +1,57 @@
+package backends
+
+import (
+	"strconv"
+	"time"
+)
+
+// RateLimiter counts events per key, eg. messages per sender IP, in fixed windows kept in a KVStore,
+// so that instances sharing a Redis store enforce a common limit
+type RateLimiter struct {
+	store  KVStore
+	prefix string
+	limit  int64
+	window time.Duration
+
+	// now can be replaced in tests
+	now func() time.Time
+}
+
+// NewRateLimiter allows limit events per key in each window. The prefix namespaces the keys in the store
+func NewRateLimiter(store KVStore, prefix string, limit int, window time.Duration) *RateLimiter {
+	if window <= 0 {
+		window = time.Minute
+	}
+	return &RateLimiter{
+		store:  store,
+		prefix: prefix,
+		limit:  int64(limit),
+		window: window,
+		now:    time.Now,
+	}
+}
+
+// Allow records an event for key. It returns false if the key is over its limit for the
+// current window, and how long until the window ends
+func (r *RateLimiter) Allow(key string) (allowed bool, retryAfter time.Duration, err error) {
+	if r.limit <= 0 {
+		return true, 0, nil
+	}
+	now := r.now()
+	start := now.Truncate(r.window)
+	k := r.prefix + ":" + key + ":" + strconv.FormatInt(start.Unix(), 10)
+	n, err := r.store.Incr(k, 1)
+	if err != nil {
+		return false, 0, err
+	}
+	if n == 1 {
+		// first event of the window, keep the key a little longer than the window
+		if err = r.store.Expire(k, r.window+time.Minute); err != nil {
+			return false, 0, err
+		}
+	}
+	if n > r.limit {
+		return false, start.Add(r.window).Sub(now), nil
+	}
+	return true, 0, nil
+}
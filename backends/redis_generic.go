@@ -29,17 +29,43 @@ func (m *RedisMockConn) Do(commandName string, args ...interface{}) (reply inter
 }
 
 type dialOptions struct {
-	readTimeout  time.Duration
-	writeTimeout time.Duration
-	dial         func(network, addr string) (net.Conn, error)
-	db           int
-	password     string
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	dial           func(network, addr string) (net.Conn, error)
+	db             int
+	password       string
 }
 
 type RedisDialOption struct {
 	f func(*dialOptions)
 }
 
+// RedisDialConnectTimeout limits the time taken to connect to Redis
+func RedisDialConnectTimeout(d time.Duration) RedisDialOption {
+	return RedisDialOption{func(o *dialOptions) { o.connectTimeout = d }}
+}
+
+// RedisDialReadTimeout limits the time taken to read a reply
+func RedisDialReadTimeout(d time.Duration) RedisDialOption {
+	return RedisDialOption{func(o *dialOptions) { o.readTimeout = d }}
+}
+
+// RedisDialWriteTimeout limits the time taken to write a command
+func RedisDialWriteTimeout(d time.Duration) RedisDialOption {
+	return RedisDialOption{func(o *dialOptions) { o.writeTimeout = d }}
+}
+
+// RedisDialTimeouts returns the connect, read and write timeouts set by options, zero if not set.
+// Drivers pass them on to their own dialer
+func RedisDialTimeouts(options ...RedisDialOption) (connect, read, write time.Duration) {
+	var o dialOptions
+	for _, option := range options {
+		option.f(&o)
+	}
+	return o.connectTimeout, o.readTimeout, o.writeTimeout
+}
+
 type redisDial func(network, address string, options ...RedisDialOption) (RedisConn, error)
 
 var RedisDialer redisDial
@@ -0,0 +1,138 @@
+package backends
+
+import (
+	"expvar"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const defaultReputationHalfLife = time.Hour * 24
+
+// scores that have decayed to less than this are forgotten
+const reputationForget = 0.01
+
+// ReputationStore keeps a score for each sender, keyed by IP address or domain, see ReputationKeys.
+// Good signals raise the score and bad signals lower it. Over time, scores decay towards zero,
+// halving every half-life, so that old behaviour counts less than recent behaviour.
+type ReputationStore struct {
+	halfLife time.Duration
+	scores   map[string]*reputationScore
+	adds     int
+	// now can be replaced in tests
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+type reputationScore struct {
+	value   float64
+	updated time.Time
+}
+
+// NewReputationStore returns a store where scores halve every halfLife
+func NewReputationStore(halfLife time.Duration) *ReputationStore {
+	if halfLife <= 0 {
+		halfLife = defaultReputationHalfLife
+	}
+	return &ReputationStore{
+		halfLife: halfLife,
+		scores:   make(map[string]*reputationScore),
+		now:      time.Now,
+	}
+}
+
+// SetHalfLife changes the decay rate
+func (r *ReputationStore) SetHalfLife(halfLife time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if halfLife > 0 {
+		r.halfLife = halfLife
+	}
+}
+
+// Add adds delta to the score of key and returns the new score
+func (r *ReputationStore) Add(key string, delta float64) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	s, ok := r.scores[key]
+	if !ok {
+		s = &reputationScore{}
+		r.scores[key] = s
+	}
+	s.value = r.decay(s, now) + delta
+	s.updated = now
+	if r.adds++; r.adds%1000 == 0 {
+		r.forget(now)
+	}
+	return s.value
+}
+
+// Score returns the current score of key, zero for unknown senders
+func (r *ReputationStore) Score(key string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.scores[key]; ok {
+		return r.decay(s, r.now())
+	}
+	return 0
+}
+
+// Scores returns a snapshot of the current scores
+func (r *ReputationStore) Scores() map[string]float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.forget(now)
+	ret := make(map[string]float64, len(r.scores))
+	for key, s := range r.scores {
+		ret[key] = r.decay(s, now)
+	}
+	return ret
+}
+
+func (r *ReputationStore) decay(s *reputationScore, now time.Time) float64 {
+	elapsed := now.Sub(s.updated)
+	if elapsed <= 0 {
+		return s.value
+	}
+	return s.value * math.Pow(0.5, float64(elapsed)/float64(r.halfLife))
+}
+
+// forget removes the scores that decayed to almost nothing
+func (r *ReputationStore) forget(now time.Time) {
+	for key, s := range r.scores {
+		if math.Abs(r.decay(s, now)) < reputationForget {
+			delete(r.scores, key)
+		}
+	}
+}
+
+// reputation is shared by all backends so that scores persist across connections
+var reputation = NewReputationStore(defaultReputationHalfLife)
+
+func init() {
+	// published as "guerrilla_reputation": {"ip:192.0.2.1": -4.5, "domain:example.com": 2}
+	expvar.Publish("guerrilla_reputation", expvar.Func(func() interface{} {
+		return reputation.Scores()
+	}))
+}
+
+// Reputation returns the current score of the sender key, eg. "ip:192.0.2.1" or "domain:example.com".
+// Negative scores are bad senders, positive are good
+func Reputation(key string) float64 {
+	return reputation.Score(key)
+}
+
+// ReputationKeys returns the keys the sender of the envelope is scored by:
+// the IP address it connected from, and the domain of the MAIL FROM address if not a bounce
+func ReputationKeys(e *mail.Envelope) []string {
+	keys := []string{"ip:" + e.RemoteIP}
+	if e.MailFrom.Host != "" {
+		keys = append(keys, "domain:"+strings.ToLower(e.MailFrom.Host))
+	}
+	return keys
+}
@@ -0,0 +1,578 @@
+package backends
+
+import (
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// The filtering language is a subset of Sieve (RFC 5228):
+//
+//   require ["fileinto"];
+//   if header :contains "subject" ["[SPAM]", "viagra"] {
+//       fileinto "Junk";
+//       stop;
+//   } elsif anyof (size :over 10M, not exists "from") {
+//       discard;
+//   } else {
+//       keep;
+//   }
+//
+// Commands: if/elsif/else, keep, discard, stop, fileinto "<folder>", redirect "<address>".
+// require is accepted and ignored.
+// Tests: header [:is|:contains|:matches] <names> <keys>, exists <names>,
+// size :over|:under <number>[K|M|G], not <test>, anyof (<tests>), allof (<tests>), true, false.
+// Names and keys are a string or a list of strings in brackets. Comparisons ignore case,
+// :matches supports the * and ? wildcards. Comments start with # and end with the line.
+//
+// As in Sieve, the message is kept in the inbox unless it was discarded, filed into a
+// folder or redirected, or kept explicitly with keep.
+
+// sieveScript is a parsed filtering script
+type sieveScript struct {
+	commands []sieveCommand
+}
+
+// sieveCommand is an action, or an if with its branches
+type sieveCommand struct {
+	name     string
+	arg      string
+	branches []sieveBranch
+}
+
+// sieveBranch is a block run if test is true, test is nil for an else
+type sieveBranch struct {
+	test  sieveTest
+	block []sieveCommand
+}
+
+// sieveMessage is what the tests are evaluated against
+type sieveMessage struct {
+	header textproto.MIMEHeader
+	size   int64
+}
+
+// sieveActions collects the results of running scripts for a recipient
+type sieveActions struct {
+	implicitKeep bool
+	keep         bool
+	fileinto     []string
+	redirect     []string
+	stopped      bool
+}
+
+func newSieveActions() *sieveActions {
+	return &sieveActions{implicitKeep: true}
+}
+
+// folders returns the folders that the message is delivered to, "" is the inbox
+func (a *sieveActions) folders() []string {
+	var folders []string
+	if a.keep || a.implicitKeep {
+		folders = append(folders, "")
+	}
+	for _, f := range a.fileinto {
+		if strings.EqualFold(f, "INBOX") {
+			f = ""
+		}
+		found := false
+		for _, existing := range folders {
+			found = found || existing == f
+		}
+		if !found {
+			folders = append(folders, f)
+		}
+	}
+	return folders
+}
+
+// run runs the script, adding to the actions. Does nothing if an earlier script stopped
+func (s *sieveScript) run(m *sieveMessage, a *sieveActions) {
+	if !a.stopped {
+		runSieveBlock(s.commands, m, a)
+	}
+}
+
+func runSieveBlock(commands []sieveCommand, m *sieveMessage, a *sieveActions) {
+	for i := range commands {
+		if a.stopped {
+			return
+		}
+		c := &commands[i]
+		switch c.name {
+		case "if":
+			for _, b := range c.branches {
+				if b.test == nil || b.test.eval(m) {
+					runSieveBlock(b.block, m, a)
+					break
+				}
+			}
+		case "keep":
+			a.keep = true
+		case "discard":
+			a.implicitKeep = false
+		case "fileinto":
+			a.implicitKeep = false
+			a.fileinto = append(a.fileinto, c.arg)
+		case "redirect":
+			a.implicitKeep = false
+			a.redirect = append(a.redirect, c.arg)
+		case "stop":
+			a.stopped = true
+		}
+	}
+}
+
+// sieveTest is a condition of an if
+type sieveTest interface {
+	eval(m *sieveMessage) bool
+}
+
+type sieveBool bool
+
+func (t sieveBool) eval(m *sieveMessage) bool {
+	return bool(t)
+}
+
+type sieveNot struct {
+	test sieveTest
+}
+
+func (t sieveNot) eval(m *sieveMessage) bool {
+	return !t.test.eval(m)
+}
+
+// sieveAnyOf is anyof if any is true, else allof
+type sieveAnyOf struct {
+	any   bool
+	tests []sieveTest
+}
+
+func (t sieveAnyOf) eval(m *sieveMessage) bool {
+	for _, test := range t.tests {
+		if test.eval(m) == t.any {
+			return t.any
+		}
+	}
+	return !t.any
+}
+
+type sieveExists struct {
+	names []string
+}
+
+func (t sieveExists) eval(m *sieveMessage) bool {
+	for _, name := range t.names {
+		if len(m.header[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type sieveSize struct {
+	over  bool
+	limit int64
+}
+
+func (t sieveSize) eval(m *sieveMessage) bool {
+	if t.over {
+		return m.size > t.limit
+	}
+	return m.size < t.limit
+}
+
+type sieveHeader struct {
+	match string
+	names []string
+	keys  []string
+}
+
+func (t sieveHeader) eval(m *sieveMessage) bool {
+	for _, name := range t.names {
+		for _, value := range m.header[textproto.CanonicalMIMEHeaderKey(name)] {
+			value = strings.ToLower(strings.TrimSpace(mail.MimeHeaderDecode(value)))
+			for _, key := range t.keys {
+				if sieveMatch(t.match, value, strings.ToLower(key)) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func sieveMatch(match, value, key string) bool {
+	switch match {
+	case ":contains":
+		return strings.Contains(value, key)
+	case ":matches":
+		return sieveWildcard([]rune(key), []rune(value))
+	}
+	return value == key
+}
+
+// sieveWildcard matches s against pattern, where * matches any sequence and ? any character
+func sieveWildcard(pattern, s []rune) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]) {
+			p++
+			i++
+		} else if p < len(pattern) && pattern[p] == '*' {
+			// try matching nothing first, backtrack to here if that fails
+			star, next = p, i
+			p++
+		} else if star > -1 {
+			next++
+			p, i = star+1, next
+		} else {
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// parseSieve parses a script
+func parseSieve(script string) (*sieveScript, error) {
+	p := &sieveParser{}
+	if err := p.tokenize(script); err != nil {
+		return nil, err
+	}
+	commands, err := p.block(false)
+	if err != nil {
+		return nil, err
+	}
+	return &sieveScript{commands: commands}, nil
+}
+
+type sieveTokenKind int
+
+const (
+	sieveWord sieveTokenKind = iota
+	sieveTag
+	sieveString
+	sieveNumber
+	sievePunct
+)
+
+type sieveToken struct {
+	kind sieveTokenKind
+	text string
+	line int
+}
+
+type sieveParser struct {
+	tokens []sieveToken
+	pos    int
+}
+
+func (p *sieveParser) tokenize(s string) error {
+	line := 1
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case strings.IndexByte("{}()[],;", c) > -1:
+			p.tokens = append(p.tokens, sieveToken{sievePunct, string(c), line})
+			i++
+		case c == '"':
+			var str []byte
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				if s[i] == '\n' {
+					line++
+				}
+				str = append(str, s[i])
+			}
+			if i == len(s) {
+				return fmt.Errorf("line %d: unterminated string", line)
+			}
+			i++
+			p.tokens = append(p.tokens, sieveToken{sieveString, string(str), line})
+		case c == ':' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			start := i
+			for i++; i < len(s) && (unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i])) || s[i] == '_'); i++ {
+			}
+			kind := sieveWord
+			if c == ':' {
+				kind = sieveTag
+			} else if unicode.IsDigit(rune(c)) {
+				kind = sieveNumber
+			}
+			p.tokens = append(p.tokens, sieveToken{kind, strings.ToLower(s[start:i]), line})
+		default:
+			return fmt.Errorf("line %d: unexpected %q", line, c)
+		}
+	}
+	return nil
+}
+
+func (p *sieveParser) peek() *sieveToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *sieveParser) next() (*sieveToken, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of script")
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *sieveParser) expect(punct string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t.kind != sievePunct || t.text != punct {
+		return fmt.Errorf("line %d: expecting %q, got %q", t.line, punct, t.text)
+	}
+	return nil
+}
+
+// accept consumes the next token if it's punct
+func (p *sieveParser) accept(punct string) bool {
+	if t := p.peek(); t != nil && t.kind == sievePunct && t.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// block parses commands up to the end of the script, or the closing brace if braced
+func (p *sieveParser) block(braced bool) ([]sieveCommand, error) {
+	var commands []sieveCommand
+	for {
+		t := p.peek()
+		if t == nil {
+			if braced {
+				return nil, fmt.Errorf("unexpected end of script, expecting \"}\"")
+			}
+			return commands, nil
+		}
+		if braced && p.accept("}") {
+			return commands, nil
+		}
+		c, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			commands = append(commands, *c)
+		}
+	}
+}
+
+func (p *sieveParser) command() (*sieveCommand, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind != sieveWord {
+		return nil, fmt.Errorf("line %d: expecting a command, got %q", t.line, t.text)
+	}
+	c := &sieveCommand{name: t.text}
+	switch t.text {
+	case "require":
+		if _, err = p.stringList(); err != nil {
+			return nil, err
+		}
+		return nil, p.expect(";")
+	case "if":
+		for {
+			b := sieveBranch{}
+			if b.test, err = p.test(); err != nil {
+				return nil, err
+			}
+			if err = p.expect("{"); err != nil {
+				return nil, err
+			}
+			if b.block, err = p.block(true); err != nil {
+				return nil, err
+			}
+			c.branches = append(c.branches, b)
+			next := p.peek()
+			if next == nil || next.kind != sieveWord || (next.text != "elsif" && next.text != "else") {
+				return c, nil
+			}
+			p.pos++
+			if next.text == "else" {
+				if err = p.expect("{"); err != nil {
+					return nil, err
+				}
+				b = sieveBranch{}
+				if b.block, err = p.block(true); err != nil {
+					return nil, err
+				}
+				c.branches = append(c.branches, b)
+				return c, nil
+			}
+		}
+	case "keep", "discard", "stop":
+	case "fileinto", "redirect":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if arg.kind != sieveString || arg.text == "" {
+			return nil, fmt.Errorf("line %d: %s expects a string", arg.line, t.text)
+		}
+		c.arg = arg.text
+		if t.text == "redirect" {
+			if _, _, ok := splitAddress(arg.text); !ok {
+				return nil, fmt.Errorf("line %d: invalid redirect address %q", arg.line, arg.text)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("line %d: unsupported command %q", t.line, t.text)
+	}
+	return c, p.expect(";")
+}
+
+func (p *sieveParser) test() (sieveTest, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind != sieveWord {
+		return nil, fmt.Errorf("line %d: expecting a test, got %q", t.line, t.text)
+	}
+	switch t.text {
+	case "true", "false":
+		return sieveBool(t.text == "true"), nil
+	case "not":
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		return sieveNot{test}, nil
+	case "anyof", "allof":
+		if err = p.expect("("); err != nil {
+			return nil, err
+		}
+		list := sieveAnyOf{any: t.text == "anyof"}
+		for {
+			test, err := p.test()
+			if err != nil {
+				return nil, err
+			}
+			list.tests = append(list.tests, test)
+			if !p.accept(",") {
+				break
+			}
+		}
+		return list, p.expect(")")
+	case "exists":
+		names, err := p.stringList()
+		if err != nil {
+			return nil, err
+		}
+		return sieveExists{names}, nil
+	case "size":
+		tag, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tag.kind != sieveTag || (tag.text != ":over" && tag.text != ":under") {
+			return nil, fmt.Errorf("line %d: size expects :over or :under", tag.line)
+		}
+		n, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		limit, err := parseSieveNumber(n)
+		if err != nil {
+			return nil, err
+		}
+		return sieveSize{over: tag.text == ":over", limit: limit}, nil
+	case "header":
+		h := sieveHeader{match: ":is"}
+		for t := p.peek(); t != nil && t.kind == sieveTag; t = p.peek() {
+			switch t.text {
+			case ":is", ":contains", ":matches":
+				h.match = t.text
+			default:
+				return nil, fmt.Errorf("line %d: unsupported tag %s", t.line, t.text)
+			}
+			p.pos++
+		}
+		if h.names, err = p.stringList(); err != nil {
+			return nil, err
+		}
+		if h.keys, err = p.stringList(); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	return nil, fmt.Errorf("line %d: unsupported test %q", t.line, t.text)
+}
+
+// stringList parses a string, or a list of strings in brackets
+func (p *sieveParser) stringList() ([]string, error) {
+	var list []string
+	bracketed := p.accept("[")
+	for {
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.kind != sieveString {
+			return nil, fmt.Errorf("line %d: expecting a string, got %q", t.line, t.text)
+		}
+		list = append(list, t.text)
+		if !bracketed {
+			return list, nil
+		}
+		if !p.accept(",") {
+			return list, p.expect("]")
+		}
+	}
+}
+
+// parseSieveNumber parses a number with an optional K, M or G quantifier
+func parseSieveNumber(t *sieveToken) (int64, error) {
+	s := t.text
+	multiplier := int64(1)
+	if t.kind == sieveNumber && len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if t.kind != sieveNumber || err != nil {
+		return 0, fmt.Errorf("line %d: expecting a number, got %q", t.line, t.text)
+	}
+	return n * multiplier, nil
+}
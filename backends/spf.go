@@ -0,0 +1,567 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SPF results (RFC 7208 section 2.6)
+const (
+	SPFNone      = "none"
+	SPFNeutral   = "neutral"
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFTempError = "temperror"
+	SPFPermError = "permerror"
+)
+
+const (
+	// spfLookupLimit is the number of terms causing DNS lookups allowed in a check, RFC 7208 4.6.4
+	spfLookupLimit = 10
+	// spfVoidLookupLimit is the number of lookups allowed to return no records
+	spfVoidLookupLimit = 2
+)
+
+// SPFResolver looks up the DNS records needed for SPF checks. *net.Resolver implements it
+type SPFResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// errSPFPerm and errSPFTemp abort the evaluation with a permerror or temperror
+var (
+	errSPFPerm = errors.New("spf: permanent error")
+	errSPFTemp = errors.New("spf: temporary error")
+)
+
+// spfMechanismCIDR matches the optional ip4-cidr-length and ip6-cidr-length at the end of a and mx
+var spfMechanismCIDR = regexp.MustCompile(`^(.*?)(?:/(\d+))?(?://(\d+))?$`)
+
+// CheckSPF runs check_host() of RFC 7208 for the client ip and the sender, eg. "user@example.com".
+// helo is the name the client gave with HELO. When the sender is empty (a null reverse-path),
+// the HELO identity, postmaster@helo, is checked instead
+func CheckSPF(ctx context.Context, resolver SPFResolver, ip net.IP, helo, sender string) string {
+	if sender == "" || strings.HasPrefix(sender, "@") {
+		sender = "postmaster@" + helo
+	}
+	domain := sender[strings.LastIndexByte(sender, '@')+1:]
+	c := &spfCheck{
+		ctx:      ctx,
+		resolver: resolver,
+		ip:       ip,
+		helo:     helo,
+		sender:   sender,
+	}
+	return c.checkHost(domain)
+}
+
+// spfCheck holds the state of a single check, the lookup counts are shared by the
+// included records
+type spfCheck struct {
+	ctx      context.Context
+	resolver SPFResolver
+	ip       net.IP
+	helo     string
+	sender   string
+	lookups  int
+	voids    int
+}
+
+func (c *spfCheck) checkHost(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !spfValidDomain(domain) {
+		return SPFNone
+	}
+	record, result := c.record(domain)
+	if record == "" {
+		return result
+	}
+	result, err := c.evaluate(domain, record)
+	if err == errSPFTemp {
+		return SPFTempError
+	} else if err != nil {
+		return SPFPermError
+	}
+	return result
+}
+
+// record fetches the SPF record of domain. When there is no single record, it returns the result
+func (c *spfCheck) record(domain string) (string, string) {
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if spfNotFound(err) {
+			return "", SPFNone
+		}
+		return "", SPFTempError
+	}
+	var records []string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", SPFNone
+	case 1:
+		return records[0], ""
+	}
+	return "", SPFPermError
+}
+
+// evaluate runs the mechanisms of record in order, then the redirect modifier if none matched
+func (c *spfCheck) evaluate(domain, record string) (string, error) {
+	terms := strings.Fields(record)[1:]
+	redirect := ""
+	seen := make(map[string]bool)
+	// modifiers can be anywhere in the record, check them first
+	for _, term := range terms {
+		if name, value, ok := spfModifier(term); ok {
+			if name == "redirect" || name == "exp" {
+				if seen[name] {
+					return "", errSPFPerm
+				}
+				seen[name] = true
+			}
+			if name == "redirect" {
+				redirect = value
+			}
+		}
+	}
+	for _, term := range terms {
+		if _, _, ok := spfModifier(term); ok {
+			continue
+		}
+		result := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = SPFFail, term[1:]
+		case '~':
+			result, term = SPFSoftFail, term[1:]
+		case '?':
+			result, term = SPFNeutral, term[1:]
+		}
+		match, err := c.match(domain, term)
+		if err != nil {
+			return "", err
+		}
+		if match {
+			return result, nil
+		}
+	}
+	if redirect == "" {
+		return SPFNeutral, nil
+	}
+	if err := c.countLookup(); err != nil {
+		return "", err
+	}
+	target, err := c.expand(redirect, domain)
+	if err != nil {
+		return "", err
+	}
+	switch result := c.checkHost(target); result {
+	case SPFNone:
+		return "", errSPFPerm
+	case SPFTempError:
+		return "", errSPFTemp
+	case SPFPermError:
+		return "", errSPFPerm
+	default:
+		return result, nil
+	}
+}
+
+// match returns true if the mechanism (without its qualifier) matches the client
+func (c *spfCheck) match(domain, mechanism string) (bool, error) {
+	name, arg := mechanism, ""
+	if i := strings.IndexAny(mechanism, ":/"); i >= 0 {
+		name, arg = mechanism[:i], mechanism[i:]
+	}
+	switch strings.ToLower(name) {
+	case "all":
+		if arg != "" {
+			return false, errSPFPerm
+		}
+		return true, nil
+	case "include":
+		target, err := c.domainSpec(arg, domain, true)
+		if err != nil {
+			return false, err
+		}
+		if err = c.countLookup(); err != nil {
+			return false, err
+		}
+		switch c.checkHost(target) {
+		case SPFPass:
+			return true, nil
+		case SPFTempError:
+			return false, errSPFTemp
+		case SPFPermError, SPFNone:
+			return false, errSPFPerm
+		}
+		return false, nil
+	case "a", "mx":
+		m := spfMechanismCIDR.FindStringSubmatch(arg)
+		target, err := c.domainSpec(m[1], domain, false)
+		if err != nil {
+			return false, err
+		}
+		mask4, mask6, err := spfMasks(m[2], m[3])
+		if err != nil {
+			return false, err
+		}
+		if err = c.countLookup(); err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if strings.ToLower(name) == "mx" {
+			mxs, err := c.resolver.LookupMX(c.ctx, target)
+			if err = c.lookupErr(err, len(mxs)); err != nil {
+				return false, err
+			}
+			if len(mxs) > spfLookupLimit {
+				return false, errSPFPerm
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := c.resolver.LookupIPAddr(c.ctx, host)
+			if err = c.lookupErr(err, len(addrs)); err != nil {
+				return false, err
+			}
+			for _, addr := range addrs {
+				if spfContains(addr.IP, c.ip, mask4, mask6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "ptr":
+		target, err := c.domainSpec(arg, domain, false)
+		if err != nil {
+			return false, err
+		}
+		if err = c.countLookup(); err != nil {
+			return false, err
+		}
+		name := c.validatedName(target)
+		return name != "", nil
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPerm
+		}
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			if strings.ToLower(name) == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil || (strings.ToLower(name) == "ip4") != (ipNet.IP.To4() != nil) {
+			return false, errSPFPerm
+		}
+		return ipNet.Contains(c.ip), nil
+	case "exists":
+		target, err := c.domainSpec(arg, domain, true)
+		if err != nil {
+			return false, err
+		}
+		if err = c.countLookup(); err != nil {
+			return false, err
+		}
+		addrs, err := c.resolver.LookupIPAddr(c.ctx, target)
+		if err = c.lookupErr(err, len(addrs)); err != nil {
+			return false, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, errSPFPerm
+}
+
+// domainSpec expands the ":domain-spec" argument of a mechanism, which defaults to domain
+// unless required
+func (c *spfCheck) domainSpec(arg, domain string, required bool) (string, error) {
+	if arg == "" && !required {
+		return domain, nil
+	}
+	if !strings.HasPrefix(arg, ":") || len(arg) == 1 {
+		return "", errSPFPerm
+	}
+	return c.expand(arg[1:], domain)
+}
+
+// validatedName returns the first name pointing back to the client's IP that is target
+// or a subdomain of it, RFC 7208 5.5
+func (c *spfCheck) validatedName(target string) string {
+	names, err := c.resolver.LookupAddr(c.ctx, c.ip.String())
+	if err != nil {
+		return ""
+	}
+	target = strings.ToLower(target)
+	for i, name := range names {
+		if i == spfLookupLimit {
+			break
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		addrs, err := c.resolver.LookupIPAddr(c.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(c.ip) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func (c *spfCheck) countLookup() error {
+	c.lookups++
+	if c.lookups > spfLookupLimit {
+		return errSPFPerm
+	}
+	return nil
+}
+
+// lookupErr converts a lookup error, and counts lookups returning no records
+func (c *spfCheck) lookupErr(err error, n int) error {
+	if err != nil && !spfNotFound(err) {
+		return errSPFTemp
+	}
+	if n == 0 {
+		c.voids++
+		if c.voids > spfVoidLookupLimit {
+			return errSPFPerm
+		}
+	}
+	return nil
+}
+
+// expand expands the macros of a domain-spec, RFC 7208 section 7
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	var out []byte
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out = append(out, spec[i])
+			continue
+		}
+		if i+1 == len(spec) {
+			return "", errSPFPerm
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out = append(out, '%')
+			continue
+		case '_':
+			out = append(out, ' ')
+			continue
+		case '-':
+			out = append(out, "%20"...)
+			continue
+		case '{':
+		default:
+			return "", errSPFPerm
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", errSPFPerm
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+		value, err := c.macro(macro, domain)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, value...)
+	}
+	expanded := string(out)
+	// keep the rightmost labels of names that are too long, RFC 7208 4.8
+	for len(expanded) > 253 {
+		j := strings.IndexByte(expanded, '.')
+		if j < 0 {
+			return "", errSPFPerm
+		}
+		expanded = expanded[j+1:]
+	}
+	return expanded, nil
+}
+
+// macro expands a single macro, eg. "ir" of %{ir}: the letter, an optional number of parts to
+// keep, r to reverse the parts, then the delimiters to split at
+func (c *spfCheck) macro(macro, domain string) (string, error) {
+	letter := macro[0]
+	var value string
+	switch letter | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = c.sender[:strings.LastIndexByte(c.sender, '@')]
+	case 'o':
+		value = c.sender[strings.LastIndexByte(c.sender, '@')+1:]
+	case 'd':
+		value = domain
+	case 'i':
+		value = spfDottedIP(c.ip)
+	case 'p':
+		value = "unknown"
+		if name := c.validatedName(domain); name != "" {
+			value = name
+		}
+	case 'v':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = c.helo
+	default:
+		return "", errSPFPerm
+	}
+	rest := macro[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		var err error
+		if keep, err = strconv.Atoi(rest[:digits]); err != nil || keep == 0 {
+			return "", errSPFPerm
+		}
+	}
+	rest = rest[digits:]
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse, rest = true, rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", errSPFPerm
+		}
+		delimiters = rest
+	}
+	if digits > 0 || reverse || rest != "" {
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		value = strings.Join(parts, ".")
+	}
+	if letter >= 'A' && letter <= 'Z' {
+		value = url.QueryEscape(value)
+	}
+	return value, nil
+}
+
+// spfModifier returns the name and value of a modifier term, eg. redirect=_spf.example.com
+func spfModifier(term string) (name, value string, ok bool) {
+	i := strings.IndexByte(term, '=')
+	if i < 1 {
+		return "", "", false
+	}
+	name = term[:i]
+	for j := 0; j < len(name); j++ {
+		b := name[j] | 0x20
+		if !(b >= 'a' && b <= 'z') && !(j > 0 && (name[j] >= '0' && name[j] <= '9' || strings.IndexByte("-_.", name[j]) >= 0)) {
+			return "", "", false
+		}
+	}
+	return strings.ToLower(name), term[i+1:], true
+}
+
+// spfMasks parses the cidr lengths of a and mx, which default to the full address
+func spfMasks(ip4, ip6 string) (int, int, error) {
+	mask4, mask6 := 32, 128
+	var err error
+	if ip4 != "" {
+		if mask4, err = strconv.Atoi(ip4); err != nil || mask4 > 32 {
+			return 0, 0, errSPFPerm
+		}
+	}
+	if ip6 != "" {
+		if mask6, err = strconv.Atoi(ip6); err != nil || mask6 > 128 {
+			return 0, 0, errSPFPerm
+		}
+	}
+	return mask4, mask6, nil
+}
+
+// spfContains returns true if ip is in the network of addr with the mask of its family
+func spfContains(addr, ip net.IP, mask4, mask6 int) bool {
+	if addr4 := addr.To4(); addr4 != nil {
+		ip4 := ip.To4()
+		return ip4 != nil && addr4.Mask(net.CIDRMask(mask4, 32)).Equal(ip4.Mask(net.CIDRMask(mask4, 32)))
+	}
+	if ip.To4() != nil {
+		return false
+	}
+	return addr.Mask(net.CIDRMask(mask6, 128)).Equal(ip.Mask(net.CIDRMask(mask6, 128)))
+}
+
+// spfDottedIP formats the ip for the i macro: dotted quads, or dotted nibbles for IPv6
+func spfDottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	const hexDigits = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hexDigits[b>>4]), string(hexDigits[b&0xf]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// spfValidDomain returns true if domain is a multi-label name that can be looked up
+func spfValidDomain(domain string) bool {
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// spfNotFound returns true if the error means that the name or records do not exist
+func spfNotFound(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.Err == "no such host"
+	}
+	return false
+}
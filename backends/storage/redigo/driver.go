@@ -5,6 +5,10 @@ import redigo "github.com/gomodule/redigo/redis"
 
 func init() {
 	backends.RedisDialer = func(network, address string, options ...backends.RedisDialOption) (backends.RedisConn, error) {
-		return redigo.Dial(network, address)
+		connect, read, write := backends.RedisDialTimeouts(options...)
+		return redigo.Dial(network, address,
+			redigo.DialConnectTimeout(connect),
+			redigo.DialReadTimeout(read),
+			redigo.DialWriteTimeout(write))
 	}
 }
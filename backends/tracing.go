@@ -0,0 +1,109 @@
+package backends
+
+import (
+	"sync"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// Span is a timed operation in a trace, eg. an SMTP session, a message or a processor
+type Span interface {
+	// SetAttribute records a key/value pair on the span, eg. "queued_id"
+	SetAttribute(key string, value interface{})
+	// End finishes the span, marking it as failed if err is not nil
+	End(err error)
+	// TraceParent returns the W3C Trace Context traceparent value of the span, so that
+	// the trace can be continued downstream, eg. "00-<trace id>-<span id>-01"
+	TraceParent() string
+}
+
+// Tracer starts spans. An OpenTelemetry compatible exporter is provided by NewOTLPTracer,
+// other tracing systems can be plugged in by implementing this interface
+type Tracer interface {
+	// Start begins a span named name. It's a child of parent, or the root of a new trace if parent is nil
+	Start(name string, parent Span) Span
+}
+
+// EnvelopeSpanKey is the key in e.Values for the span of the message being processed.
+// When set, each processor in the stack gets its own child span
+const EnvelopeSpanKey = "trace_span"
+
+var (
+	tracer     Tracer
+	tracerLock sync.RWMutex
+)
+
+// SetTracer sets the tracer used for all spans, nil turns tracing off (default)
+func SetTracer(t Tracer) {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+	tracer = t
+}
+
+// StartSpan starts a span using the tracer set with SetTracer. It returns nil if tracing is off
+func StartSpan(name string, parent Span) Span {
+	tracerLock.RLock()
+	t := tracer
+	tracerLock.RUnlock()
+	if t == nil {
+		return nil
+	}
+	return t.Start(name, parent)
+}
+
+// EnvelopeSpan returns the span of the message being processed, nil if not traced
+func EnvelopeSpan(e *mail.Envelope) Span {
+	if span, ok := e.Values[EnvelopeSpanKey].(Span); ok {
+		return span
+	}
+	return nil
+}
+
+// processorSpanKey holds the span of the processor currently running
+const processorSpanKey = "trace_processor_span"
+
+type processorSpan struct {
+	Span
+	ended bool
+}
+
+func (s *processorSpan) end(err error) {
+	if !s.ended {
+		s.ended = true
+		s.End(err)
+	}
+}
+
+// traceDecorator wraps the processor made by d so that each time it runs on a traced
+// envelope, a child span named after the processor covers the time until it returns,
+// or until it calls the next processor, whichever comes first
+func traceDecorator(name string, d Decorator) Decorator {
+	return func(next Processor) Processor {
+		inner := d(ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if span, ok := e.Values[processorSpanKey].(*processorSpan); ok {
+				span.end(nil)
+			}
+			return next.Process(e, task)
+		}))
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			parent := EnvelopeSpan(e)
+			if parent == nil {
+				return inner.Process(e, task)
+			}
+			s := StartSpan("processor "+name, parent)
+			if s == nil {
+				return inner.Process(e, task)
+			}
+			s.SetAttribute("task", task.String())
+			span := &processorSpan{Span: s}
+			e.Values[processorSpanKey] = span
+			result, err := inner.Process(e, task)
+			if !span.ended && result != nil {
+				// the processor returned without passing on to the next
+				span.SetAttribute("result", result.String())
+			}
+			span.end(err)
+			return result, err
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	otlpBatchSize     = 100
+	otlpFlushInterval = time.Second * 5
+	otlpQueueSize     = 2048
+	otlpTimeout       = time.Second * 10
+)
+
+// OTLPTracer is a Tracer that exports spans to an OpenTelemetry collector using
+// OTLP/HTTP with JSON encoding. Spans are sent in batches, in the background
+type OTLPTracer struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	queue       chan *otlpSpan
+	stop        chan struct{}
+	done        sync.WaitGroup
+	stopOnce    sync.Once
+}
+
+// NewOTLPTracer returns a tracer exporting to endpoint, the traces URL of the collector,
+// eg. "http://localhost:4318/v1/traces". Call Stop to flush the remaining spans
+func NewOTLPTracer(endpoint, serviceName string) *OTLPTracer {
+	if serviceName == "" {
+		serviceName = "go-guerrilla"
+	}
+	t := &OTLPTracer{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: otlpTimeout},
+		queue:       make(chan *otlpSpan, otlpQueueSize),
+		stop:        make(chan struct{}),
+	}
+	t.done.Add(1)
+	go t.run()
+	return t
+}
+
+// Start implements Tracer
+func (t *OTLPTracer) Start(name string, parent Span) Span {
+	s := &otlpSpan{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+		spanID: randomHex(8),
+		attrs:  make(map[string]interface{}),
+	}
+	if p, ok := parent.(*otlpSpan); ok {
+		s.traceID = p.traceID
+		s.parentID = p.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return s
+}
+
+// Stop exports the queued spans and stops the exporter
+func (t *OTLPTracer) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		t.done.Wait()
+	})
+}
+
+func (t *OTLPTracer) enqueue(s *otlpSpan) {
+	select {
+	case t.queue <- s:
+	default:
+		Log().Debug("trace queue full, span dropped")
+	}
+}
+
+func (t *OTLPTracer) run() {
+	defer t.done.Done()
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*otlpSpan, 0, otlpBatchSize)
+	for {
+		select {
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) >= otlpBatchSize {
+				t.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				t.export(batch)
+				batch = batch[:0]
+			}
+		case <-t.stop:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			if len(batch) > 0 {
+				t.export(batch)
+			}
+			return
+		}
+	}
+}
+
+func (t *OTLPTracer) export(batch []*otlpSpan) {
+	body, err := json.Marshal(t.request(batch))
+	if err != nil {
+		Log().WithError(err).Error("could not encode spans")
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		Log().WithError(err).Warn("could not export spans")
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		Log().Warnf("could not export spans, collector returned %s", resp.Status)
+	}
+}
+
+// request builds an ExportTraceServiceRequest in the OTLP JSON encoding
+func (t *OTLPTracer) request(batch []*otlpSpan) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              1, // internal
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != "" {
+			span["parentSpanId"] = s.parentID
+		} else {
+			span["kind"] = 2 // server
+		}
+		if s.err != nil {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+		}
+		s.mu.Unlock()
+		spans = append(spans, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": t.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/flashmob/go-guerrilla"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	ret := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch val := v.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": val}
+		case bool:
+			value = map[string]interface{}{"boolValue": val}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(val)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": val}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(val)}
+		}
+		ret = append(ret, map[string]interface{}{"key": k, "value": value})
+	}
+	return ret
+}
+
+type otlpSpan struct {
+	tracer   *OTLPTracer
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      error
+	mu       sync.Mutex
+}
+
+func (s *otlpSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *otlpSpan) End(err error) {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+func (s *otlpSpan) TraceParent() string {
+	return "00-" + s.traceID + "-" + s.spanID + "-01"
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// ids only need to be unique
+		return fmt.Sprintf("%0*x", n*2, time.Now().UnixNano())[:n*2]
+	}
+	return hex.EncodeToString(b)
+}
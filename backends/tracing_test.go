@@ -0,0 +1,147 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	ended  int
+	err    error
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *testSpan) End(err error)                              { s.ended++; s.err = err }
+func (s *testSpan) TraceParent() string                        { return "00-trace-" + s.name + "-01" }
+
+type testTracer struct {
+	spans []*testSpan
+	mu    sync.Mutex
+}
+
+func (t *testTracer) Start(name string, parent Span) Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &testSpan{name: name, attrs: make(map[string]interface{})}
+	if p, ok := parent.(*testSpan); ok {
+		s.parent = p
+	}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+func TestTraceDecorator(t *testing.T) {
+	tracer := &testTracer{}
+	SetTracer(tracer)
+	defer SetTracer(nil)
+	Svc.reset()
+	p := Decorate(DefaultProcessor{}, traceDecorator("header", Header()), traceDecorator("headersparser", HeadersParser()))
+	if err := Svc.initialize(BackendConfig{"primary_mail_host": "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc123"
+	e.RcptTo = []mail.Address{{User: "test", Host: "example.com"}}
+	_, _ = e.Data.WriteString("Subject: test\n\nhello\n")
+	// not traced, no spans
+	if result, _ := p.Process(e, TaskSaveMail); result.Code() != 200 {
+		t.Error("expecting 200, got", result)
+	}
+	if len(tracer.spans) != 0 {
+		t.Error("expecting no spans, got", len(tracer.spans))
+	}
+	if strings.Contains(e.DeliveryHeader, "Traceparent") {
+		t.Error("untraced message should not have a Traceparent header")
+	}
+
+	e.DeliveryHeader = ""
+	message := StartSpan("smtp message", nil)
+	e.Values[EnvelopeSpanKey] = message
+	if result, _ := p.Process(e, TaskSaveMail); result.Code() != 200 {
+		t.Error("expecting 200, got", result)
+	}
+	if len(tracer.spans) != 3 {
+		t.Fatal("expecting 3 spans, got", len(tracer.spans))
+	}
+	for i, name := range []string{"smtp message", "processor headersparser", "processor header"} {
+		s := tracer.spans[i]
+		if s.name != name {
+			t.Error("expecting span", name, "got", s.name)
+		}
+		if i == 0 {
+			continue
+		}
+		if s.parent != message {
+			t.Error(name, "should be a child of the message span")
+		}
+		if s.ended != 1 {
+			t.Error(name, "should be ended once, ended", s.ended)
+		}
+		if s.attrs["task"] != TaskSaveMail.String() {
+			t.Error(name, "unexpected task attribute", s.attrs["task"])
+		}
+	}
+	if !strings.Contains(e.DeliveryHeader, "Traceparent: 00-trace-smtp message-01\n") {
+		t.Error("expecting a Traceparent header, got", e.DeliveryHeader)
+	}
+}
+
+func TestOTLPTracer(t *testing.T) {
+	var (
+		received []map[string]interface{}
+		mu       sync.Mutex
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var req map[string]interface{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Error("invalid json", err)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Error("unexpected content type", r.Header.Get("Content-Type"))
+		}
+		mu.Lock()
+		received = append(received, req)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	tracer := NewOTLPTracer(ts.URL+"/v1/traces", "")
+	session := tracer.Start("smtp session", nil)
+	message := tracer.Start("smtp message", session)
+	message.SetAttribute("queued_id", "abc123")
+	message.SetAttribute("size", int64(42))
+	parts := strings.Split(message.TraceParent(), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		t.Error("invalid traceparent", message.TraceParent())
+	}
+	if !strings.Contains(session.TraceParent(), parts[1]) {
+		t.Error("the message should have the trace id of the session")
+	}
+	message.End(nil)
+	session.End(nil)
+	tracer.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 {
+		t.Fatal("expecting 1 export request, got", len(received))
+	}
+	b, _ := json.Marshal(received[0])
+	for _, expect := range []string{`"go-guerrilla"`, `"smtp session"`, `"smtp message"`, `"abc123"`, `"intValue":"42"`, `"parentSpanId":"` + strings.Split(session.TraceParent(), "-")[2]} {
+		if !strings.Contains(string(b), expect) {
+			t.Error("export request missing", expect, string(b))
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package backends
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// BodyTransformer modifies the message of an envelope, eg. to add or rewrite headers, sign
+// the message or downgrade the body to 7-bit. Transformers are run by the transform processor,
+// which takes care of splitting the message into its header and body before each transform,
+// and writing the result back to e.Data
+type BodyTransformer interface {
+	// Transform is given the header block, including the line ending of the last header but
+	// not the blank line separating it from the body, and the body. It returns the new header
+	// and body, which may be the same slices when nothing changed
+	Transform(e *mail.Envelope, header, body []byte) (newHeader, newBody []byte, err error)
+}
+
+// TransformerFunc is an adapter to allow the use of a function as a BodyTransformer
+type TransformerFunc func(e *mail.Envelope, header, body []byte) ([]byte, []byte, error)
+
+// Transform implements BodyTransformer
+func (f TransformerFunc) Transform(e *mail.Envelope, header, body []byte) ([]byte, []byte, error) {
+	return f(e, header, body)
+}
+
+// TransformerConstructor makes a new BodyTransformer, it's called each time the
+// backend is initialized
+type TransformerConstructor func() BodyTransformer
+
+var transformers = make(map[string]TransformerConstructor)
+
+// AddTransformer adds a new transformer, which becomes available to the
+// backend_config.transform_process option of the transform processor
+func (s *service) AddTransformer(name string, t TransformerConstructor) {
+	transformers[strings.ToLower(name)] = t
+}
+
+// splitMessage returns the header and body of the message. The header is empty if
+// the message has no blank line after its header
+func splitMessage(data []byte) (header, body []byte) {
+	if i := bytes.Index(data, []byte{'\n', '\n'}); i > -1 {
+		return data[:i+1], data[i+2:]
+	}
+	return nil, data
+}
+
+// ApplyTransforms runs each of the transforms on the message in the given order, each transform
+// seeing the output of the previous one. e.Data is rewritten when done, so e.Len() reports the
+// new size, and e.Header is parsed again if it was parsed before.
+// Headers in e.DeliveryHeader are not part of the header given to the transforms.
+func ApplyTransforms(e *mail.Envelope, transforms ...BodyTransformer) error {
+	if len(transforms) == 0 {
+		return nil
+	}
+	header, body := splitMessage(e.Data.Bytes())
+	// copy, so that the transforms are free to modify the slices they are given
+	header = append([]byte(nil), header...)
+	body = append([]byte(nil), body...)
+	var err error
+	for _, t := range transforms {
+		if header, body, err = t.Transform(e, header, body); err != nil {
+			return err
+		}
+	}
+	e.Data.Reset()
+	if len(header) > 0 {
+		_, _ = e.Data.Write(header)
+		if header[len(header)-1] != '\n' {
+			_ = e.Data.WriteByte('\n')
+		}
+		_ = e.Data.WriteByte('\n')
+	}
+	_, _ = e.Data.Write(body)
+	if e.Header != nil {
+		e.Header = nil
+		if err = e.ParseHeaders(); err != nil {
+			Log().WithError(err).Debug("could not parse the transformed headers")
+		}
+	}
+	return nil
+}
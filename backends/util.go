@@ -3,9 +3,12 @@ package backends
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/textproto"
 	"regexp"
 	"strings"
@@ -59,3 +62,57 @@ func Compress(stringArguments ...string) string {
 	_ = w.Close()
 	return b.String()
 }
+
+// dnsResolver returns a resolver querying the DNS server at address, eg. "127.0.0.1:53",
+// or the system's resolver if address is empty
+func dnsResolver(address string) *net.Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// ParseNetworks parses a list of IP addresses and CIDR ranges, eg. "10.0.0.0/8", skipping
+// empty entries. Addresses are returned as single address networks
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, network := range list {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(network); err == nil {
+			networks = append(networks, ipNet)
+			continue
+		}
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, errors.New("not an IP address or CIDR range: " + network)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return networks, nil
+}
+
+// InNetworks returns true if ip is in any of the networks
+func InNetworks(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -14,4 +14,6 @@ var (
 	QuotaExceeded       = RcptError(errors.New("quota exceeded"))
 	UserSuspended       = RcptError(errors.New("user suspended"))
 	StorageError        = RcptError(errors.New("storage error"))
+	Greylisted          = RcptError(errors.New("greylisted"))
+	Blocklisted         = RcptError(errors.New("listed in a DNS blocklist"))
 )
@@ -8,13 +8,15 @@ import (
 	"fmt"
 	"net"
 	"net/textproto"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"go-guerrilla/mail/rfc5321"
-
+	"github.com/flashmob/go-guerrilla/backends"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/mail/rfc5321"
 	"github.com/flashmob/go-guerrilla/response"
 )
 
@@ -43,6 +45,34 @@ type client struct {
 	errors       int
 	state        ClientState
 	messagesSent int
+	// messages counts the transactions started with MAIL, for max_messages_per_connection
+	messages int
+	// rateLimited counts the MAIL commands refused by the message limits
+	rateLimited int
+	// greeted is true once the client sent HELO/EHLO, it's not cleared by RSET
+	greeted bool
+	// chunking is true once the message is being sent with BDAT
+	chunking bool
+	// xclient holds the NAME, PROTO and LOGIN attributes given with XCLIENT
+	xclient map[string]string
+	// binaryMIME is true when MAIL declared BODY=BINARYMIME, the message must be sent with BDAT
+	binaryMIME bool
+	// enhancedCodes is false when the x.y.z codes are left out of replies
+	enhancedCodes bool
+	// transactionStart is when MAIL was accepted
+	transactionStart time.Time
+	// transacting is 1 from MAIL until the end of the transaction, read by drain
+	transacting int32
+	// maxSize is the size limit of the message in the transaction: the server's max_size,
+	// or the SIZE declared with MAIL if smaller
+	maxSize int64
+	// authUser is the username the client authenticated as with AUTH, empty if not authenticated
+	authUser string
+	// span traces the session, nil when tracing is off
+	span backends.Span
+	// txSpan traces the transaction, from MAIL until the message is delivered or the
+	// transaction ends without it. A child of span, nil outside a traced transaction
+	txSpan backends.Span
 	// Response to be written to the client (for debugging)
 	response   bytes.Buffer
 	bufErr     error
@@ -54,7 +84,9 @@ type client struct {
 	// guards access to conn
 	connGuard sync.Mutex
 	log       log.Logger
-	parser    rfc5321.AddressParser
+	parser    rfc5321.Parser
+	// tlsState is the state of the TLS connection, after a successful handshake
+	tlsState tls.ConnectionState
 }
 
 // NewClient allocates a new client.
@@ -63,12 +95,13 @@ func NewClient(conn net.Conn, clientID uint64, logger log.Logger, envelope *mail
 		conn: conn,
 		// Envelope will be borrowed from the envelope pool
 		// the envelope could be 'detached' from the client later when processing
-		Envelope:    envelope.Borrow(getRemoteAddr(conn), clientID),
-		ConnectedAt: time.Now(),
-		bufin:       newSMTPBufferedReader(conn),
-		bufout:      bufio.NewWriter(conn),
-		ID:          clientID,
-		log:         logger,
+		Envelope:      envelope.Borrow(getRemoteAddr(conn), clientID),
+		ConnectedAt:   time.Now(),
+		bufin:         newSMTPBufferedReader(conn),
+		bufout:        bufio.NewWriter(conn),
+		ID:            clientID,
+		log:           logger,
+		enhancedCodes: true,
 	}
 
 	// used for reading the DATA state
@@ -77,18 +110,15 @@ func NewClient(conn net.Conn, clientID uint64, logger log.Logger, envelope *mail
 }
 
 // sendResponse adds a response to be written on the next turn
-// the response gets buffered
+// the response gets buffered, responses to pipelined commands may be buffered together
 func (c *client) sendResponse(r ...interface{}) {
-	c.bufout.Reset(c.conn)
-	if c.log.IsDebug() {
-		// an additional buffer so that we can log the response in debug mode only
-		c.response.Reset()
-	}
 	var out string
 	if c.bufErr != nil {
+		// the writer cannot be used after an error
+		c.bufout.Reset(c.conn)
 		c.bufErr = nil
 	}
-	for _, item := range r {
+	for i, item := range r {
 		switch v := item.(type) {
 		case error:
 			out = v.Error()
@@ -97,6 +127,9 @@ func (c *client) sendResponse(r ...interface{}) {
 		case string:
 			out = v
 		}
+		if i == 0 && !c.enhancedCodes {
+			out = response.WithoutEnhancedCode(out)
+		}
 		if _, c.bufErr = c.bufout.WriteString(out); c.bufErr != nil {
 			c.log.WithError(c.bufErr).Error("could not write to c.bufout")
 		}
@@ -113,15 +146,38 @@ func (c *client) sendResponse(r ...interface{}) {
 	}
 }
 
+// hasPipelinedCommand returns true if a complete command line has already been received
+// and is waiting to be read
+func (c *client) hasPipelinedCommand() bool {
+	n := c.bufin.Buffered()
+	if n == 0 {
+		return false
+	}
+	b, err := c.bufin.Peek(n)
+	return err == nil && bytes.IndexByte(b, '\n') > -1
+}
+
 // resetTransaction resets the SMTP transaction, ready for the next email (doesn't disconnect)
 // Transaction ends on:
 // -HELO/EHLO/REST command
 // -End of DATA command
 // TLS handshake
 func (c *client) resetTransaction() {
+	c.endTxSpan(errors.New("transaction ended before delivery"))
+	atomic.StoreInt32(&c.transacting, 0)
+	c.chunking = false
+	c.binaryMIME = false
 	c.Envelope.ResetTransaction()
 }
 
+// endTxSpan ends the span of the transaction, if any, marking it as failed if err is not nil
+func (c *client) endTxSpan(err error) {
+	if c.txSpan != nil {
+		c.txSpan.End(err)
+		c.txSpan = nil
+	}
+}
+
 // isInTransaction returns true if the connection is inside a transaction.
 // A transaction starts after a MAIL command gets issued by the client.
 // Call resetTransaction to end the transaction
@@ -142,6 +198,11 @@ func (c *client) isAlive() bool {
 	return c.KilledAt.IsZero()
 }
 
+// drain returns true if the client is in a transaction, goroutine safe
+func (c *client) drain() bool {
+	return atomic.LoadInt32(&c.transacting) == 1
+}
+
 // setTimeout adjust the timeout on the connection, goroutine safe
 func (c *client) setTimeout(t time.Duration) (err error) {
 	defer c.connGuard.Unlock()
@@ -152,6 +213,16 @@ func (c *client) setTimeout(t time.Duration) (err error) {
 	return
 }
 
+// setReadDeadline sets the deadline for reading from the connection, goroutine safe
+func (c *client) setReadDeadline(t time.Time) (err error) {
+	defer c.connGuard.Unlock()
+	c.connGuard.Lock()
+	if c.conn != nil {
+		err = c.conn.SetReadDeadline(t)
+	}
+	return
+}
+
 // closeConn closes a client connection, , goroutine safe
 func (c *client) closeConn() {
 	defer c.connGuard.Unlock()
@@ -172,6 +243,17 @@ func (c *client) init(conn net.Conn, clientID uint64, ep *mail.Pool) {
 	c.ConnectedAt = time.Now()
 	c.ID = clientID
 	c.errors = 0
+	c.messages = 0
+	c.rateLimited = 0
+	c.greeted = false
+	c.xclient = nil
+	c.enhancedCodes = true
+	atomic.StoreInt32(&c.transacting, 0)
+	c.authUser = ""
+	c.span = nil
+	c.txSpan = nil
+	c.response.Reset()
+	c.tlsState = tls.ConnectionState{}
 	// borrow an envelope from the envelope pool
 	c.Envelope = ep.Borrow(getRemoteAddr(conn), clientID)
 }
@@ -195,9 +277,54 @@ func (c *client) upgradeToTLS(tlsConfig *tls.Config) error {
 	c.bufout.Reset(c.conn)
 	c.bufin.Reset(c.conn)
 	c.TLS = true
+	c.tlsState = tlsConn.ConnectionState()
+	c.TLSInfo = tlsInfo(c.tlsState)
 	return err
 }
 
+// tlsInfo describes the negotiated version and cipher of a TLS connection
+func tlsInfo(state tls.ConnectionState) mail.TLSInfo {
+	info := mail.TLSInfo{Cipher: fmt.Sprintf("0x%04X", state.CipherSuite)}
+	switch state.Version {
+	case tls.VersionSSL30:
+		info.Version = "SSLv3"
+	case tls.VersionTLS10:
+		info.Version = "TLSv1"
+	case tls.VersionTLS11:
+		info.Version = "TLSv1.1"
+	case tls.VersionTLS12:
+		info.Version = "TLSv1.2"
+	case 0x0304:
+		info.Version = "TLSv1.3"
+	default:
+		info.Version = fmt.Sprintf("0x%04X", state.Version)
+	}
+	for name, id := range TLSCiphers {
+		if id == state.CipherSuite {
+			info.Cipher = name
+			break
+		}
+	}
+	// TLS 1.3 suites are not configurable, so they are not in TLSCiphers
+	switch state.CipherSuite {
+	case 0x1301:
+		info.Cipher = "TLS_AES_128_GCM_SHA256"
+	case 0x1302:
+		info.Cipher = "TLS_AES_256_GCM_SHA384"
+	case 0x1303:
+		info.Cipher = "TLS_CHACHA20_POLY1305_SHA256"
+	}
+	switch {
+	case strings.Contains(info.Cipher, "AES_128"), strings.Contains(info.Cipher, "RC4_128"):
+		info.Bits = 128
+	case strings.Contains(info.Cipher, "AES_256"), strings.Contains(info.Cipher, "CHACHA20"):
+		info.Bits = 256
+	case strings.Contains(info.Cipher, "3DES"):
+		info.Bits = 168
+	}
+	return info
+}
+
 func getRemoteAddr(conn net.Conn) string {
 	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
 		// we just want the IP (not the port)
@@ -217,20 +344,23 @@ func (c *client) parsePath(in []byte, p pathParser) (mail.Address, error) {
 	}
 	if err = p(in); err != nil {
 		return address, errors.New(response.Canned.FailInvalidAddress.String())
-	} else if c.parser.(*rfc5321.Parser).NullPath {
+	} else if c.parser.NullPath {
 		// bounce has empty from address
-		address = mail.Address{}
-	} else if len(c.parser.(*rfc5321.Parser).LocalPart) > rfc5321.LimitLocalPart {
+		address = mail.Address{
+			PathParams: c.parser.PathParams,
+			NullPath:   true,
+		}
+	} else if len(c.parser.LocalPart) > rfc5321.LimitLocalPart {
 		err = errors.New(response.Canned.FailLocalPartTooLong.String())
-	} else if len(c.parser.(*rfc5321.Parser).Domain) > rfc5321.LimitDomain {
+	} else if len(c.parser.Domain) > rfc5321.LimitDomain {
 		err = errors.New(response.Canned.FailDomainTooLong.String())
 	} else {
 		address = mail.Address{
-			User:       c.parser.(*rfc5321.Parser).LocalPart,
-			Host:       c.parser.(*rfc5321.Parser).Domain,
-			ADL:        c.parser.(*rfc5321.Parser).ADL,
-			PathParams: c.parser.(*rfc5321.Parser).PathParams,
-			NullPath:   c.parser.(*rfc5321.Parser).NullPath,
+			User:       c.parser.LocalPart,
+			Host:       c.parser.Domain,
+			ADL:        c.parser.ADL,
+			PathParams: c.parser.PathParams,
+			NullPath:   c.parser.NullPath,
 		}
 	}
 	return address, err
@@ -901,6 +901,9 @@ func TestDebug(t *testing.T) {
 			if strings.Index(result, expect) != 0 {
 				t.Error("Expected", expect, "but got", result)
 			} else {
+				if _, err = test.Command(conn, buffin, "MAIL FROM:<test@example.com>"); err != nil {
+					t.Error("MAIL failed", err)
+				}
 				if result, err = test.Command(conn, buffin, "RCPT TO:<test@grr.la>"); err == nil {
 					expect := "250 2.1.5 OK"
 					if strings.Index(result, expect) != 0 {
@@ -963,6 +966,9 @@ func TestAllowedHostsEvent(t *testing.T) {
 			if strings.Index(result, expect) != 0 {
 				t.Error("Expected", expect, "but got", result)
 			} else {
+				if _, err = test.Command(conn, buffin, "MAIL FROM:<test@example.com>"); err != nil {
+					t.Error("MAIL failed", err)
+				}
 				if result, err = test.Command(conn, buffin, "RCPT TO:<test@grr.la>"); err == nil {
 					expect := "454 4.1.1 Error: Relay access denied: grr.la"
 					if strings.Index(result, expect) != 0 {
@@ -1002,6 +1008,9 @@ func TestAllowedHostsEvent(t *testing.T) {
 			if strings.Index(result, expect) != 0 {
 				t.Error("Expected", expect, "but got", result)
 			} else {
+				if _, err = test.Command(conn, buffin, "MAIL FROM:<test@example.com>"); err != nil {
+					t.Error("MAIL failed", err)
+				}
 				if result, err = test.Command(conn, buffin, "RCPT TO:<test@grr.la>"); err == nil {
 					expect := "250 2.1.5 OK"
 					if strings.Index(result, expect) != 0 {
@@ -29,8 +29,23 @@ type AppConfig struct {
 	// LogLevel controls the lowest level we log.
 	// "info", "debug", "error", "panic". Default "info"
 	LogLevel string `json:"log_level,omitempty"`
+	// LogFormat is the format of the log lines, "text" or "json" for one JSON object per line.
+	// Default "text"
+	LogFormat string `json:"log_format,omitempty"`
 	// BackendConfig configures the email envelope processing backend
 	BackendConfig backends.BackendConfig `json:"backend_config"`
+	// TracingEndpoint turns on tracing, exporting spans to this OpenTelemetry collector URL using
+	// OTLP/HTTP, eg. "http://localhost:4318/v1/traces". Off if empty (default)
+	TracingEndpoint string `json:"tracing_endpoint,omitempty"`
+	// TracingServiceName is the service.name of the exported spans. Default "go-guerrilla"
+	TracingServiceName string `json:"tracing_service_name,omitempty"`
+	// MetricsListenInterface turns on metrics, serving them for Prometheus at /metrics on this
+	// <ip>:<port>, eg. "127.0.0.1:9090". Off if empty (default)
+	MetricsListenInterface string `json:"metrics_listen_interface,omitempty"`
+	// ShutdownGracePeriod is the number of seconds that clients in the middle of a transaction
+	// get to finish it when shutting down. Idle clients get a 421 right away. When 0 (default),
+	// all clients get a 1 second timeout
+	ShutdownGracePeriod int `json:"shutdown_grace_period,omitempty"`
 }
 
 // ServerConfig specifies config options for a single server
@@ -50,21 +65,79 @@ type ServerConfig struct {
 	MaxSize int64 `json:"max_size"`
 	// Timeout specifies the connection timeout in seconds. Defaults to 30
 	Timeout int `json:"timeout"`
+	// DataReadTimeout is the number of seconds a client may stay silent while sending DATA.
+	// When 0 (default), the whole message must arrive within Timeout
+	DataReadTimeout int `json:"data_read_timeout,omitempty"`
+	// TransactionTimeout is the number of seconds from MAIL to the end of DATA, so that a client
+	// sending a few bytes at a time cannot hold the connection. No limit when 0 (default)
+	TransactionTimeout int `json:"transaction_timeout,omitempty"`
 	// MaxClients controls how many maximum clients we can handle at once.
 	// Defaults to defaultMaxClients
 	MaxClients int `json:"max_clients"`
+	// MaxRecipients is the number of recipients accepted in a transaction, any further RCPT
+	// gets "452 Too many recipients". Defaults to defaultMaxRecipients
+	MaxRecipients int `json:"max_recipients,omitempty"`
+	// MaxConnectionsPerIP limits the connections open at the same time from a single IP address.
+	// Further connections get "421 Too many connections" and are closed. No limit when 0 (default)
+	MaxConnectionsPerIP int `json:"max_connections_per_ip,omitempty"`
+	// ConnectionLimitExempt lists the IP addresses or CIDR ranges, eg. "10.0.0.0/8", of the
+	// clients that MaxConnectionsPerIP does not apply to
+	ConnectionLimitExempt []string `json:"max_connections_exempt_networks,omitempty"`
+	// MaxMessagesPerConnection limits the messages sent over a connection, further MAIL
+	// commands get "451 rate limit exceeded". No limit when 0 (default)
+	MaxMessagesPerConnection int `json:"max_messages_per_connection,omitempty"`
+	// MessagesPerMinutePerIP limits the messages sent from a single IP address, with a token
+	// bucket allowing bursts of up to this many messages. The buckets are kept by the
+	// Daemon's RateLimitStore. No limit when 0 (default)
+	MessagesPerMinutePerIP int `json:"messages_per_minute_per_ip,omitempty"`
+	// RateLimitDisconnectAfter closes the connection after this many MAIL commands were
+	// refused by the limits above. The connection is kept open when 0 (default)
+	RateLimitDisconnectAfter int `json:"rate_limit_disconnect_after,omitempty"`
 	// IsEnabled set to true to start the server, false will ignore it
 	IsEnabled bool `json:"is_enabled"`
 	// XClientOn when using a proxy such as Nginx, XCLIENT command is used to pass the
 	// original client's IP address & client's HELO
 	XClientOn bool `json:"xclient_on,omitempty"`
+	// XClientTrusted lists the IP addresses or CIDR ranges, eg. "10.0.0.0/8", of the proxies
+	// allowed to use XCLIENT. XCLIENT is only advertised to them, and rejected from others.
+	// It must be set when XClientOn is, since XCLIENT lets a client change its address.
+	// The NAME, PROTO and LOGIN attributes are passed to the backend in e.Values, as
+	// "xclient_name", "xclient_proto" and "xclient_login"
+	XClientTrusted []string `json:"xclient_trusted_networks,omitempty"`
+	// HeloRequired when true rejects MAIL commands from clients that have not sent HELO/EHLO.
+	// Otherwise, the HELO defaults to the client's address literal
+	HeloRequired bool `json:"helo_required,omitempty"`
+	// EnhancedStatusCodes when false stops advertising ENHANCEDSTATUSCODES (RFC 2034), and the
+	// x.y.z codes of RFC 3463 are left out of the replies. Defaults to true
+	EnhancedStatusCodes *bool `json:"enhanced_status_codes,omitempty"`
+	// MTPriority enables the MT-PRIORITY extension (RFC 6710) when set to the name of the
+	// priority assignment policy to advertise, one of "MIXER", "STANAG4406" or "NSEP"
+	MTPriority string `json:"mt_priority,omitempty"`
+	// DedupRcpts when true accepts a repeated RCPT TO for the same mailbox (compared
+	// case-insensitively) without adding it again, so that the mailbox gets a single copy.
+	// By default, recipients given more than once in a transaction are kept
+	DedupRcpts bool `json:"dedup_recipients,omitempty"`
+	// ProxyProtocol when true expects a PROXY protocol header (v1 or v2) at the start of each
+	// connection, such as sent by HAProxy or an AWS NLB, and takes the client's address from it.
+	// Connections without a valid header are closed. Changes need a restart of the server
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
+	// AuthAllowInsecure when true advertises and accepts AUTH on connections that are not
+	// encrypted. By default AUTH is only available after STARTTLS, or with TLS always on.
+	// AUTH is turned on by setting an Authenticator on the Daemon
+	AuthAllowInsecure bool `json:"auth_allow_insecure,omitempty"`
 }
 
 type ServerTLSConfig struct {
 	// TLS Protocols to use. [0] = min, [1]max
 	// Use Go's default if empty
 	Protocols []string `json:"protocols,omitempty"`
-	// TLS Ciphers to use.
+	// MinVersion is the minimum TLS version accepted, eg. "1.2" or "1.3". Takes precedence over
+	// Protocols. Use Go's default if empty
+	MinVersion string `json:"tls_min_version,omitempty"`
+	// MaxVersion is the maximum TLS version accepted. Takes precedence over Protocols.
+	// Use Go's default if empty
+	MaxVersion string `json:"tls_max_version,omitempty"`
+	// TLS Ciphers to use, named as in TLSCiphers. Unknown names fail validation.
 	// Use Go's default if empty
 	Ciphers []string `json:"ciphers,omitempty"`
 	// TLS Curves to use.
@@ -74,12 +147,24 @@ type ServerTLSConfig struct {
 	PrivateKeyFile string `json:"private_key_file"`
 	// PublicKeyFile path to cert (public key) chain in PEM format.
 	PublicKeyFile string `json:"public_key_file"`
+	// Certificates are served instead of the default cert (above) to clients that ask for
+	// their host with SNI, so that one listener can serve several domains
+	Certificates []TLSCertificate `json:"certificates,omitempty"`
+	// ReloadInterval when set, eg. "1m", checks the certificate files this often and reloads
+	// them when they change on disk, such as after a renewal by certbot. Changes need a restart
+	// of the server. The files are otherwise only reloaded with the config, on SIGHUP
+	ReloadInterval string `json:"reload_interval,omitempty"`
 	// TLS Root cert authorities to use. "A PEM encoded CA's certificate file.
 	// Defaults to system's root CA file if empty
 	RootCAs string `json:"root_cas_file,omitempty"`
 	// declares the policy the server will follow for TLS Client Authentication.
 	// Use Go's default if empty
 	ClientAuthType string `json:"client_auth_type,omitempty"`
+	// ClientCAFile is a PEM encoded file of the CA certificates used to verify client certificates,
+	// eg. for mutual TLS between relays with "RequireAndVerifyClientCert". The common name of a
+	// verified certificate is available as e.Values["client_cert_cn"].
+	// Defaults to system's root CA file if empty
+	ClientCAFile string `json:"client_ca_file,omitempty"`
 	// The following used to watch certificate changes so that the TLS can be reloaded
 	_privateKeyFileMtime int64
 	_publicKeyFileMtime  int64
@@ -91,6 +176,30 @@ type ServerTLSConfig struct {
 	StartTLSOn bool `json:"start_tls_on,omitempty"`
 	// AlwaysOn run this server as a pure TLS server, i.e. SMTPS
 	AlwaysOn bool `json:"tls_always_on,omitempty"`
+	// DANE checks the certificate presented by a client after STARTTLS against the TLSA
+	// records published at _25._tcp.<helo domain>. Off if empty. Set to "advisory" to only
+	// record the result, available as TLSInfo.DANE on the envelope, or "enforce" to also
+	// disconnect clients whose certificate does not match. A client presenting no certificate
+	// while its domain publishes TLSA records fails the check.
+	// ClientAuthType must be "RequestClientCert" or "RequireAnyClientCert", so that clients are
+	// asked for their certificate and DANE-EE certificates are not rejected by PKIX validation
+	DANE string `json:"dane,omitempty"`
+	// DANEResolver is the address of the resolver used for TLSA lookups, eg. "127.0.0.1:53"
+	// It must be a DNSSEC validating resolver that can be trusted, such as unbound running on
+	// localhost, since only answers with the AD (authenticated data) flag are used.
+	// Defaults to 127.0.0.1:53
+	DANEResolver string `json:"dane_resolver,omitempty"`
+}
+
+// TLSCertificate is a certificate selected by the server name a client sends with SNI
+type TLSCertificate struct {
+	// Host is the server name the certificate is for, eg. mail.example.org
+	// A wildcard such as *.example.org matches any one label in place of the *
+	Host string `json:"host"`
+	// PrivateKeyFile path to cert private key in PEM format.
+	PrivateKeyFile string `json:"private_key_file"`
+	// PublicKeyFile path to cert (public key) chain in PEM format.
+	PublicKeyFile string `json:"public_key_file"`
 }
 
 // https://golang.org/pkg/crypto/tls/#pkg-constants
@@ -130,6 +239,16 @@ var TLSProtocols = map[string]uint16{
 	"tls1.2": tls.VersionTLS12,
 }
 
+// tlsVersion returns the protocol version for name, which is a key of TLSProtocols
+// or just the version number, eg. "1.2"
+func tlsVersion(name string) (uint16, bool) {
+	if v, ok := TLSProtocols[name]; ok {
+		return v, true
+	}
+	v, ok := TLSProtocols["tls"+name]
+	return v, ok
+}
+
 // https://golang.org/pkg/crypto/tls/#CurveID
 var TLSCurves = map[string]tls.CurveID{
 	"P256": tls.CurveP256,
@@ -147,6 +266,9 @@ var TLSClientAuthTypes = map[string]tls.ClientAuthType{
 }
 
 const defaultMaxClients = 100
+
+// defaultMaxRecipients is the minimum that RFC 5321 requires servers to accept
+const defaultMaxRecipients = 100
 const defaultTimeout = 30
 const defaultInterface = "127.0.0.1:2525"
 const defaultMaxSize = int64(10 << 20) // 10 Mebibytes
@@ -207,6 +329,10 @@ func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 	if strings.Compare(oldConfig.LogLevel, c.LogLevel) != 0 {
 		app.Publish(EventConfigLogLevel, c)
 	}
+	// has log format changed?
+	if strings.Compare(oldConfig.LogFormat, c.LogFormat) != 0 {
+		app.Publish(EventConfigLogFormat, c)
+	}
 	// server config changes
 	oldServers := oldConfig.getServers()
 	for iface, newServer := range c.getServers() {
@@ -263,6 +389,11 @@ func (c *AppConfig) setDefaults() error {
 	if c.LogLevel == "" {
 		c.LogLevel = "debug"
 	}
+	if c.LogFormat == "" {
+		c.LogFormat = log.FormatText
+	} else if c.LogFormat != log.FormatText && c.LogFormat != log.FormatJSON {
+		return fmt.Errorf("invalid log_format [%s], use %s or %s", c.LogFormat, log.FormatText, log.FormatJSON)
+	}
 	if len(c.AllowedHosts) == 0 {
 		if h, err := os.Hostname(); err != nil {
 			return err
@@ -281,6 +412,7 @@ func (c *AppConfig) setDefaults() error {
 		sc.IsEnabled = true
 		sc.Hostname = h
 		sc.MaxClients = defaultMaxClients
+		sc.MaxRecipients = defaultMaxRecipients
 		sc.Timeout = defaultTimeout
 		sc.MaxSize = defaultMaxSize
 		c.Servers = append(c.Servers, sc)
@@ -293,6 +425,9 @@ func (c *AppConfig) setDefaults() error {
 			if c.Servers[i].MaxClients == 0 {
 				c.Servers[i].MaxClients = defaultMaxClients
 			}
+			if c.Servers[i].MaxRecipients == 0 {
+				c.Servers[i].MaxRecipients = defaultMaxRecipients
+			}
 			if c.Servers[i].Timeout == 0 {
 				c.Servers[i].Timeout = defaultTimeout
 			}
@@ -446,6 +581,83 @@ func (sc *ServerConfig) Validate() error {
 			errs = append(errs, fmt.Errorf("cannot use TLS config for [%s], %v", sc.ListenInterface, err))
 		}
 	}
+	for _, c := range sc.TLS.Certificates {
+		if c.Host == "" {
+			errs = append(errs, fmt.Errorf("certificate without a host for [%s]", sc.ListenInterface))
+		}
+		if _, err := tls.LoadX509KeyPair(c.PublicKeyFile, c.PrivateKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("cannot use certificate for [%s] on [%s], %v", c.Host, sc.ListenInterface, err))
+		}
+	}
+	for _, name := range sc.TLS.Protocols {
+		if _, ok := TLSProtocols[name]; !ok {
+			errs = append(errs, fmt.Errorf("unknown TLS protocol [%s] for [%s]", name, sc.ListenInterface))
+		}
+	}
+	for _, name := range sc.TLS.Ciphers {
+		if _, ok := TLSCiphers[name]; !ok {
+			errs = append(errs, fmt.Errorf("unknown TLS cipher [%s] for [%s]", name, sc.ListenInterface))
+		}
+	}
+	for _, name := range sc.TLS.Curves {
+		if _, ok := TLSCurves[name]; !ok {
+			errs = append(errs, fmt.Errorf("unknown TLS curve [%s] for [%s]", name, sc.ListenInterface))
+		}
+	}
+	var min, max uint16
+	if sc.TLS.MinVersion != "" {
+		var ok bool
+		if min, ok = tlsVersion(sc.TLS.MinVersion); !ok {
+			errs = append(errs, fmt.Errorf("invalid tls_min_version [%s] for [%s], eg. use 1.2", sc.TLS.MinVersion, sc.ListenInterface))
+		}
+	}
+	if sc.TLS.MaxVersion != "" {
+		var ok bool
+		if max, ok = tlsVersion(sc.TLS.MaxVersion); !ok {
+			errs = append(errs, fmt.Errorf("invalid tls_max_version [%s] for [%s], eg. use 1.3", sc.TLS.MaxVersion, sc.ListenInterface))
+		}
+	}
+	if min > 0 && max > 0 && min > max {
+		errs = append(errs, fmt.Errorf("tls_min_version is greater than tls_max_version for [%s]", sc.ListenInterface))
+	}
+	if sc.TLS.ReloadInterval != "" {
+		if interval, err := time.ParseDuration(sc.TLS.ReloadInterval); err != nil || interval <= 0 {
+			errs = append(errs, fmt.Errorf("invalid reload_interval [%s] for [%s]", sc.TLS.ReloadInterval, sc.ListenInterface))
+		}
+	}
+	if sc.TLS.ClientAuthType != "" {
+		if _, ok := TLSClientAuthTypes[sc.TLS.ClientAuthType]; !ok {
+			errs = append(errs, fmt.Errorf("invalid client_auth_type [%s]", sc.TLS.ClientAuthType))
+		}
+	}
+	if sc.TLS.ClientCAFile != "" {
+		if _, err := loadCertPool(sc.TLS.ClientCAFile); err != nil {
+			errs = append(errs, fmt.Errorf("cannot use client_ca_file for [%s], %v", sc.ListenInterface, err))
+		}
+	}
+	switch sc.TLS.DANE {
+	case daneOff:
+	case daneAdvisory, daneEnforce:
+		if sc.TLS.ClientAuthType != "RequestClientCert" && sc.TLS.ClientAuthType != "RequireAnyClientCert" {
+			errs = append(errs, fmt.Errorf("dane needs client_auth_type RequestClientCert or RequireAnyClientCert for [%s]", sc.ListenInterface))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid dane option [%s], use advisory or enforce", sc.TLS.DANE))
+	}
+	if sc.XClientOn && len(sc.XClientTrusted) == 0 {
+		errs = append(errs, fmt.Errorf("xclient_on needs xclient_trusted_networks for [%s]", sc.ListenInterface))
+	}
+	if _, err := backends.ParseNetworks(sc.XClientTrusted); err != nil {
+		errs = append(errs, fmt.Errorf("invalid xclient_trusted_networks for [%s], %s", sc.ListenInterface, err))
+	}
+	if _, err := backends.ParseNetworks(sc.ConnectionLimitExempt); err != nil {
+		errs = append(errs, fmt.Errorf("invalid max_connections_exempt_networks for [%s], %s", sc.ListenInterface, err))
+	}
+	switch sc.MTPriority {
+	case "", "MIXER", "STANAG4406", "NSEP":
+	default:
+		errs = append(errs, fmt.Errorf("invalid mt_priority policy [%s], use MIXER, STANAG4406 or NSEP", sc.MTPriority))
+	}
 	if len(errs) > 0 {
 		return errs
 	}
@@ -496,7 +708,7 @@ func getChanges(a interface{}, b interface{}) map[string]interface{} {
 }
 
 // Convert fields of a struct to a map
-// only able to convert int, bool, slice-of-strings and string; not recursive
+// only able to convert int, bool, slices and string; not recursive
 // slices are marshal'd to json for convenient comparison later
 func structtomap(obj interface{}) map[string]interface{} {
 	ret := make(map[string]interface{})
@@ -519,7 +731,22 @@ func structtomap(obj interface{}) map[string]interface{} {
 			value := vField.Bool()
 			ret[fName] = value
 		case reflect.Slice:
-			ret[fName] = vField.Interface().([]string)
+			if sliceOfStr, ok := vField.Interface().([]string); ok {
+				ret[fName] = sliceOfStr
+			} else {
+				// other slices, such as of structs, compared as json
+				value, _ := json.Marshal(vField.Interface())
+				ret[fName] = string(value)
+			}
+		case reflect.Ptr:
+			// optional bools, compared by value
+			if b, ok := vField.Interface().(*bool); ok {
+				if b == nil {
+					ret[fName] = "unset"
+				} else {
+					ret[fName] = *b
+				}
+			}
 		}
 	}
 	return ret
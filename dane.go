@@ -0,0 +1,268 @@
+package guerrilla
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// DANE results recorded in mail.TLSInfo.DANE
+const (
+	// the client's domain publishes no TLSA records, or they are not DNSSEC signed
+	DANENone = "none"
+	// the client presented a certificate matching one of the TLSA records
+	DANEPass = "pass"
+	// TLSA records exist but the client's certificate does not match any of them
+	DANEFail = "fail"
+	// the TLSA lookup failed
+	DANETempError = "temperror"
+)
+
+const (
+	// DANE checks are off
+	daneOff = ""
+	// DANE result is only recorded
+	daneAdvisory = "advisory"
+	// clients failing the DANE check are rejected
+	daneEnforce = "enforce"
+
+	defaultDANEResolver = "127.0.0.1:53"
+	daneLookupTimeout   = time.Second * 5
+
+	dnsTypeTLSA = 52
+	dnsTypeOPT  = 41
+)
+
+// tlsaRecord is the RDATA of a TLSA resource record, RFC 6698
+type tlsaRecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// tlsaLookup is used to look up TLSA records, can be replaced in tests
+var tlsaLookup = lookupTLSA
+
+// checkDANE matches the certificate presented by the client against the TLSA records
+// published at _25._tcp.<helo>
+func checkDANE(resolver string, helo string, chain []*x509.Certificate) string {
+	helo = strings.TrimSuffix(strings.TrimSpace(helo), ".")
+	if helo == "" || strings.HasPrefix(helo, "[") || net.ParseIP(helo) != nil {
+		// address literals have no TLSA records
+		return DANENone
+	}
+	if resolver == "" {
+		resolver = defaultDANEResolver
+	}
+	records, secure, err := tlsaLookup(resolver, "_25._tcp."+helo, daneLookupTimeout)
+	if err != nil {
+		return DANETempError
+	}
+	if !secure || len(records) == 0 {
+		// records that were not validated by DNSSEC must be ignored, RFC 7672 2.2
+		return DANENone
+	}
+	if daneVerify(records, chain) {
+		return DANEPass
+	}
+	return DANEFail
+}
+
+// daneVerify returns true if any of the records match the certificate chain.
+// Only the certificate association is checked, the PKIX-TA and PKIX-EE usages do
+// not get the additional PKIX validation.
+func daneVerify(records []tlsaRecord, chain []*x509.Certificate) bool {
+	for _, r := range records {
+		for i, cert := range chain {
+			if (r.Usage == 1 || r.Usage == 3) && i > 0 {
+				// end entity usages only match the client's own certificate
+				break
+			}
+			var data []byte
+			switch r.Selector {
+			case 0:
+				data = cert.Raw
+			case 1:
+				data = cert.RawSubjectPublicKeyInfo
+			default:
+				continue
+			}
+			switch r.MatchingType {
+			case 0:
+			case 1:
+				sum := sha256.Sum256(data)
+				data = sum[:]
+			case 2:
+				sum := sha512.Sum512(data)
+				data = sum[:]
+			default:
+				continue
+			}
+			if bytes.Equal(data, r.Data) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookupTLSA queries the resolver for the TLSA records of name.
+// secure is true when the resolver set the AD (authenticated data) flag, which means that
+// the resolver validated the answer with DNSSEC. The resolver must be trusted, eg. running on localhost
+func lookupTLSA(resolver, name string, timeout time.Duration) (records []tlsaRecord, secure bool, err error) {
+	query, id, err := newDNSQuery(name, dnsTypeTLSA)
+	if err != nil {
+		return nil, false, err
+	}
+	msg, err := dnsExchange("udp", resolver, query, timeout)
+	if err == nil && len(msg) > 3 && msg[2]&0x02 != 0 {
+		// truncated, try again using tcp
+		msg, err = dnsExchange("tcp", resolver, query, timeout)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return parseTLSAResponse(msg, id)
+}
+
+// newDNSQuery builds a recursive query with the AD bit set and an EDNS0 OPT record with DO set,
+// asking a validating resolver to return the DNSSEC status of the answer
+func newDNSQuery(name string, qtype uint16) ([]byte, uint16, error) {
+	var idb [2]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idb[:])
+	var b bytes.Buffer
+	header := []uint16{id, 0x0120, 1, 0, 0, 1} // id, RD|AD, qdcount, ancount, nscount, arcount
+	for _, v := range header {
+		_ = binary.Write(&b, binary.BigEndian, v)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, errors.New("invalid domain name: " + name)
+		}
+		b.WriteByte(byte(len(label)))
+		b.WriteString(label)
+	}
+	b.WriteByte(0)
+	_ = binary.Write(&b, binary.BigEndian, []uint16{qtype, 1})
+	// OPT: root name, type, udp payload size, extended rcode & version, DO flag, rdlen
+	b.WriteByte(0)
+	_ = binary.Write(&b, binary.BigEndian, []uint16{dnsTypeOPT, 4096, 0, 0x8000, 0})
+	return b.Bytes(), id, nil
+}
+
+func dnsExchange(network, resolver string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(network, resolver, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if network == "tcp" {
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(query)))
+		if _, err = conn.Write(append(l[:], query...)); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+		_, err = io.ReadFull(conn, msg)
+		return msg, err
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 4096)
+	n, err := conn.Read(msg)
+	return msg[:n], err
+}
+
+var errDNSMalformed = errors.New("malformed dns response")
+
+// parseTLSAResponse extracts the TLSA records from the answer section of a dns response
+func parseTLSAResponse(msg []byte, id uint16) (records []tlsaRecord, secure bool, err error) {
+	if len(msg) < 12 {
+		return nil, false, errDNSMalformed
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != id || msg[2]&0x80 == 0 {
+		return nil, false, errors.New("unexpected dns response")
+	}
+	secure = msg[3]&0x20 != 0
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		// NXDOMAIN
+		return nil, secure, nil
+	default:
+		return nil, false, errors.New("dns lookup failed")
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:8]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, false, err
+		}
+		off += 4
+	}
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, false, err
+		}
+		if off+10 > len(msg) {
+			return nil, false, errDNSMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[off : off+2])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, false, errDNSMalformed
+		}
+		if rtype == dnsTypeTLSA && rdlen > 3 {
+			rdata := msg[off : off+rdlen]
+			records = append(records, tlsaRecord{
+				Usage:        rdata[0],
+				Selector:     rdata[1],
+				MatchingType: rdata[2],
+				Data:         append([]byte(nil), rdata[3:]...),
+			})
+		}
+		off += rdlen
+	}
+	return records, secure, nil
+}
+
+// skipDNSName returns the offset after the (possibly compressed) name starting at off
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return off, errDNSMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += 1 + l
+		}
+	}
+}
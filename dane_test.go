@@ -0,0 +1,245 @@
+package guerrilla
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func getClientCert(t *testing.T) *x509.Certificate {
+	block, _ := pem.Decode([]byte(clientPubKey))
+	if block == nil {
+		t.Fatal("could not decode client cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// fakeResolver answers every query with a single TLSA record, setting the AD flag if secure
+func fakeResolver(t *testing.T, record tlsaRecord, secure bool) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			end, _ := skipDNSName(query, 12)
+			end += 4
+			resp := make([]byte, 12)
+			copy(resp, query[:2])
+			resp[2] = 0x81 // QR, RD
+			resp[3] = 0x80 // RA
+			if secure {
+				resp[3] |= 0x20
+			}
+			binary.BigEndian.PutUint16(resp[4:], 1)
+			binary.BigEndian.PutUint16(resp[6:], 1)
+			resp = append(resp, query[12:end]...)
+			rdata := append([]byte{record.Usage, record.Selector, record.MatchingType}, record.Data...)
+			rr := []byte{0xc0, 0x0c, 0, dnsTypeTLSA, 0, 1, 0, 0, 0x0e, 0x10, 0, 0}
+			binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+			resp = append(resp, rr...)
+			resp = append(resp, rdata...)
+			_, _ = pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String(), func() { _ = pc.Close() }
+}
+
+func TestLookupTLSA(t *testing.T) {
+	cert := getClientCert(t)
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	record := tlsaRecord{Usage: 3, Selector: 1, MatchingType: 1, Data: sum[:]}
+	addr, stop := fakeResolver(t, record, true)
+	defer stop()
+
+	records, secure, err := lookupTLSA(addr, "_25._tcp.mx.example.com", time.Second)
+	if err != nil {
+		t.Error("lookup failed", err)
+		return
+	}
+	if !secure {
+		t.Error("expecting the answer to be secure")
+	}
+	if len(records) != 1 || records[0].Usage != 3 || string(records[0].Data) != string(sum[:]) {
+		t.Error("unexpected records", records)
+	}
+
+	if result := checkDANE(addr, "mx.example.com", []*x509.Certificate{cert}); result != DANEPass {
+		t.Error("expecting", DANEPass, "got", result)
+	}
+	if result := checkDANE(addr, "mx.example.com", nil); result != DANEFail {
+		t.Error("no certificate presented, expecting", DANEFail, "got", result)
+	}
+	if result := checkDANE(addr, "[127.0.0.1]", nil); result != DANENone {
+		t.Error("address literal, expecting", DANENone, "got", result)
+	}
+}
+
+func TestLookupTLSAInsecure(t *testing.T) {
+	record := tlsaRecord{Usage: 3, Selector: 1, MatchingType: 1, Data: make([]byte, 32)}
+	addr, stop := fakeResolver(t, record, false)
+	defer stop()
+	if result := checkDANE(addr, "mx.example.com", nil); result != DANENone {
+		t.Error("records without the AD flag must be ignored, got", result)
+	}
+}
+
+func TestDANEVerify(t *testing.T) {
+	cert := getClientCert(t)
+	full := tlsaRecord{Usage: 3, Selector: 0, MatchingType: 0, Data: cert.Raw}
+	if !daneVerify([]tlsaRecord{full}, []*x509.Certificate{cert}) {
+		t.Error("full certificate should match")
+	}
+	sum := sha256.Sum256(cert.Raw)
+	ta := tlsaRecord{Usage: 2, Selector: 0, MatchingType: 1, Data: sum[:]}
+	if daneVerify([]tlsaRecord{ta}, nil) {
+		t.Error("no certificate should not match")
+	}
+	ee := tlsaRecord{Usage: 3, Selector: 0, MatchingType: 1, Data: sum[:]}
+	other := &x509.Certificate{Raw: []byte("other")}
+	if daneVerify([]tlsaRecord{ee}, []*x509.Certificate{other, cert}) {
+		t.Error("end entity usage should only match the leaf certificate")
+	}
+	if !daneVerify([]tlsaRecord{ta}, []*x509.Certificate{other, cert}) {
+		t.Error("trust anchor usage should match a certificate in the chain")
+	}
+}
+
+func TestDANEConfig(t *testing.T) {
+	for authType, valid := range map[string]bool{
+		"":                           false,
+		"NoClientCert":               false,
+		"VerifyClientCertIfGiven":    false,
+		"RequireAndVerifyClientCert": false,
+		"RequestClientCert":          true,
+		"RequireAnyClientCert":       true,
+	} {
+		sc := ServerConfig{ListenInterface: "127.0.0.1:2525"}
+		sc.TLS.DANE = daneEnforce
+		sc.TLS.ClientAuthType = authType
+		if err := sc.Validate(); (err == nil) != valid {
+			t.Errorf("client_auth_type %q: expecting valid %v, got %v", authType, valid, err)
+		}
+	}
+}
+
+// A client presenting no certificate fails the check when its domain publishes TLSA records
+func TestDANEEnforce(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	ca := issueTestCert(t, "Test CA", true, nil)
+	writeTestCert(t, issueTestCert(t, "mx.test.com", false, &ca), "server.test.pem", "server.test.key")
+	defer func() {
+		for _, file := range []string{"server.test.pem", "server.test.key"} {
+			if err := deleteIfExists(file); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	clientCert := issueTestCert(t, "mx.example.com", false, nil)
+	sum := sha256.Sum256(clientCert.Leaf.RawSubjectPublicKeyInfo)
+	defer func(f func(string, string, time.Duration) ([]tlsaRecord, bool, error)) { tlsaLookup = f }(tlsaLookup)
+	tlsaLookup = func(resolver, name string, timeout time.Duration) ([]tlsaRecord, bool, error) {
+		if name != "_25._tcp.mx.example.com" {
+			return nil, true, nil
+		}
+		return []tlsaRecord{{Usage: 3, Selector: 1, MatchingType: 1, Data: sum[:]}}, true, nil
+	}
+
+	sc := getMockServerConfig()
+	sc.TLS = ServerTLSConfig{
+		StartTLSOn:     true,
+		PublicKeyFile:  "server.test.pem",
+		PrivateKeyFile: "server.test.key",
+		ClientAuthType: "RequestClientCert",
+		DANE:           daneEnforce,
+	}
+	if err := sc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	mainlog, err := log.GetLogger(sc.LogFile, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// session returns the reply to EHLO after STARTTLS
+	session := func(helo string, certs []tls.Certificate) string {
+		conn, server := getMockServerConn(sc, t)
+		client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			server.handleClient(client)
+			wg.Done()
+		}()
+		defer wg.Wait()
+		// close the pipe rather than the TLS connection, both ends would block writing close_notify
+		defer func() {
+			_ = conn.Client.Close()
+		}()
+		r := textproto.NewReader(bufio.NewReader(conn.Client))
+		w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+		_, _ = r.ReadLine()
+		if err := w.PrintfLine("%s", "EHLO "+helo); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			line, err := r.ReadLine()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, "250 ") {
+				break
+			}
+		}
+		if err := w.PrintfLine("STARTTLS"); err != nil {
+			t.Fatal(err)
+		}
+		if line, _ := r.ReadLine(); !strings.HasPrefix(line, "220") {
+			t.Fatal("expecting STARTTLS to be accepted, got", line)
+		}
+		tlsConn := tls.Client(conn.Client, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		r = textproto.NewReader(bufio.NewReader(tlsConn))
+		w = textproto.NewWriter(bufio.NewWriter(tlsConn))
+		// a rejected client gets the reply without sending anything, write while reading
+		go func() {
+			_ = w.PrintfLine("%s", "EHLO "+helo)
+		}()
+		line, _ := r.ReadLine()
+		return line
+	}
+
+	if line := session("mx.example.com", []tls.Certificate{clientCert}); !strings.HasPrefix(line, "250") {
+		t.Error("expecting a matching certificate to pass, got", line)
+	}
+	if line := session("mx.example.com", nil); line != "554 5.7.5 Error: certificate does not match the TLSA records" {
+		t.Error("expecting a client without a certificate to be rejected, got", line)
+	}
+	if line := session("other.example.com", nil); !strings.HasPrefix(line, "250") {
+		t.Error("expecting a domain without TLSA records to pass without a certificate, got", line)
+	}
+}
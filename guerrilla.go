@@ -3,6 +3,8 @@ package guerrilla
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -50,6 +52,20 @@ type guerrilla struct {
 	// guard controls access to g.servers
 	guard sync.Mutex
 	state int8
+	// tracer exports spans when tracing is configured
+	tracer *backends.OTLPTracer
+	// customTracer is the tracer set on the Daemon, used instead of tracer
+	customTracer backends.Tracer
+	// metrics is the registry served on metrics_listen_interface
+	metrics *backends.Metrics
+	// customMetrics is the registry set on the Daemon, used instead of metrics
+	customMetrics backends.MetricsRegistry
+	// metricsServer serves the metrics, nil when not listening
+	metricsServer *http.Server
+	// authenticator checks the AUTH credentials, nil when AUTH is off
+	authenticator Authenticator
+	// rateLimitStore keeps the buckets of messages_per_minute_per_ip, nil for the servers' own
+	rateLimitStore RateLimitStore
 	EventHandler
 	logStore
 	backendStore
@@ -96,6 +112,11 @@ func New(ac *AppConfig, b backends.Backend, l log.Logger) (Guerrilla, error) {
 			}
 		}
 	}
+	if ac.LogFormat != "" {
+		if err := log.SetFormat(ac.LogFormat); err != nil {
+			return g, err
+		}
+	}
 	// Write the process id (pid) to a file
 	// we should still be able to continue even if we can't write the pid, error will be logged by writePid()
 	_ = g.writePid()
@@ -141,6 +162,10 @@ func (g *guerrilla) makeServers() error {
 			if server != nil {
 				g.servers[sc.ListenInterface] = server
 				server.setAllowedHosts(g.Config.AllowedHosts)
+				server.setAuthenticator(g.authenticator)
+				if g.rateLimitStore != nil {
+					server.setRateLimitStore(g.rateLimitStore)
+				}
 			}
 		}
 	}
@@ -252,6 +277,15 @@ func (g *guerrilla) subscribeEvents() {
 		}
 	})
 
+	// when log format changes, it applies to all the loggers
+	events[EventConfigLogFormat] = daemonEvent(func(c *AppConfig) {
+		if err := log.SetFormat(c.LogFormat); err == nil {
+			g.mainlog().Infof("log format changed to [%s]", c.LogFormat)
+		} else {
+			g.mainlog().WithError(err).Error("log format change failed")
+		}
+	})
+
 	// write out our pid whenever the file name changes in the config
 	events[EventConfigPidFile] = daemonEvent(func(ac *AppConfig) {
 		_ = g.writePid()
@@ -428,6 +462,22 @@ func (g *guerrilla) storeBackend(b backends.Backend) {
 	})
 }
 
+// setAuthenticator sets the Authenticator for the servers, including those added later
+func (g *guerrilla) setAuthenticator(a Authenticator) {
+	g.authenticator = a
+	g.mapServers(func(server *server) {
+		server.setAuthenticator(a)
+	})
+}
+
+// setRateLimitStore sets the RateLimitStore shared by the servers, including those added later
+func (g *guerrilla) setRateLimitStore(store RateLimitStore) {
+	g.rateLimitStore = store
+	g.mapServers(func(server *server) {
+		server.setRateLimitStore(store)
+	})
+}
+
 func (g *guerrilla) backend() backends.Backend {
 	if b, ok := g.backendStore.Load().(backends.Backend); ok {
 		return b
@@ -455,6 +505,15 @@ func (g *guerrilla) Start() error {
 			startErrors = append(startErrors, err)
 		}
 	}
+	if g.customTracer != nil {
+		backends.SetTracer(g.customTracer)
+	} else if g.Config.TracingEndpoint != "" && g.tracer == nil {
+		g.tracer = backends.NewOTLPTracer(g.Config.TracingEndpoint, g.Config.TracingServiceName)
+		backends.SetTracer(g.tracer)
+	}
+	if err := g.startMetrics(); err != nil {
+		startErrors = append(startErrors, err)
+	}
 	// channel for reading errors
 	errs := make(chan error, len(g.servers))
 	var startWG sync.WaitGroup
@@ -498,6 +557,7 @@ func (g *guerrilla) Shutdown() {
 	// shut down the servers first
 	g.mapServers(func(s *server) {
 		if s.state == ServerStateRunning {
+			s.setShutdownGrace(g.Config.ShutdownGracePeriod)
 			s.Shutdown()
 			g.mainlog().Infof("shutdown completed for [%s]", s.listenInterface)
 		}
@@ -513,6 +573,51 @@ func (g *guerrilla) Shutdown() {
 	} else {
 		g.mainlog().Infof("Backend shutdown completed")
 	}
+	if g.customTracer != nil {
+		backends.SetTracer(nil)
+	}
+	if g.tracer != nil {
+		backends.SetTracer(nil)
+		g.tracer.Stop()
+		g.tracer = nil
+	}
+	backends.SetMetrics(nil)
+	if g.metricsServer != nil {
+		_ = g.metricsServer.Close()
+		g.metricsServer = nil
+	}
+}
+
+// startMetrics sets the registry where the metrics are recorded, and serves it on
+// metrics_listen_interface if configured. The Daemon's registry is only served if it's an http.Handler
+func (g *guerrilla) startMetrics() error {
+	registry := g.customMetrics
+	if registry == nil && g.Config.MetricsListenInterface != "" {
+		if g.metrics == nil {
+			g.metrics = backends.NewMetrics()
+		}
+		registry = g.metrics
+	}
+	if registry == nil {
+		return nil
+	}
+	backends.SetMetrics(registry)
+	handler, ok := registry.(http.Handler)
+	if !ok || g.Config.MetricsListenInterface == "" || g.metricsServer != nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", g.Config.MetricsListenInterface)
+	if err != nil {
+		return fmt.Errorf("cannot listen on metrics interface %s: %s", g.Config.MetricsListenInterface, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	g.metricsServer = &http.Server{Handler: mux}
+	go func(srv *http.Server) {
+		_ = srv.Serve(listener)
+	}(g.metricsServer)
+	g.mainlog().Infof("Serving metrics on http://%s/metrics", g.Config.MetricsListenInterface)
+	return nil
 }
 
 // SetLogger sets the logger for the app and propagates it to sub-packages (eg.
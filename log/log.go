@@ -1,6 +1,7 @@
 package log
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
@@ -51,8 +52,21 @@ func (level Level) String() string {
 	return "unknown"
 }
 
-type Logger interface {
+// Formats of the log lines, see SetFormat
+const (
+	// FormatText writes lines of text, with the fields as key=value pairs (default)
+	FormatText = "text"
+	// FormatJSON writes each line as a JSON object, with the level, time, msg and fields as keys
+	FormatJSON = "json"
+)
+
+// FieldLogger logs lines with fields, such as the entries returned by Logger.WithFields
+type FieldLogger interface {
 	log.FieldLogger
+}
+
+type Logger interface {
+	FieldLogger
 	WithConn(conn net.Conn) *log.Entry
 	Reopen() error
 	GetLogDest() string
@@ -86,6 +100,8 @@ type loggerCache map[loggerKey]Logger
 // loggers store the cached loggers created by NewLogger
 var loggers struct {
 	cache loggerCache
+	// format of the lines of all the loggers, see SetFormat
+	format string
 	// mutex guards the cache
 	sync.Mutex
 }
@@ -114,7 +130,7 @@ func GetLogger(dest string, level string) (Logger, error) {
 		}
 	}
 	o := parseOutputOption(dest)
-	logrus, err := newLogrus(o, level)
+	logrus, err := newLogrus(o, level, loggers.format)
 	if err != nil {
 		return nil, err
 	}
@@ -143,7 +159,32 @@ func GetLogger(dest string, level string) (Logger, error) {
 	return l, nil
 }
 
-func newLogrus(o OutputOption, level string) (*log.Logger, error) {
+// SetFormat sets the format of the lines written by all loggers, including those already
+// created, to FormatText or FormatJSON. Use FormatJSON for ingesting the logs into ELK or Loki
+func SetFormat(format string) error {
+	loggers.Lock()
+	defer loggers.Unlock()
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("invalid log format [%s], use %s or %s", format, FormatText, FormatJSON)
+	}
+	loggers.format = format
+	for _, l := range loggers.cache {
+		if h, ok := l.(*HookedLogger); ok {
+			h.Logger.SetFormatter(newFormatter(format))
+		}
+	}
+	return nil
+}
+
+// newFormatter returns the logrus formatter for format
+func newFormatter(format string) log.Formatter {
+	if format == FormatJSON {
+		return new(log.JSONFormatter)
+	}
+	return new(log.TextFormatter)
+}
+
+func newLogrus(o OutputOption, level string, format string) (*log.Logger, error) {
 	logLevel, err := log.ParseLevel(level)
 	if err != nil {
 		return nil, err
@@ -165,7 +206,7 @@ func newLogrus(o OutputOption, level string) (*log.Logger, error) {
 
 	logger := &log.Logger{
 		Out:       out,
-		Formatter: new(log.TextFormatter),
+		Formatter: newFormatter(format),
 		Hooks:     make(log.LevelHooks),
 		Level:     logLevel,
 	}
@@ -0,0 +1,74 @@
+package mail
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the time. Everything that stamps a time on a message, such as the
+// Received header and queue ids, gets it from DefaultClock
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator generates the queue ids of envelopes and the boundaries of generated MIME messages
+type IDGenerator interface {
+	// QueuedID returns a new queue id for an envelope of the client with clientID
+	QueuedID(clientID uint64) string
+	// Boundary returns a new MIME multipart boundary
+	Boundary() string
+}
+
+// DefaultClock and DefaultIDGenerator can be replaced for deterministic output, eg. in
+// golden-file tests. They should only be replaced before the server is started
+var (
+	DefaultClock       Clock       = systemClock{}
+	DefaultIDGenerator IDGenerator = hashIDGenerator{}
+)
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// hashIDGenerator derives queue ids from the time and client id, and boundaries from crypto/rand
+type hashIDGenerator struct{}
+
+func (hashIDGenerator) QueuedID(clientID uint64) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%d.%d", DefaultClock.Now().Unix(), clientID))))
+}
+
+func (hashIDGenerator) Boundary() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// fall back to something unique enough
+		return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%d", DefaultClock.Now().UnixNano()))))
+	}
+	return fmt.Sprintf("%x", b[:])
+}
+
+// FixedClock is a Clock that always returns the same time, for tests
+type FixedClock time.Time
+
+func (c FixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// SequenceIDGenerator is an IDGenerator for tests. It returns Prefix followed by a
+// counter that increments with each id or boundary returned
+type SequenceIDGenerator struct {
+	Prefix string
+	n      uint64
+}
+
+func (g *SequenceIDGenerator) QueuedID(clientID uint64) string {
+	return fmt.Sprintf("%s%d", g.Prefix, atomic.AddUint64(&g.n, 1))
+}
+
+func (g *SequenceIDGenerator) Boundary() string {
+	return fmt.Sprintf("%sboundary%d", g.Prefix, atomic.AddUint64(&g.n, 1))
+}
@@ -0,0 +1,153 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrNullReversePath is returned when asked for a DSN for a message sent from <>,
+// bounces are never sent to the null reverse-path so that they can't loop
+var ErrNullReversePath = errors.New("no DSN for the null reverse-path")
+
+// DSN is a delivery status notification (RFC 3464) reporting the recipients that a
+// message could not be delivered to, sent back to the message's sender
+type DSN struct {
+	// ReportingMTA is the host name of the MTA that attempted the delivery
+	ReportingMTA string
+	// Sender is the reverse-path of the original message, the DSN is sent to it
+	Sender string
+	// ArrivalDate is when the original message was received
+	ArrivalDate time.Time
+	// Recipients are the failed recipients
+	Recipients []DSNRecipient
+	// Headers are the headers of the original message, returned with the DSN
+	Headers []byte
+}
+
+// DSNRecipient is the delivery status of one recipient
+type DSNRecipient struct {
+	// OriginalRecipient is the address as given with RCPT
+	OriginalRecipient string
+	// FinalRecipient is the address that delivery was attempted to, the OriginalRecipient if empty
+	FinalRecipient string
+	// Status is the enhanced status code, eg. "5.1.1"
+	Status string
+	// DiagnosticCode is the reply of the remote server, eg. "550 5.1.1 no such user"
+	DiagnosticCode string
+}
+
+// enhancedStatus matches the enhanced status code at the start of a reply text
+var enhancedStatus = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// NewDSNRecipient returns the status of rcpt that failed with reply, the SMTP reply of the
+// remote server, eg. "550 5.1.1 no such user". The status is taken from the reply's enhanced
+// code, or the class of its basic code if it has none
+func NewDSNRecipient(rcpt, reply string) DSNRecipient {
+	r := DSNRecipient{OriginalRecipient: rcpt, DiagnosticCode: reply, Status: "5.0.0"}
+	if len(reply) > 4 && reply[0] == '4' {
+		r.Status = "4.0.0"
+	}
+	if len(reply) > 4 {
+		if status := enhancedStatus.FindString(reply[4:]); status != "" {
+			r.Status = status
+		}
+	}
+	return r
+}
+
+// NewDSNReply returns the status of rcpt that failed with the reply code and text of the
+// remote server, eg. 550 and "5.1.1 no such user", as in a net/textproto.Error. The status is
+// taken from the text's enhanced code, or the class of the code if it has none
+func NewDSNReply(rcpt string, code int, text string) DSNRecipient {
+	// the lines of a multi-line reply are joined, so that the Diagnostic-Code is one line
+	text = strings.Replace(strings.TrimSpace(text), "\n", " ", -1)
+	r := DSNRecipient{OriginalRecipient: rcpt, DiagnosticCode: fmt.Sprintf("%03d %s", code, text), Status: "5.0.0"}
+	if code/100 == 4 {
+		r.Status = "4.0.0"
+	}
+	if status := enhancedStatus.FindString(text); status != "" {
+		r.Status = status
+	}
+	return r
+}
+
+// NewDSN returns a DSN to sender for the failed recipients of a message with headers.
+// Returns ErrNullReversePath if sender is empty
+func NewDSN(reportingMTA, sender string, headers []byte, failed ...DSNRecipient) (*DSN, error) {
+	if sender == "" {
+		return nil, ErrNullReversePath
+	}
+	return &DSN{
+		ReportingMTA: reportingMTA,
+		Sender:       sender,
+		Recipients:   failed,
+		Headers:      headers,
+	}, nil
+}
+
+// Bytes returns the DSN as a multipart/report message with three parts: a description for
+// people, the machine readable message/delivery-status, and the headers of the original message
+func (d *DSN) Bytes() []byte {
+	var buf bytes.Buffer
+	boundary := DefaultIDGenerator.Boundary()
+	now := DefaultClock.Now()
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", d.ReportingMTA)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", d.Sender)
+	buf.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", DefaultIDGenerator.Boundary(), d.ReportingMTA)
+	buf.WriteString("Auto-Submitted: auto-replied\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+	buf.WriteString("This is a MIME-encapsulated message.\r\n\r\n")
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString("Your message could not be delivered to the following recipients:\r\n\r\n")
+	for _, r := range d.Recipients {
+		fmt.Fprintf(&buf, "<%s>: %s\r\n", r.OriginalRecipient, r.DiagnosticCode)
+	}
+
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&buf, "Reporting-MTA: dns; %s\r\n", d.ReportingMTA)
+	if !d.ArrivalDate.IsZero() {
+		fmt.Fprintf(&buf, "Arrival-Date: %s\r\n", d.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, r := range d.Recipients {
+		final := r.FinalRecipient
+		if final == "" {
+			final = r.OriginalRecipient
+		}
+		buf.WriteString("\r\n")
+		fmt.Fprintf(&buf, "Original-Recipient: rfc822; %s\r\n", r.OriginalRecipient)
+		fmt.Fprintf(&buf, "Final-Recipient: rfc822; %s\r\n", final)
+		buf.WriteString("Action: failed\r\n")
+		fmt.Fprintf(&buf, "Status: %s\r\n", r.Status)
+		if r.DiagnosticCode != "" {
+			fmt.Fprintf(&buf, "Diagnostic-Code: smtp; %s\r\n", r.DiagnosticCode)
+		}
+		fmt.Fprintf(&buf, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+	buf.Write(d.Headers)
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes()
+}
+
+// HeadersOf returns the header section of a message, up to and including the empty line
+func HeadersOf(msg []byte) []byte {
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i > -1 {
+		return msg[:i+4]
+	}
+	if i := bytes.Index(msg, []byte("\n\n")); i > -1 {
+		return msg[:i+2]
+	}
+	return msg
+}
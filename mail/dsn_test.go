@@ -0,0 +1,106 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDSN(t *testing.T) {
+	defer func(c Clock, g IDGenerator) {
+		DefaultClock, DefaultIDGenerator = c, g
+	}(DefaultClock, DefaultIDGenerator)
+	DefaultClock = FixedClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	DefaultIDGenerator = &SequenceIDGenerator{Prefix: "dsn"}
+
+	original := []byte("From: sender@example.com\r\nSubject: hello\r\n\r\nbody\r\n")
+	dsn, err := NewDSN("mx.example.com", "sender@example.com", HeadersOf(original),
+		NewDSNRecipient("bad@example.org", "550 5.1.1 no such user"),
+		NewDSNRecipient("full@example.org", "452 mailbox full"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(dsn.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("To") != "<sender@example.com>" || msg.Header.Get("Auto-Submitted") != "auto-replied" {
+		t.Error("expecting an auto-replied DSN to the sender, got", msg.Header)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatal("expecting a multipart/report of delivery-status, got", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	var bodies []string
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(part)
+		types = append(types, part.Header.Get("Content-Type"))
+		bodies = append(bodies, string(b))
+	}
+	if strings.Join(types, ",") != "text/plain; charset=utf-8,message/delivery-status,text/rfc822-headers" {
+		t.Fatal("expecting the three parts of a DSN, got", types)
+	}
+	if !strings.Contains(bodies[0], "<bad@example.org>: 550 5.1.1 no such user") {
+		t.Error("expecting the human readable part to list the failures, got", bodies[0])
+	}
+	if !strings.HasPrefix(bodies[2], "From: sender@example.com\r\nSubject: hello\r\n") || strings.Contains(bodies[2], "body") {
+		t.Error("expecting the headers of the original message, got", bodies[2])
+	}
+
+	// the delivery-status is a group of message fields, then a group for each recipient
+	tp := textproto.NewReader(bufio.NewReader(strings.NewReader(bodies[1])))
+	fields, err := tp.ReadMIMEHeader()
+	if err != nil || fields.Get("Reporting-MTA") != "dns; mx.example.com" {
+		t.Fatal("expecting the Reporting-MTA, got", fields, err)
+	}
+	for _, want := range []map[string]string{
+		{"Original-Recipient": "rfc822; bad@example.org", "Final-Recipient": "rfc822; bad@example.org",
+			"Action": "failed", "Status": "5.1.1", "Diagnostic-Code": "smtp; 550 5.1.1 no such user"},
+		{"Original-Recipient": "rfc822; full@example.org", "Action": "failed", "Status": "4.0.0"},
+	} {
+		fields, err := tp.ReadMIMEHeader()
+		if err != nil && len(fields) == 0 {
+			t.Fatal(err)
+		}
+		for name, value := range want {
+			if fields.Get(name) != value {
+				t.Errorf("expecting %s: %s, got %q", name, value, fields.Get(name))
+			}
+		}
+	}
+}
+
+func TestNewDSNReply(t *testing.T) {
+	for _, test := range []struct {
+		code               int
+		text, status, diag string
+	}{
+		{550, "5.1.1 no such user", "5.1.1", "550 5.1.1 no such user"},
+		{452, "mailbox full", "4.0.0", "452 mailbox full"},
+		{554, "5.7.1 rejected\n5.7.1 see the policy", "5.7.1", "554 5.7.1 rejected 5.7.1 see the policy"},
+	} {
+		r := NewDSNReply("bad@example.org", test.code, test.text)
+		if r.OriginalRecipient != "bad@example.org" || r.Status != test.status || r.DiagnosticCode != test.diag {
+			t.Errorf("expecting %s and %q, got %+v", test.status, test.diag, r)
+		}
+	}
+}
+
+func TestDSNNullReversePath(t *testing.T) {
+	if _, err := NewDSN("mx.example.com", "", nil, NewDSNRecipient("bad@example.org", "550 no")); err != ErrNullReversePath {
+		t.Error("expecting no DSN for <>, got", err)
+	}
+}
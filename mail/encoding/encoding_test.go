@@ -17,3 +17,20 @@ func TestEncodingMimeHeaderDecode(t *testing.T) {
 		t.Error("expecting André Pirard, got:", str)
 	}
 }
+
+func TestEncodingDecodeHeaderToUTF8(t *testing.T) {
+	for raw, expect := range map[string]string{
+		"=?Shift_JIS?B?k/qWe4zqgsyMj5a8?=":                "日本語の件名",
+		"=?GB2312?B?1tDOxNb3zOI=?=":                       "中文主题",
+		"=?windows-1252?B?k1NtYXJ0lCBxdW90ZXMgliCANQ==?=": "“Smart” quotes – €5",
+	} {
+		if decoded, err := mail.DecodeHeaderToUTF8(raw); err != nil || decoded != expect {
+			t.Errorf("expecting %q, got %q %v", expect, decoded, err)
+		}
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: =?Shift_JIS?B?k/qWe4zqgsyMj5a8?=\n\nbody\n")
+	if err := e.ParseHeaders(); err != nil || e.Subject != "日本語の件名" {
+		t.Error("expecting the subject to be converted, got", e.Subject, err)
+	}
+}
@@ -3,7 +3,6 @@ package mail
 import (
 	"bufio"
 	"bytes"
-	"crypto/md5"
 	"errors"
 	"fmt"
 	"io"
@@ -12,7 +11,7 @@ import (
 	"net/textproto"
 	"strings"
 	"sync"
-	"time"
+	"unicode/utf8"
 )
 
 // A WordDecoder decodes MIME headers containing RFC 2047 encoded-words.
@@ -27,7 +26,8 @@ func init() {
 	Dec = mime.WordDecoder{}
 }
 
-const maxHeaderChunk = 1 + (4 << 10) // 4KB
+// maxHeaderSize is the most data that ParseHeaders looks at for the end of the header section
+const maxHeaderSize = 1 << 20 // 1MB
 
 // Address encodes an email address of the form `<user@host>`
 type Address struct {
@@ -41,6 +41,9 @@ type Address struct {
 	PathParams [][]string
 	// NullPath is true if <> was received
 	NullPath bool
+	// Detail is the sub-address detail (the "tag" of user+tag@host) if it was
+	// stripped from User by the subaddress processor
+	Detail string
 }
 
 func (ep *Address) String() string {
@@ -51,7 +54,22 @@ func (ep *Address) IsEmpty() bool {
 	return ep.User == "" && ep.Host == ""
 }
 
-var ap = mail.AddressParser{}
+// Subaddress splits the local part at the first separator into the base mailbox and the detail,
+// eg. "user+tag" with the separator "+" gives "user" and "tag". The detail is empty when
+// the local part has no separator, or when the base mailbox would be empty
+func (ep *Address) Subaddress(separator string) (base, detail string) {
+	if separator == "" {
+		return ep.User, ""
+	}
+	i := strings.Index(ep.User, separator)
+	if i < 1 {
+		return ep.User, ""
+	}
+	return ep.User[:i], ep.User[i+len(separator):]
+}
+
+// ap decodes encoded-words in display names with Dec, so that it supports the same charsets
+var ap = mail.AddressParser{WordDecoder: &Dec}
 
 // NewAddress takes a string of an RFC 5322 address of the
 // form "Gogh Fir <gf@example.com>" or "foo@example.com".
@@ -71,6 +89,29 @@ func NewAddress(str string) (Address, error) {
 	return Address{}, errors.New("invalid address")
 }
 
+// TLSInfo describes the TLS session an envelope was received over
+type TLSInfo struct {
+	// Version is the protocol version, eg. "TLSv1.2"
+	Version string
+	// Cipher is the name of the negotiated cipher suite, eg. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+	Cipher string
+	// Bits is the strength of the cipher's symmetric key
+	Bits int
+	// DANE is the result of matching the client's certificate against the TLSA records of
+	// its HELO domain, empty if not checked
+	DANE string
+}
+
+// String returns the TLS clause used in trace headers, eg.
+// "version=TLSv1.3 cipher=TLS_AES_256_GCM_SHA384 bits=256"
+// An empty string is returned if no TLS session was negotiated
+func (t TLSInfo) String() string {
+	if t.Version == "" {
+		return ""
+	}
+	return fmt.Sprintf("version=%s cipher=%s bits=%d", t.Version, t.Cipher, t.Bits)
+}
+
 // Envelope of Email represents a single SMTP message.
 type Envelope struct {
 	// Remote IP address
@@ -81,12 +122,17 @@ type Envelope struct {
 	MailFrom Address
 	// Recipients
 	RcptTo []Address
+	// MTPriority is the priority requested with the MT-PRIORITY parameter (RFC 6710), from -9 to 9.
+	// Zero when not given
+	MTPriority int
 	// Data stores the header and message body
 	Data bytes.Buffer
 	// Subject stores the subject of the email, extracted and decoded after calling ParseHeaders()
 	Subject string
 	// TLS is true if the email was received using a TLS connection
 	TLS bool
+	// TLSInfo describes the negotiated TLS session, set when TLS is true
+	TLSInfo TLSInfo
 	// Header stores the results from ParseHeaders()
 	Header textproto.MIMEHeader
 	// Values hold the values generated when processing the envelope by the backend
@@ -110,33 +156,38 @@ func NewEnvelope(remoteAddr string, clientID uint64) *Envelope {
 }
 
 func queuedID(clientID uint64) string {
-	return fmt.Sprintf("%x", md5.Sum([]byte(string(time.Now().Unix())+string(clientID))))
+	return DefaultIDGenerator.QueuedID(clientID)
 }
 
 // ParseHeaders parses the headers into Header field of the Envelope struct.
 // Data buffer must be full before calling.
-// It assumes that at most 30kb of email data can be a header
+// Folded header fields are unfolded, and fields that appear more than once, such as Received,
+// keep all their values in the order they appear. The header section ends at the first empty
+// line, which must be within the first 1MB of the data.
 // Decoding of encoding to UTF is only done on the Subject, where the result is assigned to the Subject field
 func (e *Envelope) ParseHeaders() error {
+	return e.ParseHeadersCharset("")
+}
+
+// ParseHeadersCharset is like ParseHeaders, but unencoded 8-bit text in the Subject is converted
+// from defaultCharset. An empty defaultCharset means DefaultCharset
+func (e *Envelope) ParseHeadersCharset(defaultCharset string) error {
 	var err error
 	if e.Header != nil {
 		return errors.New("headers already parsed")
 	}
 	buf := e.Data.Bytes()
-	// find where the header ends, assuming that over 30 kb would be max
-	if len(buf) > maxHeaderChunk {
-		buf = buf[:maxHeaderChunk]
+	if len(buf) > maxHeaderSize {
+		buf = buf[:maxHeaderSize]
 	}
-
-	headerEnd := bytes.Index(buf, []byte{'\n', '\n'}) // the first two new-lines chars are the End Of Header
+	headerEnd := headerSectionEnd(buf)
 	if headerEnd > -1 {
-		header := buf[0 : headerEnd+2]
-		headerReader := textproto.NewReader(bufio.NewReader(bytes.NewBuffer(header)))
+		headerReader := textproto.NewReader(bufio.NewReader(bytes.NewReader(buf[:headerEnd])))
 		e.Header, err = headerReader.ReadMIMEHeader()
 		if err == nil || err == io.EOF {
 			// decode the subject
 			if subject, ok := e.Header["Subject"]; ok {
-				e.Subject = MimeHeaderDecode(subject[0])
+				e.Subject, _ = DecodeHeaderCharset(subject[0], defaultCharset)
 			}
 		}
 	} else {
@@ -145,6 +196,22 @@ func (e *Envelope) ParseHeaders() error {
 	return err
 }
 
+// headerSectionEnd returns the length of the header section of data, including the empty line
+// that ends it, or -1 if there is no empty line. Lines may end with LF or CRLF
+func headerSectionEnd(data []byte) int {
+	for pos := 0; pos < len(data); {
+		i := bytes.IndexByte(data[pos:], '\n')
+		if i < 0 {
+			break
+		}
+		if i == 0 || (i == 1 && data[pos] == '\r') {
+			return pos + i + 1
+		}
+		pos += i + 1
+	}
+	return -1
+}
+
 // Len returns the number of bytes that would be in the reader returned by NewReader()
 func (e *Envelope) Len() int {
 	return len(e.DeliveryHeader) + e.Data.Len()
@@ -174,6 +241,7 @@ func (e *Envelope) ResetTransaction() {
 
 	e.MailFrom = Address{}
 	e.RcptTo = []Address{}
+	e.MTPriority = 0
 	// reset the data buffer, keep it allocated
 	e.Data.Reset()
 
@@ -191,6 +259,7 @@ func (e *Envelope) Reseed(remoteIP string, clientID uint64) {
 	e.QueuedId = queuedID(clientID)
 	e.Helo = ""
 	e.TLS = false
+	e.TLSInfo = TLSInfo{}
 }
 
 // PushRcpt adds a recipient email address to the envelope
@@ -198,6 +267,17 @@ func (e *Envelope) PushRcpt(addr Address) {
 	e.RcptTo = append(e.RcptTo, addr)
 }
 
+// HasRcpt returns true if the mailbox is already one of the recipients, comparing
+// the local part and domain without regard to case
+func (e *Envelope) HasRcpt(addr Address) bool {
+	for i := range e.RcptTo {
+		if strings.EqualFold(e.RcptTo[i].User, addr.User) && strings.EqualFold(e.RcptTo[i].Host, addr.Host) {
+			return true
+		}
+	}
+	return false
+}
+
 // PopRcpt removes the last email address that was pushed to the envelope
 func (e *Envelope) PopRcpt() Address {
 	ret := e.RcptTo[len(e.RcptTo)-1]
@@ -205,55 +285,81 @@ func (e *Envelope) PopRcpt() Address {
 	return ret
 }
 
-// MimeHeaderDecode converts 7 bit encoded mime header strings to UTF-8
+// MimeHeaderDecode converts 7 bit encoded mime header strings to UTF-8.
+// Words that cannot be decoded are kept as they are, see DecodeHeaderToUTF8
 func MimeHeaderDecode(str string) string {
-	state := 0
-	var buf bytes.Buffer
-	var out []byte
-	for i := 0; i < len(str); i++ {
-		switch state {
-		case 0:
-			if str[i] == '=' {
-				buf.WriteByte(str[i])
-				state = 1
-			} else {
-				out = append(out, str[i])
+	decoded, _ := DecodeHeaderToUTF8(str)
+	return decoded
+}
+
+// DecodeHeaderToUTF8 converts the raw value of a header field to UTF-8.
+// Encoded-words (RFC 2047) in B or Q encoding are decoded and converted from their charset with
+// NewTextReader, so each word can have a different charset. The whitespace between two adjacent
+// encoded-words is removed, as it's only there to separate them. Unencoded text that is not valid
+// UTF-8 is converted from DefaultCharset.
+// Text in a charset that can't be converted is kept as it is, and the error is returned along
+// with the rest of the value decoded
+func DecodeHeaderToUTF8(raw string) (string, error) {
+	return DecodeHeaderCharset(raw, "")
+}
+
+// DecodeHeaderCharset is like DecodeHeaderToUTF8, but unencoded text that is not valid UTF-8
+// is converted from defaultCharset. An empty defaultCharset means DefaultCharset
+func DecodeHeaderCharset(raw, defaultCharset string) (string, error) {
+	if defaultCharset == "" {
+		defaultCharset = DefaultCharset
+	}
+	dec := Dec
+	dec.CharsetReader = NewTextReader
+	var out bytes.Buffer
+	var firstErr error
+	prevEncoded := false
+	for len(raw) > 0 {
+		i := strings.IndexFunc(raw, func(r rune) bool {
+			return r != ' ' && r != '\t' && r != '\r' && r != '\n'
+		})
+		if i < 0 {
+			out.WriteString(raw)
+			break
+		}
+		space := raw[:i]
+		raw = raw[i:]
+		j := strings.IndexAny(raw, " \t\r\n")
+		if j < 0 {
+			j = len(raw)
+		}
+		word := raw[:j]
+		raw = raw[j:]
+		if strings.HasPrefix(word, "=?") && strings.HasSuffix(word, "?=") {
+			d, err := dec.Decode(word)
+			if err == nil {
+				if !prevEncoded {
+					out.WriteString(space)
+				}
+				out.WriteString(d)
+				prevEncoded = true
+				continue
 			}
-		case 1:
-			if str[i] == '?' {
-				buf.WriteByte(str[i])
-				state = 2
-			} else {
-				out = append(out, str[i])
-				buf.Reset()
-				state = 0
+			if firstErr == nil && strings.Count(word, "?") == 4 {
+				// a well formed encoded-word in a charset we can't convert
+				firstErr = err
 			}
-
-		case 2:
-			if str[i] == ' ' {
-				d, err := Dec.Decode(buf.String())
+		} else if !utf8.ValidString(word) {
+			d, err := DecodeText(defaultCharset, []byte(word))
+			if err == nil && utf8.ValidString(d) {
+				word = d
+			} else if firstErr == nil {
 				if err == nil {
-					out = append(out, []byte(d)...)
-				} else {
-					out = append(out, buf.Bytes()...)
+					err = fmt.Errorf("header text is not valid %s", defaultCharset)
 				}
-				out = append(out, ' ')
-				buf.Reset()
-				state = 0
-			} else {
-				buf.WriteByte(str[i])
+				firstErr = err
 			}
 		}
+		out.WriteString(space)
+		out.WriteString(word)
+		prevEncoded = false
 	}
-	if buf.Len() > 0 {
-		d, err := Dec.Decode(buf.String())
-		if err == nil {
-			out = append(out, []byte(d)...)
-		} else {
-			out = append(out, buf.Bytes()...)
-		}
-	}
-	return string(out)
+	return out.String(), firstErr
 }
 
 // Envelopes have their own pool
@@ -19,14 +19,77 @@ func TestMimeHeaderDecode(t *testing.T) {
 	*/
 
 	str := MimeHeaderDecode("=?utf-8?B?55So5oi34oCcRXBpZGVtaW9sb2d5IGluIG51cnNpbmcgYW5kIGg=?=  =?utf-8?B?ZWFsdGggY2FyZSBlQm9vayByZWFkL2F1ZGlvIGlkOm8=?=  =?utf-8?B?cTNqZWVr4oCd5Zyo572R56uZ4oCcU1BZ5Lit5paH5a6Y5pa5572R56uZ4oCd?=  =?utf-8?B?55qE5biQ5Y+36K+m5oOF?=")
-	if i := strings.Index(str, "用户“Epidemiology in nursing and h  ealth care eBook read/audio id:o  q3jeek”在网站“SPY中文官方网站”  的帐号详情"); i != 0 {
-		t.Error("expecting 用户“Epidemiology in nursing and h  ealth care eBook read/audio id:o  q3jeek”在网站“SPY中文官方网站”  的帐号详情, got:", str)
+	// the whitespace between adjacent encoded-words is not part of the text
+	if str != "用户“Epidemiology in nursing and health care eBook read/audio id:oq3jeek”在网站“SPY中文官方网站”的帐号详情" {
+		t.Error("expecting 用户“Epidemiology in nursing and health care eBook read/audio id:oq3jeek”在网站“SPY中文官方网站”的帐号详情, got:", str)
 	}
 	str = MimeHeaderDecode("=?ISO-8859-1?Q?Andr=E9?= Pirard <PIRARD@vm1.ulg.ac.be>")
 	if strings.Index(str, "André Pirard") != 0 {
 		t.Error("expecting André Pirard, got:", str)
 	}
+	for encoded, expect := range map[string]string{
+		"=?UTF-8?B?w4lsw6h2ZSBkdSBtb2lz?=":                            "Élève du mois",
+		"=?iso-8859-1?q?Caf=E9_cr=E8me?=":                             "Café crème",
+		"Re: =?UTF-8?Q?r=C3=A9union_?= \t=?ISO-8859-1?Q?=E0_10h?= ok": "Re: réunion à 10h ok",
+		"=?UTF-8?B?bm90IGJhc2U2NA!?= and =?unknown?Q?x?=":             "=?UTF-8?B?bm90IGJhc2U2NA!?= and =?unknown?Q?x?=",
+		"  plain   text ": "  plain   text ",
+	} {
+		if str = MimeHeaderDecode(encoded); str != expect {
+			t.Errorf("expecting %q, got %q", expect, str)
+		}
+	}
+}
+func TestDecodeHeaderToUTF8(t *testing.T) {
+	defer func(charset string) { DefaultCharset = charset }(DefaultCharset)
+	for raw, expect := range map[string]string{
+		"=?windows-1252?B?k1NtYXJ0lCBxdW90ZXMgliCANQ==?=": "“Smart” quotes – €5",
+		"=?windows-1252?Q?=93Smart=94_quotes?= ok":        "“Smart” quotes ok",
+		"=?ISO-8859-1?Q?Caf=E9?=":                         "Café",
+		"already UTF-8 ✓":                                 "already UTF-8 ✓",
+	} {
+		if decoded, err := DecodeHeaderToUTF8(raw); err != nil || decoded != expect {
+			t.Errorf("expecting %q, got %q %v", expect, decoded, err)
+		}
+	}
+	// unknown charsets are kept as they are, the rest is decoded
+	decoded, err := DecodeHeaderToUTF8("=?x-unknown?Q?abc?= =?utf-8?Q?caf=C3=A9?=")
+	if err == nil || decoded != "=?x-unknown?Q?abc?= café" {
+		t.Errorf("expecting the unknown charset to be kept with an error, got %q %v", decoded, err)
+	}
+	// unencoded 8bit text is converted from the default charset
+	DefaultCharset = "windows-1252"
+	if decoded, err = DecodeHeaderToUTF8("Caf\xe9 \x80"); err != nil || decoded != "Café €" {
+		t.Errorf("expecting Café €, got %q %v", decoded, err)
+	}
+	DefaultCharset = "us-ascii"
+	if decoded, err = DecodeHeaderToUTF8("Caf\xe9"); err == nil || decoded != "Caf\xe9" {
+		t.Errorf("expecting the raw bytes with an error, got %q %v", decoded, err)
+	}
+	// or from the charset given
+	if decoded, err = DecodeHeaderCharset("Caf\xe9", "iso-8859-1"); err != nil || decoded != "Café" {
+		t.Errorf("expecting Café, got %q %v", decoded, err)
+	}
+}
+
+func TestParseHeadersEncodedWords(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.Data.WriteString("Subject: =?UTF-8?B?w4lsw6h2ZSBkdSBtb2lz?=\n" +
+		"From: =?ISO-8859-1?Q?Andr=E9?= Pirard <andre@example.com>\n\nbody\n")
+	if err := e.ParseHeaders(); err != nil {
+		t.Fatal(err)
+	}
+	if e.Subject != "Élève du mois" {
+		t.Error("expecting the subject to be decoded, got", e.Subject)
+	}
+	// the raw header is kept
+	if e.Header.Get("Subject") != "=?UTF-8?B?w4lsw6h2ZSBkdSBtb2lz?=" {
+		t.Error("expecting the raw subject in e.Header, got", e.Header.Get("Subject"))
+	}
+	if a, err := NewAddress(e.Header.Get("From")); err != nil || a.String() != "andre@example.com" {
+		t.Error("expecting andre@example.com, got", a.String(), err)
+	}
 }
+
 func TestNewAddress(t *testing.T) {
 
 	addr, err := NewAddress("<hoop>")
@@ -73,3 +136,98 @@ func TestEnvelope(t *testing.T) {
 	}
 
 }
+
+func TestParseHeadersFolded(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.Data.WriteString("Subject: a subject\n that is folded\n\tover three lines\n" +
+		"Received: from a.example.com by b.example.com;\n\tSat, 20 Oct 2018 12:00:03 +0000\n" +
+		"Received: from c.example.com by a.example.com; Sat, 20 Oct 2018 12:00:02 +0000\n" +
+		"Received: from d.example.com by c.example.com; Sat, 20 Oct 2018 12:00:01 +0000\n" +
+		"Received: from e.example.com by d.example.com; Sat, 20 Oct 2018 12:00:00 +0000\n" +
+		"DKIM-Signature: v=1; b=" + strings.Repeat("a", 5000) + "\n" +
+		"To: test@example.com\n" +
+		"\n" +
+		"Received: from the body\n")
+	if err := e.ParseHeaders(); err != nil {
+		t.Fatal("cannot parse headers:", err)
+	}
+	if e.Subject != "a subject that is folded over three lines" {
+		t.Error("expecting the folded subject to be joined, got:", e.Subject)
+	}
+	received := e.Header["Received"]
+	if len(received) != 4 {
+		t.Fatal("expecting 4 Received headers, got", len(received))
+	}
+	if received[0] != "from a.example.com by b.example.com; Sat, 20 Oct 2018 12:00:03 +0000" ||
+		!strings.HasPrefix(received[3], "from e.example.com") {
+		t.Error("expecting the Received headers in order, got", received)
+	}
+	// after a header larger than 4KB
+	if e.Header.Get("To") != "test@example.com" {
+		t.Error("expecting the To header, got", e.Header.Get("To"))
+	}
+
+	e = NewEnvelope("127.0.0.1", 22)
+	e.Data.WriteString("Subject: crlf\r\n folded\r\n\r\nbody\r\n")
+	if err := e.ParseHeaders(); err != nil || e.Subject != "crlf folded" {
+		t.Error("expecting CRLF line endings to be parsed, got", e.Subject, err)
+	}
+}
+
+func TestTLSInfo(t *testing.T) {
+	info := TLSInfo{}
+	if info.String() != "" {
+		t.Error("expecting an empty clause when not using TLS, got:", info.String())
+	}
+	info = TLSInfo{Version: "TLSv1.3", Cipher: "TLS_AES_256_GCM_SHA384", Bits: 256}
+	if info.String() != "version=TLSv1.3 cipher=TLS_AES_256_GCM_SHA384 bits=256" {
+		t.Error("unexpected TLS clause:", info.String())
+	}
+	e := NewEnvelope("127.0.0.1", 22)
+	e.TLS = true
+	e.TLSInfo = info
+	e.Reseed("127.0.0.2", 23)
+	if e.TLSInfo.String() != "" {
+		t.Error("TLSInfo should be reset when the envelope is reseeded")
+	}
+}
+
+func TestSubaddress(t *testing.T) {
+	a := Address{User: "user+tag+more", Host: "example.com"}
+	if base, detail := a.Subaddress("+"); base != "user" || detail != "tag+more" {
+		t.Error("expecting user and tag+more, got", base, detail)
+	}
+	if base, detail := a.Subaddress("-"); base != "user+tag+more" || detail != "" {
+		t.Error("expecting no detail, got", base, detail)
+	}
+	a.User = "+tag"
+	if base, detail := a.Subaddress("+"); base != "+tag" || detail != "" {
+		t.Error("empty base mailbox should not be split, got", base, detail)
+	}
+}
+
+func TestHasRcpt(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(Address{User: "User", Host: "Example.com"})
+	if !e.HasRcpt(Address{User: "user", Host: "example.COM"}) {
+		t.Error("expecting the recipient to match regardless of case")
+	}
+	if e.HasRcpt(Address{User: "user2", Host: "example.com"}) {
+		t.Error("expecting a different mailbox not to match")
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	defer func(g IDGenerator) { DefaultIDGenerator = g }(DefaultIDGenerator)
+	a, b := DefaultIDGenerator.Boundary(), DefaultIDGenerator.Boundary()
+	if a == b || len(a) != 32 {
+		t.Error("expecting unique 32 character boundaries, got", a, b)
+	}
+	DefaultIDGenerator = &SequenceIDGenerator{Prefix: "test-"}
+	if e := NewEnvelope("127.0.0.1", 1); e.QueuedId != "test-1" {
+		t.Error("expecting queued id test-1, got", e.QueuedId)
+	}
+	if b := DefaultIDGenerator.Boundary(); b != "test-boundary2" {
+		t.Error("expecting boundary test-boundary2, got", b)
+	}
+}
@@ -0,0 +1,644 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultCharset is the charset assumed for text parts that do not declare one.
+// RFC 2045 says us-ascii, but such parts often contain 8-bit text, so it can be set to
+// eg. "windows-1252" to have them decoded. It is shared by all the callers, so only set it
+// before any messages are processed, the functions taking a default charset use another one per call
+var DefaultCharset = "us-ascii"
+
+// DefaultContentType is assumed for parts without a (valid) Content-Type header
+const DefaultContentType = "text/plain"
+
+// PartType returns the media type and charset of a MIME part from its header.
+// A missing or invalid Content-Type is treated as text/plain, and text parts without
+// a charset parameter get DefaultCharset. The charset is empty for other parts that do not declare one
+func PartType(header textproto.MIMEHeader) (mediaType, charset string) {
+	return PartTypeCharset(header, "")
+}
+
+// PartTypeCharset is like PartType, but text parts without a charset get defaultCharset.
+// An empty defaultCharset means DefaultCharset
+func PartTypeCharset(header textproto.MIMEHeader, defaultCharset string) (mediaType, charset string) {
+	if defaultCharset == "" {
+		defaultCharset = DefaultCharset
+	}
+	mediaType = DefaultContentType
+	if v := header.Get("Content-Type"); v != "" {
+		if t, params := parseMediaType(v); t != "" {
+			mediaType = t
+			charset = strings.ToLower(strings.TrimSpace(params["charset"]))
+		}
+	}
+	if charset == "" && strings.HasPrefix(mediaType, "text/") {
+		charset = strings.ToLower(defaultCharset)
+	}
+	return
+}
+
+// parseMediaType is like mime.ParseMediaType, but tolerates malformed and repeated parameters.
+// The first value of a repeated parameter is used, eg. the first boundary. An empty media
+// type is returned if the value can't be parsed
+func parseMediaType(v string) (string, map[string]string) {
+	if t, params, err := mime.ParseMediaType(v); err == nil {
+		return t, params
+	}
+	fields := splitParams(v)
+	t := strings.ToLower(strings.TrimSpace(fields[0]))
+	if i := strings.IndexByte(t, '/'); i < 1 || i == len(t)-1 || strings.ContainsAny(t, " \t\"") {
+		return "", nil
+	}
+	params := make(map[string]string)
+	for _, param := range fields[1:] {
+		i := strings.IndexByte(param, '=')
+		if i < 1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(param[:i]))
+		if _, ok := params[key]; !ok {
+			params[key] = unquoteParam(strings.TrimSpace(param[i+1:]))
+		}
+	}
+	return t, params
+}
+
+// unquoteParam removes the quotes and escapes of a quoted parameter value
+func unquoteParam(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	v = v[1 : len(v)-1]
+	if strings.IndexByte(v, '\\') < 0 {
+		return v
+	}
+	b := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			i++
+		}
+		b = append(b, v[i])
+	}
+	return string(b)
+}
+
+// MaxPartDepth is how deep multiparts can be nested when no other limit is given.
+// Walking a message nested deeper stops with ErrPartDepthExceeded
+const MaxPartDepth = 10
+
+// PartLimits limits the MIME structure of a message, see WalkPartsLimited. Zero means no limit,
+// except for MaxDepth which is then MaxPartDepth
+type PartLimits struct {
+	// MaxDepth is how deep multiparts can be nested, the parts of the message are at depth 1
+	MaxDepth int
+	// MaxParts is how many parts there can be in total, multiparts included
+	MaxParts int
+	// DefaultCharset is the charset of text without one, in the parts and their filenames.
+	// Empty means DefaultCharset
+	DefaultCharset string
+}
+
+var (
+	ErrPartDepthExceeded = errors.New("mime: parts nested too deep")
+	ErrPartCountExceeded = errors.New("mime: too many parts")
+)
+
+// Part is a leaf (non-multipart) part of a MIME message, see WalkParts
+type Part struct {
+	Header textproto.MIMEHeader
+	// ContentType and Charset are as returned by PartType
+	ContentType string
+	Charset     string
+	// Encoding is the Content-Transfer-Encoding of the part in lower case, "7bit" if it has none
+	Encoding string
+	// Filename is taken from the Content-Disposition, or the name parameter of the Content-Type
+	Filename string
+	// Attachment is true if the disposition is attachment, or the part has a filename
+	Attachment bool
+	// Body reads the content of the part, decoded from its Content-Transfer-Encoding
+	Body io.Reader
+}
+
+// DecodedReader returns a reader that decodes raw, the content of the part as it is in the
+// message, according to the part's Content-Transfer-Encoding. raw is only read from, so the
+// part can be scanned decoded while the message is kept as it was received.
+// 7bit, 8bit, binary and unknown encodings are read as they are
+func (p *Part) DecodedReader(raw io.Reader) io.Reader {
+	return newDecoder(p.Encoding, raw)
+}
+
+// WalkParts reads a message and calls fn with each of its leaf parts, in order.
+// A message that is not multipart is a single part. Walking stops when fn returns an error,
+// which is then returned. The parts are read as they are found, so fn should not keep
+// p.Body to read after it returns. Walking stops with ErrPartDepthExceeded at a part nested
+// deeper than MaxPartDepth, so that a caller checking the parts can't be bypassed by nesting
+func WalkParts(r io.Reader, fn func(p *Part) error) error {
+	return walkMessage(r, &partWalker{fn: fn})
+}
+
+// WalkPartsLimited is like WalkParts, but stops with ErrPartDepthExceeded or ErrPartCountExceeded
+// as soon as a part beyond the limits is found, without reading the rest of the message.
+// If limits.MaxDepth is zero, MaxPartDepth is the limit
+func WalkPartsLimited(r io.Reader, limits PartLimits, fn func(p *Part) error) error {
+	return walkMessage(r, &partWalker{fn: fn, limits: limits})
+}
+
+func walkMessage(r io.Reader, w *partWalker) error {
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	return w.walk(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+}
+
+// partWalker walks the parts of a message, counting them
+type partWalker struct {
+	fn     func(p *Part) error
+	limits PartLimits
+	parts  int
+}
+
+// maxDepth is how deep the parts can be nested
+func (w *partWalker) maxDepth() int {
+	if w.limits.MaxDepth > 0 {
+		return w.limits.MaxDepth
+	}
+	return MaxPartDepth
+}
+
+func (w *partWalker) walk(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	mediaType, charset := PartTypeCharset(header, w.limits.DefaultCharset)
+	if strings.HasPrefix(mediaType, "multipart/") {
+		_, params := parseMediaType(header.Get("Content-Type"))
+		if boundary := params["boundary"]; boundary != "" {
+			pr := newPartsReader(body, boundary)
+			for {
+				partHeader, partBody, err := pr.next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				w.parts++
+				if w.limits.MaxParts > 0 && w.parts > w.limits.MaxParts {
+					return ErrPartCountExceeded
+				}
+				if depth+1 > w.maxDepth() {
+					return ErrPartDepthExceeded
+				}
+				if err = w.walk(partHeader, partBody, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	p := &Part{
+		Header:      header,
+		ContentType: mediaType,
+		Charset:     charset,
+		Encoding:    transferEncoding(header),
+	}
+	p.Body = p.DecodedReader(body)
+	disposition := strings.ToLower(strings.TrimSpace(splitParams(header.Get("Content-Disposition"))[0]))
+	p.Filename = headerParam(header.Get("Content-Disposition"), "filename", w.limits.DefaultCharset)
+	if p.Filename == "" {
+		p.Filename = headerParam(header.Get("Content-Type"), "name", w.limits.DefaultCharset)
+	}
+	p.Attachment = disposition == "attachment" || p.Filename != ""
+	return w.fn(p)
+}
+
+// headerParam returns the decoded value of a parameter of a Content-Type or Content-Disposition
+// header value. RFC 2231 continuations and charsets (eg. filename*0*=iso-8859-1'fr'caf%E9) are
+// decoded, as are RFC 2047 encoded-words, which some clients use in quoted values.
+// Unencoded 8-bit text is converted from defaultCharset, see DecodeHeaderCharset
+func headerParam(value, name, defaultCharset string) string {
+	if _, params, err := mime.ParseMediaType(value); err == nil {
+		if v, ok := params[name]; ok {
+			decoded, _ := DecodeHeaderCharset(v, defaultCharset)
+			return decoded
+		}
+	}
+	// mime.ParseMediaType drops RFC 2231 values in charsets other than utf-8 and us-ascii,
+	// and fails on the whole value if any parameter is malformed
+	return rfc2231Param(value, name, defaultCharset)
+}
+
+// rfc2231Param finds the parameter in a header value and decodes it, joining its
+// continuations (name*0, name*1...) and converting it from its charset with DecodeText
+func rfc2231Param(value, name, defaultCharset string) string {
+	segments := make(map[int]string)
+	encoded := make(map[int]bool)
+	plain := ""
+	for _, param := range splitParams(value) {
+		i := strings.IndexByte(param, '=')
+		if i < 1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(param[:i]))
+		v := strings.TrimSpace(param[i+1:])
+		v = unquoteParam(v)
+		if key == name {
+			if plain == "" {
+				plain = v
+			}
+			continue
+		}
+		if !strings.HasPrefix(key, name+"*") {
+			continue
+		}
+		section := key[len(name)+1:]
+		isEncoded := strings.HasSuffix(section, "*") || section == ""
+		section = strings.TrimSuffix(section, "*")
+		n := 0
+		if section != "" {
+			var err error
+			if n, err = strconv.Atoi(section); err != nil || n < 0 || n > 100 {
+				continue
+			}
+		}
+		segments[n] = v
+		encoded[n] = isEncoded
+	}
+	if len(segments) == 0 {
+		decoded, _ := DecodeHeaderCharset(plain, defaultCharset)
+		return decoded
+	}
+	var raw []byte
+	charset := "us-ascii"
+	for n := 0; ; n++ {
+		v, ok := segments[n]
+		if !ok {
+			break
+		}
+		if encoded[n] {
+			if n == 0 {
+				// charset'language'value
+				if parts := strings.SplitN(v, "'", 3); len(parts) == 3 {
+					if parts[0] != "" {
+						charset = parts[0]
+					}
+					v = parts[2]
+				}
+			}
+			unescaped, err := percentDecode(v)
+			if err != nil {
+				decoded, _ := DecodeHeaderCharset(plain, defaultCharset)
+				return decoded
+			}
+			raw = append(raw, unescaped...)
+		} else {
+			raw = append(raw, v...)
+		}
+	}
+	decoded, err := DecodeText(charset, raw)
+	if err != nil {
+		return string(raw)
+	}
+	return decoded
+}
+
+// splitParams splits a header value on the semicolons that are not in a quoted string
+func splitParams(value string) []string {
+	var params []string
+	quoted, escaped := false, false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			params = append(params, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(params, value[start:])
+}
+
+// percentDecode decodes the %XX escapes of an RFC 2231 value
+func percentDecode(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return nil, fmt.Errorf("invalid escape in %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid escape in %q", s)
+		}
+		b = append(b, byte(c))
+		i += 2
+	}
+	return b, nil
+}
+
+// Attachment describes an attachment of a message, see Attachments
+type Attachment struct {
+	// Filename is the decoded file name, empty if the part has none
+	Filename string
+	// ContentType is the declared media type, eg. "application/pdf"
+	ContentType string
+	// Encoding is the Content-Transfer-Encoding
+	Encoding string
+	// Size is the size of the decoded content in bytes
+	Size int64
+}
+
+// Attachments reads a message and returns its attachments, the parts that have a filename or
+// an attachment disposition. The parts are decoded to find their size, without being kept in memory.
+// The attachments found before an error are returned with it
+func Attachments(r io.Reader, limits PartLimits) ([]Attachment, error) {
+	var attachments []Attachment
+	err := WalkPartsLimited(r, limits, func(p *Part) error {
+		if !p.Attachment {
+			return nil
+		}
+		size, err := io.Copy(ioutil.Discard, p.Body)
+		if err != nil {
+			return err
+		}
+		attachments = append(attachments, Attachment{
+			Filename:    p.Filename,
+			ContentType: p.ContentType,
+			Encoding:    p.Encoding,
+			Size:        size,
+		})
+		return nil
+	})
+	return attachments, err
+}
+
+// transferEncoding returns the Content-Transfer-Encoding of the header in lower case, "7bit" if none
+func transferEncoding(header textproto.MIMEHeader) string {
+	if cte := strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))); cte != "" {
+		return cte
+	}
+	return "7bit"
+}
+
+// NewPartReader returns a reader that decodes the body of a part according to the
+// Content-Transfer-Encoding in its header. 7bit, 8bit, binary and unknown encodings are read as they are
+func NewPartReader(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	return newDecoder(transferEncoding(header), body)
+}
+
+func newDecoder(encoding string, r io.Reader) io.Reader {
+	switch encoding {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// partsReader splits the body of a multipart entity into the raw content of its parts
+// (RFC 2046 5.1.1). Unlike mime/multipart, the parts are not decoded, so that the
+// Content-Transfer-Encoding of each part is known and the raw content can be read
+type partsReader struct {
+	r *bufio.Reader
+	// dash is "--" followed by the boundary
+	dash    []byte
+	started bool
+	// done is set after the close delimiter
+	done    bool
+	current *partBody
+}
+
+func newPartsReader(r io.Reader, boundary string) *partsReader {
+	return &partsReader{
+		r:    bufio.NewReader(r),
+		dash: []byte("--" + boundary),
+	}
+}
+
+const (
+	notDelimiter = iota
+	delimiter
+	closeDelimiter
+)
+
+// delimiterType returns whether the line is a delimiter, a close delimiter, or neither.
+// Delimiters may be followed by whitespace
+func (pr *partsReader) delimiterType(line []byte) int {
+	if !bytes.HasPrefix(line, pr.dash) {
+		return notDelimiter
+	}
+	rest := bytes.TrimRight(line[len(pr.dash):], " \t\r\n")
+	if len(rest) == 0 {
+		return delimiter
+	}
+	if string(rest) == "--" {
+		return closeDelimiter
+	}
+	return notDelimiter
+}
+
+// next returns the header and raw body of the next part, io.EOF after the last one
+func (pr *partsReader) next() (textproto.MIMEHeader, io.Reader, error) {
+	if pr.current != nil {
+		// the rest of the previous part
+		if _, err := io.Copy(ioutil.Discard, pr.current); err != nil {
+			return nil, nil, err
+		}
+		pr.current = nil
+	} else if !pr.started {
+		if err := pr.skipPreamble(); err != nil {
+			return nil, nil, err
+		}
+	}
+	pr.started = true
+	if pr.done {
+		return nil, nil, io.EOF
+	}
+	header, err := textproto.NewReader(pr.r).ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	pr.current = &partBody{pr: pr, lineStart: true}
+	return header, pr.current, nil
+}
+
+// skipPreamble reads up to the first delimiter
+func (pr *partsReader) skipPreamble() error {
+	lineStart := true
+	for {
+		line, err := pr.r.ReadSlice('\n')
+		if lineStart && err != bufio.ErrBufferFull {
+			switch pr.delimiterType(line) {
+			case delimiter:
+				return nil
+			case closeDelimiter:
+				pr.done = true
+				return nil
+			}
+		}
+		lineStart = err != bufio.ErrBufferFull
+		if err == io.EOF {
+			// no parts
+			pr.done = true
+			return nil
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// partBody reads the raw content of a part, up to the next delimiter. The line break before
+// the delimiter is part of the delimiter, not the content
+type partBody struct {
+	pr *partsReader
+	// buf is content read but not returned yet
+	buf []byte
+	// eol is the line break of the last line, held back until it's known not to be
+	// followed by a delimiter
+	eol       []byte
+	lineStart bool
+	err       error
+}
+
+func (b *partBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.readLine()
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *partBody) readLine() {
+	line, err := b.pr.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// a long line, it can't be a delimiter
+		b.buf = append(append(b.buf[:0], b.eol...), line...)
+		b.eol = b.eol[:0]
+		b.lineStart = false
+		return
+	}
+	if b.lineStart {
+		if t := b.pr.delimiterType(line); t != notDelimiter {
+			b.pr.done = t == closeDelimiter
+			b.err = io.EOF
+			return
+		}
+	}
+	content := line
+	if bytes.HasSuffix(content, []byte("\r\n")) {
+		content = content[:len(content)-2]
+	} else if bytes.HasSuffix(content, []byte("\n")) {
+		content = content[:len(content)-1]
+	}
+	b.buf = append(append(b.buf[:0], b.eol...), content...)
+	b.eol = append(b.eol[:0], line[len(content):]...)
+	b.lineStart = true
+	if err != nil {
+		b.buf = append(b.buf, b.eol...)
+		b.eol = b.eol[:0]
+		if err == io.EOF {
+			// the close delimiter is missing, the end of the data ends the last part
+			b.pr.done = true
+		}
+		b.err = err
+	}
+}
+
+// NewTextReader returns a reader that converts text in the given charset to UTF-8.
+// An empty charset means DefaultCharset. Charsets other than utf-8, us-ascii, iso-8859-1 and
+// windows-1252 need Dec.CharsetReader, set by importing the mail/encoding or mail/iconv package
+func NewTextReader(charset string, r io.Reader) (io.Reader, error) {
+	if charset == "" {
+		charset = DefaultCharset
+	}
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return r, nil
+	case "iso-8859-1", "latin1", "l1":
+		return &singleByteReader{r: bufio.NewReader(r)}, nil
+	case "windows-1252", "cp1252":
+		return &singleByteReader{r: bufio.NewReader(r), table: &windows1252}, nil
+	}
+	if Dec.CharsetReader != nil {
+		return Dec.CharsetReader(charset, r)
+	}
+	return nil, fmt.Errorf("unhandled charset %q", charset)
+}
+
+// DecodeText converts the text in the given charset to a UTF-8 string, see NewTextReader
+func DecodeText(charset string, text []byte) (string, error) {
+	r, err := NewTextReader(charset, bytes.NewReader(text))
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+// singleByteReader decodes a single byte charset to UTF-8.
+// Bytes are mapped to the code points of the same value (iso-8859-1) unless in table
+type singleByteReader struct {
+	r     *bufio.Reader
+	table *[32]rune // code points for 0x80 - 0x9f
+	buf   []byte
+}
+
+func (s *singleByteReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if len(s.buf) > 0 {
+			c := copy(p[n:], s.buf)
+			n += c
+			s.buf = s.buf[c:]
+			continue
+		}
+		b, err := s.r.ReadByte()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		if b < utf8.RuneSelf {
+			p[n] = b
+			n++
+			continue
+		}
+		r := rune(b)
+		if s.table != nil && b < 0xa0 {
+			r = s.table[b-0x80]
+		}
+		var enc [utf8.UTFMax]byte
+		s.buf = append(s.buf[:0], enc[:utf8.EncodeRune(enc[:], r)]...)
+	}
+	return n, nil
+}
+
+var windows1252 = [32]rune{
+	'€', '�', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '�', 'Ž', '�',
+	'�', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '�', 'ž', 'Ÿ',
+}
@@ -0,0 +1,374 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestPartType(t *testing.T) {
+	defer func(c string) { DefaultCharset = c }(DefaultCharset)
+	DefaultCharset = "windows-1252"
+
+	tests := []struct {
+		header    textproto.MIMEHeader
+		mediaType string
+		charset   string
+	}{
+		{textproto.MIMEHeader{}, "text/plain", "windows-1252"},
+		{textproto.MIMEHeader{"Content-Type": {"text/html"}}, "text/html", "windows-1252"},
+		{textproto.MIMEHeader{"Content-Type": {`text/plain; charset="UTF-8"`}}, "text/plain", "utf-8"},
+		{textproto.MIMEHeader{"Content-Type": {"image/png"}}, "image/png", ""},
+		{textproto.MIMEHeader{"Content-Type": {"text/plain; charset"}}, "text/plain", "windows-1252"},
+	}
+	for _, test := range tests {
+		mediaType, charset := PartType(test.header)
+		if mediaType != test.mediaType || charset != test.charset {
+			t.Error("for", test.header, "expecting", test.mediaType, test.charset, "got", mediaType, charset)
+		}
+	}
+	if _, charset := PartTypeCharset(textproto.MIMEHeader{}, "ISO-8859-1"); charset != "iso-8859-1" {
+		t.Error("expecting the charset given, got", charset)
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	defer func(c string) { DefaultCharset = c }(DefaultCharset)
+	// "café – “quoted” €5" in windows-1252, from a part that declared no charset
+	part := []byte("caf\xe9 \x96 \x93quoted\x94 \x805")
+	DefaultCharset = "windows-1252"
+	_, charset := PartType(textproto.MIMEHeader{})
+	text, err := DecodeText(charset, part)
+	if err != nil {
+		t.Error(err)
+	}
+	if text != "café – “quoted” €5" {
+		t.Error("unexpected windows-1252 decoding:", text)
+	}
+	text, err = DecodeText("iso-8859-1", []byte("caf\xe9"))
+	if err != nil || text != "café" {
+		t.Error("unexpected iso-8859-1 decoding:", text, err)
+	}
+	if _, err = DecodeText("x-unknown", part); err == nil {
+		t.Error("expecting an error for an unknown charset")
+	}
+}
+
+func TestWalkParts(t *testing.T) {
+	msg := "Subject: test\n" +
+		"Content-Type: multipart/mixed; boundary=outer\n\n" +
+		"--outer\n" +
+		"Content-Type: multipart/alternative; boundary=inner\n\n" +
+		"--inner\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\n" +
+		"Content-Transfer-Encoding: quoted-printable\n\n" +
+		"caf=E9\n" +
+		"--inner\n" +
+		"Content-Type: text/html\n\n" +
+		"<p>hi</p>\n" +
+		"--inner--\n" +
+		"--outer\n" +
+		"Content-Type: application/pdf; name=\"=?utf-8?q?r=C3=A9sum=C3=A9.pdf?=\"\n" +
+		"Content-Transfer-Encoding: base64\n\n" +
+		"JVBERi0=\n" +
+		"--outer--\n"
+	var parts []string
+	err := WalkParts(strings.NewReader(msg), func(p *Part) error {
+		b, err := ioutil.ReadAll(p.Body)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, p.ContentType+"|"+p.Charset+"|"+p.Filename+"|"+string(b))
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	expect := []string{
+		"text/plain|iso-8859-1||caf\xe9",
+		"text/html|us-ascii||<p>hi</p>",
+		"application/pdf||résumé.pdf|%PDF-",
+	}
+	if len(parts) != len(expect) {
+		t.Fatal("expecting", len(expect), "parts, got", parts)
+	}
+	for i := range expect {
+		if strings.TrimSpace(parts[i]) != expect[i] {
+			t.Errorf("part %d, expecting %q got %q", i, expect[i], parts[i])
+		}
+	}
+}
+
+func TestDecodedReader(t *testing.T) {
+	binary := make([]byte, 3000)
+	for i := range binary {
+		binary[i] = byte(i * 7)
+	}
+	encoded := base64.StdEncoding.EncodeToString(binary)
+	var lines []string
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	lines = append(lines, encoded)
+	text := "a = b, soft line breaks and caf\xe9 " + strings.Repeat("x", 5000) + "\r\n--not-the-boundary\r\n"
+	var qp bytes.Buffer
+	w := quotedprintable.NewWriter(&qp)
+	_, _ = w.Write([]byte(text))
+	_ = w.Close()
+	rawText := qp.String()
+	rawAttachment := strings.Join(lines, "\r\n") + "\r\n"
+	msg := "Subject: test\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"preamble\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: Quoted-Printable\r\n\r\n" +
+		rawText + "\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=data.bin\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		rawAttachment + "\r\n" +
+		"--b--\r\n" +
+		"epilogue\r\n"
+	var encodings []string
+	var decoded [][]byte
+	err := WalkParts(strings.NewReader(msg), func(p *Part) error {
+		b, err := ioutil.ReadAll(p.Body)
+		encodings = append(encodings, p.Encoding)
+		decoded = append(decoded, b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || encodings[0] != "quoted-printable" || encodings[1] != "base64" {
+		t.Fatal("expecting a quoted-printable and a base64 part, got", encodings)
+	}
+	if string(decoded[0]) != text {
+		t.Errorf("the text part was not decoded to its original bytes, got %q", decoded[0])
+	}
+	if !bytes.Equal(decoded[1], binary) {
+		t.Error("the attachment was not decoded to its original bytes")
+	}
+
+	// the raw content is left as it is
+	p := &Part{Encoding: "base64"}
+	raw := strings.NewReader(rawAttachment)
+	if b, err := ioutil.ReadAll(p.DecodedReader(raw)); err != nil || !bytes.Equal(b, binary) {
+		t.Error("expecting the attachment to be decoded, got", err)
+	}
+	p = &Part{Encoding: "7bit"}
+	if b, _ := ioutil.ReadAll(p.DecodedReader(strings.NewReader(rawText))); string(b) != rawText {
+		t.Error("expecting 7bit content to be read as it is")
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	msg := "Subject: test\n" +
+		"Content-Type: multipart/mixed; boundary=b\n\n" +
+		"--b\n" +
+		"Content-Type: text/plain\n\n" +
+		"not an attachment\n" +
+		"--b\n" +
+		"Content-Type: application/pdf\n" +
+		"Content-Disposition: attachment;\n" +
+		" filename*0*=utf-8''%E2%82%AC%20budget%20;\n" +
+		" filename*1=\"for 2019\";\n" +
+		" filename*2*=%C3%A9t%C3%A9.pdf\n" +
+		"Content-Transfer-Encoding: base64\n\n" +
+		"JVBERi0=\n" +
+		"--b\n" +
+		"Content-Type: text/plain; name*=iso-8859-1'fr'caf%E9.txt\n\n" +
+		"caf\xe9\n" +
+		"--b\n" +
+		"Content-Type: image/png\n" +
+		"Content-Disposition: inline; filename=\"my \\\"photo\\\"; 1.png\"\n\n" +
+		"png\n" +
+		"--b\n" +
+		"Content-Type: application/octet-stream\n" +
+		"Content-Disposition: attachment\n\n" +
+		"data\n" +
+		"--b--\n"
+	attachments, err := Attachments(strings.NewReader(msg), PartLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Attachment{
+		{Filename: "€ budget for 2019été.pdf", ContentType: "application/pdf", Encoding: "base64", Size: 5},
+		{Filename: "café.txt", ContentType: "text/plain", Encoding: "7bit", Size: 4},
+		{Filename: "my \"photo\"; 1.png", ContentType: "image/png", Encoding: "7bit", Size: 3},
+		{Filename: "", ContentType: "application/octet-stream", Encoding: "7bit", Size: 4},
+	}
+	if len(attachments) != len(expect) {
+		t.Fatal("expecting", len(expect), "attachments, got", attachments)
+	}
+	for i := range expect {
+		if attachments[i] != expect[i] {
+			t.Errorf("attachment %d, expecting %+v got %+v", i, expect[i], attachments[i])
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// nestedMessage returns a message with multiparts nested depth levels deep
+func nestedMessage(depth int) string {
+	var b bytes.Buffer
+	b.WriteString("Subject: nested\nContent-Type: multipart/mixed; boundary=b0\n\n")
+	for i := 1; i <= depth; i++ {
+		fmt.Fprintf(&b, "--b%d\nContent-Type: multipart/mixed; boundary=b%d\n\n", i-1, i)
+	}
+	fmt.Fprintf(&b, "--b%d\nContent-Type: text/plain\n\nhello\n--b%d--\n", depth, depth)
+	for i := depth - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "--b%d--\n", i)
+	}
+	return b.String()
+}
+
+func TestWalkPartsLimited(t *testing.T) {
+	walk := func(msg string, limits PartLimits) (int, int, error) {
+		r := &countingReader{r: strings.NewReader(msg)}
+		parts := 0
+		err := WalkPartsLimited(r, limits, func(p *Part) error {
+			parts++
+			return nil
+		})
+		return parts, r.n, err
+	}
+
+	msg := nestedMessage(50)
+	if parts, _, err := walk(msg, PartLimits{MaxDepth: 60}); err != nil || parts != 1 {
+		t.Fatal("expecting the nested part to be found within the limit, got", parts, err)
+	}
+	if parts, _, err := walk(msg, PartLimits{MaxDepth: 20}); err != ErrPartDepthExceeded || parts != 0 {
+		t.Error("expecting", ErrPartDepthExceeded, "got", parts, err)
+	}
+	// without a limit, MaxPartDepth applies
+	if parts, _, err := walk(msg, PartLimits{}); err != ErrPartDepthExceeded || parts != 0 {
+		t.Error("expecting", ErrPartDepthExceeded, "got", parts, err)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("Subject: parts\nContent-Type: multipart/mixed; boundary=b\n\n")
+	for i := 0; i < 5000; i++ {
+		b.WriteString("--b\n\nx\n")
+	}
+	b.WriteString("--b--\n")
+	msg = b.String()
+	if parts, _, err := walk(msg, PartLimits{MaxParts: 10000}); err != nil || parts != 5000 {
+		t.Fatal("expecting 5000 parts within the limit, got", parts, err)
+	}
+	parts, read, err := walk(msg, PartLimits{MaxParts: 100})
+	if err != ErrPartCountExceeded || parts != 100 {
+		t.Error("expecting", ErrPartCountExceeded, "after 100 parts, got", parts, err)
+	}
+	if read >= len(msg)/2 {
+		t.Errorf("expecting the walk to stop early, read %d of %d bytes", read, len(msg))
+	}
+}
+
+func TestWalkPartsBoundaries(t *testing.T) {
+	walk := func(msg string) ([]string, error) {
+		var parts []string
+		err := WalkParts(strings.NewReader(msg), func(p *Part) error {
+			b, err := ioutil.ReadAll(p.Body)
+			parts = append(parts, string(b))
+			return err
+		})
+		return parts, err
+	}
+	for _, test := range []struct {
+		name   string
+		msg    string
+		expect []string
+	}{
+		{
+			"missing close delimiter",
+			"Content-Type: multipart/mixed; boundary=b\n\n" +
+				"--b\n\nfirst\n" +
+				"--b\n\nsecond\nlast line\n",
+			[]string{"first", "second\nlast line\n"},
+		},
+		{
+			"missing nested close delimiter",
+			"Content-Type: multipart/mixed; boundary=outer\n\n" +
+				"--outer\nContent-Type: multipart/alternative; boundary=inner\n\n" +
+				"--inner\n\ninner part\n" +
+				"--outer\n\nouter part\n" +
+				"--outer--\n",
+			[]string{"inner part", "outer part"},
+		},
+		{
+			"quoted special characters",
+			"Content-Type: multipart/mixed; boundary=\"=_Part:1/(x)?+,. 'q'\"\r\n\r\n" +
+				"--=_Part:1/(x)?+,. 'q'\r\n\r\n" +
+				"--=_Part:1/(x)?+,. 'q'X is not a delimiter\r\n" +
+				"nor is this --=_Part:1/(x)?+,. 'q'\r\n" +
+				"--=_Part:1/(x)?+,. 'q'--\r\n",
+			[]string{"--=_Part:1/(x)?+,. 'q'X is not a delimiter\r\nnor is this --=_Part:1/(x)?+,. 'q'"},
+		},
+		{
+			"repeated boundary",
+			"Content-Type: multipart/mixed; boundary=first; boundary=second\n\n" +
+				"--first\n\none\n--second\n" +
+				"--first--\n",
+			[]string{"one\n--second"},
+		},
+		{
+			"trailing whitespace",
+			"Content-Type: multipart/mixed; boundary=b\n\n" +
+				"--b \t\n\none\n" +
+				"--b\t\n\ntwo\n" +
+				"--b-- \n" +
+				"--b\n\nepilogue\n",
+			[]string{"one", "two"},
+		},
+		{
+			"no delimiters",
+			"Content-Type: multipart/mixed; boundary=b\n\njust a preamble\n",
+			nil,
+		},
+	} {
+		parts, err := walk(test.msg)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(parts) != len(test.expect) {
+			t.Errorf("%s: expecting %q, got %q", test.name, test.expect, parts)
+			continue
+		}
+		for i := range parts {
+			if parts[i] != test.expect[i] {
+				t.Errorf("%s: part %d, expecting %q got %q", test.name, i, test.expect[i], parts[i])
+			}
+		}
+	}
+
+	// the first boundary is used for the media type too
+	mediaType, params := parseMediaType("multipart/mixed; boundary=a; boundary=b; charset=\"x\\\\y\"")
+	if mediaType != "multipart/mixed" || params["boundary"] != "a" || params["charset"] != "x\\y" {
+		t.Error("unexpected media type", mediaType, params)
+	}
+	if mediaType, _ = parseMediaType("not a media type; boundary=a"); mediaType != "" {
+		t.Error("expecting an invalid media type to be empty, got", mediaType)
+	}
+}
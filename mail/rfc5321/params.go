@@ -0,0 +1,43 @@
+package rfc5321
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MinMTPriority and MaxMTPriority are the bounds of the MT-PRIORITY parameter, RFC 6710
+	MinMTPriority = -9
+	MaxMTPriority = 9
+)
+
+// GetParam returns the value of the esmtp-param with the keyword key from params, ignoring case.
+// ok is false when the parameter is not present
+func GetParam(params [][]string, key string) (value string, ok bool) {
+	for _, param := range params {
+		if len(param) == 2 && strings.EqualFold(param[0], key) {
+			return param[1], true
+		}
+	}
+	return "", false
+}
+
+// MTPriority returns the value of the MT-PRIORITY parameter, RFC 6710.
+// ok is false if the parameter was not given. An error is returned if the
+// value is not an integer between MinMTPriority and MaxMTPriority
+func MTPriority(params [][]string) (priority int, ok bool, err error) {
+	value, ok := GetParam(params, "MT-PRIORITY")
+	if !ok {
+		return 0, false, nil
+	}
+	// mt-priority-value = [ "+" / "-" ] 1*DIGIT
+	priority, err = strconv.Atoi(value)
+	if err != nil {
+		return 0, true, errors.New("MT-PRIORITY is not an integer")
+	}
+	if priority < MinMTPriority || priority > MaxMTPriority {
+		return 0, true, errors.New("MT-PRIORITY out of range")
+	}
+	return priority, true, nil
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"net"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -31,7 +32,12 @@ type Parser struct {
 	Domain     string
 	pos        int
 	NullPath   bool
-	ch         byte
+	// Body is the value of the BODY parameter given to MailFrom, in upper case:
+	// 7BIT, 8BITMIME (RFC 6152) or BINARYMIME (RFC 3030). Empty if not given
+	Body string
+	// Size is the value of the SIZE parameter given to MailFrom (RFC 1870), 0 if not given
+	Size int64
+	ch   byte
 }
 
 func NewParser(buf []byte) *Parser {
@@ -81,6 +87,8 @@ func (s *Parser) reversePath() (err error) {
 	}
 	if i := bytes.Index(s.buf[s.pos+1:], []byte{'<', '>'}); i == 0 {
 		s.NullPath = true
+		// position at '<' so that the closing '>' is next
+		s.next()
 		return nil
 	}
 	if err = s.path(); err != nil {
@@ -95,6 +103,8 @@ func (s *Parser) forwardPath() (err error) {
 	}
 	if i := bytes.Index(bytes.ToLower(s.buf[s.pos+1:]), []byte(postmasterPath)); i == 0 {
 		s.LocalPart = postmasterLocalPart
+		// position before the closing '>'
+		s.pos += len(postmasterPath) - 1
 		return nil
 	}
 	if err = s.path(); err != nil {
@@ -105,7 +115,10 @@ func (s *Parser) forwardPath() (err error) {
 
 //MailFrom accepts the following syntax: Reverse-path [SP Mail-parameters] CRLF
 func (s *Parser) MailFrom(input []byte) (err error) {
-	s.set(input)
+	// some clients send trailing whitespace, it's not an extra token
+	s.set(bytes.TrimRight(input, " \t"))
+	s.Body = ""
+	s.Size = 0
 	if err := s.reversePath(); err != nil {
 		return err
 	}
@@ -119,6 +132,23 @@ func (s *Parser) MailFrom(input []byte) (err error) {
 		} else if len(tup) > 0 {
 			s.PathParams = tup
 		}
+		for _, param := range s.PathParams {
+			if strings.EqualFold(param[0], "BODY") {
+				switch body := strings.ToUpper(param[1]); body {
+				case "7BIT", "8BITMIME", "BINARYMIME":
+					s.Body = body
+				default:
+					return errors.New("invalid BODY value [" + param[1] + "]")
+				}
+			} else if strings.EqualFold(param[0], "SIZE") {
+				if s.Size, err = parseSize(param[1]); err != nil {
+					return err
+				}
+			}
+		}
+	} else if s.pos < len(s.buf) {
+		// anything else after the path, such as a second address, is a syntax error
+		return errors.New("unexpected characters after path")
 	}
 	return nil
 }
@@ -129,7 +159,7 @@ const postmasterLocalPart = "Postmaster"
 //RcptTo accepts the following syntax: ( "<Postmaster@" Domain ">" / "<Postmaster>" /
 //                  Forward-path ) [SP Rcpt-parameters] CRLF
 func (s *Parser) RcptTo(input []byte) (err error) {
-	s.set(input)
+	s.set(bytes.TrimRight(input, " \t"))
 	if err := s.forwardPath(); err != nil {
 		return err
 	}
@@ -141,6 +171,9 @@ func (s *Parser) RcptTo(input []byte) (err error) {
 		} else if len(tup) > 0 {
 			s.PathParams = tup
 		}
+	} else if s.pos < len(s.buf) {
+		// anything else after the path, such as a second address, is a syntax error
+		return errors.New("unexpected characters after path")
 	}
 	return nil
 }
@@ -155,6 +188,9 @@ func (s *Parser) parameters() ([][]string, error) {
 			params = append(params, result)
 		}
 		if p := s.next(); p != ' ' {
+			if s.pos < len(s.buf) {
+				return params, errors.New("unexpected character after parameter")
+			}
 			return params, nil
 		}
 	}
@@ -206,6 +242,8 @@ func (s *Parser) param() (result []string, err error) {
 
 				}
 				key = s.accept.String()
+				// keyword without a value, leave c for the caller
+				s.pos--
 				return result, nil
 			}
 			s.accept.WriteByte(c)
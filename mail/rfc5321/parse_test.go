@@ -60,7 +60,33 @@ func TestParseRcptTo(t *testing.T) {
 		t.Error("error not expected ", err)
 	}
 
-	//
+	// only one recipient per command is allowed
+	for _, in := range []string{
+		"<a@example.com> <b@example.com>",
+		"<a@example.com>,<b@example.com>",
+		"<a@example.com> NOTIFY=NEVER <b@example.com>",
+		"<a@example.com>junk",
+		"<Postmaster> <b@example.com>",
+	} {
+		if err = s.RcptTo([]byte(in)); err == nil {
+			t.Error("error expected for", in)
+		}
+	}
+
+	// trailing whitespace is tolerated
+	for _, in := range []string{"<a@example.com> ", "<a@example.com> NOTIFY=NEVER \t", "<Postmaster> "} {
+		if err = s.RcptTo([]byte(in)); err != nil {
+			t.Errorf("error not expected for %q: %s", in, err)
+		}
+	}
+
+	// keyword without a value, followed by another parameter
+	err = s.RcptTo([]byte("<a@example.com> FOO NOTIFY=NEVER"))
+	if err != nil {
+		t.Error("error not expected ", err)
+	} else if len(s.PathParams) != 2 || s.PathParams[1][0] != "NOTIFY" {
+		t.Error("expecting 2 params, got", s.PathParams)
+	}
 }
 
 func TestParseForwardPath(t *testing.T) {
@@ -581,3 +607,74 @@ func TestParse(t *testing.T) {
 	}
 
 }
+
+func TestParseBody(t *testing.T) {
+	s := NewParser([]byte(""))
+	for in, expect := range map[string]string{
+		"<test@example.com>":                 "",
+		"<test@example.com> BODY=8BITMIME":   "8BITMIME",
+		"<test@example.com> body=binarymime": "BINARYMIME",
+		"<> BODY=7BIT SIZE=100":              "7BIT",
+	} {
+		if err := s.MailFrom([]byte(in)); err != nil {
+			t.Error(in, "not expected parse error", err)
+		} else if s.Body != expect {
+			t.Error(in, "expecting BODY", expect, "got", s.Body)
+		}
+	}
+	if err := s.MailFrom([]byte("<test@example.com> BODY=16BITMIME")); err == nil {
+		t.Error("expecting an invalid BODY value to be rejected")
+	}
+	if err := s.MailFrom([]byte("<test@example.com>")); err != nil || s.Body != "" {
+		t.Error("expecting BODY to be reset by the next MAIL command, got", s.Body, err)
+	}
+}
+
+func TestParseMailFromTrailingSpace(t *testing.T) {
+	s := NewParser([]byte(""))
+	for _, in := range []string{"<> ", "<>  ", "<test@example.com>\t", "<test@example.com> BODY=8BITMIME "} {
+		if err := s.MailFrom([]byte(in)); err != nil {
+			t.Errorf("error not expected for %q: %s", in, err)
+		}
+	}
+	if s.Body != "8BITMIME" {
+		t.Error("expecting BODY=8BITMIME, got", s.Body)
+	}
+	if err := s.MailFrom([]byte("<test@example.com> <other@example.com> ")); err == nil {
+		t.Error("expecting a second address to be rejected")
+	}
+}
+
+func TestParseSizeParam(t *testing.T) {
+	s := NewParser([]byte(""))
+	if err := s.MailFrom([]byte("<test@example.com> SIZE=2000 BODY=8BITMIME")); err != nil || s.Size != 2000 {
+		t.Error("expecting the size to be 2000, got", s.Size, err)
+	}
+	if err := s.MailFrom([]byte("<test@example.com>")); err != nil || s.Size != 0 {
+		t.Error("expecting SIZE to be reset by the next MAIL command, got", s.Size, err)
+	}
+	if err := s.MailFrom([]byte("<test@example.com> SIZE=2k")); err == nil {
+		t.Error("expecting an invalid SIZE value to be rejected")
+	}
+}
+
+func TestMTPriority(t *testing.T) {
+	s := NewParser([]byte(""))
+	if err := s.MailFrom([]byte("<test@example.com> BODY=8BITMIME MT-PRIORITY=-3")); err != nil {
+		t.Error("error not expected", err)
+	}
+	if p, ok, err := MTPriority(s.PathParams); err != nil || !ok || p != -3 {
+		t.Error("expecting priority -3, got", p, ok, err)
+	}
+	if p, ok, err := MTPriority([][]string{{"mt-priority", "+9"}}); err != nil || !ok || p != 9 {
+		t.Error("expecting priority 9, got", p, ok, err)
+	}
+	if _, ok, err := MTPriority([][]string{{"BODY", "7BIT"}}); err != nil || ok {
+		t.Error("expecting no priority", ok, err)
+	}
+	for _, v := range []string{"10", "-10", "high", "1.5", ""} {
+		if _, _, err := MTPriority([][]string{{"MT-PRIORITY", v}}); err == nil {
+			t.Error("expecting an error for MT-PRIORITY", v)
+		}
+	}
+}
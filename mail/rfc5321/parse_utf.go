@@ -7,7 +7,9 @@ import (
 	"errors"
 	"net"
 	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // Parse Email Addresses according to https://tools.ietf.org/html/rfc5321
@@ -20,7 +22,13 @@ type ParserUTF struct {
 	Domain     string
 	pos        int
 	NullPath   bool
-	ch         rune
+	// SMTPUTF8 is set by MailFrom when the SMTPUTF8 parameter was given (RFC 6531).
+	// Addresses with UTF-8 characters are only accepted when it's true. It stays set
+	// for the RcptTo calls of the transaction, until the next MailFrom
+	SMTPUTF8 bool
+	// Size is the value of the SIZE parameter given to MailFrom (RFC 1870), 0 if not given
+	Size int64
+	ch   rune
 }
 
 func NewParserUTF(buf []rune) *ParserUTF {
@@ -70,6 +78,8 @@ func (s *ParserUTF) reversePath() (err error) {
 	}
 	if i := bytes.Index([]byte(string(s.buf[s.pos+1:])), []byte{'<', '>'}); i == 0 {
 		s.NullPath = true
+		// position at '<' so that the closing '>' is next
+		s.next()
 		return nil
 	}
 	if err = s.path(); err != nil {
@@ -84,6 +94,8 @@ func (s *ParserUTF) forwardPath() (err error) {
 	}
 	if i := bytes.Index(bytes.ToLower([]byte(string(s.buf[s.pos+1:]))), []byte(postmasterPath)); i == 0 {
 		s.LocalPart = postmasterLocalPart
+		// position before the closing '>'
+		s.pos += len(postmasterPath) - 1
 		return nil
 	}
 	if err = s.path(); err != nil {
@@ -92,9 +104,48 @@ func (s *ParserUTF) forwardPath() (err error) {
 	return nil
 }
 
+// errUTF8NotAllowed is returned when an address has UTF-8 characters but SMTPUTF8 was not given
+var errUTF8NotAllowed = errors.New("UTF-8 address without SMTPUTF8")
+
+// hasUTF8 returns true if the parsed path has any non-ASCII characters
+func (s *ParserUTF) hasUTF8() bool {
+	for _, str := range append([]string{s.LocalPart, s.Domain}, s.ADL...) {
+		for i := 0; i < len(str); i++ {
+			if str[i] >= utf8.RuneSelf {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseSize parses the value of the SIZE parameter, size-value = 1*20DIGIT
+func parseSize(value string) (int64, error) {
+	if len(value) == 0 || len(value) > 20 {
+		return 0, errors.New("invalid SIZE value [" + value + "], expecting the size in bytes")
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return 0, errors.New("invalid SIZE value [" + value + "], expecting the size in bytes")
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.New("SIZE value [" + value + "] out of range")
+	}
+	return size, nil
+}
+
 //MailFrom accepts the following syntax: Reverse-path [SP Mail-parameters] CRLF
 func (s *ParserUTF) MailFrom(input []rune) (err error) {
 	s.set(input)
+	s.SMTPUTF8 = false
+	s.Size = 0
+	defer func() {
+		if err == nil && !s.SMTPUTF8 && s.hasUTF8() {
+			err = errUTF8NotAllowed
+		}
+	}()
 	if err := s.reversePath(); err != nil {
 		return err
 	}
@@ -108,6 +159,21 @@ func (s *ParserUTF) MailFrom(input []rune) (err error) {
 		} else if len(tup) > 0 {
 			s.PathParams = tup
 		}
+		for _, param := range s.PathParams {
+			if strings.EqualFold(param[0], "SMTPUTF8") {
+				if param[1] != "" {
+					return errors.New("SMTPUTF8 does not take a value")
+				}
+				s.SMTPUTF8 = true
+			} else if strings.EqualFold(param[0], "SIZE") {
+				if s.Size, err = parseSize(param[1]); err != nil {
+					return err
+				}
+			}
+		}
+	} else if s.pos < len(s.buf) {
+		// anything else after the path, such as a second address, is a syntax error
+		return errors.New("unexpected characters after path")
 	}
 	return nil
 }
@@ -116,6 +182,11 @@ func (s *ParserUTF) MailFrom(input []rune) (err error) {
 //                  Forward-path ) [SP Rcpt-parameters] CRLF
 func (s *ParserUTF) RcptTo(input []rune) (err error) {
 	s.set(input)
+	defer func() {
+		if err == nil && !s.SMTPUTF8 && s.hasUTF8() {
+			err = errUTF8NotAllowed
+		}
+	}()
 	if err := s.forwardPath(); err != nil {
 		return err
 	}
@@ -127,6 +198,9 @@ func (s *ParserUTF) RcptTo(input []rune) (err error) {
 		} else if len(tup) > 0 {
 			s.PathParams = tup
 		}
+	} else if s.pos < len(s.buf) {
+		// anything else after the path, such as a second address, is a syntax error
+		return errors.New("unexpected characters after path")
 	}
 	return nil
 }
@@ -141,6 +215,9 @@ func (s *ParserUTF) parameters() ([][]string, error) {
 			params = append(params, result)
 		}
 		if p := s.next(); p != ' ' {
+			if s.pos < len(s.buf) {
+				return params, errors.New("unexpected character after parameter")
+			}
 			return params, nil
 		}
 	}
@@ -192,6 +269,8 @@ func (s *ParserUTF) param() (result []string, err error) {
 
 				}
 				key = s.accept.String()
+				// keyword without a value, leave c for the caller
+				s.pos--
 				return result, nil
 			}
 			s.accept.WriteRune(c)
@@ -550,12 +629,14 @@ atext           =       ALPHA / DIGIT / ; Any character except controls,
                         "|" / "}" /
                         "~"
 
+atext           =/      UTF8-non-ascii  ; RFC 6531
+
 */
 
 func (s *ParserUTF) isAtext(c rune) bool {
 	if ('0' <= c && c <= '9') ||
 		('A' <= c && c <= 'z') ||
-		unicode.IsLetter(c) ||
+		(c >= utf8.RuneSelf && c != utf8.RuneError) ||
 		c == '!' || c == '#' ||
 		c == '$' || c == '%' ||
 		c == '&' || c == '\'' ||
@@ -60,7 +60,26 @@ func TestParseRcptToUnicode(t *testing.T) {
 		t.Error("error not expected ", err)
 	}
 
-	//
+	// only one recipient per command is allowed
+	for _, in := range []string{
+		"<a@example.com> <b@example.com>",
+		"<a@example.com>,<b@example.com>",
+		"<a@example.com> NOTIFY=NEVER <b@example.com>",
+		"<a@example.com>junk",
+		"<Postmaster> <b@example.com>",
+	} {
+		if err = s.RcptTo([]rune(in)); err == nil {
+			t.Error("error expected for", in)
+		}
+	}
+
+	// keyword without a value, followed by another parameter
+	err = s.RcptTo([]rune("<a@example.com> FOO NOTIFY=NEVER"))
+	if err != nil {
+		t.Error("error not expected ", err)
+	} else if len(s.PathParams) != 2 || s.PathParams[1][0] != "NOTIFY" {
+		t.Error("expecting 2 params, got", s.PathParams)
+	}
 }
 
 func TestParseForwardPathUnicode(t *testing.T) {
@@ -587,3 +606,103 @@ func TestParseUnicode(t *testing.T) {
 	}
 
 }
+
+func TestParseUTF8Atext(t *testing.T) {
+	var s ParserUTF
+	s.SMTPUTF8 = true
+	for _, in := range []struct {
+		path, local, domain string
+	}{
+		{"<用户@例子.广告>", "用户", "例子.广告"},
+		{"<Pelé@example.com>", "Pelé", "example.com"},
+		{"<Pele\u0301@example.com>", "Pele\u0301", "example.com"}, // combining accent
+		{"<δοκιμή.χρήστης@example.com>", "δοκιμή.χρήστης", "example.com"},
+		{"<☕@example.com>", "☕", "example.com"},
+	} {
+		if err := s.RcptTo([]rune(in.path)); err != nil {
+			t.Error("error not expected for", in.path, err)
+			continue
+		}
+		if s.LocalPart != in.local || s.Domain != in.domain {
+			t.Error("expecting", in.local, in.domain, "got", s.LocalPart, s.Domain)
+		}
+	}
+	if err := s.RcptTo([]rune("<a\ufffdb@example.com>")); err == nil {
+		t.Error("invalid utf-8 should not be accepted")
+	}
+
+	// the base parser stays ASCII only
+	var p Parser
+	for _, in := range []string{"<用户@example.com>", "<Pelé@example.com>"} {
+		if err := p.RcptTo([]byte(in)); err == nil {
+			t.Error("error expected from the ASCII parser for", in)
+		}
+	}
+}
+
+func TestParseSMTPUTF8(t *testing.T) {
+	var s ParserUTF
+	if err := s.MailFrom([]rune("<user@例え.jp> SMTPUTF8")); err != nil {
+		t.Error("error not expected ", err)
+	}
+	if !s.SMTPUTF8 || s.Domain != "例え.jp" {
+		t.Error("expecting SMTPUTF8 and the domain 例え.jp, got", s.SMTPUTF8, s.Domain)
+	}
+	// the recipients of the transaction may use UTF-8 too
+	if err := s.RcptTo([]rune("<用户@例子.广告>")); err != nil {
+		t.Error("error not expected ", err)
+	}
+
+	if err := s.MailFrom([]rune("<用户@example.com> BODY=8BITMIME smtputf8")); err != nil {
+		t.Error("error not expected ", err)
+	}
+	if !s.SMTPUTF8 || len(s.PathParams) != 2 || s.PathParams[0][0] != "BODY" || s.PathParams[0][1] != "8BITMIME" {
+		t.Error("expecting SMTPUTF8 and BODY=8BITMIME, got", s.SMTPUTF8, s.PathParams)
+	}
+
+	if err := s.MailFrom([]rune("<用户@example.com> BODY=8BITMIME")); err == nil {
+		t.Error("expecting an error for a UTF-8 address without SMTPUTF8")
+	}
+	if s.SMTPUTF8 {
+		t.Error("SMTPUTF8 should be cleared by the next MailFrom")
+	}
+	if err := s.RcptTo([]rune("<用户@例子.广告>")); err == nil {
+		t.Error("expecting an error for a UTF-8 recipient without SMTPUTF8")
+	}
+	if err := s.MailFrom([]rune("<user@example.com> SMTPUTF8=yes")); err == nil {
+		t.Error("expecting an error for SMTPUTF8 with a value")
+	}
+	if err := s.MailFrom([]rune("<user@example.com>")); err != nil || s.SMTPUTF8 {
+		t.Error("expecting an ASCII address to be accepted without SMTPUTF8", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	var s ParserUTF
+	if err := s.MailFrom([]rune("<user@example.com> SIZE=2000 BODY=8BITMIME")); err != nil {
+		t.Error("error not expected ", err)
+	} else if s.Size != 2000 {
+		t.Error("expecting the size to be 2000, got", s.Size)
+	}
+	if err := s.MailFrom([]rune("<user@example.com>")); err != nil {
+		t.Error("error not expected ", err)
+	} else if s.Size != 0 {
+		t.Error("expecting no size, got", s.Size)
+	}
+	if err := s.MailFrom([]rune("<user@example.com> SIZE=0")); err != nil {
+		t.Error("SIZE=0 should be accepted", err)
+	}
+	for _, in := range []string{
+		"<user@example.com> SIZE=abc",
+		"<user@example.com> SIZE=-1",
+		"<user@example.com> SIZE=+1",
+		"<user@example.com> SIZE",
+		"<user@example.com> SIZE=99999999999999999999",
+	} {
+		if err := s.MailFrom([]rune(in)); err == nil {
+			t.Error("error expected for", in)
+		} else if !strings.Contains(err.Error(), "SIZE") {
+			t.Error("expecting the error to mention SIZE, got", err)
+		}
+	}
+}
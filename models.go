@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"time"
 )
 
 var (
@@ -62,3 +63,53 @@ func newSMTPBufferedReader(rd io.Reader) *smtpBufferedReader {
 	s := &smtpBufferedReader{bufio.NewReader(alr), alr}
 	return s
 }
+
+// sizeLimitedReader returns MessageSizeExceeded as soon as more than max bytes are read,
+// so that an oversized message is not read to the end
+type sizeLimitedReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func newSizeLimitedReader(r io.Reader, max int64) *sizeLimitedReader {
+	return &sizeLimitedReader{r: r, max: max}
+}
+
+func (slr *sizeLimitedReader) Read(p []byte) (n int, err error) {
+	if slr.n > slr.max {
+		return 0, MessageSizeExceeded
+	}
+	// read no more than one byte past the limit
+	if left := slr.max - slr.n + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err = slr.r.Read(p)
+	slr.n += int64(n)
+	if slr.n > slr.max {
+		err = MessageSizeExceeded
+	}
+	return
+}
+
+// dataDeadlineReader moves the read deadline of the client's connection before each read,
+// giving idle time after the previous read, but no later than end when not zero
+type dataDeadlineReader struct {
+	r      io.Reader
+	client *client
+	idle   time.Duration
+	end    time.Time
+}
+
+func (ddr *dataDeadlineReader) Read(p []byte) (n int, err error) {
+	deadline := ddr.end
+	if ddr.idle > 0 {
+		if next := time.Now().Add(ddr.idle); deadline.IsZero() || next.Before(deadline) {
+			deadline = next
+		}
+	}
+	if err = ddr.client.setReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	return ddr.r.Read(p)
+}
@@ -23,6 +23,9 @@ type Poolable interface {
 	// get a unique id
 	getID() uint64
 	kill()
+	// drain is called when shutting down with a grace period, returns true if the client is
+	// in a transaction that it may finish
+	drain() bool
 }
 
 // Pool holds Clients.
@@ -36,6 +39,8 @@ type Pool struct {
 	isShuttingDownFlg atomic.Value
 	poolGuard         sync.Mutex
 	ShutdownChan      chan int
+	// graceTimer stops the clients still busy at the end of the grace period
+	graceTimer *time.Timer
 }
 
 type lentClients struct {
@@ -92,10 +97,37 @@ func (p *Pool) ShutdownState() {
 
 }
 
+// ShutdownDrain is ShutdownState with a grace period: the idle clients time out right away,
+// while those in a transaction have until the end of the grace period to finish it
+func (p *Pool) ShutdownDrain(grace time.Duration) {
+	p.poolGuard.Lock()
+	defer p.poolGuard.Unlock()
+	p.isShuttingDownFlg.Store(true)
+	p.ShutdownChan <- 1
+
+	p.activeClients.mapAll(func(p Poolable) {
+		if !p.drain() {
+			if err := p.setTimeout(0); err != nil {
+				p.kill()
+			}
+		}
+	})
+	p.graceTimer = time.AfterFunc(grace, func() {
+		p.activeClients.mapAll(func(p Poolable) {
+			p.kill()
+			_ = p.setTimeout(0)
+		})
+	})
+}
+
 func (p *Pool) ShutdownWait() {
 	p.poolGuard.Lock() // ensure no other thread is in the borrowing now
 	defer p.poolGuard.Unlock()
 	p.activeClients.wg.Wait() // wait for clients to finish
+	if p.graceTimer != nil {
+		p.graceTimer.Stop()
+		p.graceTimer = nil
+	}
 	if len(p.ShutdownChan) > 0 {
 		// drain
 		<-p.ShutdownChan
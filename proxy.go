@@ -0,0 +1,245 @@
+package guerrilla
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+// The PROXY protocol lets a load balancer such as HAProxy or an AWS NLB pass on the address
+// of the client it accepted the connection from. It sends a header before any SMTP data,
+// either in text (v1) or binary (v2) form.
+// See https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// proxyV1MaxLength is the longest v1 header, including the CRLF
+	proxyV1MaxLength = 107
+	proxyV2CmdLocal  = 0x0
+	proxyV2CmdProxy  = 0x1
+	proxyV2FamTCP4   = 0x11
+	proxyV2FamTCP6   = 0x21
+)
+
+var errProxyHeader = errors.New("invalid or missing PROXY protocol header")
+
+// proxyConn is a connection that reports the client address given by the PROXY header
+type proxyConn struct {
+	net.Conn
+	// r holds any data read past the header
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads the PROXY header at the start of conn. The returned connection reports
+// the source address from the header. For health checks (v2 LOCAL, v1 UNKNOWN), it reports
+// the address of the balancer
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	var remote net.Addr
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		remote, err = readProxyV2(r)
+	case bytes.HasPrefix(start, proxyV1Prefix):
+		remote, err = readProxyV1(r)
+	default:
+		err = errProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// readProxyV1 parses "PROXY TCP4|TCP6 <src ip> <dst ip> <src port> <dst port>\r\n"
+// or "PROXY UNKNOWN ...\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errProxyHeader
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	if _, err = strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary header: the signature, version and command, address family,
+// length of the rest, then the addresses followed by optional TLVs, which are skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errProxyHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	cmd, fam := header[12]&0xf, header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errProxyHeader
+	}
+	switch cmd {
+	case proxyV2CmdLocal:
+		return nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, errProxyHeader
+	}
+	switch fam {
+	case proxyV2FamTCP4:
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case proxyV2FamTCP6:
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// other protocols, such as UDP or unix sockets, are not relayed to SMTP
+	return nil, errProxyHeader
+}
+
+// proxyListener reads the PROXY header of each accepted connection before handing it to
+// the server. Connections without a valid header are closed. The headers are read in their
+// own goroutines so that a slow client does not hold up the others
+type proxyListener struct {
+	net.Listener
+	timeout time.Duration
+	log     log.Logger
+	conns   chan net.Conn
+	errs    chan error
+	// done is closed when serve returns
+	done chan struct{}
+	// closed is closed by Close, so that serve does not wait for Accept to take an error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyListener(l net.Listener, timeout time.Duration, logger log.Logger) *proxyListener {
+	p := &proxyListener{
+		Listener: l,
+		timeout:  timeout,
+		log:      logger,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go p.serve()
+	return p
+}
+
+func (p *proxyListener) serve() {
+	defer close(p.done)
+	for {
+		conn, err := p.Listener.Accept()
+		if err != nil {
+			select {
+			case p.errs <- err:
+			case <-p.closed:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go func() {
+			pc, err := readProxyHeader(conn, p.timeout)
+			if err != nil {
+				p.log.WithError(err).Warnf("[%s] rejected connection", getRemoteAddr(conn))
+				_ = conn.Close()
+				return
+			}
+			select {
+			case p.conns <- pc:
+			case <-p.closed:
+				_ = conn.Close()
+			case <-p.done:
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+// Close closes the listener, connections waiting to be accepted are closed
+func (p *proxyListener) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return p.Listener.Close()
+}
+
+// Accept returns the next connection with a valid PROXY header
+func (p *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case err := <-p.errs:
+		return nil, err
+	case <-p.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: p.Addr(), Err: errors.New("listener closed")}
+	}
+}
@@ -0,0 +1,150 @@
+package guerrilla
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// proxyV2Header builds a binary header for cmd and family, with the addresses and a TLV
+func proxyV2Header(cmd, fam byte, src, dst net.IP, srcPort, dstPort uint16) string {
+	body := append(append([]byte{}, src...), dst...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+	body = append(body, ports...)
+	// a PP2_TYPE_AUTHORITY TLV, to be skipped
+	body = append(body, 0x02, 0x00, 0x04, 'm', 'x', '.', 'a')
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(body)))
+	return string(append(header, body...))
+}
+
+// proxyTestListener returns a listener expecting PROXY headers on a random local port
+func proxyTestListener(t *testing.T) *proxyListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	return newProxyListener(l, time.Second, mainlog)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	l := proxyTestListener(t)
+	defer func() {
+		_ = l.Close()
+	}()
+	for header, expect := range map[string]string{
+		"PROXY TCP4 203.0.113.7 192.0.2.1 56324 25\r\n":   "203.0.113.7",
+		"PROXY TCP6 2001:db8::7 2001:db8::1 56324 25\r\n": "2001:db8::7",
+		"PROXY UNKNOWN\r\n":                     "127.0.0.1",
+		"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n": "127.0.0.1",
+		proxyV2Header(proxyV2CmdProxy, proxyV2FamTCP4, net.IPv4(198, 51, 100, 9).To4(), net.IPv4(192, 0, 2, 1).To4(), 1234, 25): "198.51.100.9",
+		proxyV2Header(proxyV2CmdProxy, proxyV2FamTCP6, net.ParseIP("2001:db8::9"), net.ParseIP("2001:db8::1"), 1234, 25):        "2001:db8::9",
+		proxyV2Header(proxyV2CmdLocal, 0, nil, nil, 0, 0):                                                                       "127.0.0.1",
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the data after the header must reach the server
+		if _, err := io.WriteString(conn, header+"EHLO test\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewClient(accepted, 1, nil, mail.NewPool(1))
+		if client.RemoteIP != expect {
+			t.Errorf("header %q: expecting the remote IP %s, got %s", header, expect, client.RemoteIP)
+		}
+		if line, _ := bufio.NewReader(accepted).ReadString('\n'); line != "EHLO test\r\n" {
+			t.Errorf("header %q: expecting EHLO to follow, got %q", header, line)
+		}
+		_ = accepted.Close()
+		_ = conn.Close()
+	}
+}
+
+func TestProxyProtocolRejected(t *testing.T) {
+	l := proxyTestListener(t)
+	defer func() {
+		_ = l.Close()
+	}()
+	for _, header := range []string{
+		"EHLO test\r\n",
+		"PROXY TCP4 203.0.113.7\r\n",
+		"PROXY TCP4 2001:db8::7 192.0.2.1 56324 25\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 99999 25\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 56324 25\n",
+		"PROXY " + strings.Repeat("x", proxyV1MaxLength) + "\r\n",
+		proxyV2Header(0x2, proxyV2FamTCP4, net.IPv4(198, 51, 100, 9).To4(), net.IPv4(192, 0, 2, 1).To4(), 1234, 25),
+		proxyV2Header(proxyV2CmdProxy, proxyV2FamTCP6, net.IPv4(198, 51, 100, 9).To4(), net.IPv4(192, 0, 2, 1).To4(), 1234, 25),
+		// truncated
+		proxyV2Header(proxyV2CmdProxy, proxyV2FamTCP4, net.IPv4(198, 51, 100, 9).To4(), net.IPv4(192, 0, 2, 1).To4(), 1234, 25)[:20],
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(conn, header); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("header %q: expecting the connection to be closed, got %v", header, err)
+		}
+		_ = conn.Close()
+	}
+	// none of the connections were passed on
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, _ = io.WriteString(conn, "PROXY TCP4 203.0.113.7 192.0.2.1 56324 25\r\n")
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := getRemoteAddr(accepted); ip != "203.0.113.7" {
+		t.Error("expecting the valid connection to be accepted, got", ip)
+	}
+	_ = accepted.Close()
+
+	// the listener reports being closed, so that the server stops accepting
+	_ = l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Error("expecting an error after close")
+	} else if ne, ok := err.(net.Error); !ok || ne.Temporary() {
+		t.Error("expecting a permanent error after close, got", err)
+	}
+}
+
+// serve returns after Close, even when nothing calls Accept to take the error
+func TestProxyListenerClose(t *testing.T) {
+	l := proxyTestListener(t)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-l.done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expecting serve to return after Close")
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Error("expecting Accept to fail after Close")
+	}
+}
@@ -0,0 +1,113 @@
+package guerrilla
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimitStore keeps the token buckets of ServerConfig.MessagesPerMinutePerIP. The default
+// keeps them in memory, for each server. Set one on the Daemon to share the buckets, eg. between
+// the instances of a cluster
+type RateLimitStore interface {
+	// Take removes a token from the bucket of key, which holds up to perMinute tokens and is
+	// refilled at perMinute tokens a minute. It returns false if the bucket is empty.
+	// An error means that the bucket could not be checked, the message is then allowed
+	Take(key string, perMinute int) (bool, error)
+}
+
+// rateLimitHolder keeps the type stored in the server's atomic.Value the same,
+// whatever the type of the RateLimitStore
+type rateLimitHolder struct {
+	RateLimitStore
+}
+
+// tokenBucket holds the tokens left at the time of the last take
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// memoryRateLimitStore is a RateLimitStore keeping the buckets in a map
+type memoryRateLimitStore struct {
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	// now returns the current time, can be replaced in tests
+	now        func() time.Time
+	sync.Mutex // guard access to the map
+}
+
+// NewMemoryRateLimitStore returns a RateLimitStore keeping the buckets in memory
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+func (m *memoryRateLimitStore) Take(key string, perMinute int) (bool, error) {
+	if perMinute <= 0 {
+		return true, nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	now := m.now()
+	capacity := float64(perMinute)
+	if now.Sub(m.lastSweep) >= time.Minute {
+		// buckets refilled for over a minute are full, as good as new ones
+		for k, b := range m.buckets {
+			if now.Sub(b.last) >= time.Minute {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		m.buckets[key] = b
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Minutes() * capacity
+		if b.tokens > capacity {
+			b.tokens = capacity
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	return true, nil
+}
+
+// setRateLimitStore sets the RateLimitStore used for messages_per_minute_per_ip
+func (s *server) setRateLimitStore(store RateLimitStore) {
+	s.rateLimitStore.Store(rateLimitHolder{store})
+}
+
+// rateLimits gets the RateLimitStore used for messages_per_minute_per_ip
+func (s *server) rateLimits() RateLimitStore {
+	if h, ok := s.rateLimitStore.Load().(rateLimitHolder); ok {
+		return h.RateLimitStore
+	}
+	return nil
+}
+
+// allowMessage checks the message limits of the config before a new transaction. It returns
+// false when the client sent max_messages_per_connection messages already, or the bucket of its
+// IP address is empty
+func (s *server) allowMessage(client *client, sc *ServerConfig) bool {
+	if sc.MaxMessagesPerConnection > 0 && client.messages >= sc.MaxMessagesPerConnection {
+		return false
+	}
+	if sc.MessagesPerMinutePerIP > 0 {
+		if store := s.rateLimits(); store != nil {
+			allowed, err := store.Take(client.RemoteIP, sc.MessagesPerMinutePerIP)
+			if err != nil {
+				s.log().WithError(err).Warnf("could not check the rate limit of [%s]", client.RemoteIP)
+			} else if !allowed {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package guerrilla
+
+import (
+	"bufio"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	store := NewMemoryRateLimitStore().(*memoryRateLimitStore)
+	store.now = func() time.Time { return now }
+	take := func(key string) bool {
+		allowed, err := store.Take(key, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return allowed
+	}
+	// a burst of 6 is allowed
+	for i := 0; i < 6; i++ {
+		if !take("192.0.2.1") {
+			t.Fatal("expecting message", i+1, "of the burst to be allowed")
+		}
+	}
+	if take("192.0.2.1") {
+		t.Error("expecting the empty bucket to refuse the 7th message")
+	}
+	if !take("192.0.2.2") {
+		t.Error("expecting each key to have its own bucket")
+	}
+	// 6 per minute, a token every 10 seconds
+	now = now.Add(time.Second * 5)
+	if take("192.0.2.1") {
+		t.Error("expecting no token after 5 seconds")
+	}
+	now = now.Add(time.Second * 5)
+	if !take("192.0.2.1") {
+		t.Error("expecting a token after 10 seconds")
+	}
+	if take("192.0.2.1") {
+		t.Error("expecting a single token after 10 seconds")
+	}
+	// refilled up to the burst, old buckets are swept
+	now = now.Add(time.Hour)
+	for i := 0; i < 6; i++ {
+		if !take("192.0.2.1") {
+			t.Fatal("expecting the bucket to be full again, message", i+1)
+		}
+	}
+	if take("192.0.2.1") {
+		t.Error("expecting the refill to be limited to the burst")
+	}
+	if len(store.buckets) != 1 {
+		t.Error("expecting the unused bucket to be swept, got", len(store.buckets), "buckets")
+	}
+}
+
+// rateLimitSession sends MAIL and RSET over a connection, returning the replies to MAIL
+func rateLimitSession(t *testing.T, sc *ServerConfig, store RateLimitStore, messages int) []string {
+	mainlog, err := log.GetLogger(sc.LogFile, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, server := getMockServerConn(sc, t)
+	if store != nil {
+		server.setRateLimitStore(store)
+	}
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	_, _ = r.ReadLine()
+	if err := w.PrintfLine("HELO test.test.com"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = r.ReadLine()
+	var replies []string
+	for i := 0; i < messages; i++ {
+		if err := w.PrintfLine("MAIL FROM:<test@example.com>"); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, line)
+		if strings.HasPrefix(line, "421") {
+			// closed by the server
+			_ = conn.Client.Close()
+			wg.Wait()
+			return replies
+		}
+		if err := w.PrintfLine("RSET"); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = r.ReadLine()
+	}
+	_ = w.PrintfLine("QUIT")
+	_, _ = r.ReadLine()
+	_ = conn.Client.Close()
+	wg.Wait()
+	return replies
+}
+
+func TestMaxMessagesPerConnection(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	sc.MaxMessagesPerConnection = 3
+	replies := rateLimitSession(t, sc, nil, 4)
+	if len(replies) != 4 {
+		t.Fatal("expecting 4 replies, got", replies)
+	}
+	for i := 0; i < 3; i++ {
+		if !strings.HasPrefix(replies[i], "250") {
+			t.Error("expecting message", i+1, "to be accepted, got", replies[i])
+		}
+	}
+	if expect := "451 4.7.0 Error: rate limit exceeded"; replies[3] != expect {
+		t.Error("expecting", expect, "got", replies[3])
+	}
+
+	// the connection is dropped after the 2nd refusal
+	sc.RateLimitDisconnectAfter = 2
+	replies = rateLimitSession(t, sc, nil, 6)
+	if len(replies) != 5 {
+		t.Fatal("expecting the connection to be closed after 5 replies, got", replies)
+	}
+	if expect := "421 4.7.0 Error: rate limit exceeded, closing connection"; replies[4] != expect {
+		t.Error("expecting", expect, "got", replies[4])
+	}
+}
+
+func TestMessagesPerMinutePerIP(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	now := time.Unix(1500000000, 0)
+	store := NewMemoryRateLimitStore().(*memoryRateLimitStore)
+	store.now = func() time.Time { return now }
+	sc := getMockServerConfig()
+	sc.MessagesPerMinutePerIP = 2
+	// the bucket is shared by the connections from the same IP
+	replies := append(rateLimitSession(t, sc, store, 1), rateLimitSession(t, sc, store, 2)...)
+	for i, expect := range []string{"250", "250", "451"} {
+		if !strings.HasPrefix(replies[i], expect) {
+			t.Error("expecting message", i+1, "to get", expect, "got", replies[i])
+		}
+	}
+	now = now.Add(time.Second * 30)
+	replies = rateLimitSession(t, sc, store, 2)
+	for i, expect := range []string{"250", "451"} {
+		if !strings.HasPrefix(replies[i], expect) {
+			t.Error("expecting message", i+1, "after the refill to get", expect, "got", replies[i])
+		}
+	}
+}
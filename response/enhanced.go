@@ -2,6 +2,7 @@ package response
 
 import (
 	"fmt"
+	"strings"
 )
 
 const (
@@ -123,8 +124,26 @@ type Responses struct {
 	// The 500's
 	FailLineTooLong              *Response
 	FailNestedMailCmd            *Response
+	FailNoHeloMailCmd            *Response
+	FailInvalidMTPriority        *Response
+	FailNoSenderRcptCmd          *Response
 	FailNoSenderDataCmd          *Response
 	FailNoRecipientsDataCmd      *Response
+	FailInvalidBdatCmd           *Response
+	FailDataAfterBdatCmd         *Response
+	FailBinaryMIMEDataCmd        *Response
+	FailXClientCmd               *Response
+	FailXClientNotAllowed        *Response
+	FailXClientInTransaction     *Response
+	FailNoHeloAuthCmd            *Response
+	FailAlreadyAuthenticated     *Response
+	FailAuthInTransaction        *Response
+	FailUnrecognizedAuthType     *Response
+	FailAuthCancelled            *Response
+	FailAuthDecode               *Response
+	FailAuthInvalid              *Response
+	FailMaxAuthAttempts          *Response
+	FailEncryptionRequired       *Response
 	FailUnrecognizedCmd          *Response
 	FailMaxUnrecognizedCmd       *Response
 	FailReadLimitExceededDataCmd *Response
@@ -138,11 +157,36 @@ type Responses struct {
 	FailBackendTransaction       *Response
 	FailBackendTimeout           *Response
 	FailRcptCmd                  *Response
+	FailInvalidDateHeader        *Response
+	FailUndeclared8Bit           *Response
+	FailDANEMismatch             *Response
+	FailRcptMailboxDisabled      *Response
+	FailHeaderLimitExceeded      *Response
+	FailReputation               *Response
+	FailBannedAttachment         *Response
+	FailSPF                      *Response
+	FailDNSBL                    *Response
+	FailVirusDetected            *Response
+	FailSpam                     *Response
+	FailDMARC                    *Response
+	FailBlockedAttachment        *Response
+	FailMIMELimitExceeded        *Response
+	FailAttachmentsUnchecked     *Response
 
 	// The 400's
-	ErrorTooManyRecipients *Response
-	ErrorRelayDenied       *Response
-	ErrorShutdown          *Response
+	ErrorTooManyRecipients   *Response
+	ErrorRelayDenied         *Response
+	ErrorShutdown            *Response
+	ErrorRcptMailboxFull     *Response
+	ErrorRcptStorage         *Response
+	ErrorReputation          *Response
+	ErrorAuthTemporary       *Response
+	ErrorDataTimeout         *Response
+	ErrorGreylisted          *Response
+	ErrorTooManyConnections  *Response
+	ErrorRateLimited         *Response
+	ErrorRateLimitDisconnect *Response
+	ErrorDependencyDown      *Response
 
 	// The 200's
 	SuccessMailCmd       *Response
@@ -152,7 +196,10 @@ type Responses struct {
 	SuccessNoopCmd       *Response
 	SuccessQuitCmd       *Response
 	SuccessDataCmd       *Response
+	SuccessBdatCmd       *Response
+	SuccessAuthCmd       *Response
 	SuccessStartTLSCmd   *Response
+	SuccessXClientCmd    *Response
 	SuccessMessageQueued *Response
 }
 
@@ -175,6 +222,20 @@ func init() {
 		Comment:      "Error: nested MAIL command",
 	}
 
+	Canned.FailNoHeloMailCmd = &Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    503,
+		Class:        ClassPermanentFailure,
+		Comment:      "Send HELO/EHLO first",
+	}
+
+	Canned.FailInvalidMTPriority = &Response{
+		EnhancedCode: InvalidCommandArguments,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Invalid MT-PRIORITY value",
+	}
+
 	Canned.SuccessMailCmd = &Response{
 		EnhancedCode: OtherAddressStatus,
 		Class:        ClassSuccess,
@@ -220,6 +281,13 @@ func init() {
 		Comment:      "Bye",
 	}
 
+	Canned.FailNoSenderRcptCmd = &Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    503,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: need MAIL command",
+	}
+
 	Canned.FailNoSenderDataCmd = &Response{
 		EnhancedCode: InvalidCommand,
 		BasicCode:    503,
@@ -239,6 +307,132 @@ func init() {
 		Comment:   "354 Enter message, ending with '.' on a line by itself",
 	}
 
+	Canned.FailInvalidBdatCmd = &Response{
+		EnhancedCode: InvalidCommandArguments,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Syntax: BDAT <size> [LAST]",
+	}
+
+	Canned.FailDataAfterBdatCmd = &Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    503,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: DATA not allowed after BDAT",
+	}
+
+	Canned.FailBinaryMIMEDataCmd = &Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    503,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: BODY=BINARYMIME requires BDAT",
+	}
+
+	Canned.FailXClientCmd = &Response{
+		EnhancedCode: InvalidCommandArguments,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Bad XCLIENT attribute value:",
+	}
+
+	Canned.FailXClientNotAllowed = &Response{
+		EnhancedCode: OtherOrUndefinedSecurityStatus,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: insufficient authorization",
+	}
+
+	Canned.FailXClientInTransaction = &Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    503,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: XCLIENT not allowed during a mail transaction",
+	}
+
+	Canned.FailNoHeloAuthCmd = &Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    503,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: send HELO/EHLO first",
+	}
+
+	Canned.FailAlreadyAuthenticated = &Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    503,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: already authenticated",
+	}
+
+	Canned.FailAuthInTransaction = &Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    503,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: AUTH not allowed during a mail transaction",
+	}
+
+	Canned.FailUnrecognizedAuthType = &Response{
+		EnhancedCode: InvalidCommandArguments,
+		BasicCode:    504,
+		Class:        ClassPermanentFailure,
+		Comment:      "Unrecognized authentication type",
+	}
+
+	Canned.FailAuthCancelled = &Response{
+		EnhancedCode: SyntaxError,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Authentication cancelled",
+	}
+
+	Canned.FailAuthDecode = &Response{
+		EnhancedCode: SyntaxError,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Cannot decode the authentication response",
+	}
+
+	Canned.FailAuthInvalid = &Response{
+		EnhancedCode: AuthenticationCredentialsInvalid,
+		BasicCode:    535,
+		Class:        ClassPermanentFailure,
+		Comment:      "Authentication credentials invalid",
+	}
+
+	Canned.FailMaxAuthAttempts = &Response{
+		EnhancedCode: OtherOrUndefinedSecurityStatus,
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Too many failed authentication attempts",
+	}
+
+	Canned.FailEncryptionRequired = &Response{
+		EnhancedCode: EncryptionRequiredForAuthentication,
+		BasicCode:    538,
+		Class:        ClassPermanentFailure,
+		Comment:      "Encryption required for requested authentication mechanism",
+	}
+
+	Canned.ErrorAuthTemporary = &Response{
+		EnhancedCode: OtherOrUndefinedSecurityStatus,
+		BasicCode:    454,
+		Class:        ClassTransientFailure,
+		Comment:      "Temporary authentication failure",
+	}
+
+	Canned.SuccessAuthCmd = &Response{
+		EnhancedCode: OtherOrUndefinedSecurityStatus,
+		BasicCode:    235,
+		Class:        ClassSuccess,
+		Comment:      "Authentication successful",
+	}
+
+	Canned.SuccessBdatCmd = &Response{
+		EnhancedCode: OtherStatus,
+		BasicCode:    250,
+		Class:        ClassSuccess,
+		Comment:      "Chunk received",
+	}
+
 	Canned.SuccessStartTLSCmd = &Response{
 		EnhancedCode: OtherStatus,
 		BasicCode:    220,
@@ -246,6 +440,11 @@ func init() {
 		Comment:      "Ready to start TLS",
 	}
 
+	Canned.SuccessXClientCmd = &Response{
+		EnhancedCode: OtherAddressStatus,
+		Class:        ClassSuccess,
+	}
+
 	Canned.FailUnrecognizedCmd = &Response{
 		EnhancedCode: InvalidCommand,
 		BasicCode:    554,
@@ -260,6 +459,13 @@ func init() {
 		Comment:      "Too many unrecognized commands",
 	}
 
+	Canned.ErrorDataTimeout = &Response{
+		EnhancedCode: BadConnection,
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: timeout exceeded",
+	}
+
 	Canned.ErrorShutdown = &Response{
 		EnhancedCode: OtherOrUndefinedMailSystemStatus,
 		BasicCode:    421,
@@ -275,10 +481,10 @@ func init() {
 	}
 
 	Canned.FailMessageSizeExceeded = &Response{
-		EnhancedCode: SyntaxError,
-		BasicCode:    550,
+		EnhancedCode: MessageTooBigForSystem,
+		BasicCode:    552,
 		Class:        ClassPermanentFailure,
-		Comment:      "Error:",
+		Comment:      "Error: message size exceeds maximum",
 	}
 
 	Canned.FailReadErrorDataCmd = &Response{
@@ -351,6 +557,167 @@ func init() {
 		Comment:      "User unknown in local recipient table",
 	}
 
+	Canned.FailInvalidDateHeader = &Response{
+		EnhancedCode: OtherOrUndefinedMediaError,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: missing or invalid Date header",
+	}
+
+	Canned.FailUndeclared8Bit = &Response{
+		EnhancedCode: MediaNotSupported,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: 8-bit data sent without BODY=8BITMIME",
+	}
+
+	Canned.FailDANEMismatch = &Response{
+		EnhancedCode: CryptographicFailure,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: certificate does not match the TLSA records",
+	}
+
+	Canned.FailRcptMailboxDisabled = &Response{
+		EnhancedCode: MailboxDisabled,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Mailbox disabled",
+	}
+
+	Canned.FailHeaderLimitExceeded = &Response{
+		EnhancedCode: MessageLengthExceedsAdministrativeLimit,
+		BasicCode:    552,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: too many headers or header section too large",
+	}
+
+	Canned.FailReputation = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: sender reputation too low",
+	}
+
+	Canned.FailBannedAttachment = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: message contains a banned attachment",
+	}
+
+	Canned.FailSPF = &Response{
+		EnhancedCode: SPFValidationFailed,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: SPF check failed",
+	}
+
+	Canned.FailDNSBL = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: client host rejected:",
+	}
+
+	Canned.FailVirusDetected = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "virus detected:",
+	}
+
+	Canned.FailSpam = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: message rejected as spam, score",
+	}
+
+	Canned.FailDMARC = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: rejected by the DMARC policy of",
+	}
+
+	Canned.FailBlockedAttachment = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: attachment type not allowed:",
+	}
+
+	Canned.FailMIMELimitExceeded = &Response{
+		EnhancedCode: OtherOrUndefinedMediaError,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: MIME parts nested too deep or too many parts",
+	}
+
+	Canned.FailAttachmentsUnchecked = &Response{
+		EnhancedCode: OtherOrUndefinedMediaError,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: could not check the attachments",
+	}
+
+	Canned.ErrorRcptMailboxFull = &Response{
+		EnhancedCode: MailboxFull,
+		BasicCode:    452,
+		Class:        ClassTransientFailure,
+		Comment:      "Mailbox full",
+	}
+
+	Canned.ErrorRcptStorage = &Response{
+		EnhancedCode: OtherOrUndefinedMailSystemStatus,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Temporary problem, try again later",
+	}
+
+	Canned.ErrorReputation = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Sender throttled, try again later",
+	}
+
+	Canned.ErrorTooManyConnections = &Response{
+		EnhancedCode: OtherOrUndefinedSecurityStatus,
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: too many connections",
+	}
+
+	Canned.ErrorGreylisted = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Temporary rejection, try again later",
+	}
+
+	Canned.ErrorDependencyDown = &Response{
+		EnhancedCode: RoutingServerFailure,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Temporary failure, a dependency is unavailable",
+	}
+
+	Canned.ErrorRateLimited = &Response{
+		EnhancedCode: OtherOrUndefinedSecurityStatus,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: rate limit exceeded",
+	}
+
+	Canned.ErrorRateLimitDisconnect = &Response{
+		EnhancedCode: OtherOrUndefinedSecurityStatus,
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: rate limit exceeded, closing connection",
+	}
+
 }
 
 // DefaultMap contains defined default codes (RfC 3463)
@@ -395,6 +762,17 @@ const (
 	ConversionRequiredButNotSupported       = ".6.3"
 	ConversionWithLossPerformed             = ".6.4"
 	ConversionFailed                        = ".6.5"
+	OtherOrUndefinedSecurityStatus          = ".7.0"
+	DeliveryNotAuthorized                   = ".7.1"
+	MailingListExpansionProhibited          = ".7.2"
+	SecurityConversionRequired              = ".7.3"
+	SecurityFeaturesNotSupported            = ".7.4"
+	CryptographicFailure                    = ".7.5"
+	CryptographicAlgorithmNotSupported      = ".7.6"
+	MessageIntegrityFailure                 = ".7.7"
+	AuthenticationCredentialsInvalid        = ".7.8"
+	EncryptionRequiredForAuthentication     = ".7.11"
+	SPFValidationFailed                     = ".7.23"
 )
 
 var defaultTexts = struct {
@@ -475,3 +853,40 @@ func getBasicStatusCode(e EnhancedStatusCode) int {
 	// Fallback if code is not defined
 	return int(e.Class) * 100
 }
+
+// WithoutEnhancedCode removes the enhanced status code that follows the basic code of the reply,
+// eg. "250 2.1.0 OK" becomes "250 OK". Used when ENHANCEDSTATUSCODES is not advertised.
+// Replies without an enhanced code are returned as they are
+func WithoutEnhancedCode(reply string) string {
+	if len(reply) < 4 || (reply[3] != ' ' && reply[3] != '-') {
+		return reply
+	}
+	for i := 0; i < 3; i++ {
+		if reply[i] < '0' || reply[i] > '9' {
+			return reply
+		}
+	}
+	// class "." subject "." detail, RFC 3463
+	code := reply[4:]
+	if end := strings.IndexByte(code, ' '); end > -1 {
+		code = code[:end]
+	}
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 || len(parts[0]) != 1 || (parts[0] != "2" && parts[0] != "4" && parts[0] != "5") {
+		return reply
+	}
+	for _, part := range parts[1:] {
+		if len(part) == 0 || len(part) > 3 {
+			return reply
+		}
+		for i := 0; i < len(part); i++ {
+			if part[i] < '0' || part[i] > '9' {
+				return reply
+			}
+		}
+	}
+	if len(reply) == 4+len(code) {
+		return reply[:3]
+	}
+	return reply[:4] + reply[4+len(code)+1:]
+}
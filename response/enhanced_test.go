@@ -49,3 +49,24 @@ func TestBuildEnhancedResponseFromDefaultStatus(t *testing.T) {
 		t.Errorf("buildEnhancedResponseFromDefaultStatus failed. String \"%s\" not expected.", a)
 	}
 }
+
+func TestWithoutEnhancedCode(t *testing.T) {
+	for reply, expected := range map[string]string{
+		"250 2.1.0 OK":                       "250 OK",
+		"550 5.1.1 User unknown":             "550 User unknown",
+		"452 4.5.3 Too many recipients":      "452 Too many recipients",
+		"538 5.7.11 Encryption required":     "538 Encryption required",
+		"250-2.0.0 multi-line":               "250-multi-line",
+		"200 2.0.0":                          "200",
+		"354 Enter message":                  "354 Enter message",
+		"250 mail.example.com Hello":         "250 mail.example.com Hello",
+		"250 2.1 OK":                         "250 2.1 OK",
+		"250 3.1.0 not a class":              "250 3.1.0 not a class",
+		"220 ready 2.0.0 not after the code": "220 ready 2.0.0 not after the code",
+		"":                                   "",
+	} {
+		if got := WithoutEnhancedCode(reply); got != expected {
+			t.Errorf("WithoutEnhancedCode(%q) expected %q, got %q", reply, expected, got)
+		}
+	}
+}
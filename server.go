@@ -5,11 +5,14 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -56,7 +59,28 @@ type server struct {
 	logStore     atomic.Value
 	mainlogStore atomic.Value
 	backendStore atomic.Value
-	envelopePool *mail.Pool
+	// authenticatorStore stores the Authenticator used for AUTH, see setAuthenticator
+	authenticatorStore atomic.Value
+	// rateLimitStore stores the RateLimitStore used for messages_per_minute_per_ip
+	rateLimitStore atomic.Value
+	// shutdownGrace stores the grace period given to clients when shutting down, time.Duration
+	shutdownGrace atomic.Value
+	envelopePool  *mail.Pool
+	// ipConns counts the open connections of each remote IP, for max_connections_per_ip
+	ipConns ipConnCounts
+	// networksStore stores the *serverNetworks parsed from the config, see setConfig
+	networksStore atomic.Value
+}
+
+// serverNetworks are the network lists of the ServerConfig, parsed once when it's set
+type serverNetworks struct {
+	xclientTrusted        []*net.IPNet
+	connectionLimitExempt []*net.IPNet
+}
+
+type ipConnCounts struct {
+	counts     map[string]int
+	sync.Mutex // guard access to the map
 }
 
 type allowedHosts struct {
@@ -72,6 +96,7 @@ var (
 	cmdEHLO     command = []byte("EHLO")
 	cmdHELP     command = []byte("HELP")
 	cmdXCLIENT  command = []byte("XCLIENT")
+	cmdAUTH     command = []byte("AUTH")
 	cmdMAIL     command = []byte("MAIL FROM:")
 	cmdRCPT     command = []byte("RCPT TO:")
 	cmdRSET     command = []byte("RSET")
@@ -79,6 +104,7 @@ var (
 	cmdNOOP     command = []byte("NOOP")
 	cmdQUIT     command = []byte("QUIT")
 	cmdDATA     command = []byte("DATA")
+	cmdBDAT     command = []byte("BDAT")
 	cmdSTARTTLS command = []byte("STARTTLS")
 )
 
@@ -86,6 +112,20 @@ func (c command) match(in []byte) bool {
 	return bytes.Index(in, []byte(c)) == 0
 }
 
+// verbs are the commands counted in backends.MetricCommands, others are counted as "unknown"
+var verbs = []command{cmdHELO, cmdEHLO, cmdHELP, cmdXCLIENT, cmdAUTH, cmdMAIL, cmdRCPT,
+	cmdRSET, cmdVRFY, cmdNOOP, cmdQUIT, cmdDATA, cmdBDAT, cmdSTARTTLS}
+
+// commandVerb returns the verb of the upper-cased command line in, eg. "MAIL", or "unknown"
+func commandVerb(in []byte) string {
+	for _, c := range verbs {
+		if c.match(in) {
+			return strings.Fields(string(c))[0]
+		}
+	}
+	return "unknown"
+}
+
 // Creates and returns a new ready-to-run Server from a ServerConfig configuration
 func newServer(sc *ServerConfig, b backends.Backend, mainlog log.Logger) (*server, error) {
 	server := &server{
@@ -97,6 +137,7 @@ func newServer(sc *ServerConfig, b backends.Backend, mainlog log.Logger) (*serve
 	}
 	server.mainlogStore.Store(mainlog)
 	server.backendStore.Store(b)
+	server.setRateLimitStore(NewMemoryRateLimitStore())
 	if sc.LogFile == "" {
 		// none set, use the mainlog for the server log
 		server.logStore.Store(mainlog)
@@ -130,6 +171,17 @@ func (s *server) configureSSL() error {
 			ClientAuth:   tls.VerifyClientCertIfGiven,
 			ServerName:   sConfig.Hostname,
 		}
+		if len(sConfig.TLS.Certificates) > 0 {
+			certs := &sniCertificates{hosts: make(map[string]*tls.Certificate), fallback: &cert}
+			for _, c := range sConfig.TLS.Certificates {
+				hostCert, err := tls.LoadX509KeyPair(c.PublicKeyFile, c.PrivateKeyFile)
+				if err != nil {
+					return fmt.Errorf("error while loading the certificate for [%s]: %s", c.Host, err)
+				}
+				certs.hosts[strings.ToLower(c.Host)] = &hostCert
+			}
+			tlsConfig.GetCertificate = certs.getCertificate
+		}
 		if len(sConfig.TLS.Protocols) > 0 {
 			if min, ok := TLSProtocols[sConfig.TLS.Protocols[0]]; ok {
 				tlsConfig.MinVersion = min
@@ -140,6 +192,12 @@ func (s *server) configureSSL() error {
 				tlsConfig.MaxVersion = max
 			}
 		}
+		if min, ok := tlsVersion(sConfig.TLS.MinVersion); ok {
+			tlsConfig.MinVersion = min
+		}
+		if max, ok := tlsVersion(sConfig.TLS.MaxVersion); ok {
+			tlsConfig.MaxVersion = max
+		}
 		if len(sConfig.TLS.Ciphers) > 0 {
 			for _, val := range sConfig.TLS.Ciphers {
 				if c, ok := TLSCiphers[val]; ok {
@@ -170,6 +228,13 @@ func (s *server) configureSSL() error {
 				tlsConfig.ClientAuth = ca
 			}
 		}
+		if len(sConfig.TLS.ClientCAFile) > 0 {
+			pool, err := loadCertPool(sConfig.TLS.ClientCAFile)
+			if err != nil {
+				return fmt.Errorf("error while loading the client CA certificates: %s", err)
+			}
+			tlsConfig.ClientCAs = pool
+		}
 		tlsConfig.PreferServerCipherSuites = sConfig.TLS.PreferServerCipherSuites
 		tlsConfig.Rand = rand.Reader
 		s.tlsConfigStore.Store(tlsConfig)
@@ -177,6 +242,83 @@ func (s *server) configureSSL() error {
 	return nil
 }
 
+// sniCertificates selects the certificate to serve by the server name sent with SNI
+type sniCertificates struct {
+	hosts    map[string]*tls.Certificate // keyed by lower-case host, may have a *. wildcard
+	fallback *tls.Certificate            // served when no host matches, or without SNI
+}
+
+// getCertificate is used for tls.Config.GetCertificate
+func (sc *sniCertificates) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if name == "" {
+		return sc.fallback, nil
+	}
+	if cert, ok := sc.hosts[name]; ok {
+		return cert, nil
+	}
+	// try a wildcard in place of the first label
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := sc.hosts["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return sc.fallback, nil
+}
+
+// watchCertificates reloads the TLS configuration when the certificate files change on disk,
+// checking every interval until stop is closed. modTime is the modification time of the files
+// that are loaded. New connections get the new certificates, while the old ones are kept if
+// the new files cannot be loaded
+func (s *server) watchCertificates(modTime time.Time, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if latest := s.certificatesModTime(); latest != modTime {
+			modTime = latest
+			if err := s.configureSSL(); err != nil {
+				s.log().WithError(err).Errorf("Server [%s] failed to reload the changed certificates, keeping the old ones", s.listenInterface)
+			} else {
+				s.log().Infof("Server [%s] reloaded the changed certificates", s.listenInterface)
+			}
+		}
+	}
+}
+
+// certificatesModTime returns the latest modification time of the certificate and key files
+func (s *server) certificatesModTime() time.Time {
+	sc := s.configStore.Load().(ServerConfig)
+	files := []string{sc.TLS.PublicKeyFile, sc.TLS.PrivateKeyFile}
+	for _, c := range sc.TLS.Certificates {
+		files = append(files, c.PublicKeyFile, c.PrivateKeyFile)
+	}
+	var latest time.Time
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// loadCertPool reads the PEM encoded certificates of file into a pool
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in [%s]", file)
+	}
+	return pool, nil
+}
+
 // setBackend sets the backend to use for processing email envelopes
 func (s *server) setBackend(b backends.Backend) {
 	s.backendStore.Store(b)
@@ -199,9 +341,19 @@ func (s *server) setTimeout(seconds int) {
 
 // goroutine safe config store
 func (s *server) setConfig(sc *ServerConfig) {
+	// the lists were validated, see ServerConfig.Validate
+	networks := &serverNetworks{}
+	networks.xclientTrusted, _ = backends.ParseNetworks(sc.XClientTrusted)
+	networks.connectionLimitExempt, _ = backends.ParseNetworks(sc.ConnectionLimitExempt)
+	s.networksStore.Store(networks)
 	s.configStore.Store(*sc)
 }
 
+// goroutine safe
+func (s *server) networks() *serverNetworks {
+	return s.networksStore.Load().(*serverNetworks)
+}
+
 // goroutine safe
 func (s *server) isEnabled() bool {
 	sc := s.configStore.Load().(ServerConfig)
@@ -229,12 +381,21 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 	clientID = 0
 
 	listener, err := net.Listen("tcp", s.listenInterface)
-	s.listener = listener
 	if err != nil {
 		startWG.Done() // don't wait for me
 		s.state = ServerStateStartError
 		return fmt.Errorf("[%s] Cannot listen on port: %s ", s.listenInterface, err.Error())
 	}
+	if sc := s.configStore.Load().(ServerConfig); sc.ProxyProtocol {
+		listener = newProxyListener(listener, s.timeout.Load().(time.Duration)*time.Second, s.log())
+	}
+	s.listener = listener
+	stopWatching := make(chan struct{})
+	if sc := s.configStore.Load().(ServerConfig); sc.TLS.ReloadInterval != "" {
+		if interval, err := time.ParseDuration(sc.TLS.ReloadInterval); err == nil && interval > 0 {
+			go s.watchCertificates(s.certificatesModTime(), interval, stopWatching)
+		}
+	}
 
 	s.log().Infof("Listening on TCP %s", s.listenInterface)
 	s.state = ServerStateRunning
@@ -249,8 +410,13 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 				s.log().Infof("Server [%s] has stopped accepting new clients", s.listenInterface)
 				// the listener has been closed, wait for clients to exit
 				s.log().Infof("shutting down pool [%s]", s.listenInterface)
-				s.clientPool.ShutdownState()
+				if grace := s.gracePeriod(); grace > 0 {
+					s.clientPool.ShutdownDrain(grace)
+				} else {
+					s.clientPool.ShutdownState()
+				}
 				s.clientPool.ShutdownWait()
+				close(stopWatching)
 				s.state = ServerStateStopped
 				s.closedListener <- true
 				return nil
@@ -258,6 +424,13 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 			s.mainlog().WithError(err).Info("Temporary error accepting client")
 			continue
 		}
+		backends.AddMetric(backends.MetricConnections, 1, "server", s.listenInterface)
+		remoteIP := getRemoteAddr(conn)
+		if !s.acquireIPConn(remoteIP) {
+			s.log().Infof("[%s] too many connections, refused", remoteIP)
+			go s.refuseConn(conn)
+			continue
+		}
 		go func(p Poolable, borrowErr error) {
 			c := p.(*client)
 			if borrowErr == nil {
@@ -270,6 +443,7 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 				_ = conn.Close()
 
 			}
+			s.releaseIPConn(remoteIP)
 			// intentionally placed Borrow in args so that it's called in the
 			// same main goroutine.
 		}(s.clientPool.Borrow(conn, clientID, s.log(), s.envelopePool))
@@ -277,6 +451,41 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 	}
 }
 
+// acquireIPConn counts a new connection from ip. It returns false if ip already has
+// max_connections_per_ip connections open, unless it's in an exempt network
+func (s *server) acquireIPConn(ip string) bool {
+	sc := s.configStore.Load().(ServerConfig)
+	s.ipConns.Lock()
+	defer s.ipConns.Unlock()
+	if s.ipConns.counts == nil {
+		s.ipConns.counts = make(map[string]int)
+	}
+	if sc.MaxConnectionsPerIP > 0 && s.ipConns.counts[ip] >= sc.MaxConnectionsPerIP &&
+		!backends.InNetworks(s.networks().connectionLimitExempt, net.ParseIP(ip)) {
+		return false
+	}
+	s.ipConns.counts[ip]++
+	return true
+}
+
+// releaseIPConn counts a connection from ip as closed
+func (s *server) releaseIPConn(ip string) {
+	s.ipConns.Lock()
+	defer s.ipConns.Unlock()
+	if s.ipConns.counts[ip] <= 1 {
+		delete(s.ipConns.counts, ip)
+	} else {
+		s.ipConns.counts[ip]--
+	}
+}
+
+// refuseConn tells the client that it has too many connections open, then closes conn
+func (s *server) refuseConn(conn net.Conn) {
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	_, _ = io.WriteString(conn, response.Canned.ErrorTooManyConnections.String()+"\r\n")
+	_ = conn.Close()
+}
+
 func (s *server) Shutdown() {
 	if s.listener != nil {
 		// This will cause Start function to return, by causing an error on listener.Accept
@@ -292,6 +501,19 @@ func (s *server) Shutdown() {
 	}
 }
 
+// setShutdownGrace sets the seconds given to clients to finish their transaction on Shutdown
+func (s *server) setShutdownGrace(seconds int) {
+	s.shutdownGrace.Store(time.Duration(seconds) * time.Second)
+}
+
+// gracePeriod returns the time given to clients to finish their transaction on Shutdown
+func (s *server) gracePeriod() time.Duration {
+	if grace, ok := s.shutdownGrace.Load().(time.Duration); ok {
+		return grace
+	}
+	return 0
+}
+
 func (s *server) GetActiveClientsCount() int {
 	return s.clientPool.GetActiveClientsCount()
 }
@@ -353,12 +575,12 @@ func (s *server) isShuttingDown() bool {
 func (s *server) handleClient(client *client) {
 	defer client.closeConn()
 	sc := s.configStore.Load().(ServerConfig)
-	s.log().Infof("Handle client [%s], id: %d", client.RemoteIP, client.ID)
+	s.clientLog(client).WithField("client_id", client.ID).Infof("Handle client [%s], id: %d", client.RemoteIP, client.ID)
 
 	// Initial greeting
 	greeting := fmt.Sprintf("220 %s SMTP Guerrilla(%s) #%d (%d) %s",
 		sc.Hostname, Version, client.ID,
-		s.clientPool.GetActiveClientsCount(), time.Now().Format(time.RFC3339))
+		s.clientPool.GetActiveClientsCount(), mail.DefaultClock.Now().Format(time.RFC3339))
 
 	helo := fmt.Sprintf("250 %s Hello", sc.Hostname)
 	// ehlo is a multi-line reply and need additional \r\n at the end
@@ -367,8 +589,22 @@ func (s *server) handleClient(client *client) {
 	// Extended feature advertisements
 	messageSize := fmt.Sprintf("250-SIZE %d\r\n", sc.MaxSize)
 	pipelining := "250-PIPELINING\r\n"
+	chunking := "250-CHUNKING\r\n"
+	binaryMIME := "250-BINARYMIME\r\n"
 	advertiseTLS := "250-STARTTLS\r\n"
 	advertiseEnhancedStatusCodes := "250-ENHANCEDSTATUSCODES\r\n"
+	client.enhancedCodes = sc.EnhancedStatusCodes == nil || *sc.EnhancedStatusCodes
+	if !client.enhancedCodes {
+		advertiseEnhancedStatusCodes = ""
+	}
+	advertiseXClient := ""
+	if sc.XClientOn && xclientAllowed(s.networks().xclientTrusted, client.conn.RemoteAddr()) {
+		advertiseXClient = "250-XCLIENT ADDR NAME PROTO HELO LOGIN\r\n"
+	}
+	advertiseMTPriority := ""
+	if sc.MTPriority != "" {
+		advertiseMTPriority = "250-MT-PRIORITY " + sc.MTPriority + "\r\n"
+	}
 	// The last line doesn't need \r\n since string will be printed as a new line.
 	// Also, Last line has no dash -
 	help := "250 HELP"
@@ -379,8 +615,9 @@ func (s *server) handleClient(client *client) {
 			s.mainlog().Error("Failed to load *tls.Config")
 		} else if err := client.upgradeToTLS(tlsConfig); err == nil {
 			advertiseTLS = ""
+			s.clientLog(client).WithField("tls", client.TLSInfo.String()).Infof("[%s] TLS established", client.RemoteIP)
 		} else {
-			s.log().WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
+			s.clientLog(client).WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
 			// server requires TLS, but can't handshake
 			client.kill()
 		}
@@ -389,6 +626,21 @@ func (s *server) handleClient(client *client) {
 		// STARTTLS turned off, don't advertise it
 		advertiseTLS = ""
 	}
+	if span := backends.StartSpan("smtp session", nil); span != nil {
+		span.SetAttribute("remote_ip", client.RemoteIP)
+		span.SetAttribute("listen_interface", sc.ListenInterface)
+		client.span = span
+		defer func() {
+			client.endTxSpan(errors.New("connection closed before delivery"))
+			span.SetAttribute("helo", client.Helo)
+			span.SetAttribute("messages", client.messagesSent)
+			span.End(nil)
+		}()
+	}
+	maxRecipients := sc.MaxRecipients
+	if maxRecipients <= 0 {
+		maxRecipients = defaultMaxRecipients
+	}
 	r := response.Canned
 	for client.isAlive() {
 		switch client.state {
@@ -398,23 +650,28 @@ func (s *server) handleClient(client *client) {
 		case ClientCmd:
 			client.bufin.setLimit(CommandLineMaxLength)
 			input, err := s.readCommand(client)
-			s.log().Debugf("Client sent: %s", input)
+			s.clientLog(client).Debugf("Client sent: %s", input)
 			if err == io.EOF {
-				s.log().WithError(err).Warnf("Client closed the connection: %s", client.RemoteIP)
+				s.clientLog(client).WithError(err).Warnf("Client closed the connection: %s", client.RemoteIP)
 				return
 			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				s.log().WithError(err).Warnf("Timeout: %s", client.RemoteIP)
+				if s.isShuttingDown() {
+					// timed out by the shutdown, tell the client why
+					client.state = ClientShutdown
+					continue
+				}
+				s.clientLog(client).WithError(err).Warnf("Timeout: %s", client.RemoteIP)
 				return
 			} else if err == LineLimitExceeded {
 				client.sendResponse(r.FailLineTooLong)
 				client.kill()
 				break
 			} else if err != nil {
-				s.log().WithError(err).Warnf("Read error: %s", client.RemoteIP)
+				s.clientLog(client).WithError(err).Warnf("Read error: %s", client.RemoteIP)
 				client.kill()
 				break
 			}
-			if s.isShuttingDown() {
+			if s.isShuttingDown() && (s.gracePeriod() == 0 || !client.isInTransaction()) {
 				client.state = ClientShutdown
 				continue
 			}
@@ -424,20 +681,32 @@ func (s *server) handleClient(client *client) {
 				cmdLen = CommandVerbMaxLength
 			}
 			cmd := bytes.ToUpper(input[:cmdLen])
+			backends.AddMetric(backends.MetricCommands, 1, "verb", commandVerb(cmd))
 			switch {
 			case cmdHELO.match(cmd):
 				client.Helo = string(bytes.Trim(input[4:], " "))
+				client.greeted = true
 				client.resetTransaction()
 				client.sendResponse(helo)
 
 			case cmdEHLO.match(cmd):
 				client.Helo = string(bytes.Trim(input[4:], " "))
+				client.greeted = true
 				client.resetTransaction()
+				advertiseAuth := ""
+				if s.authAllowed(client, &sc) {
+					advertiseAuth = "250-AUTH " + authMechanisms(s.authenticator()) + "\r\n"
+				}
 				client.sendResponse(ehlo,
 					messageSize,
 					pipelining,
+					chunking,
+					binaryMIME,
 					advertiseTLS,
+					advertiseAuth,
 					advertiseEnhancedStatusCodes,
+					advertiseMTPriority,
+					advertiseXClient,
 					help)
 
 			case cmdHELP.match(cmd):
@@ -445,58 +714,108 @@ func (s *server) handleClient(client *client) {
 				client.sendResponse("214-OK\r\n", quote)
 
 			case sc.XClientOn && cmdXCLIENT.match(cmd):
-				if toks := bytes.Split(input[8:], []byte{' '}); len(toks) > 0 {
-					for i := range toks {
-						if vals := bytes.Split(toks[i], []byte{'='}); len(vals) == 2 {
-							if bytes.Equal(vals[1], []byte("[UNAVAILABLE]")) {
-								// skip
-								continue
-							}
-							if bytes.Equal(vals[0], []byte("ADDR")) {
-								client.RemoteIP = string(vals[1])
-							}
-							if bytes.Equal(vals[0], []byte("HELO")) {
-								client.Helo = string(vals[1])
-							}
-						}
-					}
+				s.handleXClient(client, input[7:], s.networks().xclientTrusted)
+
+			case cmdAUTH.match(cmd):
+				if !client.greeted {
+					client.sendResponse(r.FailNoHeloAuthCmd)
+					break
 				}
-				client.sendResponse(r.SuccessMailCmd)
+				s.handleAuth(client, input[4:], &sc)
+
 			case cmdMAIL.match(cmd):
 				if client.isInTransaction() {
 					client.sendResponse(r.FailNestedMailCmd)
 					break
 				}
+				if !client.greeted {
+					if sc.HeloRequired {
+						client.sendResponse(r.FailNoHeloMailCmd)
+						break
+					}
+					// be lenient and greet on behalf of the client
+					client.Helo = "[" + client.RemoteIP + "]"
+					client.greeted = true
+				}
+				if !s.allowMessage(client, &sc) {
+					client.rateLimited++
+					if sc.RateLimitDisconnectAfter > 0 && client.rateLimited >= sc.RateLimitDisconnectAfter {
+						client.sendResponse(r.ErrorRateLimitDisconnect)
+						client.kill()
+					} else {
+						client.sendResponse(r.ErrorRateLimited)
+					}
+					break
+				}
 				client.MailFrom, err = client.parsePath(input[10:], client.parser.MailFrom)
 				if err != nil {
-					s.log().WithError(err).Error("MAIL parse error", "["+string(input[10:])+"]")
+					s.clientLog(client).WithError(err).Error("MAIL parse error", "["+string(input[10:])+"]")
 					client.sendResponse(err)
 					break
-				} else if client.parser.(*rfc5321.Parser).NullPath {
-					// bounce has empty from address
+				}
+				if sc.MTPriority != "" {
+					priority, _, err := rfc5321.MTPriority(client.MailFrom.PathParams)
+					if err != nil {
+						client.MailFrom = mail.Address{}
+						client.sendResponse(r.FailInvalidMTPriority)
+						break
+					}
+					client.MTPriority = priority
+				}
+				if client.parser.Size > sc.MaxSize {
 					client.MailFrom = mail.Address{}
+					client.sendResponse(r.FailMessageSizeExceeded)
+					break
+				}
+				// a message declared smaller than the maximum must keep to its size
+				client.maxSize = sc.MaxSize
+				if client.parser.Size > 0 {
+					client.maxSize = client.parser.Size
+				}
+				client.binaryMIME = client.parser.Body == "BINARYMIME"
+				atomic.StoreInt32(&client.transacting, 1)
+				client.transactionStart = time.Now()
+				client.messages++
+				if client.authUser != "" {
+					client.Values["authenticated"] = true
+					client.Values["auth_user"] = client.authUser
+				}
+				if client.span != nil {
+					if client.txSpan = backends.StartSpan("smtp message", client.span); client.txSpan != nil {
+						client.txSpan.SetAttribute("remote_ip", client.RemoteIP)
+					}
 				}
 				client.sendResponse(r.SuccessMailCmd)
 
 			case cmdRCPT.match(cmd):
-				if len(client.RcptTo) > rfc5321.LimitRecipients {
+				if !client.isInTransaction() {
+					client.sendResponse(r.FailNoSenderRcptCmd)
+					break
+				}
+				if len(client.RcptTo) >= maxRecipients {
 					client.sendResponse(r.ErrorTooManyRecipients)
 					break
 				}
 				to, err := client.parsePath(input[8:], client.parser.RcptTo)
 				if err != nil {
-					s.log().WithError(err).Error("RCPT parse error", "["+string(input[8:])+"]")
+					s.clientLog(client).WithError(err).Error("RCPT parse error", "["+string(input[8:])+"]")
 					client.sendResponse(err.Error())
 					break
 				}
+				if sc.DedupRcpts && client.HasRcpt(to) {
+					// already accepted, deliver only one copy
+					client.sendResponse(r.SuccessRcptCmd)
+					break
+				}
 				if !s.allowsHost(to.Host) {
 					client.sendResponse(r.ErrorRelayDenied, " ", to.Host)
 				} else {
 					client.PushRcpt(to)
 					rcptError := s.backend().ValidateRcpt(client.Envelope)
 					if rcptError != nil {
+						// reject only this recipient, the transaction continues with the others
 						client.PopRcpt()
-						client.sendResponse(r.FailRcptCmd, " ", rcptError.Error())
+						client.sendResponse(rcptErrorResponse(rcptError), " ", rcptError.Error())
 					} else {
 						client.sendResponse(r.SuccessRcptCmd)
 					}
@@ -517,15 +836,39 @@ func (s *server) handleClient(client *client) {
 				client.kill()
 
 			case cmdDATA.match(cmd):
+				if !client.isInTransaction() {
+					client.sendResponse(r.FailNoSenderDataCmd)
+					break
+				}
 				if len(client.RcptTo) == 0 {
 					client.sendResponse(r.FailNoRecipientsDataCmd)
 					break
 				}
+				if client.chunking {
+					client.sendResponse(r.FailDataAfterBdatCmd)
+					break
+				}
+				if client.binaryMIME {
+					client.sendResponse(r.FailBinaryMIMEDataCmd)
+					break
+				}
 				client.sendResponse(r.SuccessDataCmd)
 				client.state = ClientData
 
-			case sc.TLS.StartTLSOn && cmdSTARTTLS.match(cmd):
+			case cmdBDAT.match(cmd):
+				maxSize := sc.MaxSize
+				if client.isInTransaction() {
+					maxSize = client.maxSize
+				}
+				s.handleBDAT(client, input[4:], maxSize)
 
+			case sc.TLS.StartTLSOn && cmdSTARTTLS.match(cmd):
+				// anything sent along with STARTTLS is plaintext that could be injected by an
+				// attacker, it must not be taken as commands sent over TLS (CVE-2011-0411)
+				if n := client.bufin.Buffered(); n > 0 {
+					s.clientLog(client).Warnf("[%s] discarded %d bytes sent after STARTTLS", client.RemoteIP, n)
+					_, _ = client.bufin.Discard(n)
+				}
 				client.sendResponse(r.SuccessStartTLSCmd)
 				client.state = ClientStartTLS
 			default:
@@ -544,36 +887,38 @@ func (s *server) handleClient(client *client) {
 			// if the client goes a little over. Anything above will err
 			client.bufin.setLimit(sc.MaxSize + 1024000) // This a hard limit.
 
-			n, err := client.Data.ReadFrom(client.smtpReader.DotReader())
-			if n > sc.MaxSize {
-				err = fmt.Errorf("maximum DATA size exceeded (%d)", sc.MaxSize)
+			var data io.Reader = client.smtpReader.DotReader()
+			if sc.DataReadTimeout > 0 || sc.TransactionTimeout > 0 {
+				ddr := &dataDeadlineReader{r: data, client: client, idle: time.Duration(sc.DataReadTimeout) * time.Second}
+				if sc.TransactionTimeout > 0 {
+					ddr.end = client.transactionStart.Add(time.Duration(sc.TransactionTimeout) * time.Second)
+				}
+				data = ddr
 			}
+			// the message is counted as it's read, reading stops once over the limit
+			_, err := client.Data.ReadFrom(newSizeLimitedReader(data, client.maxSize))
 			if err != nil {
-				if err == LineLimitExceeded {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					s.clientLog(client).WithError(err).Warnf("[%s] DATA timed out", client.RemoteIP)
+					client.sendResponse(r.ErrorDataTimeout)
+					client.kill()
+				} else if err == LineLimitExceeded {
 					client.sendResponse(r.FailReadLimitExceededDataCmd, " ", LineLimitExceeded.Error())
 					client.kill()
 				} else if err == MessageSizeExceeded {
-					client.sendResponse(r.FailMessageSizeExceeded, " ", MessageSizeExceeded.Error())
+					// the rest of the message would be taken as commands
+					client.sendResponse(r.FailMessageSizeExceeded)
 					client.kill()
 				} else {
 					client.sendResponse(r.FailReadErrorDataCmd, " ", err.Error())
 					client.kill()
 				}
-				s.log().WithError(err).Warn("Error reading data")
+				s.clientLog(client).WithError(err).Warn("Error reading data")
 				client.resetTransaction()
 				break
 			}
 
-			res := s.backend().Process(client.Envelope)
-			if res.Code() < 300 {
-				client.messagesSent++
-			}
-			client.sendResponse(res)
-			client.state = ClientCmd
-			if s.isShuttingDown() {
-				client.state = ClientShutdown
-			}
-			client.resetTransaction()
+			s.processMessage(client)
 
 		case ClientStartTLS:
 			if !client.TLS && sc.TLS.StartTLSOn {
@@ -583,8 +928,26 @@ func (s *server) handleClient(client *client) {
 				} else if err := client.upgradeToTLS(tlsConfig); err == nil {
 					advertiseTLS = ""
 					client.resetTransaction()
+					// the client must greet again after the TLS handshake and any
+					// authentication is forgotten, RFC 3207
+					client.greeted = false
+					client.authUser = ""
+					if sc.TLS.DANE != daneOff {
+						client.TLSInfo.DANE = checkDANE(sc.TLS.DANEResolver, client.Helo, client.tlsState.PeerCertificates)
+						if client.TLSInfo.DANE == DANEFail && sc.TLS.DANE == daneEnforce {
+							s.clientLog(client).Warnf("[%s] DANE check failed for %s", client.RemoteIP, client.Helo)
+							client.sendResponse(r.FailDANEMismatch)
+							client.kill()
+						}
+					}
+					// forget the HELO given before TLS, it's used for DANE only
+					client.Helo = ""
+					s.clientLog(client).WithFields(map[string]interface{}{
+						"tls":  client.TLSInfo.String(),
+						"dane": client.TLSInfo.DANE,
+					}).Infof("[%s] TLS established", client.RemoteIP)
 				} else {
-					s.log().WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
+					s.clientLog(client).WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
 					// Don't disconnect, let the client decide if it wants to continue
 				}
 			}
@@ -597,17 +960,21 @@ func (s *server) handleClient(client *client) {
 		}
 
 		if client.bufErr != nil {
-			s.log().WithError(client.bufErr).Debug("client could not buffer a response")
+			s.clientLog(client).WithError(client.bufErr).Debug("client could not buffer a response")
 			return
 		}
-		// flush the response buffer
-		if client.bufout.Buffered() > 0 {
+		// flush the response buffer. When more pipelined commands have already been received,
+		// their responses are held back and written together. Only done in the command state,
+		// in other states the client may be waiting for the response before sending more
+		if client.bufout.Buffered() > 0 &&
+			!(client.state == ClientCmd && client.isAlive() && client.hasPipelinedCommand()) {
 			if s.log().IsDebug() {
-				s.log().Debugf("Writing response to client: \n%s", client.response.String())
+				s.clientLog(client).Debugf("Writing response to client: \n%s", client.response.String())
+				client.response.Reset()
 			}
 			err := s.flushResponse(client)
 			if err != nil {
-				s.log().WithError(err).Debug("error writing response")
+				s.clientLog(client).WithError(err).Debug("error writing response")
 				return
 			}
 		}
@@ -615,6 +982,251 @@ func (s *server) handleClient(client *client) {
 	}
 }
 
+// handleXClient overrides the identity of the client with the attributes passed by a trusted
+// proxy, using the Postfix XCLIENT extension: XCLIENT ADDR=ip NAME=host PROTO=SMTP|ESMTP HELO=name
+// LOGIN=user. Values are xtext encoded, [UNAVAILABLE] and [TEMPUNAVAIL] leave the attribute as is.
+// It's refused during a mail transaction, as the transaction was started by another client
+func (s *server) handleXClient(client *client, args []byte, trusted []*net.IPNet) {
+	r := response.Canned
+	if !xclientAllowed(trusted, client.conn.RemoteAddr()) {
+		s.clientLog(client).Warnf("[%s] XCLIENT not allowed", client.RemoteIP)
+		client.sendResponse(r.FailXClientNotAllowed)
+		return
+	}
+	if client.isInTransaction() {
+		client.sendResponse(r.FailXClientInTransaction)
+		return
+	}
+	attrs := make(map[string]string)
+	for _, tok := range strings.Fields(string(args)) {
+		kv := strings.SplitN(tok, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if kv[1] == "[UNAVAILABLE]" || kv[1] == "[TEMPUNAVAIL]" {
+			continue
+		}
+		name := strings.ToUpper(kv[0])
+		value, err := xtextDecode(kv[1])
+		if err == nil && name == "ADDR" {
+			// IPv6 addresses are prefixed with IPV6:
+			if len(value) > 5 && strings.EqualFold(value[:5], "IPV6:") {
+				value = value[5:]
+			}
+			if net.ParseIP(value) == nil {
+				err = errors.New("invalid address")
+			}
+		}
+		if err != nil {
+			client.sendResponse(r.FailXClientCmd, " ", name)
+			return
+		}
+		attrs[name] = value
+	}
+	for name, value := range attrs {
+		switch name {
+		case "ADDR":
+			client.RemoteIP = value
+		case "HELO":
+			client.Helo = value
+			client.greeted = true
+		case "NAME", "PROTO", "LOGIN":
+			if client.xclient == nil {
+				client.xclient = make(map[string]string)
+			}
+			client.xclient[name] = value
+		}
+	}
+	client.sendResponse(r.SuccessXClientCmd)
+}
+
+// xclientAllowed returns true if XCLIENT is accepted from the peer at addr, when it's in one of
+// the trusted networks. No peer is trusted if none are given
+func xclientAllowed(trusted []*net.IPNet, addr net.Addr) bool {
+	var ip net.IP
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	} else {
+		host := addr.String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		ip = net.ParseIP(host)
+	}
+	return backends.InNetworks(trusted, ip)
+}
+
+// xtextDecode decodes an xtext value (RFC 3461), where +XX encodes a byte in hex
+func xtextDecode(value string) (string, error) {
+	if !strings.Contains(value, "+") {
+		return value, nil
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] != '+' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return "", errors.New("invalid xtext")
+		}
+		n, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("invalid xtext")
+		}
+		b.WriteByte(byte(n))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// handleBDAT reads a chunk of the message sent with BDAT <size> [LAST], RFC 3030.
+// The chunk follows the command line and is read even when the command is rejected,
+// since the client sends it without waiting for a reply
+func (s *server) handleBDAT(client *client, args []byte, maxSize int64) {
+	r := response.Canned
+	size := int64(-1)
+	last := false
+	fields := strings.Fields(string(args))
+	if len(fields) == 1 || len(fields) == 2 {
+		if n, err := strconv.ParseInt(fields[0], 10, 64); err == nil && n >= 0 {
+			size = n
+		}
+		if len(fields) == 2 {
+			if strings.EqualFold(fields[1], "LAST") {
+				last = true
+			} else {
+				size = -1
+			}
+		}
+	}
+	if size < 0 {
+		// the end of the chunk is unknown, the session cannot continue
+		client.sendResponse(r.FailInvalidBdatCmd)
+		client.kill()
+		return
+	}
+	accept := client.isInTransaction() && len(client.RcptTo) > 0
+	if int64(client.Data.Len())+size > maxSize {
+		client.sendResponse(r.FailMessageSizeExceeded)
+		client.resetTransaction()
+		client.kill()
+		return
+	}
+	var dst io.Writer = ioutil.Discard
+	if accept {
+		dst = &client.Data
+	}
+	client.bufin.setLimit(size + CommandLineMaxLength)
+	if _, err := io.CopyN(dst, client.bufin, size); err != nil {
+		s.clientLog(client).WithError(err).Warn("Error reading BDAT chunk")
+		client.sendResponse(r.FailReadErrorDataCmd, " ", err.Error())
+		client.resetTransaction()
+		client.kill()
+		return
+	}
+	if !client.isInTransaction() {
+		client.sendResponse(r.FailNoSenderDataCmd)
+		return
+	}
+	if !accept {
+		client.sendResponse(r.FailNoRecipientsDataCmd)
+		return
+	}
+	client.chunking = true
+	if !last {
+		client.sendResponse(r.SuccessBdatCmd)
+		return
+	}
+	if !client.binaryMIME {
+		// the chunks are not dot-stuffed, but use CRLF line endings. Convert them to \n
+		// like the DATA reader does. A BINARYMIME message is passed on as sent
+		data := bytes.Replace(client.Data.Bytes(), []byte("\r\n"), []byte("\n"), -1)
+		client.Data.Reset()
+		_, _ = client.Data.Write(data)
+	}
+	s.processMessage(client)
+}
+
+// processMessage hands the received message to the backend, replies with the result
+// and ends the transaction
+func (s *server) processMessage(client *client) {
+	if span := client.txSpan; span != nil {
+		span.SetAttribute("queued_id", client.QueuedId)
+		span.SetAttribute("size", int64(client.Data.Len()))
+		span.SetAttribute("recipients", len(client.RcptTo))
+		client.Values[backends.EnvelopeSpanKey] = span
+	}
+	for name, value := range client.xclient {
+		client.Values["xclient_"+strings.ToLower(name)] = value
+	}
+	if len(client.tlsState.VerifiedChains) > 0 {
+		client.Values["client_cert_cn"] = client.tlsState.PeerCertificates[0].Subject.CommonName
+	}
+	res := s.backend().Process(client.Envelope)
+	result := "rejected"
+	if res.Code() < 300 {
+		client.messagesSent++
+		result = "accepted"
+	}
+	backends.AddMetric(backends.MetricMessages, 1, "result", result)
+	backends.AddMetric(backends.MetricReceivedBytes, float64(client.Data.Len()))
+	fields := map[string]interface{}{"code": res.Code()}
+	if client.Header != nil {
+		fields["message_id"] = client.Header.Get("Message-Id")
+	}
+	s.clientLog(client).WithFields(fields).Infof("[%s] message processed", client.RemoteIP)
+	if client.txSpan != nil {
+		client.txSpan.SetAttribute("result_code", res.Code())
+		if res.Code() >= 400 {
+			client.endTxSpan(errors.New(res.String()))
+		} else {
+			client.endTxSpan(nil)
+		}
+	}
+	client.sendResponse(res)
+	client.state = ClientCmd
+	if s.isShuttingDown() {
+		client.state = ClientShutdown
+	}
+	client.resetTransaction()
+}
+
+// rcptErrorResponse maps an error from the backend's recipient validation to the reply
+// for the rejected recipient
+func rcptErrorResponse(err backends.RcptError) *response.Response {
+	switch err {
+	case backends.QuotaExceeded:
+		return response.Canned.ErrorRcptMailboxFull
+	case backends.UserSuspended:
+		return response.Canned.FailRcptMailboxDisabled
+	case backends.Greylisted:
+		return response.Canned.ErrorGreylisted
+	case backends.Blocklisted:
+		return response.Canned.FailDNSBL
+	case backends.ErrCircuitOpen:
+		return response.Canned.ErrorDependencyDown
+	case backends.StorageNotAvailable,
+		backends.StorageTooBusy,
+		backends.StorageTimeout,
+		backends.StorageError:
+		return response.Canned.ErrorRcptStorage
+	}
+	return response.Canned.FailRcptCmd
+}
+
+// clientLog returns the server's log with the remote_ip, helo and queue_id of client as fields
+func (s *server) clientLog(client *client) log.FieldLogger {
+	fields := map[string]interface{}{"remote_ip": client.RemoteIP}
+	if client.Helo != "" {
+		fields["helo"] = client.Helo
+	}
+	if client.QueuedId != "" {
+		fields["queue_id"] = client.QueuedId
+	}
+	return s.log().WithFields(fields)
+}
+
 func (s *server) log() log.Logger {
 	return s.loadLog(&s.logStore)
 }
@@ -8,16 +8,28 @@ import (
 	"net/textproto"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
+	"time"
 
 	"github.com/flashmob/go-guerrilla/backends"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
 	"github.com/flashmob/go-guerrilla/mocks"
+	"github.com/flashmob/go-guerrilla/response"
 )
 
 // getMockServerConfig gets a mock ServerConfig struct used for creating a new server
@@ -308,6 +320,7 @@ func TestXClient(t *testing.T) {
 	defer cleanTestArtifacts(t)
 	sc := getMockServerConfig()
 	sc.XClientOn = true
+	sc.XClientTrusted = []string{"127.0.0.1"}
 	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
 	if logOpenError != nil {
 		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
@@ -362,6 +375,408 @@ func TestXClient(t *testing.T) {
 	wg.Wait() // wait for handleClient to exit
 }
 
+// xclientSession runs the commands on a server with XCLIENT enabled for the trusted networks,
+// checking the start of each reply. It returns the client once the session ended, and the
+// extensions advertised in reply to EHLO
+func xclientSession(t *testing.T, trusted []string, expectations [][2]string) (*client, string) {
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	sc.XClientOn = true
+	sc.XClientTrusted = trusted
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	_, _ = r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	if err := w.PrintfLine("EHLO proxy.example.com"); err != nil {
+		t.Error(err)
+	}
+	var ehlo []string
+	for {
+		line, _ := r.ReadLine()
+		ehlo = append(ehlo, line)
+		if !strings.HasPrefix(line, "250-") {
+			break
+		}
+	}
+	for _, e := range expectations {
+		if err := w.PrintfLine("%s", e[0]); err != nil {
+			t.Error(err)
+		}
+		line, _ := r.ReadLine()
+		if strings.Index(line, e[1]) != 0 {
+			t.Error(e[0], "expected", e[1], "but got:", line)
+		}
+	}
+	if err := w.PrintfLine("QUIT"); err != nil {
+		t.Error(err)
+	}
+	_, _ = r.ReadLine()
+	wg.Wait()
+	return client, strings.Join(ehlo, "\n")
+}
+
+func TestXClientTrusted(t *testing.T) {
+	client, ehlo := xclientSession(t, []string{"192.0.2.1", "127.0.0.0/8"}, [][2]string{
+		{"XCLIENT ADDR=IPV6:2001:db8::1 NAME=mail.example.com HELO=relay.example.com", "250 2.1.0 OK"},
+		{"XCLIENT PROTO=ESMTP LOGIN=joe+40example.com NAME=[UNAVAILABLE]", "250 2.1.0 OK"},
+		// nothing changes when a value is invalid
+		{"XCLIENT HELO=other ADDR=not.an.ip", "501 5.5.4 Bad XCLIENT attribute value: ADDR"},
+		{"XCLIENT LOGIN=bad+4", "501 5.5.4 Bad XCLIENT attribute value: LOGIN"},
+		// nor during a transaction
+		{"MAIL FROM:<test@example.com>", "250 2.1.0"},
+		{"XCLIENT ADDR=192.0.2.9", "503 5.5.1 Error: XCLIENT not allowed during a mail transaction"},
+	})
+	if !strings.Contains(ehlo, "250-XCLIENT ADDR NAME PROTO HELO LOGIN\n") {
+		t.Error("expecting XCLIENT to be advertised to a trusted network, got", ehlo)
+	}
+	if client.RemoteIP != "2001:db8::1" {
+		t.Error("e.RemoteIP should be 2001:db8::1, but got:", client.RemoteIP)
+	}
+	if client.Helo != "relay.example.com" {
+		t.Error("e.Helo should be relay.example.com, but got:", client.Helo)
+	}
+	for name, expect := range map[string]string{
+		"NAME":  "mail.example.com",
+		"PROTO": "ESMTP",
+		"LOGIN": "joe@example.com",
+	} {
+		if client.xclient[name] != expect {
+			t.Error("expecting", name, "to be", expect, "got", client.xclient[name])
+		}
+	}
+}
+
+func TestXClientNotTrusted(t *testing.T) {
+	// nobody is trusted when no networks are given
+	for _, trusted := range [][]string{{"10.0.0.0/8"}, nil} {
+		client, ehlo := xclientSession(t, trusted, [][2]string{
+			{"XCLIENT ADDR=212.96.64.216 HELO=relay.example.com", "550 5.7.0 Error: insufficient authorization"},
+		})
+		if client.RemoteIP == "212.96.64.216" || client.Helo != "proxy.example.com" {
+			t.Error("XCLIENT should not change the client from an untrusted network, got", client.RemoteIP, client.Helo)
+		}
+		if strings.Contains(ehlo, "XCLIENT") {
+			t.Error("XCLIENT should not be advertised to an untrusted network, got", ehlo)
+		}
+	}
+	sc := getMockServerConfig()
+	sc.XClientOn = true
+	if err := sc.Validate(); err == nil || !strings.Contains(err.Error(), "xclient_trusted_networks") {
+		t.Error("expecting xclient_on without xclient_trusted_networks to be invalid, got", err)
+	}
+}
+
+// RFC 5321 allows only one forward-path per RCPT command
+func TestMultipleRcptOnOneLine(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	// call the serve.handleClient() func in a goroutine.
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	// Wait for the greeting from the server
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	if err := w.PrintfLine("HELO test.test.com"); err != nil {
+		t.Error(err)
+	}
+	line, _ = r.ReadLine()
+	if err := w.PrintfLine("MAIL FROM:<test@example.com>"); err != nil {
+		t.Error(err)
+	}
+	line, _ = r.ReadLine()
+
+	for _, rcpt := range []string{
+		"RCPT TO:<a@test.com> <b@test.com>",
+		"RCPT TO:<a@test.com>,<b@test.com>",
+	} {
+		if err := w.PrintfLine("%s", rcpt); err != nil {
+			t.Error(err)
+		}
+		line, _ = r.ReadLine()
+		expected := "501 5.5.4 Invalid address"
+		if strings.Index(line, expected) != 0 {
+			t.Error("expected", expected, "but got:", line)
+		}
+	}
+	if len(client.RcptTo) != 0 {
+		t.Error("no recipients should have been added, got", client.RcptTo)
+	}
+
+	if err := w.PrintfLine("QUIT"); err != nil {
+		t.Error(err)
+	}
+	line, _ = r.ReadLine()
+	wg.Wait() // wait for handleClient to exit
+}
+
+// A rejected recipient should not abort the transaction, only the accepted recipients get the message
+func TestRcptRejectionContinuesTransaction(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.DedupRcpts = true
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	delivered := make(chan []string, 1)
+	backends.Svc.AddProcessor("rcpttest", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskValidateRcpt {
+					switch e.RcptTo[len(e.RcptTo)-1].User {
+					case "unknown":
+						return backends.NewResult(response.Canned.FailRcptCmd), backends.NoSuchUser
+					case "full":
+						return backends.NewResult(response.Canned.ErrorRcptMailboxFull), backends.QuotaExceeded
+					}
+				} else if task == backends.TaskSaveMail {
+					var to []string
+					for i := range e.RcptTo {
+						to = append(to, e.RcptTo[i].String())
+					}
+					delivered <- to
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	backend, err := backends.New(
+		backends.BackendConfig{
+			"log_received_mails": true,
+			"save_workers_size":  1,
+			"save_process":       "rcpttest|Debugger",
+			"validate_process":   "rcpttest",
+		},
+		mainlog)
+	if err != nil {
+		t.Error("new backend failed because:", err)
+		return
+	}
+	if err = backend.Start(); err != nil {
+		t.Error("backend did not start", err)
+		return
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	server, err := newServer(sc, backend, mainlog)
+	if err != nil {
+		t.Error("new server failed because:", err)
+		return
+	}
+	server.setAllowedHosts([]string{"test.com"})
+	conn := mocks.NewConn()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+
+	expectations := []struct {
+		cmd, expected string
+	}{
+		{"HELO test.test.com", "250 "},
+		{"MAIL FROM:<test@example.com>", "250 2.1.0"},
+		{"RCPT TO:<good@test.com>", "250 2.1.5"},
+		{"RCPT TO:<unknown@test.com>", "550 5.1.1"},
+		{"RCPT TO:<full@test.com>", "452 4.2.2"},
+		{"RCPT TO:<also.good@test.com>", "250 2.1.5"},
+		{"RCPT TO:<Good@TEST.com>", "250 2.1.5"},
+		{"DATA", "354 "},
+	}
+	for _, e := range expectations {
+		if err := w.PrintfLine("%s", e.cmd); err != nil {
+			t.Error(err)
+		}
+		line, _ = r.ReadLine()
+		if strings.Index(line, e.expected) != 0 {
+			t.Error(e.cmd, "expected", e.expected, "but got:", line)
+		}
+	}
+	if err := w.PrintfLine("Subject: Test\r\n\r\nHello\r\n."); err != nil {
+		t.Error(err)
+	}
+	line, _ = r.ReadLine()
+	if strings.Index(line, "250 2.0.0 OK") != 0 {
+		t.Error("expected the message to be queued, but got:", line)
+	}
+	select {
+	case to := <-delivered:
+		if len(to) != 2 || to[0] != "good@test.com" || to[1] != "also.good@test.com" {
+			t.Error("only the accepted recipients should be delivered, got", to)
+		}
+	default:
+		t.Error("message was not delivered")
+	}
+
+	if err := w.PrintfLine("QUIT"); err != nil {
+		t.Error(err)
+	}
+	line, _ = r.ReadLine()
+	wg.Wait() // wait for handleClient to exit
+}
+
+// A message sent in several BDAT chunks is assembled in order, chunk boundaries can fall anywhere
+func TestBDAT(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	delivered := make(chan string, 1)
+	backends.Svc.AddProcessor("bdattest", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					delivered <- e.Data.String()
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	backend, err := backends.New(
+		backends.BackendConfig{
+			"save_workers_size": 1,
+			"save_process":      "bdattest",
+		},
+		mainlog)
+	if err != nil {
+		t.Error("new backend failed because:", err)
+		return
+	}
+	if err = backend.Start(); err != nil {
+		t.Error("backend did not start", err)
+		return
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	server, err := newServer(sc, backend, mainlog)
+	if err != nil {
+		t.Error("new server failed because:", err)
+		return
+	}
+	server.setAllowedHosts([]string{"test.com"})
+	conn := mocks.NewConn()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+
+	if err := w.PrintfLine("EHLO test.test.com"); err != nil {
+		t.Error(err)
+	}
+	chunking := false
+	for {
+		line, _ = r.ReadLine()
+		if line == "250-CHUNKING" {
+			chunking = true
+		}
+		if strings.Index(line, "250 ") == 0 {
+			break
+		}
+	}
+	if !chunking {
+		t.Error("expecting CHUNKING to be advertised")
+	}
+
+	expectations := []struct {
+		cmd, chunk, expected string
+		// delivered is the message the backend should have received, if set
+		delivered string
+	}{
+		{"MAIL FROM:<test@example.com>", "", "250 2.1.0", ""},
+		{"RCPT TO:<good@test.com>", "", "250 2.1.5", ""},
+		{"BDAT 17", "Subject: chunked\r", "250 2.0.0 Chunk received", ""},
+		{"BDAT 15", "\n\r\nline one\r\nli", "250 2.0.0 Chunk received", ""},
+		{"BDAT 8 LAST", "ne two\r\n", "250 2.0.0 OK", "Subject: chunked\n\nline one\nline two\n"},
+		// a chunk after RSET is read and rejected, the session continues
+		{"MAIL FROM:<test@example.com>", "", "250 2.1.0", ""},
+		{"RCPT TO:<good@test.com>", "", "250 2.1.5", ""},
+		{"BDAT 5", "Hello", "250 2.0.0 Chunk received", ""},
+		{"RSET", "", "250 2.1.0", ""},
+		{"BDAT 6 LAST", "Hello\n", "503 5.5.1 Error: No sender", ""},
+		{"NOOP", "", "200 2.0.0", ""},
+		// no mixing of DATA and BDAT
+		{"MAIL FROM:<test@example.com>", "", "250 2.1.0", ""},
+		{"RCPT TO:<good@test.com>", "", "250 2.1.5", ""},
+		{"BDAT 3", "abc", "250 2.0.0 Chunk received", ""},
+		{"DATA", "", "503 5.5.1 Error: DATA not allowed after BDAT", ""},
+		{"BDAT 0 LAST", "", "250 2.0.0 OK", "abc"},
+		// binary data is passed on as sent, including line endings and dots
+		{"MAIL FROM:<test@example.com> BODY=BINARYMIME", "", "250 2.1.0", ""},
+		{"RCPT TO:<good@test.com>", "", "250 2.1.5", ""},
+		{"DATA", "", "503 5.5.1 Error: BODY=BINARYMIME requires BDAT", ""},
+		{"BDAT 13 LAST", "\x00\r\n.\r\n\xff\rbare\n", "250 2.0.0 OK", "\x00\r\n.\r\n\xff\rbare\n"},
+		// the size is required
+		{"BDAT LAST", "", "501 5.5.4", ""},
+	}
+	for _, e := range expectations {
+		// the chunk follows the command line, without a line ending of its own
+		if _, err := w.W.WriteString(e.cmd + "\r\n" + e.chunk); err != nil {
+			t.Error(err)
+		}
+		_ = w.W.Flush()
+		line, _ = r.ReadLine()
+		if strings.Index(line, e.expected) != 0 {
+			t.Error(e.cmd, "expected", e.expected, "but got:", line)
+		}
+		if e.delivered != "" {
+			select {
+			case data := <-delivered:
+				if data != e.delivered {
+					t.Errorf("the chunks were not assembled correctly, expecting %q got %q", e.delivered, data)
+				}
+			case <-time.After(time.Second):
+				t.Error("message was not delivered")
+			}
+		}
+	}
+	wg.Wait() // the invalid BDAT closes the connection
+}
+
 // The backend gateway should time out after 1 second because it sleeps for 2 sec.
 // The transaction should wait until finished, and then test to see if we can do
 // a second transaction
@@ -407,7 +822,7 @@ func TestGatewayTimeout(t *testing.T) {
 		// perform 2 transactions
 		// both should panic.
 		for i := 0; i < 2; i++ {
-			if _, err := fmt.Fprint(conn, "MAIL FROM:<test@example.com>r\r\n"); err != nil {
+			if _, err := fmt.Fprint(conn, "MAIL FROM:<test@example.com>\r\n"); err != nil {
 				t.Error(err)
 			}
 			if str, err = in.ReadString('\n'); err != nil {
@@ -497,7 +912,7 @@ func TestGatewayPanic(t *testing.T) {
 		// sure that the client waits until processing finishes, and the
 		// timeout event is captured.
 		for i := 0; i < 2; i++ {
-			if _, err := fmt.Fprint(conn, "MAIL FROM:<test@example.com>r\r\n"); err != nil {
+			if _, err := fmt.Fprint(conn, "MAIL FROM:<test@example.com>\r\n"); err != nil {
 				t.Error(err)
 			}
 			if _, err = in.ReadString('\n'); err != nil {
@@ -588,3 +1003,1334 @@ func TestAllowsHosts(t *testing.T) {
 	s.setAllowedHosts([]string{"grr.la", "example.com"})
 
 }
+
+func TestHeloRequired(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	for _, required := range []bool{false, true} {
+		sc := getMockServerConfig()
+		sc.HeloRequired = required
+		mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+		if logOpenError != nil {
+			mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+		}
+		conn, server := getMockServerConn(sc, t)
+		client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			server.handleClient(client)
+			wg.Done()
+		}()
+		r := textproto.NewReader(bufio.NewReader(conn.Client))
+		w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+		_, _ = r.ReadLine()
+
+		if err := w.PrintfLine("MAIL FROM:<test@example.com>"); err != nil {
+			t.Error(err)
+		}
+		line, _ := r.ReadLine()
+		if required {
+			expected := "503 5.5.1 Send HELO/EHLO first"
+			if strings.Index(line, expected) != 0 {
+				t.Error("expected", expected, "but got:", line)
+			}
+			if err := w.PrintfLine("HELO test.test.com"); err != nil {
+				t.Error(err)
+			}
+			_, _ = r.ReadLine()
+			// RSET does not clear the greeting
+			if err := w.PrintfLine("RSET"); err != nil {
+				t.Error(err)
+			}
+			_, _ = r.ReadLine()
+			if err := w.PrintfLine("MAIL FROM:<test@example.com>"); err != nil {
+				t.Error(err)
+			}
+			line, _ = r.ReadLine()
+			if strings.Index(line, "250") != 0 {
+				t.Error("expected MAIL to be accepted after HELO and RSET, got:", line)
+			}
+			if client.Helo != "test.test.com" {
+				t.Error("expected helo test.test.com, got:", client.Helo)
+			}
+		} else {
+			if strings.Index(line, "250") != 0 {
+				t.Error("expected MAIL to be accepted without HELO, got:", line)
+			}
+			if client.Helo != "["+client.RemoteIP+"]" {
+				t.Error("expected the helo to default to the address literal, got:", client.Helo)
+			}
+		}
+
+		if err := w.PrintfLine("QUIT"); err != nil {
+			t.Error(err)
+		}
+		_, _ = r.ReadLine()
+		wg.Wait()
+	}
+}
+
+func TestMaxRecipients(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	// 0 is the default of 100
+	for _, max := range []int{0, 2} {
+		sc := getMockServerConfig()
+		sc.MaxRecipients = max
+		if max == 0 {
+			max = defaultMaxRecipients
+		}
+		mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+		if logOpenError != nil {
+			mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+		}
+		conn, server := getMockServerConn(sc, t)
+		server.setAllowedHosts([]string{"test.com"})
+		if err := server.backend().Start(); err != nil {
+			t.Fatal("backend did not start", err)
+		}
+		client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			server.handleClient(client)
+			wg.Done()
+		}()
+		r := textproto.NewReader(bufio.NewReader(conn.Client))
+		w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+		_, _ = r.ReadLine()
+		expect := func(cmd, expected string) {
+			if err := w.PrintfLine("%s", cmd); err != nil {
+				t.Error(err)
+			}
+			line, _ := r.ReadLine()
+			if strings.Index(line, expected) != 0 {
+				t.Error(cmd, "expected", expected, "but got:", line)
+			}
+		}
+		fill := func() {
+			for i := 0; i < max; i++ {
+				expect(fmt.Sprintf("RCPT TO:<test%d@test.com>", i), "250")
+			}
+			expect("RCPT TO:<over@test.com>", "452 4.5.3 Too many recipients")
+		}
+		expect("HELO test.test.com", "250")
+		expect("MAIL FROM:<test@example.com>", "250")
+		fill()
+		if len(client.RcptTo) != max {
+			t.Errorf("expecting %d recipients, got %d", max, len(client.RcptTo))
+		}
+		// the connection stays open, and RSET or a new MAIL starts counting again
+		expect("NOOP", "200")
+		expect("RSET", "250")
+		expect("MAIL FROM:<test@example.com>", "250")
+		fill()
+		expect("RSET", "250")
+		expect("MAIL FROM:<test@example.com>", "250")
+		expect("RCPT TO:<again@test.com>", "250")
+
+		expect("QUIT", "221")
+		wg.Wait()
+		_ = server.backend().Shutdown()
+	}
+}
+
+func TestMessageSize(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	_, server := getMockServerConn(sc, t)
+	server.setAllowedHosts([]string{"test.com"})
+	if err := server.backend().Start(); err != nil {
+		t.Fatal("backend did not start", err)
+	}
+	defer func() {
+		_ = server.backend().Shutdown()
+	}()
+	// message returns a message of size bytes once the dots and CRLFs are decoded
+	message := func(size int) string {
+		header := "Subject: test\r\n\r\n"
+		return header + strings.Repeat("a", size-len(header)+1) + "\r\n.\r\n"
+	}
+	// send runs a transaction with the message and returns the replies to MAIL and DATA
+	send := func(mailFrom, msg string) (string, string) {
+		conn := mocks.NewConn()
+		client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			server.handleClient(client)
+			wg.Done()
+		}()
+		defer wg.Wait()
+		r := textproto.NewReader(bufio.NewReader(conn.Client))
+		w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+		_, _ = r.ReadLine()
+		ehlo := ""
+		_ = w.PrintfLine("EHLO test.test.com")
+		for {
+			line, _ := r.ReadLine()
+			if strings.HasPrefix(line, "250-SIZE") {
+				ehlo = line
+			}
+			if !strings.HasPrefix(line, "250-") {
+				break
+			}
+		}
+		if ehlo != fmt.Sprintf("250-SIZE %d", sc.MaxSize) {
+			t.Error("expecting the maximum size to be advertised, got", ehlo)
+		}
+		_ = w.PrintfLine("%s", mailFrom)
+		mailReply, _ := r.ReadLine()
+		if !strings.HasPrefix(mailReply, "250") {
+			_ = w.PrintfLine("QUIT")
+			_, _ = r.ReadLine()
+			return mailReply, ""
+		}
+		_ = w.PrintfLine("RCPT TO:<test@test.com>")
+		_, _ = r.ReadLine()
+		_ = w.PrintfLine("DATA")
+		_, _ = r.ReadLine()
+		// the server may stop reading before the end of the message
+		go func() {
+			_, _ = w.W.WriteString(msg)
+			_ = w.W.Flush()
+		}()
+		dataReply, _ := r.ReadLine()
+		if strings.HasPrefix(dataReply, "250") {
+			_ = w.PrintfLine("QUIT")
+			_, _ = r.ReadLine()
+		} else if _, err := r.ReadLine(); err == nil {
+			t.Error("expecting the connection to be closed after", dataReply)
+		}
+		return mailReply, dataReply
+	}
+	max := int(sc.MaxSize)
+	if _, reply := send("MAIL FROM:<test@example.com>", message(max)); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting a message at the limit to be accepted, got", reply)
+	}
+	if _, reply := send("MAIL FROM:<test@example.com>", message(max+1)); !strings.HasPrefix(reply, "552 5.3.4") {
+		t.Error("expecting a message over the limit to be rejected, got", reply)
+	}
+	// far over the limit, the rest of the message is not read
+	if _, reply := send("MAIL FROM:<test@example.com>", message(max*100)); !strings.HasPrefix(reply, "552 5.3.4") {
+		t.Error("expecting a message over the limit to be rejected, got", reply)
+	}
+	if _, reply := send("MAIL FROM:<test@example.com> SIZE=100", message(101)); !strings.HasPrefix(reply, "552 5.3.4") {
+		t.Error("expecting a message over the declared size to be rejected, got", reply)
+	}
+	if _, reply := send("MAIL FROM:<test@example.com> SIZE=100", message(100)); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting a message of the declared size to be accepted, got", reply)
+	}
+	if reply, _ := send(fmt.Sprintf("MAIL FROM:<test@example.com> SIZE=%d", max+1), ""); !strings.HasPrefix(reply, "552 5.3.4") {
+		t.Error("expecting a declared size over the limit to be rejected, got", reply)
+	}
+}
+
+func TestDataTimeout(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	// dribble sends the message a byte at a time, pausing between each
+	run := func(dataReadTimeout, transactionTimeout int, pause time.Duration) (string, time.Duration) {
+		sc := getMockServerConfig()
+		sc.MaxSize = 1 << 20
+		sc.DataReadTimeout = dataReadTimeout
+		sc.TransactionTimeout = transactionTimeout
+		mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+		if logOpenError != nil {
+			mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+		}
+		_, server := getMockServerConn(sc, t)
+		server.setAllowedHosts([]string{"test.com"})
+		if err := server.backend().Start(); err != nil {
+			t.Fatal("backend did not start", err)
+		}
+		defer func() {
+			_ = server.backend().Shutdown()
+		}()
+		// the mock connection has no deadlines, use a real one
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = l.Close()
+		}()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewClient(accepted, 1, mainlog, mail.NewPool(5))
+		done := make(chan struct{})
+		go func() {
+			server.handleClient(client)
+			close(done)
+		}()
+		r := textproto.NewReader(bufio.NewReader(conn))
+		_, _ = r.ReadLine()
+		for _, cmd := range []string{"HELO test.test.com", "MAIL FROM:<test@example.com>", "RCPT TO:<test@test.com>", "DATA"} {
+			_, _ = fmt.Fprint(conn, cmd+"\r\n")
+			_, _ = r.ReadLine()
+		}
+		start := time.Now()
+		go func() {
+			for _, b := range []byte(strings.Repeat("Subject: slow\r\n", 100)) {
+				if _, err := conn.Write([]byte{b}); err != nil {
+					return
+				}
+				time.Sleep(pause)
+			}
+		}()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+		line, _ := r.ReadLine()
+		elapsed := time.Since(start)
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Error("expecting the connection to be closed")
+		}
+		if client.Data.Len() != 0 {
+			t.Error("expecting the partial message to be discarded")
+		}
+		return line, elapsed
+	}
+	// silent for longer than the read timeout
+	if line, elapsed := run(1, 0, time.Second*3); !strings.HasPrefix(line, "421 4.4.2") || elapsed > time.Second*3 {
+		t.Error("expecting the read timeout to fire, got", line, elapsed)
+	}
+	// each byte comes in time, but the whole transaction takes too long
+	if line, elapsed := run(1, 2, time.Millisecond*100); !strings.HasPrefix(line, "421 4.4.2") || elapsed > time.Second*4 {
+		t.Error("expecting the transaction timeout to fire, got", line, elapsed)
+	}
+}
+
+func TestEnhancedStatusCodes(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	off := false
+	for _, enabled := range []*bool{nil, &off} {
+		sc := getMockServerConfig()
+		sc.EnhancedStatusCodes = enabled
+		mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+		if logOpenError != nil {
+			mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+		}
+		conn, server := getMockServerConn(sc, t)
+		server.setAllowedHosts([]string{"test.com"})
+		if err := server.backend().Start(); err != nil {
+			t.Fatal("backend did not start", err)
+		}
+		client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			server.handleClient(client)
+			wg.Done()
+		}()
+		r := textproto.NewReader(bufio.NewReader(conn.Client))
+		w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+		_, _ = r.ReadLine()
+		_ = w.PrintfLine("EHLO test.test.com")
+		advertised := false
+		for {
+			line, _ := r.ReadLine()
+			if line == "250-ENHANCEDSTATUSCODES" {
+				advertised = true
+			}
+			if !strings.HasPrefix(line, "250-") {
+				break
+			}
+		}
+		if advertised != (enabled == nil) {
+			t.Error("expecting ENHANCEDSTATUSCODES to be advertised only when on, got", advertised)
+		}
+		for _, e := range [][3]string{
+			{"MAIL FROM:<test@example.com>", "250 2.1.0 OK", "250 OK"},
+			{"RCPT TO:<test@example.org>", "454 4.1.1 Error: Relay access denied: example.org", "454 Error: Relay access denied: example.org"},
+			{"RCPT TO:<test@test.com>", "250 2.1.5 OK", "250 OK"},
+			{"MAIL FROM:<test@example.com>", "503 5.5.1 Error: nested MAIL command", "503 Error: nested MAIL command"},
+			{"NOOP", "200 2.0.0 OK", "200 OK"},
+			{"BOGUS", "554 5.5.1 Unrecognized command", "554 Unrecognized command"},
+			{"DATA", "354 Enter message", "354 Enter message"},
+			{"Subject: test\r\n\r\nHello\r\n.", "250 2.0.0 OK: queued as ", "250 OK: queued as "},
+			{"RSET", "250 2.1.0 OK", "250 OK"},
+		} {
+			expected := e[1]
+			if enabled != nil {
+				expected = e[2]
+			}
+			_ = w.PrintfLine("%s", e[0])
+			if line, _ := r.ReadLine(); strings.Index(line, expected) != 0 {
+				t.Error(e[0], "expected", expected, "but got:", line)
+			}
+		}
+		_ = w.PrintfLine("QUIT")
+		_, _ = r.ReadLine()
+		wg.Wait()
+		_ = server.backend().Shutdown()
+	}
+}
+
+func TestCommandSequence(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	_, _ = r.ReadLine()
+
+	for _, step := range []struct {
+		cmd      string
+		expected string
+	}{
+		{"HELO test.test.com", "250"},
+		{"RCPT TO:<test@test.com>", "503 5.5.1 Error: need MAIL command"},
+		{"DATA", "503 5.5.1 Error: No sender"},
+		{"MAIL FROM:<test@example.com>", "250"},
+		{"MAIL FROM:<other@example.com>", "503 5.5.1 Error: nested MAIL command"},
+		{"DATA", "503 5.5.1 Error: No recipients"},
+		{"RSET", "250"},
+		{"MAIL FROM:<>", "250"},
+		{"MAIL FROM:<>", "503 5.5.1 Error: nested MAIL command"},
+		{"QUIT", "221"},
+	} {
+		if err := w.PrintfLine("%s", step.cmd); err != nil {
+			t.Error(err)
+		}
+		line, _ := r.ReadLine()
+		if strings.Index(line, step.expected) != 0 {
+			t.Error(step.cmd, "expected", step.expected, "but got:", line)
+		}
+	}
+	if client.MailFrom.NullPath != true {
+		t.Error("the nested MAIL command should not have replaced the sender")
+	}
+	wg.Wait()
+}
+
+func TestMTPriority(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	sc.MTPriority = "MIXER"
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	_, _ = r.ReadLine()
+
+	if err := w.PrintfLine("EHLO test.test.com"); err != nil {
+		t.Error(err)
+	}
+	advertised := false
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			t.Error(err)
+			break
+		}
+		if line == "250-MT-PRIORITY MIXER" {
+			advertised = true
+		}
+		if strings.Index(line, "250 ") == 0 {
+			break
+		}
+	}
+	if !advertised {
+		t.Error("expecting MT-PRIORITY MIXER to be advertised")
+	}
+	for _, v := range []string{"10", "high"} {
+		if err := w.PrintfLine("%s", "MAIL FROM:<test@example.com> MT-PRIORITY="+v); err != nil {
+			t.Error(err)
+		}
+		line, _ := r.ReadLine()
+		expected := "501 5.5.4 Invalid MT-PRIORITY value"
+		if strings.Index(line, expected) != 0 {
+			t.Error("expected", expected, "but got:", line)
+		}
+	}
+	if err := w.PrintfLine("MAIL FROM:<test@example.com> MT-PRIORITY=-4"); err != nil {
+		t.Error(err)
+	}
+	line, _ := r.ReadLine()
+	if strings.Index(line, "250") != 0 {
+		t.Error("expected MAIL to be accepted, got:", line)
+	}
+	if client.MTPriority != -4 {
+		t.Error("expected priority -4 on the envelope, got", client.MTPriority)
+	}
+
+	if err := w.PrintfLine("QUIT"); err != nil {
+		t.Error(err)
+	}
+	_, _ = r.ReadLine()
+	wg.Wait()
+}
+
+// writeCountConn counts the writes to the connection, each would be a syscall on a real connection
+type writeCountConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *writeCountConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// Responses to pipelined commands should be written together, once all the received commands were processed
+func TestPipelinedResponsesFlushedTogether(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	server.setAllowedHosts([]string{"test.com"})
+	counter := &writeCountConn{Conn: conn.Server}
+	client := NewClient(counter, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	bw := bufio.NewWriter(conn.Client)
+	_, _ = r.ReadLine()
+	if _, err := bw.WriteString("EHLO test.test.com\r\n"); err != nil {
+		t.Error(err)
+	}
+	_ = bw.Flush()
+	for {
+		line, err := r.ReadLine()
+		if err != nil || strings.Index(line, "250 ") == 0 {
+			break
+		}
+	}
+	if writes := atomic.LoadInt32(&counter.writes); writes != 2 {
+		t.Error("expecting the greeting and the multi-line EHLO reply to take 2 writes, got", writes)
+	}
+	// a pipelined batch of commands, sent in a single write
+	if _, err := bw.WriteString("MAIL FROM:<test@example.com>\r\nRCPT TO:<a@test.com>\r\nRCPT TO:<b@test.com>\r\nNOOP\r\n"); err != nil {
+		t.Error(err)
+	}
+	_ = bw.Flush()
+	for i := 0; i < 4; i++ {
+		if _, err := r.ReadLine(); err != nil {
+			t.Error(err)
+		}
+	}
+	if writes := atomic.LoadInt32(&counter.writes); writes != 3 {
+		t.Error("expecting the 4 pipelined responses to be written at once, total writes", writes)
+	}
+	// a command on its own is answered straight away
+	if _, err := bw.WriteString("QUIT\r\n"); err != nil {
+		t.Error(err)
+	}
+	_ = bw.Flush()
+	_, _ = r.ReadLine()
+	wg.Wait()
+	if writes := atomic.LoadInt32(&counter.writes); writes != 4 {
+		t.Error("expecting 4 writes for the session, got", writes)
+	}
+}
+
+func TestPipelinedData(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	server.setAllowedHosts([]string{"test.com"})
+	if err := server.backend().Start(); err != nil {
+		t.Fatal("backend did not start", err)
+	}
+	defer func() {
+		_ = server.backend().Shutdown()
+	}()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	bw := bufio.NewWriter(conn.Client)
+	_, _ = r.ReadLine()
+	_, _ = bw.WriteString("EHLO test.test.com\r\n")
+	_ = bw.Flush()
+	pipelining := false
+	for {
+		line, err := r.ReadLine()
+		if line == "250-PIPELINING" {
+			pipelining = true
+		}
+		if err != nil || strings.Index(line, "250 ") == 0 {
+			break
+		}
+	}
+	if !pipelining {
+		t.Error("expecting PIPELINING to be advertised")
+	}
+	// the whole envelope at once. DATA is the last of the group, its reply must come
+	// before the client sends the message
+	_, _ = bw.WriteString("MAIL FROM:<test@example.com>\r\nRCPT TO:<a@test.com>\r\nRCPT TO:<b@test.com>\r\nDATA\r\n")
+	_ = bw.Flush()
+	for _, expected := range []string{"250 2.1.0", "250 2.1.5", "250 2.1.5", "354"} {
+		if line, _ := r.ReadLine(); strings.Index(line, expected) != 0 {
+			t.Error("expected", expected, "but got:", line)
+		}
+	}
+	_, _ = bw.WriteString("Subject: pipelined\r\n\r\nHello\r\n.\r\nQUIT\r\n")
+	_ = bw.Flush()
+	if line, _ := r.ReadLine(); strings.Index(line, "250 2.0.0") != 0 {
+		t.Error("expected the message to be queued, got:", line)
+	}
+	if line, _ := r.ReadLine(); strings.Index(line, "221") != 0 {
+		t.Error("expected 221 for QUIT, got:", line)
+	}
+	wg.Wait()
+	if len(client.RcptTo) != 0 {
+		t.Error("expecting the transaction to be over")
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	sc.ListenInterface = "127.0.0.1:2552"
+	sc.MaxConnectionsPerIP = 2
+	sc.ConnectionLimitExempt = []string{"127.0.0.3"}
+	_, server := getMockServerConn(sc, t)
+	var startWG sync.WaitGroup
+	startWG.Add(1)
+	go func() {
+		if err := server.Start(&startWG); err != nil {
+			t.Error(err)
+		}
+	}()
+	startWG.Wait()
+	defer server.Shutdown()
+
+	// connect from the loopback address from, returning the greeting
+	connect := func(from string) (net.Conn, string) {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(from)}, Timeout: time.Second * 5}
+		conn, err := d.Dial("tcp", sc.ListenInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return conn, line
+	}
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		conn, greeting := connect("127.0.0.1")
+		conns = append(conns, conn)
+		if !strings.HasPrefix(greeting, "220 ") {
+			t.Error("expecting connection", i+1, "to be accepted, got", greeting)
+		}
+	}
+	conn, reply := connect("127.0.0.1")
+	if !strings.HasPrefix(reply, "421 4.7.0 Error: too many connections") {
+		t.Error("expecting the third connection to be refused, got", reply)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("expecting the refused connection to be closed, got", err)
+	}
+	_ = conn.Close()
+
+	// other addresses are unaffected, and exempt ones are not limited
+	conn, greeting := connect("127.0.0.2")
+	conns = append(conns, conn)
+	if !strings.HasPrefix(greeting, "220 ") {
+		t.Error("expecting another IP to be accepted, got", greeting)
+	}
+	for i := 0; i < 3; i++ {
+		conn, greeting := connect("127.0.0.3")
+		conns = append(conns, conn)
+		if !strings.HasPrefix(greeting, "220 ") {
+			t.Error("expecting an exempt IP to be accepted, got", greeting)
+		}
+	}
+
+	// a closed connection frees its slot
+	_ = conns[0].Close()
+	for i := 0; ; i++ {
+		conn, greeting := connect("127.0.0.1")
+		if strings.HasPrefix(greeting, "220 ") {
+			conns[0] = conn
+			break
+		}
+		_ = conn.Close()
+		if i == 20 {
+			t.Error("expecting a connection to be accepted after one closed, got", greeting)
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// issueTestCert returns a certificate for cn signed by parent, or self-signed if parent is nil
+func issueTestCert(t *testing.T, cn string, isCA bool, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"Guerrilla Test"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeTestCert writes the certificate and its key to PEM files
+func writeTestCert(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Clients must present a certificate issued by the client_ca_file CA with RequireAndVerifyClientCert
+func TestClientCertRequired(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	ca := issueTestCert(t, "Test CA", true, nil)
+	writeTestCert(t, ca, "clientca.test.pem", "")
+	writeTestCert(t, issueTestCert(t, "mx.test.com", false, &ca), "server.test.pem", "server.test.key")
+	defer func() {
+		for _, file := range []string{"clientca.test.pem", "server.test.pem", "server.test.key"} {
+			if err := deleteIfExists(file); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	sc := getMockServerConfig()
+	sc.TLS = ServerTLSConfig{
+		AlwaysOn:       true,
+		PublicKeyFile:  "server.test.pem",
+		PrivateKeyFile: "server.test.key",
+		ClientAuthType: "RequireAndVerifyClientCert",
+		ClientCAFile:   "clientca.test.pem",
+	}
+	if err := sc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	mainlog, err := log.GetLogger(sc.LogFile, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan interface{}, 1)
+	backends.Svc.AddProcessor("certtest", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					delivered <- e.Values["client_cert_cn"]
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	backend, err := backends.New(backends.BackendConfig{"save_workers_size": 1, "save_process": "certtest"}, mainlog)
+	if err != nil {
+		t.Fatal("new backend failed because:", err)
+	}
+	if err = backend.Start(); err != nil {
+		t.Fatal("backend did not start", err)
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	server, err := newServer(sc, backend, mainlog)
+	if err != nil {
+		t.Fatal("new server failed because:", err)
+	}
+	server.setAllowedHosts([]string{"test.com"})
+
+	// session sends a message over TLS with cert, returning the first error
+	session := func(cert tls.Certificate) error {
+		conn := mocks.NewConn()
+		client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			server.handleClient(client)
+			wg.Done()
+		}()
+		defer wg.Wait()
+		tlsConn := tls.Client(conn.Client, &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{cert},
+		})
+		// close the pipe rather than tlsConn, both ends would block writing close_notify
+		defer func() {
+			_ = conn.Client.Close()
+		}()
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		r := textproto.NewReader(bufio.NewReader(tlsConn))
+		w := textproto.NewWriter(bufio.NewWriter(tlsConn))
+		// the server rejects the certificate after the client finished the TLS 1.3 handshake
+		if _, err = r.ReadLine(); err != nil {
+			return err
+		}
+		for _, cmd := range []string{"HELO test.test.com", "MAIL FROM:<test@example.com>", "RCPT TO:<good@test.com>", "DATA", "Subject: Test\r\n\r\nHello\r\n."} {
+			if err := w.PrintfLine("%s", cmd); err != nil {
+				return err
+			}
+			if _, err = r.ReadLine(); err != nil {
+				return err
+			}
+		}
+		_ = w.PrintfLine("QUIT")
+		_, _ = r.ReadLine()
+		return nil
+	}
+
+	if err := session(issueTestCert(t, "relay.test.com", false, &ca)); err != nil {
+		t.Fatal("expecting a certificate issued by the CA to be accepted, got", err)
+	}
+	select {
+	case cn := <-delivered:
+		if cn != "relay.test.com" {
+			t.Error("expecting client_cert_cn to be relay.test.com, got", cn)
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("expecting the message to be delivered")
+	}
+	if err := session(issueTestCert(t, "relay.test.com", false, nil)); err == nil {
+		t.Error("expecting a self-signed certificate to be rejected")
+	}
+	if err := session(tls.Certificate{}); err == nil {
+		t.Error("expecting a client without a certificate to be rejected")
+	}
+	if len(delivered) > 0 {
+		t.Error("expecting no message from the rejected clients")
+	}
+}
+
+// The certificate served is selected by the SNI server name, falling back to the default cert
+func TestSNICertificates(t *testing.T) {
+	files := []string{"default.test.pem", "default.test.key", "com.test.pem", "com.test.key", "org.test.pem", "org.test.key"}
+	defer func() {
+		for _, file := range files {
+			if err := deleteIfExists(file); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	writeTestCert(t, issueTestCert(t, "mx.test.net", false, nil), "default.test.pem", "default.test.key")
+	writeTestCert(t, issueTestCert(t, "mail.example.com", false, nil), "com.test.pem", "com.test.key")
+	writeTestCert(t, issueTestCert(t, "*.example.org", false, nil), "org.test.pem", "org.test.key")
+	sc := getMockServerConfig()
+	sc.TLS = ServerTLSConfig{
+		StartTLSOn:     true,
+		PublicKeyFile:  "default.test.pem",
+		PrivateKeyFile: "default.test.key",
+		Certificates: []TLSCertificate{
+			{Host: "mail.example.com", PublicKeyFile: "com.test.pem", PrivateKeyFile: "com.test.key"},
+			{Host: "*.example.org", PublicKeyFile: "org.test.pem", PrivateKeyFile: "org.test.key"},
+		},
+	}
+	if err := sc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := server{}
+	s.setConfig(sc)
+	if err := s.configureSSL(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := s.tlsConfigStore.Load().(*tls.Config)
+
+	for serverName, expect := range map[string]string{
+		"mail.example.com":  "mail.example.com",
+		"MAIL.Example.com.": "mail.example.com",
+		"mx.example.org":    "*.example.org",
+		"a.mx.example.org":  "mx.test.net",
+		"mx.example.net":    "mx.test.net",
+		"":                  "mx.test.net",
+	} {
+		if cn := servedCertificate(t, tlsConfig, serverName); cn != expect {
+			t.Errorf("expecting the certificate for [%s] to be %s, got %s", serverName, expect, cn)
+		}
+	}
+
+	sc.TLS.Certificates = append(sc.TLS.Certificates, TLSCertificate{PublicKeyFile: "com.test.pem", PrivateKeyFile: "org.test.key"})
+	if err := sc.Validate(); err == nil {
+		t.Error("expecting a certificate without a host and with the wrong key to be invalid")
+	}
+}
+
+// servedCertificate returns the common name of the certificate served by a handshake with tlsConfig
+func servedCertificate(t *testing.T, tlsConfig *tls.Config, serverName string) string {
+	clientConn, serverConn := net.Pipe()
+	defer func() {
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+	}()
+	go func() {
+		_ = tls.Server(serverConn, tlsConfig).Handshake()
+	}()
+	tlsConn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Error("handshake for", serverName, "failed:", err)
+		return ""
+	}
+	return tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// Certificate files changed on disk are picked up by new connections, invalid ones are ignored
+func TestWatchCertificates(t *testing.T) {
+	defer func() {
+		for _, file := range []string{"watch.test.pem", "watch.test.key"} {
+			if err := deleteIfExists(file); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	writeTestCert(t, issueTestCert(t, "old.test.com", false, nil), "watch.test.pem", "watch.test.key")
+	sc := getMockServerConfig()
+	sc.TLS = ServerTLSConfig{
+		StartTLSOn:     true,
+		PublicKeyFile:  "watch.test.pem",
+		PrivateKeyFile: "watch.test.key",
+		ReloadInterval: "10ms",
+	}
+	if err := sc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	mainlog, err := log.GetLogger(sc.LogFile, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server{listenInterface: sc.ListenInterface}
+	s.logStore.Store(mainlog)
+	s.setConfig(sc)
+	if err := s.configureSSL(); err != nil {
+		t.Fatal(err)
+	}
+	modTime := s.certificatesModTime()
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.watchCertificates(modTime, time.Millisecond*10, stop)
+
+	// served waits for the certificate served to be cn
+	served := func(cn string) bool {
+		for i := 0; i < 100; i++ {
+			if servedCertificate(t, s.tlsConfigStore.Load().(*tls.Config), "") == cn {
+				return true
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		return false
+	}
+	if !served("old.test.com") {
+		t.Fatal("expecting the old certificate to be served")
+	}
+	// make sure the mtime changes on file systems with a coarse resolution
+	later := time.Now().Add(time.Second * 2)
+	writeTestCert(t, issueTestCert(t, "new.test.com", false, nil), "watch.test.pem", "watch.test.key")
+	for _, file := range []string{"watch.test.pem", "watch.test.key"} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !served("new.test.com") {
+		t.Fatal("expecting the new certificate to be served after it changed")
+	}
+
+	later = later.Add(time.Second * 2)
+	if err := ioutil.WriteFile("watch.test.pem", []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("watch.test.pem", later, later); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if cn := servedCertificate(t, s.tlsConfigStore.Load().(*tls.Config), ""); cn != "new.test.com" {
+		t.Error("expecting the new certificate to be kept when the changed file is invalid, got", cn)
+	}
+
+	sc.TLS.ReloadInterval = "soon"
+	if err := sc.Validate(); err == nil {
+		t.Error("expecting an invalid reload_interval to fail validation")
+	}
+}
+
+// Commands sent in the same packet as STARTTLS must not be processed after the handshake
+func TestStartTLSInjection(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	writeTestCert(t, issueTestCert(t, "mx.test.com", false, nil), "starttls.test.pem", "starttls.test.key")
+	defer func() {
+		for _, file := range []string{"starttls.test.pem", "starttls.test.key"} {
+			if err := deleteIfExists(file); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	sc := getMockServerConfig()
+	sc.TLS.PublicKeyFile = "starttls.test.pem"
+	sc.TLS.PrivateKeyFile = "starttls.test.key"
+	mainlog, err := log.GetLogger(sc.LogFile, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, server := getMockServerConn(sc, t)
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	if _, err := r.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Client.Write([]byte("HELO test.test.com\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	// the RCPT is injected in the same packet, before the TLS handshake
+	if _, err := conn.Client.Write([]byte("STARTTLS\r\nRCPT TO:<evil@test.com>\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := r.ReadLine(); !strings.HasPrefix(line, "220") {
+		t.Fatal("expecting 220 to STARTTLS, got", line)
+	}
+	tlsConn := tls.Client(conn.Client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	r = textproto.NewReader(bufio.NewReader(tlsConn))
+	w := textproto.NewWriter(bufio.NewWriter(tlsConn))
+	if err := w.PrintfLine("NOOP"); err != nil {
+		t.Fatal(err)
+	}
+	// a reply to the injected RCPT would come first
+	if line, _ := r.ReadLine(); line != response.Canned.SuccessNoopCmd.String() {
+		t.Error("expecting the first reply over TLS to be for NOOP, got", line)
+	}
+	if client.greeted || client.Helo != "" {
+		t.Error("expecting the HELO to be forgotten after STARTTLS")
+	}
+	if err := w.PrintfLine("QUIT"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = r.ReadLine()
+	_ = conn.Client.Close()
+	wg.Wait()
+	if len(client.RcptTo) > 0 {
+		t.Error("expecting the injected RCPT to be discarded, got", client.RcptTo)
+	}
+}
+
+// Clients below tls_min_version are refused, unknown versions and ciphers fail validation
+func TestTLSMinVersion(t *testing.T) {
+	defer func() {
+		for _, file := range []string{"version.test.pem", "version.test.key"} {
+			if err := deleteIfExists(file); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	writeTestCert(t, issueTestCert(t, "mx.test.com", false, nil), "version.test.pem", "version.test.key")
+	sc := getMockServerConfig()
+	sc.TLS = ServerTLSConfig{
+		StartTLSOn:     true,
+		PublicKeyFile:  "version.test.pem",
+		PrivateKeyFile: "version.test.key",
+		Protocols:      []string{"tls1.0", "tls1.2"},
+		MinVersion:     "1.2",
+	}
+	if err := sc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := server{}
+	s.setConfig(sc)
+	if err := s.configureSSL(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := s.tlsConfigStore.Load().(*tls.Config)
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Error("expecting tls_min_version to take precedence over protocols")
+	}
+
+	// handshake returns the error of a handshake by a client limited to version max
+	handshake := func(max uint16) error {
+		clientConn, serverConn := net.Pipe()
+		defer func() {
+			_ = clientConn.Close()
+			_ = serverConn.Close()
+		}()
+		go func() {
+			_ = tls.Server(serverConn, tlsConfig).Handshake()
+		}()
+		return tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: max}).Handshake()
+	}
+	if err := handshake(tls.VersionTLS10); err == nil {
+		t.Error("expecting a TLS 1.0 client to be refused")
+	}
+	if err := handshake(tls.VersionTLS12); err != nil {
+		t.Error("expecting a TLS 1.2 client to be accepted, got", err)
+	}
+
+	for _, tlsConf := range []ServerTLSConfig{
+		{MinVersion: "1.9"},
+		{MaxVersion: "tls"},
+		{MinVersion: "1.2", MaxVersion: "1.1"},
+		{Ciphers: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_NO_SUCH_CIPHER"}},
+		{Protocols: []string{"tls2.0"}},
+	} {
+		sc.TLS = tlsConf
+		if err := sc.Validate(); err == nil {
+			t.Errorf("expecting %+v to fail validation", tlsConf)
+		}
+	}
+}
+
+// jsonLogSession sends cmds to a server logging in the json format, one reply read per command.
+// It returns the client, and the entries logged keyed by their msg.
+// Each test logs to its own file, as the logger of a file is cached after it is deleted
+func jsonLogSession(t *testing.T, cmds []string) (*client, map[string]map[string]interface{}) {
+	logFile := "./tests/" + t.Name() + ".jsonlog.test"
+	defer func() {
+		if err := log.SetFormat(log.FormatText); err != nil {
+			t.Error(err)
+		}
+		if err := deleteIfExists(logFile); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := log.SetFormat(log.FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	sc := getMockServerConfig()
+	sc.LogFile = logFile
+	sc.TLS.StartTLSOn = false
+	mainlog, err := log.GetLogger(logFile, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := backends.New(backends.BackendConfig{
+		"save_workers_size":  1,
+		"save_process":       "HeadersParser|Debugger",
+		"log_received_mails": true,
+	}, mainlog)
+	if err != nil {
+		t.Fatal("new backend failed because:", err)
+	}
+	if err = backend.Start(); err != nil {
+		t.Fatal("backend did not start", err)
+	}
+	defer func() {
+		_ = backend.Shutdown()
+	}()
+	server, err := newServer(sc, backend, mainlog)
+	if err != nil {
+		t.Fatal("new server failed because:", err)
+	}
+	server.setAllowedHosts([]string{"test.com"})
+	conn := mocks.NewConn()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	if _, err := r.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range cmds {
+		if err := w.PrintfLine("%s", cmd); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadLine(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]map[string]interface{})
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("expecting each line to be JSON, got %q: %s", line, err)
+		}
+		for _, key := range []string{"level", "time", "msg"} {
+			if _, ok := entry[key]; !ok {
+				t.Errorf("expecting %s in %q", key, line)
+			}
+		}
+		if msg, ok := entry["msg"].(string); ok {
+			entries[msg] = entry
+		}
+	}
+	return client, entries
+}
+
+// With the json log format, each line is a JSON object with the contextual fields as keys
+func TestJSONLogFormat(t *testing.T) {
+	client, entries := jsonLogSession(t, []string{
+		"HELO test.test.com",
+		"MAIL FROM:<test@example.com>",
+		"RCPT TO:<good@test.com>",
+		"DATA",
+		"Message-Id: <json@example.com>\r\nSubject: Test\r\n\r\nHello\r\n.",
+		"QUIT",
+	})
+	connected := entries[fmt.Sprintf("Handle client [%s], id: 1", client.RemoteIP)]
+	if connected == nil || connected["remote_ip"] != client.RemoteIP {
+		t.Error("expecting the connection entry to have the remote_ip, got", connected)
+	}
+	delivered := entries[fmt.Sprintf("[%s] message processed", client.RemoteIP)]
+	if delivered == nil {
+		t.Fatal("expecting an entry for the delivery")
+	}
+	if delivered["queue_id"] == "" || delivered["queue_id"] == nil {
+		t.Error("expecting the delivery entry to have the queue_id, got", delivered)
+	}
+	if delivered["message_id"] != "<json@example.com>" {
+		t.Error("expecting the delivery entry to have the message_id, got", delivered)
+	}
+}
+
+// Lines about a client, including those logged by the backend, carry its remote_ip, helo and queue_id
+func TestClientLogFields(t *testing.T) {
+	client, entries := jsonLogSession(t, []string{
+		"HELO test.test.com",
+		"MAIL FROM:<test@example.com>",
+		"RCPT TO:<good@test.com>",
+		"DATA",
+		"Subject: Test\r\n\r\nHello\r\n.",
+		"QUIT",
+	})
+	// the Debugger processor logs the envelope
+	for msg := range entries {
+		if strings.HasPrefix(msg, "Mail from: test@example.com") {
+			entries["Mail from"] = entries[msg]
+		}
+	}
+	for _, msg := range []string{
+		fmt.Sprintf("[%s] message processed", client.RemoteIP),
+		"Mail from",
+	} {
+		entry := entries[msg]
+		if entry == nil {
+			t.Errorf("expecting an entry for [%s]", msg)
+			continue
+		}
+		if entry["remote_ip"] != client.RemoteIP {
+			t.Errorf("expecting [%s] to have the remote_ip %s, got %v", msg, client.RemoteIP, entry["remote_ip"])
+		}
+		if entry["helo"] != "test.test.com" {
+			t.Errorf("expecting [%s] to have the helo, got %v", msg, entry["helo"])
+		}
+		if entry["queue_id"] != client.QueuedId {
+			t.Errorf("expecting [%s] to have the queue_id %s, got %v", msg, client.QueuedId, entry["queue_id"])
+		}
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	server := &server{}
+	if grace := server.gracePeriod(); grace != 0 {
+		t.Error("expecting no grace period by default, got", grace)
+	}
+	server.setShutdownGrace(10)
+	if grace := server.gracePeriod(); grace != time.Second*10 {
+		t.Error("expecting a grace period of 10s, got", grace)
+	}
+}
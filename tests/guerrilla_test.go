@@ -383,6 +383,9 @@ func TestRFC2821LimitRecipients(t *testing.T) {
 			if _, err := Command(conn, bufin, "HELO localtester"); err != nil {
 				t.Error("Hello command failed", err.Error())
 			}
+			if _, err := Command(conn, bufin, "MAIL FROM:<test@grr.la>"); err != nil {
+				t.Error("MAIL command failed", err.Error())
+			}
 
 			for i := 0; i < 101; i++ {
 				//fmt.Println(fmt.Sprintf("RCPT TO:test%d@grr.la", i))
@@ -432,6 +435,9 @@ func TestRFC2832LimitLocalPart(t *testing.T) {
 			if _, err := Command(conn, bufin, "HELO localtester"); err != nil {
 				t.Error("Hello command failed", err.Error())
 			}
+			if _, err := Command(conn, bufin, "MAIL FROM:<test@grr.la>"); err != nil {
+				t.Error("MAIL command failed", err.Error())
+			}
 			// repeat > 64 characters in local part
 			response, err := Command(conn, bufin, fmt.Sprintf("RCPT TO:<%s@grr.la>", strings.Repeat("a", rfc5321.LimitLocalPart+1)))
 			if err != nil {
@@ -484,6 +490,9 @@ func TestRFC2821LimitPath(t *testing.T) {
 			if _, err := Command(conn, bufin, "HELO localtester"); err != nil {
 				t.Error("Hello command failed", err.Error())
 			}
+			if _, err := Command(conn, bufin, "MAIL FROM:<test@grr.la>"); err != nil {
+				t.Error("MAIL command failed", err.Error())
+			}
 			// repeat > 256 characters in local part
 			response, err := Command(conn, bufin, fmt.Sprintf("RCPT TO:<%s@grr.la>", strings.Repeat("a", 257-7)))
 			if err != nil {
@@ -533,6 +542,9 @@ func TestRFC2821LimitDomain(t *testing.T) {
 			if _, err := Command(conn, bufin, "HELO localtester"); err != nil {
 				t.Error("Hello command failed", err.Error())
 			}
+			if _, err := Command(conn, bufin, "MAIL FROM:<test@grr.la>"); err != nil {
+				t.Error("MAIL command failed", err.Error())
+			}
 			// repeat > 64 characters in local part
 			response, err := Command(conn, bufin, fmt.Sprintf("RCPT TO:<a@%s.l>", strings.Repeat("a", 255-2)))
 			if err != nil {
@@ -867,7 +879,7 @@ func TestHeloEhlo(t *testing.T) {
 				}
 			}
 
-			expected = fmt.Sprintf("250-%s Hello\r\n250-SIZE 100017\r\n250-PIPELINING\r\n250-STARTTLS\r\n250-ENHANCEDSTATUSCODES\r\n250 HELP\r\n", hostname)
+			expected = fmt.Sprintf("250-%s Hello\r\n250-SIZE 100017\r\n250-PIPELINING\r\n250-CHUNKING\r\n250-BINARYMIME\r\n250-STARTTLS\r\n250-ENHANCEDSTATUSCODES\r\n250 HELP\r\n", hostname)
 			if fullresp != expected {
 				t.Error("Server did not respond with [" + expected + "], it said [" + fullresp + "]")
 			}
@@ -1028,7 +1040,7 @@ func TestDataMaxLength(t *testing.T) {
 				t.Error("Hello command failed", err.Error())
 			}
 
-			response, err := Command(conn, bufin, "MAIL FROM:test@grr.la")
+			response, err := Command(conn, bufin, "MAIL FROM:<test@grr.la>")
 			if err != nil {
 				t.Error("command failed", err.Error())
 			}
@@ -1050,7 +1062,7 @@ func TestDataMaxLength(t *testing.T) {
 					strings.Repeat("n", int(config.Servers[0].MaxSize-20))))
 
 			//expected := "500 Line too long"
-			expected := "451 4.3.0 Error: maximum DATA size exceeded"
+			expected := "552 5.3.4 Error: message size exceeds maximum"
 			if strings.Index(response, expected) != 0 {
 				t.Error("Server did not respond with", expected, ", it said:"+response)
 			}
@@ -1181,7 +1193,7 @@ func TestFuzz86f25b86b09897aed8f6c2aa5b5ee1557358a6de(t *testing.T) {
 				conn,
 				bufin,
 				"DATA\r\n")
-			expected := "503 5.5.1 Error: No recipients"
+			expected := "503 5.5.1 Error: No sender"
 			if strings.Index(response, expected) != 0 {
 				t.Error("Server did not respond with", expected, ", it said:"+response, err)
 			}
@@ -0,0 +1,10 @@
+// +build go1.12
+
+package guerrilla
+
+import "crypto/tls"
+
+// add the protocol version introduced in Go 1.12
+func init() {
+	TLSProtocols["tls1.3"] = tls.VersionTLS13
+}